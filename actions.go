@@ -0,0 +1,175 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	actionReprobe        = "reprobe"
+	actionReconcile      = "reconcile"
+	actionRotateAudit    = "rotate-audit"
+	actionRestoreSysctls = "restore-sysctls"
+
+	actionTimeout = time.Minute
+
+	// maxFinishedJobs is the number of finished jobs kept for retrieval.
+	maxFinishedJobs = 64
+)
+
+type jobState string
+
+const (
+	jobRunning   jobState = "running"
+	jobSucceeded jobState = "succeeded"
+	jobFailed    jobState = "failed"
+)
+
+// job is a single run of an action.
+type job struct {
+	ID       string     `json:"id"`
+	Action   string     `json:"action"`
+	State    jobState   `json:"state"`
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+	Result   any        `json:"result,omitempty"`
+	Error    string     `json:"error,omitempty"`
+}
+
+type actionFunc func(ctx context.Context) (any, error)
+
+// actionRunner runs administrative actions in the background. Starting an
+// action which is already running returns the running job instead of
+// starting it again, so impatient retries do not pile up.
+type actionRunner struct {
+	actions map[string]actionFunc
+	timeout time.Duration
+
+	mu       sync.Mutex
+	lastID   int
+	jobs     map[string]*job
+	running  map[string]*job
+	finished []string
+}
+
+func newActionRunner(actions map[string]actionFunc) *actionRunner {
+	return &actionRunner{
+		actions: actions,
+		timeout: actionTimeout,
+		jobs:    make(map[string]*job),
+		running: make(map[string]*job),
+	}
+}
+
+// start starts the action, or joins the running job of the same action.
+// It returns a snapshot of the job.
+func (r *actionRunner) start(action string) (job, error) {
+	fn, ok := r.actions[action]
+	if !ok {
+		return job{}, fmt.Errorf("unknown action %q", action)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if j, ok := r.running[action]; ok {
+		return *j, nil
+	}
+
+	r.lastID++
+	j := &job{
+		ID:      strconv.Itoa(r.lastID),
+		Action:  action,
+		State:   jobRunning,
+		Started: time.Now(),
+	}
+	r.jobs[j.ID] = j
+	r.running[action] = j
+
+	go r.run(j, fn)
+
+	return *j, nil
+}
+
+func (r *actionRunner) run(j *job, fn actionFunc) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+
+	result, err := fn(ctx)
+	finished := time.Now()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	j.Finished = &finished
+	if err != nil {
+		j.State = jobFailed
+		j.Error = err.Error()
+	} else {
+		j.State = jobSucceeded
+		j.Result = result
+	}
+
+	delete(r.running, j.Action)
+	r.finished = append(r.finished, j.ID)
+	if len(r.finished) > maxFinishedJobs {
+		delete(r.jobs, r.finished[0])
+		r.finished = r.finished[1:]
+	}
+}
+
+// get returns a snapshot of the job.
+func (r *actionRunner) get(id string) (job, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	j, ok := r.jobs[id]
+	if !ok {
+		return job{}, false
+	}
+	return *j, true
+}
+
+func (p *plugin) newActionRunner() *actionRunner {
+	return newActionRunner(map[string]actionFunc{
+		actionReprobe: func(ctx context.Context) (any, error) {
+			return p.reprobe(ctx)
+		},
+		actionReconcile: func(ctx context.Context) (any, error) {
+			return p.reconcile(ctx)
+		},
+		actionRotateAudit: func(context.Context) (any, error) {
+			if p.audit == nil {
+				return nil, errors.New("the audit log is disabled")
+			}
+			rotated, err := p.audit.rotate()
+			if err != nil {
+				return nil, err
+			}
+			return map[string]string{"rotated": rotated}, nil
+		},
+		actionRestoreSysctls: func(ctx context.Context) (any, error) {
+			return p.restoreSysctls(ctx, p.config())
+		},
+	})
+}
@@ -0,0 +1,85 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// auditLog appends events to a file, one JSON object per line.
+type auditLog struct {
+	path string
+
+	mu sync.Mutex
+	f  *os.File
+}
+
+func openAuditLog(path string) (*auditLog, error) {
+	a := &auditLog{path: path}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *auditLog) open() error {
+	f, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+	a.f = f
+	return nil
+}
+
+func (a *auditLog) write(e *event) error {
+	data, err := e.marshal()
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, err = a.f.Write(data)
+	return err
+}
+
+// rotate moves the audit log to <path>.1, replacing an older one, and
+// starts a new log. It returns the path of the rotated log.
+func (a *auditLog) rotate() (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	rotated := a.path + ".1"
+	if err := os.Rename(a.path, rotated); err != nil {
+		return "", fmt.Errorf("failed to rotate audit log: %w", err)
+	}
+	if err := a.f.Close(); err != nil {
+		return "", fmt.Errorf("failed to close rotated audit log: %w", err)
+	}
+	if err := a.open(); err != nil {
+		return "", err
+	}
+	return rotated, nil
+}
+
+func (a *auditLog) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.f.Close()
+}
@@ -0,0 +1,124 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/containerd/nri/pkg/api"
+)
+
+// eventMask returns the events the plugin subscribes to: all it handles,
+// except the ones of the boot check and the journal capture when they are
+// disabled, so that the runtime does not send them for every container in
+// vain.
+func eventMask(cfg *Config) api.EventMask {
+	var events api.EventMask
+	events.Set(api.Event_CREATE_CONTAINER, api.Event_POST_CREATE_CONTAINER, api.Event_START_CONTAINER, api.Event_REMOVE_CONTAINER,
+		api.Event_UPDATE_CONTAINER, api.Event_REMOVE_POD_SANDBOX)
+	if cfg.BootCheckWindow > 0 {
+		events.Set(api.Event_POST_START_CONTAINER, api.Event_STOP_CONTAINER)
+	}
+	if cfg.JournalCapture.Enabled {
+		events.Set(api.Event_STOP_CONTAINER)
+	}
+	return events
+}
+
+// PostStartContainer checks that a started systemd container is still
+// running. A container which exited right away is a common symptom of a
+// broken systemd setup, e.g. a read-only cgroup mount. Otherwise the start
+// is recorded, for StopContainer to check the container did not stop
+// within bootCheckWindow. Only subscribed with bootCheckWindow.
+func (p *plugin) PostStartContainer(ctx context.Context, _ *api.PodSandbox, container *api.Container) error {
+	defer p.observeHook("PostStartContainer", time.Now())
+	defer p.conn.eventHandled()
+
+	s := p.state.get(container.Id)
+	if s == nil {
+		return nil
+	}
+
+	if container.State == api.ContainerState_CONTAINER_STOPPED || container.Pid == 0 {
+		p.failedBoot(ctx, s, "exited right after starting")
+		return nil
+	}
+
+	started := time.Now()
+	p.state.update(container.Id, func(updated *containerState) {
+		updated.started = started
+	})
+	return nil
+}
+
+// StopContainer reports systemd containers which stopped within
+// bootCheckWindow after starting, and captures the journal of those which
+// failed to boot or were OOM-killed. Only subscribed with bootCheckWindow
+// or journalCapture.
+func (p *plugin) StopContainer(ctx context.Context, _ *api.PodSandbox, container *api.Container) ([]*api.ContainerUpdate, error) {
+	defer p.observeHook("StopContainer", time.Now())
+	defer p.conn.eventHandled()
+
+	s := p.state.get(container.Id)
+	if s == nil {
+		return nil, nil
+	}
+	p.state.update(container.Id, func(updated *containerState) {
+		updated.stopped = true
+	})
+
+	cfg := p.config()
+	if !s.started.IsZero() {
+		if ran := time.Since(s.started); ran < cfg.BootCheckWindow.Duration() {
+			p.failedBoot(ctx, s, "stopped "+ran.Round(time.Millisecond).String()+" after starting")
+			return nil, nil
+		}
+	}
+
+	if cfg.JournalCapture.Enabled {
+		ctx, cancel := context.WithTimeout(ctx, cfg.HookTimeout.Duration())
+		defer cancel()
+		if n := p.oomKills(ctx, s); n > 0 {
+			p.captureJournal(ctx, cfg, s, fmt.Sprintf("OOM-killed, %d processes killed by the kernel", n))
+		}
+	}
+	return nil, nil
+}
+
+// failedBoot reports a systemd container which likely failed to boot, with
+// a crash report and its journal captured if enabled.
+func (p *plugin) failedBoot(ctx context.Context, s *containerState, what string) {
+	p.metrics.failedBoots.Inc()
+
+	cfg := p.config()
+	ctx, cancel := context.WithTimeout(ctx, cfg.HookTimeout.Duration())
+	defer cancel()
+
+	hint := "check the container logs"
+	if cfg.CrashReports.Enabled {
+		file, err := p.writeCrashReport(ctx, cfg, s, what, time.Now())
+		if err != nil {
+			hint += fmt.Sprintf(" (failed to write a crash report: %v)", err)
+		} else {
+			hint += " and the crash report " + file
+		}
+	}
+	p.log.Warnf("%s: %s, systemd likely failed to boot; %s", s.name, what, hint)
+	p.captureJournal(ctx, cfg, s, what+", systemd likely failed to boot")
+}
@@ -0,0 +1,112 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/containerd/nri/pkg/api"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBootCheck(t *testing.T) {
+	// startedTestPlugin returns a plugin tracking an adjusted systemd
+	// container, and the container as started by the runtime.
+	startedTestPlugin := func(t *testing.T) (*plugin, *api.Container) {
+		p := newTestPlugin(configWith(func(c *Config) { c.BootCheckWindow = Duration(time.Minute) }))
+		container := newProfileTestContainer(nil)
+		_, _, err := p.CreateContainer(context.Background(), &api.PodSandbox{}, container)
+		require.NoError(t, err)
+
+		container.State = api.ContainerState_CONTAINER_RUNNING
+		container.Pid = 4242
+		return p, container
+	}
+
+	t.Run("event mask", func(t *testing.T) {
+		p := configureTestPlugin(t, "", "containerd", "v2.0.4")
+		events, err := p.Configure(context.Background(), "", "containerd", "v2.0.4")
+		require.NoError(t, err)
+		assert.False(t, events.IsSet(api.Event_POST_START_CONTAINER))
+		assert.False(t, events.IsSet(api.Event_STOP_CONTAINER))
+		assert.True(t, events.IsSet(api.Event_CREATE_CONTAINER))
+
+		p = configureTestPlugin(t, "bootCheckWindow: 30s\n", "containerd", "v2.0.4")
+		events, err = p.Configure(context.Background(), "", "containerd", "v2.0.4")
+		require.NoError(t, err)
+		assert.True(t, events.IsSet(api.Event_POST_START_CONTAINER))
+		assert.True(t, events.IsSet(api.Event_STOP_CONTAINER))
+	})
+
+	t.Run("exited right away", func(t *testing.T) {
+		p, container := startedTestPlugin(t)
+		logs := logtest.NewLocal(p.logs.base)
+		container.State = api.ContainerState_CONTAINER_STOPPED
+		container.Pid = 0
+
+		require.NoError(t, p.PostStartContainer(context.Background(), &api.PodSandbox{}, container))
+		require.NotNil(t, logs.LastEntry())
+		assert.Equal(t, logrus.WarnLevel, logs.LastEntry().Level)
+		assert.Contains(t, logs.LastEntry().Message, "exited right after starting, systemd likely failed to boot")
+		assert.Equal(t, 1.0, testutil.ToFloat64(p.metrics.failedBoots))
+	})
+
+	t.Run("stopped within the window", func(t *testing.T) {
+		p, container := startedTestPlugin(t)
+		logs := logtest.NewLocal(p.logs.base)
+
+		require.NoError(t, p.PostStartContainer(context.Background(), &api.PodSandbox{}, container))
+		assert.Empty(t, logs.AllEntries())
+		assert.False(t, p.state.get(container.Id).started.IsZero())
+
+		container.State = api.ContainerState_CONTAINER_STOPPED
+		_, err := p.StopContainer(context.Background(), &api.PodSandbox{}, container)
+		require.NoError(t, err)
+		require.NotNil(t, logs.LastEntry())
+		assert.Contains(t, logs.LastEntry().Message, "after starting, systemd likely failed to boot")
+		assert.Equal(t, 1.0, testutil.ToFloat64(p.metrics.failedBoots))
+	})
+
+	t.Run("stopped after the window", func(t *testing.T) {
+		p, container := startedTestPlugin(t)
+		logs := logtest.NewLocal(p.logs.base)
+
+		require.NoError(t, p.PostStartContainer(context.Background(), &api.PodSandbox{}, container))
+		p.state.update(container.Id, func(s *containerState) { s.started = time.Now().Add(-time.Hour) })
+
+		_, err := p.StopContainer(context.Background(), &api.PodSandbox{}, container)
+		require.NoError(t, err)
+		assert.Empty(t, logs.AllEntries())
+		assert.Equal(t, 0.0, testutil.ToFloat64(p.metrics.failedBoots))
+	})
+
+	t.Run("not a systemd container", func(t *testing.T) {
+		p := newTestPlugin(configWith(func(c *Config) { c.BootCheckWindow = Duration(time.Minute) }))
+		container := &api.Container{Id: "other", State: api.ContainerState_CONTAINER_STOPPED}
+
+		require.NoError(t, p.PostStartContainer(context.Background(), &api.PodSandbox{}, container))
+		_, err := p.StopContainer(context.Background(), &api.PodSandbox{}, container)
+		require.NoError(t, err)
+		assert.Equal(t, 0.0, testutil.ToFloat64(p.metrics.failedBoots))
+	})
+}
@@ -0,0 +1,100 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"slices"
+
+	"github.com/containerd/nri/pkg/stub"
+)
+
+// capabilities describes what the plugin build supports, printed with
+// -capabilities. Like events, it is a stable interface: fields may be
+// added, but are never renamed or removed.
+type capabilities struct {
+	Hooks     []string            `json:"hooks"`
+	Detection []detectionStrategy `json:"detection"`
+	Profiles  []string            `json:"profiles"`
+}
+
+// detectionStrategy is a way of detecting systemd containers, enabled or
+// not by the configuration.
+type detectionStrategy struct {
+	Name    string `json:"name"`
+	Enabled bool   `json:"enabled"`
+}
+
+// nriHooks are the NRI hooks a plugin may implement, in the order of the
+// container lifecycle.
+var nriHooks = []struct {
+	name        string
+	implemented func(plugin interface{}) bool
+}{
+	{"Configure", implements[stub.ConfigureInterface]},
+	{"Synchronize", implements[stub.SynchronizeInterface]},
+	{"Shutdown", implements[stub.ShutdownInterface]},
+	{"RunPodSandbox", implements[stub.RunPodInterface]},
+	{"StopPodSandbox", implements[stub.StopPodInterface]},
+	{"RemovePodSandbox", implements[stub.RemovePodInterface]},
+	{"CreateContainer", implements[stub.CreateContainerInterface]},
+	{"PostCreateContainer", implements[stub.PostCreateContainerInterface]},
+	{"StartContainer", implements[stub.StartContainerInterface]},
+	{"PostStartContainer", implements[stub.PostStartContainerInterface]},
+	{"UpdateContainer", implements[stub.UpdateContainerInterface]},
+	{"PostUpdateContainer", implements[stub.PostUpdateContainerInterface]},
+	{"StopContainer", implements[stub.StopContainerInterface]},
+	{"RemoveContainer", implements[stub.RemoveContainerInterface]},
+}
+
+func implements[T any](plugin interface{}) bool {
+	_, ok := plugin.(T)
+	return ok
+}
+
+// capabilities reports the hooks implemented by the plugin, the detection
+// strategies under the current configuration and the available profiles.
+func (p *plugin) capabilities() *capabilities {
+	cfg := p.config()
+	c := &capabilities{
+		Hooks:     []string{},
+		Detection: []detectionStrategy{},
+		Profiles:  []string{},
+	}
+
+	for _, h := range nriHooks {
+		if h.implemented(p) {
+			c.Hooks = append(c.Hooks, h.name)
+		}
+	}
+	for _, d := range orderedDetectors(cfg) {
+		c.Detection = append(c.Detection, detectionStrategy{Name: d.reason, Enabled: d.enabled(cfg)})
+	}
+	for name := range profiles {
+		c.Profiles = append(c.Profiles, name)
+	}
+	slices.Sort(c.Profiles)
+
+	return c
+}
+
+func (c *capabilities) write(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(c)
+}
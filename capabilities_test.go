@@ -0,0 +1,54 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCapabilities(t *testing.T) {
+	p := newTestPlugin(configWith(func(c *Config) {
+		c.Detection.ShellExec = true
+	}))
+
+	var buf bytes.Buffer
+	require.NoError(t, p.capabilities().write(&buf))
+
+	var report map[string]interface{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &report))
+	assert.Equal(t, map[string]interface{}{
+		"hooks": []interface{}{"Configure", "Synchronize", "RemovePodSandbox", "CreateContainer", "PostCreateContainer", "StartContainer", "PostStartContainer", "UpdateContainer", "StopContainer", "RemoveContainer"},
+		"detection": []interface{}{
+			map[string]interface{}{"name": "annotation", "enabled": true},
+			map[string]interface{}{"name": "entrypoint", "enabled": true},
+			map[string]interface{}{"name": "shell-exec", "enabled": true},
+		},
+		"profiles": []interface{}{"container-engine", "nested-containers", "nested-runtime", "rootless"},
+	}, report)
+
+	// the once plugin does not adjust containers
+	for _, h := range nriHooks {
+		if h.name == "CreateContainer" {
+			assert.False(t, h.implemented(&oncePlugin{}))
+		}
+	}
+}
@@ -0,0 +1,450 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/containerd/nri/pkg/api"
+)
+
+const (
+	cgroupRoot = "/sys/fs/cgroup"
+
+	// systemdCgroupDir is where systemd expects its named hierarchy on
+	// cgroup v1 hosts.
+	systemdCgroupDir = cgroupRoot + "/systemd"
+)
+
+type cgroupMode int
+
+const (
+	cgroupV1 cgroupMode = iota
+	cgroupV2
+)
+
+func (m cgroupMode) MarshalText() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+func (m cgroupMode) String() string {
+	switch m {
+	case cgroupV1:
+		return "v1"
+	case cgroupV2:
+		return "v2"
+	}
+	return fmt.Sprintf("cgroupMode(%d)", int(m))
+}
+
+// cgroupLayout describes how the cgroup hierarchies are arranged on the
+// host. Only the v1 and v2 layouts are fully supported.
+type cgroupLayout string
+
+const (
+	// cgroupLayoutV2 is the unified hierarchy mounted at /sys/fs/cgroup.
+	cgroupLayoutV2 cgroupLayout = "v2"
+	// cgroupLayoutV1 has one hierarchy per controller below /sys/fs/cgroup.
+	cgroupLayoutV1 cgroupLayout = "v1"
+	// cgroupLayoutHybrid is v1 with the unified hierarchy mounted at
+	// /sys/fs/cgroup/unified, used by systemd on some older distributions.
+	cgroupLayoutHybrid  cgroupLayout = "hybrid"
+	cgroupLayoutUnknown cgroupLayout = "unknown"
+)
+
+// v1Hierarchies are hierarchies found on every cgroup v1 host, depending
+// on whether it runs systemd.
+var v1Hierarchies = []string{"systemd", "cpu", "memory", "pids"}
+
+// classifyCgroupLayout probes the arrangement of the cgroup hierarchies.
+func classifyCgroupLayout(ctx context.Context, prober hostProber) (cgroupLayout, error) {
+	exists := func(path string) (bool, error) {
+		_, err := prober.Stat(ctx, path)
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return false, ctxErr
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return false, fmt.Errorf("failed to probe cgroup layout: %w", err)
+		}
+		return err == nil, nil
+	}
+
+	candidates := []struct {
+		path   string
+		layout cgroupLayout
+	}{
+		{cgroupRoot + "/cgroup.controllers", cgroupLayoutV2},
+		{cgroupRoot + "/unified/cgroup.controllers", cgroupLayoutHybrid},
+	}
+	for _, h := range v1Hierarchies {
+		candidates = append(candidates, struct {
+			path   string
+			layout cgroupLayout
+		}{cgroupRoot + "/" + h, cgroupLayoutV1})
+	}
+
+	for _, c := range candidates {
+		ok, err := exists(c.path)
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			return c.layout, nil
+		}
+	}
+	return cgroupLayoutUnknown, nil
+}
+
+// checkCgroupLayout logs once what the plugin does on the cgroup layout of
+// the host, instead of leaving it to per-container messages. In strict
+// mode, it fails on an unknown layout.
+func (p *plugin) checkCgroupLayout(ctx context.Context, strict bool) error {
+	info, err := p.reprobe(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to probe the host: %w", err)
+	}
+
+	switch info.CgroupLayout {
+	case cgroupLayoutV2:
+		p.hostLog.Infof("cgroup v2 host: making the cgroup mount of systemd containers writable")
+	case cgroupLayoutV1:
+		p.hostLog.Infof("cgroup v1 host: adding the name=systemd hierarchy to systemd containers")
+	case cgroupLayoutHybrid:
+		p.hostLog.Warnf("hybrid cgroup host with the unified hierarchy at %s/unified: "+
+			"systemd containers get the name=systemd v1 hierarchy, but not the unified one", cgroupRoot)
+	default:
+		if strict {
+			return fmt.Errorf("unsupported cgroup layout at %s", cgroupRoot)
+		}
+		p.hostLog.Warnf("unsupported cgroup layout at %s: systemd containers are adjusted as on cgroup %v, "+
+			"but will likely not boot", cgroupRoot, info.CgroupMode)
+	}
+
+	return nil
+}
+
+// cgroupVersion is the cgroup version of the host as given by
+// -cgroup-version, for hosts where probing it fails.
+type cgroupVersion string
+
+const (
+	cgroupVersionAuto cgroupVersion = "auto"
+	cgroupVersionV1   cgroupVersion = "v1"
+	cgroupVersionV2   cgroupVersion = "v2"
+)
+
+func (v *cgroupVersion) String() string {
+	if *v == "" {
+		return string(cgroupVersionAuto)
+	}
+	return string(*v)
+}
+
+func (v *cgroupVersion) Set(s string) error {
+	switch cgroupVersion(s) {
+	case cgroupVersionAuto, cgroupVersionV1, cgroupVersionV2:
+		*v = cgroupVersion(s)
+		return nil
+	}
+	return fmt.Errorf("invalid cgroup version %q, must be %s, %s or %s", s, cgroupVersionAuto, cgroupVersionV1, cgroupVersionV2)
+}
+
+// Filesystem magic numbers of the filesystems at /sys/fs/cgroup.
+const (
+	cgroup2SuperMagic = 0x63677270
+	cgroupSuperMagic  = 0x27e0eb
+	tmpfsMagic        = 0x01021994
+)
+
+// fsTypeProber is a hostProber telling the type of filesystems.
+type fsTypeProber interface {
+	FSType(ctx context.Context, path string) (int64, error)
+}
+
+// cgroupMode probes the cgroup version of the host, unless forced by
+// -cgroup-version, and tells how it was found. The unified (v2) hierarchy
+// is a cgroup2 filesystem, v1 hierarchies are mounted on a tmpfs, or a
+// cgroup filesystem on some hosts. Probers which cannot tell the type of
+// filesystems check for cgroup.controllers instead, which only the
+// unified hierarchy has at its root.
+func (p *plugin) cgroupMode(ctx context.Context) (cgroupMode, string, error) {
+	switch p.cgroupVersion {
+	case cgroupVersionV1:
+		return cgroupV1, "forced by -cgroup-version", nil
+	case cgroupVersionV2:
+		return cgroupV2, "forced by -cgroup-version", nil
+	}
+
+	if fp, ok := p.prober.(fsTypeProber); ok {
+		typ, err := fp.FSType(ctx, cgroupRoot)
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return 0, "", ctxErr
+		}
+		switch {
+		case err != nil:
+			p.hostLog.Debugf("failed to probe the filesystem type of %s, checking for cgroup.controllers: %v", cgroupRoot, err)
+		case typ == cgroup2SuperMagic:
+			return cgroupV2, "cgroup2 filesystem", nil
+		case typ == tmpfsMagic:
+			return cgroupV1, "tmpfs filesystem", nil
+		case typ == cgroupSuperMagic:
+			return cgroupV1, "cgroup filesystem", nil
+		default:
+			p.hostLog.Debugf("unexpected filesystem type %#x at %s, checking for cgroup.controllers", typ, cgroupRoot)
+		}
+	}
+
+	_, err := p.prober.Stat(ctx, cgroupRoot+"/cgroup.controllers")
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return 0, "", ctxErr
+	}
+	switch {
+	case err == nil:
+		return cgroupV2, "cgroup.controllers found", nil
+	case os.IsNotExist(err):
+		return cgroupV1, "no cgroup.controllers", nil
+	}
+	return 0, "", fmt.Errorf("failed to probe cgroup version: %w", err)
+}
+
+// addSystemdCgroupMount mounts the name=systemd hierarchy on cgroup v1
+// hosts. systemd refuses to boot without it, and runtimes only provide it
+// as part of /sys/fs/cgroup if it happens to be mounted on the host.
+func (p *plugin) addSystemdCgroupMount(ctx context.Context, cfg *Config, adjust *api.ContainerAdjustment, container *api.Container, ctrName string, results *mountResults) error {
+	host, err := p.host(ctx)
+	if err != nil {
+		return err
+	}
+	if host.CgroupMode != cgroupV1 {
+		return nil
+	}
+
+	if existing := findContainerMount(container, systemdCgroupDir); existing != nil {
+		if !isReadOnlyMount(existing) {
+			p.mountLog.Debugf("%s: %s already mounted, skipping", ctrName, systemdCgroupDir)
+			results.add(systemdCgroupDir, mountSkipped, "already mounted by the container")
+			return nil
+		}
+		// systemd creates its cgroups in the name=systemd hierarchy, so
+		// it needs to be writable like the cgroup mount
+		mount := &api.Mount{
+			Destination: existing.Destination,
+			Type:        existing.Type,
+			Source:      existing.Source,
+			Options:     slices.Clone(existing.Options),
+		}
+		for i, opt := range mount.Options {
+			if opt == "ro" {
+				mount.Options[i] = "rw"
+			}
+		}
+		reason := "read-only, made writable"
+		switch cfg.CgroupRemount {
+		case CgroupRemountFail:
+			p.mountLog.Errorf("%s: %s mount is read-only, but cgroupRemount is %s", ctrName, systemdCgroupDir, CgroupRemountFail)
+			return fmt.Errorf("%s mount needs to be made writable, which the runtime does not support (cgroupRemount: %s)",
+				systemdCgroupDir, CgroupRemountFail)
+		case CgroupRemountAdd:
+			reason += ", added over the runtime's mount (cgroupRemount: add)"
+		default:
+			adjust.RemoveMount(systemdCgroupDir)
+		}
+		adjust.AddMount(mount)
+		p.mountLog.Debugf("%s: changed %s mount from ro to rw", ctrName, systemdCgroupDir)
+		results.add(systemdCgroupDir, mountModified, "%s", reason)
+		return nil
+	}
+
+	m := cfg.SystemdCgroupMount
+	adjust.AddMount(&api.Mount{
+		Destination: systemdCgroupDir,
+		Type:        m.Type,
+		Source:      m.Source,
+		Options:     append([]string(nil), m.Options...),
+	})
+	p.mountLog.Debugf("%s: added %s mount for cgroup v1", ctrName, systemdCgroupDir)
+	results.add(systemdCgroupDir, mountAdded, "name=systemd hierarchy needed on cgroup v1 hosts")
+
+	return nil
+}
+
+// remountsCgroup tells whether the adjustment makes the cgroup mount
+// writable.
+func remountsCgroup(adjust *api.ContainerAdjustment) bool {
+	for _, m := range adjust.Mounts {
+		if m.Destination == cgroupRoot && !isReadOnlyMount(m) {
+			return true
+		}
+	}
+	return false
+}
+
+// writableTmpfsMounts returns the destinations of the writable tmpfs mounts
+// of the adjustment.
+func writableTmpfsMounts(adjust *api.ContainerAdjustment) []string {
+	var dests []string
+	for _, m := range adjust.Mounts {
+		if _, removed := api.IsMarkedForRemoval(m.Destination); !removed && m.Type == "tmpfs" && !isReadOnlyMount(m) {
+			dests = append(dests, m.Destination)
+		}
+	}
+	return dests
+}
+
+// cgroupIgnoredDrift is the drift recorded for a container whose runtime
+// ignored making the cgroup mount writable.
+const cgroupIgnoredDrift = "cgroup mount is read-only, the runtime ignored making it writable"
+
+// adjustmentViolation is a way the mounts of a created systemd container
+// break its adjustment, e.g. because the runtime ignored part of it or a
+// later plugin changed the mounts again.
+type adjustmentViolation struct {
+	destination string
+	problem     string
+}
+
+func (v adjustmentViolation) String() string {
+	return v.destination + " " + v.problem
+}
+
+// adjustmentViolations checks the final mounts of a container against its
+// adjustment: the cgroup mount made writable and the tmpfs mounts added
+// must be the mounts visible at their destinations, and writable.
+func adjustmentViolations(s *containerState, mounts []*api.Mount) []adjustmentViolation {
+	// the last mount at a destination is the one visible in the container
+	visible := map[string]*api.Mount{}
+	for _, m := range mounts {
+		visible[m.Destination] = m
+	}
+
+	dests := slices.Clone(s.writableMounts)
+	if s.cgroupRemounted {
+		dests = append([]string{cgroupRoot}, dests...)
+	}
+
+	var violations []adjustmentViolation
+	for _, dest := range dests {
+		m, ok := visible[dest]
+		switch {
+		case !ok:
+			violations = append(violations, adjustmentViolation{dest, "is not mounted"})
+		case isReadOnlyMount(m):
+			violations = append(violations, adjustmentViolation{dest, "is read-only"})
+		case dest != cgroupRoot && m.Type != "tmpfs":
+			violations = append(violations, adjustmentViolation{dest, "is a " + m.Type + " mount instead of a tmpfs"})
+		}
+	}
+	return violations
+}
+
+// validateAdjustment is the verdict on the final mounts of a systemd
+// container, returning the violations of its adjustment and, if the mode
+// rejects them, an error naming them. It is meant for the adjustment
+// validation of newer NRI versions, before the container is created; with
+// the NRI version of the plugin, it can only run after creating it.
+func validateAdjustment(mode AdjustmentValidation, s *containerState, mounts []*api.Mount) ([]adjustmentViolation, error) {
+	violations := adjustmentViolations(s, mounts)
+	if len(violations) == 0 || mode != AdjustmentValidationReject {
+		return violations, nil
+	}
+	problems := make([]string, 0, len(violations))
+	for _, v := range violations {
+		problems = append(problems, v.String())
+	}
+	return violations, fmt.Errorf("rejecting the final mounts, systemd cannot boot: %s", strings.Join(problems, ", "))
+}
+
+// PostCreateContainer checks that the mounts a systemd container was
+// created with still match its adjustment. Some runtimes ignore replacing
+// mounts, leaving a read-only cgroup systemd cannot boot with, see
+// cgroupRemount. Plugins running after this one may change the mounts as
+// well, e.g. mount /run read-only again. With adjustmentValidation set to
+// reject, the hook fails, though runtimes only log that for a created
+// container.
+func (p *plugin) PostCreateContainer(_ context.Context, pod *api.PodSandbox, container *api.Container) error {
+	defer p.observeHook("PostCreateContainer", time.Now())
+	defer p.conn.eventHandled()
+	p.dumpHook("PostCreateContainer", pod, container, nil, nil)
+
+	s := p.state.get(container.Id)
+	if s == nil {
+		return nil
+	}
+
+	violations, err := validateAdjustment(p.config().AdjustmentValidation, s, container.Mounts)
+	if len(violations) == 0 {
+		return nil
+	}
+
+	var drift []string
+	for _, v := range violations {
+		if v.destination == cgroupRoot && v.problem == "is read-only" {
+			p.mountLog.Warnf("%s: the runtime did not make the cgroup mount writable, systemd will fail to boot; "+
+				"set cgroupRemount to %s or %s for this runtime", s.name, CgroupRemountAdd, CgroupRemountFail)
+			p.metrics.remountIgnored.Inc()
+			drift = append(drift, cgroupIgnoredDrift)
+			continue
+		}
+		p.mountLog.Warnf("%s: %s after creating the container, systemd will likely fail to boot; "+
+			"another plugin or the runtime changed the mount", s.name, v)
+		drift = append(drift, v.String()+", changed after the adjustment")
+	}
+	p.state.update(container.Id, func(updated *containerState) {
+		updated.drift = append(slices.Clone(updated.drift), drift...)
+	})
+	if err != nil {
+		p.mountLog.Errorf("%s: %v", s.name, err)
+	}
+	return err
+}
+
+// UpdateContainer checks the mounts of a tracked systemd container again
+// when its resources are updated, recording violations of its adjustment
+// not found before. The mounts of a running container cannot be changed,
+// so the update is passed through as is. Other containers are ignored.
+func (p *plugin) UpdateContainer(_ context.Context, pod *api.PodSandbox, container *api.Container, _ *api.LinuxResources) ([]*api.ContainerUpdate, error) {
+	defer p.observeHook("UpdateContainer", time.Now())
+	defer p.conn.eventHandled()
+
+	s := p.state.get(container.Id)
+	if s == nil {
+		return nil, nil
+	}
+	p.stateLog.Debugf("%s: resources of systemd container updated", s.name)
+
+	var drift []string
+	for _, v := range adjustmentViolations(s, container.Mounts) {
+		d := v.String() + ", found on update"
+		if slices.Contains(s.drift, d) || slices.Contains(s.drift, v.String()+", changed after the adjustment") ||
+			(v.destination == cgroupRoot && v.problem == "is read-only" && slices.Contains(s.drift, cgroupIgnoredDrift)) {
+			continue
+		}
+		p.mountLog.Warnf("%s: %s, systemd may fail; another plugin or the runtime changed the mount", s.name, v)
+		drift = append(drift, d)
+	}
+	if len(drift) > 0 {
+		p.state.update(container.Id, func(updated *containerState) {
+			updated.drift = append(slices.Clone(updated.drift), drift...)
+		})
+	}
+	return nil, nil
+}
@@ -0,0 +1,889 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/containerd/nri/pkg/api"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newCgroupV1TestPlugin returns a test plugin on a fake cgroup v1 host.
+func newCgroupV1TestPlugin(cfg *Config) *plugin {
+	p := newTestPlugin(cfg)
+	p.prober = &fakeProber{
+		paths: map[string]bool{
+			"/sys/fs/cgroup": true,
+		},
+	}
+	return p
+}
+
+func findMount(mounts []*api.Mount, dest string) *api.Mount {
+	for _, m := range mounts {
+		if m.Destination == dest {
+			return m
+		}
+	}
+	return nil
+}
+
+func TestSystemdCgroupMount(t *testing.T) {
+	pod := &api.PodSandbox{Name: "test-pod"}
+
+	t.Run("added on cgroup v1", func(t *testing.T) {
+		p := newCgroupV1TestPlugin(nil)
+
+		adjust, _, err := p.CreateContainer(context.Background(), pod, newProfileTestContainer(nil))
+		require.NoError(t, err)
+
+		m := findMount(adjust.Mounts, "/sys/fs/cgroup/systemd")
+		require.NotNil(t, m)
+		assert.Equal(t, &api.Mount{
+			Destination: "/sys/fs/cgroup/systemd",
+			Type:        "cgroup",
+			Source:      "cgroup",
+			Options:     []string{"rw", "nosuid", "noexec", "nodev", "none", "name=systemd"},
+		}, m)
+	})
+
+	t.Run("configured options", func(t *testing.T) {
+		p := newCgroupV1TestPlugin(configWith(func(c *Config) {
+			c.SystemdCgroupMount.Options = []string{"rw", "nosuid", "nodev", "name=systemd", "xattr"}
+		}))
+
+		adjust, _, err := p.CreateContainer(context.Background(), pod, newProfileTestContainer(nil))
+		require.NoError(t, err)
+
+		m := findMount(adjust.Mounts, "/sys/fs/cgroup/systemd")
+		require.NotNil(t, m)
+		assert.Equal(t, []string{"rw", "nosuid", "nodev", "name=systemd", "xattr"}, m.Options)
+	})
+
+	t.Run("existing mount kept", func(t *testing.T) {
+		p := newCgroupV1TestPlugin(nil)
+		ctr := newProfileTestContainer(nil, &api.Mount{
+			Destination: "/sys/fs/cgroup/systemd",
+			Type:        "bind",
+			Source:      "/sys/fs/cgroup/systemd",
+			Options:     []string{"rbind", "rw"},
+		})
+
+		adjust, _, err := p.CreateContainer(context.Background(), pod, ctr)
+		require.NoError(t, err)
+		assert.Nil(t, findMount(adjust.Mounts, "/sys/fs/cgroup/systemd"))
+	})
+
+	t.Run("read-only mount made writable", func(t *testing.T) {
+		p := newCgroupV1TestPlugin(nil)
+		ctr := newProfileTestContainer(nil, &api.Mount{
+			Destination: "/sys/fs/cgroup/systemd",
+			Type:        "bind",
+			Source:      "/sys/fs/cgroup/systemd",
+			Options:     []string{"rbind", "ro"},
+		})
+
+		adjust, _, err := p.CreateContainer(context.Background(), pod, ctr)
+		require.NoError(t, err)
+		assert.Contains(t, adjust.Mounts, &api.Mount{Destination: api.MarkForRemoval("/sys/fs/cgroup/systemd")})
+		assert.Equal(t, &api.Mount{
+			Destination: "/sys/fs/cgroup/systemd",
+			Type:        "bind",
+			Source:      "/sys/fs/cgroup/systemd",
+			Options:     []string{"rbind", "rw"},
+		}, findMount(adjust.Mounts, "/sys/fs/cgroup/systemd"))
+
+		p = newCgroupV1TestPlugin(configWith(func(c *Config) { c.CgroupRemount = CgroupRemountFail }))
+		_, _, err = p.CreateContainer(context.Background(), pod, ctr)
+		assert.ErrorContains(t, err, "/sys/fs/cgroup/systemd mount needs to be made writable")
+	})
+
+	t.Run("skipped on cgroup v2", func(t *testing.T) {
+		p := newTestPlugin(nil)
+
+		adjust, _, err := p.CreateContainer(context.Background(), pod, newProfileTestContainer(nil))
+		require.NoError(t, err)
+		assert.Nil(t, findMount(adjust.Mounts, "/sys/fs/cgroup/systemd"))
+	})
+}
+
+func TestCgroupLayoutMounts(t *testing.T) {
+	// the mounts runtimes give containers on cgroup v1 hosts: a tmpfs
+	// holding a bind mount per hierarchy
+	v1Mounts := func(systemd bool) []*api.Mount {
+		mounts := []*api.Mount{
+			{Destination: "/sys/fs/cgroup", Type: "tmpfs", Source: "tmpfs", Options: []string{"nosuid", "noexec", "nodev", "mode=755", "ro"}},
+			{Destination: "/sys/fs/cgroup/cpu,cpuacct", Type: "bind", Source: "/sys/fs/cgroup/cpu,cpuacct", Options: []string{"rbind", "ro"}},
+			{Destination: "/sys/fs/cgroup/memory", Type: "bind", Source: "/sys/fs/cgroup/memory", Options: []string{"rbind", "ro"}},
+		}
+		if systemd {
+			mounts = append(mounts, &api.Mount{Destination: "/sys/fs/cgroup/systemd", Type: "bind", Source: "/sys/fs/cgroup/systemd", Options: []string{"rbind", "ro"}})
+		}
+		return mounts
+	}
+	newContainer := func(mounts []*api.Mount) *api.Container {
+		container := newProfileTestContainer(nil)
+		container.Mounts = mounts
+		return container
+	}
+	hybridPlugin := func() *plugin {
+		p := newTestPlugin(nil)
+		p.prober = &fakeProber{
+			paths:   map[string]bool{cgroupRoot: true, cgroupRoot + "/unified/cgroup.controllers": true},
+			fsTypes: map[string]int64{cgroupRoot: tmpfsMagic},
+		}
+		return p
+	}
+
+	for name, newPlugin := range map[string]func() *plugin{
+		"v1":     func() *plugin { return newCgroupV1TestPlugin(nil) },
+		"hybrid": hybridPlugin,
+	} {
+		t.Run(name+" with systemd hierarchy", func(t *testing.T) {
+			adjust, _, err := newPlugin().CreateContainer(context.Background(), nil, newContainer(v1Mounts(true)))
+			require.NoError(t, err)
+
+			// only the name=systemd hierarchy is made writable
+			assert.Nil(t, findMount(adjust.Mounts, "/sys/fs/cgroup"))
+			assert.Nil(t, findMount(adjust.Mounts, "/sys/fs/cgroup/cpu,cpuacct"))
+			assert.Nil(t, findMount(adjust.Mounts, "/sys/fs/cgroup/memory"))
+			assert.NotNil(t, findMount(adjust.Mounts, "-/sys/fs/cgroup/systemd"))
+			assert.Equal(t, []string{"rbind", "rw"}, findMount(adjust.Mounts, "/sys/fs/cgroup/systemd").Options)
+		})
+
+		t.Run(name+" without systemd hierarchy", func(t *testing.T) {
+			adjust, _, err := newPlugin().CreateContainer(context.Background(), nil, newContainer(v1Mounts(false)))
+			require.NoError(t, err)
+
+			assert.Nil(t, findMount(adjust.Mounts, "/sys/fs/cgroup"))
+			m := findMount(adjust.Mounts, "/sys/fs/cgroup/systemd")
+			require.NotNil(t, m)
+			assert.Equal(t, "cgroup", m.Type)
+			assert.Contains(t, m.Options, "name=systemd")
+			assert.Contains(t, m.Options, "rw")
+		})
+	}
+
+	t.Run("v2", func(t *testing.T) {
+		p := newTestPlugin(nil)
+		adjust, _, err := p.CreateContainer(context.Background(), nil, newContainer([]*api.Mount{
+			{Destination: "/sys/fs/cgroup", Type: "cgroup", Source: "cgroup", Options: []string{"nosuid", "noexec", "nodev", "relatime", "ro"}},
+		}))
+		require.NoError(t, err)
+
+		assert.NotNil(t, findMount(adjust.Mounts, "-/sys/fs/cgroup"))
+		assert.Equal(t, []string{"nosuid", "noexec", "nodev", "relatime", "rw"}, findMount(adjust.Mounts, "/sys/fs/cgroup").Options)
+		assert.Nil(t, findMount(adjust.Mounts, "/sys/fs/cgroup/systemd"))
+	})
+}
+
+func TestCgroupVersion(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		version  cgroupVersion
+		fsType   int64
+		v2Files  bool
+		expected cgroupMode
+		how      string
+	}{
+		{name: "cgroup2 filesystem", fsType: cgroup2SuperMagic, expected: cgroupV2, how: "cgroup2 filesystem"},
+		{name: "tmpfs filesystem", fsType: tmpfsMagic, v2Files: true, expected: cgroupV1, how: "tmpfs filesystem"},
+		{name: "cgroup filesystem", fsType: cgroupSuperMagic, expected: cgroupV1, how: "cgroup filesystem"},
+		{name: "unknown filesystem", fsType: 0x9123683e, v2Files: true, expected: cgroupV2, how: "cgroup.controllers found"},
+		{name: "no filesystem type", v2Files: false, expected: cgroupV1, how: "no cgroup.controllers"},
+		{name: "forced v1", version: cgroupVersionV1, fsType: cgroup2SuperMagic, expected: cgroupV1, how: "forced by -cgroup-version"},
+		{name: "forced v2", version: cgroupVersionV2, fsType: tmpfsMagic, expected: cgroupV2, how: "forced by -cgroup-version"},
+		{name: "auto", version: cgroupVersionAuto, fsType: cgroup2SuperMagic, expected: cgroupV2, how: "cgroup2 filesystem"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			prober := &fakeProber{paths: map[string]bool{cgroupRoot: true}}
+			if tt.fsType != 0 {
+				prober.fsTypes = map[string]int64{cgroupRoot: tt.fsType}
+			}
+			if tt.v2Files {
+				prober.paths[cgroupRoot+"/cgroup.controllers"] = true
+			}
+			p := newTestPlugin(configWith(func(c *Config) { c.LogLevel = "host=debug" }))
+			p.prober = prober
+			p.cgroupVersion = tt.version
+			hook := logtest.NewLocal(p.logs.base)
+
+			host, err := p.reprobe(context.Background())
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, host.CgroupMode)
+
+			var logged bool
+			for _, e := range hook.AllEntries() {
+				logged = logged || e.Message == "detected cgroup "+tt.expected.String()+": "+tt.how
+			}
+			assert.True(t, logged)
+		})
+	}
+
+	t.Run("forced v1 mounts the name=systemd hierarchy", func(t *testing.T) {
+		p := newTestPlugin(nil)
+		p.cgroupVersion = cgroupVersionV1
+
+		adjust, _, err := p.CreateContainer(context.Background(), nil, newProfileTestContainer(nil))
+		require.NoError(t, err)
+		assert.NotNil(t, findMount(adjust.Mounts, systemdCgroupDir))
+	})
+
+	t.Run("flag", func(t *testing.T) {
+		var v cgroupVersion
+		assert.Equal(t, "auto", v.String())
+		require.NoError(t, v.Set("v1"))
+		assert.Equal(t, cgroupVersionV1, v)
+		assert.ErrorContains(t, v.Set("v3"), `invalid cgroup version "v3"`)
+	})
+}
+
+func TestCgroupRWAnnotation(t *testing.T) {
+	readOnly := map[string]string{cgroupRWAnnotation: "false"}
+
+	t.Run("false leaves the cgroup mount alone", func(t *testing.T) {
+		p := newTestPlugin(configWith(func(c *Config) { c.LogLevel = "mounts=debug" }))
+		hook := logtest.NewLocal(p.logs.base)
+
+		adjust, _, err := p.CreateContainer(context.Background(), nil, newProfileTestContainer(readOnly))
+		require.NoError(t, err)
+		assert.Nil(t, findMount(adjust.Mounts, "/sys/fs/cgroup"))
+		assert.Nil(t, findMount(adjust.Mounts, "-/sys/fs/cgroup"))
+		assert.NotNil(t, findMount(adjust.Mounts, "/run"))
+		assert.Contains(t, adjust.Env, &api.KeyValue{Key: "container", Value: "other"})
+		assert.NotContains(t, adjust.Annotations[provenanceAnnotation], "cgroup")
+
+		var logged bool
+		for _, e := range hook.AllEntries() {
+			logged = logged || (e.Level == logrus.DebugLevel && strings.Contains(e.Message, "not remounting the cgroup mount"))
+		}
+		assert.True(t, logged)
+	})
+
+	t.Run("false on cgroup v1", func(t *testing.T) {
+		adjust, _, err := newCgroupV1TestPlugin(nil).CreateContainer(context.Background(), nil, newProfileTestContainer(readOnly))
+		require.NoError(t, err)
+		assert.Nil(t, findMount(adjust.Mounts, "/sys/fs/cgroup"))
+		assert.Nil(t, findMount(adjust.Mounts, systemdCgroupDir))
+	})
+
+	t.Run("false without a cgroup mount", func(t *testing.T) {
+		container := newProfileTestContainer(readOnly)
+		container.Mounts = nil
+
+		adjust, _, err := newTestPlugin(nil).CreateContainer(context.Background(), nil, container)
+		require.NoError(t, err)
+		assert.NotNil(t, findMount(adjust.Mounts, "/run"))
+	})
+
+	t.Run("true on the container wins over the pod", func(t *testing.T) {
+		pod := &api.PodSandbox{Annotations: readOnly}
+		container := newProfileTestContainer(map[string]string{cgroupRWAnnotation: "true"})
+
+		adjust, _, err := newTestPlugin(nil).CreateContainer(context.Background(), pod, container)
+		require.NoError(t, err)
+		m := findMount(adjust.Mounts, "/sys/fs/cgroup")
+		require.NotNil(t, m)
+		assert.Contains(t, m.Options, "rw")
+
+		adjust, _, err = newTestPlugin(nil).CreateContainer(context.Background(), pod, newProfileTestContainer(nil))
+		require.NoError(t, err)
+		assert.Nil(t, findMount(adjust.Mounts, "/sys/fs/cgroup"))
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		container := newProfileTestContainer(map[string]string{cgroupRWAnnotation: "maybe"})
+		_, _, err := newTestPlugin(nil).CreateContainer(context.Background(), nil, container)
+		assert.ErrorContains(t, err, `invalid io.systemd.container/cgroup-rw annotation "maybe"`)
+	})
+}
+
+func TestMissingCgroupMount(t *testing.T) {
+	newContainer := func(namespaces ...*api.LinuxNamespace) *api.Container {
+		container := newProfileTestContainer(nil)
+		container.Mounts = []*api.Mount{{Destination: "/data", Type: "bind", Source: "/srv/data", Options: []string{"rbind"}}}
+		container.Linux = &api.LinuxContainer{Namespaces: namespaces}
+		return container
+	}
+	privateNamespace := &api.LinuxNamespace{Type: "cgroup"}
+	hostNamespace := &api.LinuxNamespace{Type: "mount"}
+	joinedNamespace := &api.LinuxNamespace{Type: "cgroup", Path: "/proc/4242/ns/cgroup"}
+
+	tests := []struct {
+		name      string
+		plugin    func() *plugin
+		container *api.Container
+		expected  *api.Mount
+		systemd   bool
+	}{
+		{
+			name:      "cgroup v2",
+			plugin:    func() *plugin { return newTestPlugin(nil) },
+			container: newContainer(privateNamespace),
+			expected:  &api.Mount{Destination: "/sys/fs/cgroup", Type: "cgroup2", Source: "cgroup2", Options: []string{"rw", "nosuid", "noexec", "nodev"}},
+		},
+		{
+			name:      "cgroup v1",
+			plugin:    func() *plugin { return newCgroupV1TestPlugin(nil) },
+			container: newContainer(privateNamespace),
+			expected:  &api.Mount{Destination: "/sys/fs/cgroup", Type: "tmpfs", Source: "tmpfs", Options: []string{"rw", "nosuid", "noexec", "nodev", "mode=755"}},
+			systemd:   true,
+		},
+		{
+			name:      "cgroup v2 shared namespace",
+			plugin:    func() *plugin { return newTestPlugin(nil) },
+			container: newContainer(hostNamespace),
+			expected:  &api.Mount{Destination: "/sys/fs/cgroup", Type: "cgroup2", Source: "cgroup2", Options: []string{"ro", "nosuid", "noexec", "nodev"}},
+		},
+		{
+			name:      "cgroup v1 shared namespace",
+			plugin:    func() *plugin { return newCgroupV1TestPlugin(nil) },
+			container: newContainer(joinedNamespace),
+			expected:  &api.Mount{Destination: "/sys/fs/cgroup", Type: "tmpfs", Source: "tmpfs", Options: []string{"ro", "nosuid", "noexec", "nodev", "mode=755"}},
+		},
+		{
+			name:      "cgroup v1 without cgroup namespace",
+			plugin:    func() *plugin { return newCgroupV1TestPlugin(nil) },
+			container: newContainer(hostNamespace),
+			expected:  &api.Mount{Destination: "/sys/fs/cgroup", Type: "tmpfs", Source: "tmpfs", Options: []string{"rw", "nosuid", "noexec", "nodev", "mode=755"}},
+			systemd:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := tt.plugin()
+			adjust, _, err := p.CreateContainer(context.Background(), &api.PodSandbox{}, tt.container)
+			require.NoError(t, err)
+
+			m := findMount(adjust.Mounts, "/sys/fs/cgroup")
+			require.NotNil(t, m)
+			assert.Equal(t, tt.expected.Type, m.Type)
+			assert.Equal(t, tt.expected.Source, m.Source)
+			assert.Equal(t, tt.expected.Options, m.Options)
+			assert.Nil(t, findMount(adjust.Mounts, "-/sys/fs/cgroup"))
+			assert.Equal(t, tt.systemd, findMount(adjust.Mounts, "/sys/fs/cgroup/systemd") != nil)
+		})
+	}
+
+	t.Run("no cgroup filesystem on the host", func(t *testing.T) {
+		p := newTestPlugin(configWith(func(c *Config) { c.FailurePolicy = FailClosed }))
+		p.prober = &fakeProber{paths: map[string]bool{}}
+		_, _, err := p.CreateContainer(context.Background(), &api.PodSandbox{}, newContainer(privateNamespace))
+		assert.ErrorContains(t, err, "cgroup filesystem not available")
+	})
+}
+
+func TestSharedCgroupNamespace(t *testing.T) {
+	newContainer := func(namespaces ...*api.LinuxNamespace) *api.Container {
+		container := newProfileTestContainer(nil)
+		container.Linux = &api.LinuxContainer{Namespaces: namespaces}
+		return container
+	}
+	hostNamespace := []*api.LinuxNamespace{{Type: "pid"}, {Type: "mount"}}
+
+	t.Run("private namespace", func(t *testing.T) {
+		p := newTestPlugin(nil)
+
+		adjust, _, err := p.CreateContainer(context.Background(), nil, newContainer(append(hostNamespace, &api.LinuxNamespace{Type: "cgroup"})...))
+		require.NoError(t, err)
+		m := findMount(adjust.Mounts, cgroupRoot)
+		require.NotNil(t, m)
+		assert.Contains(t, m.Options, "rw")
+	})
+
+	t.Run("host namespace left read-only", func(t *testing.T) {
+		p := newTestPlugin(nil)
+		hook := logtest.NewLocal(p.logs.base)
+
+		adjust, _, err := p.CreateContainer(context.Background(), nil, newContainer(hostNamespace...))
+		require.NoError(t, err)
+		assert.Nil(t, findMount(adjust.Mounts, cgroupRoot))
+		assert.NotNil(t, findMount(adjust.Mounts, "/run"))
+
+		var warned bool
+		for _, e := range hook.AllEntries() {
+			warned = warned || (e.Level == logrus.WarnLevel && strings.Contains(e.Message, "shares the cgroup namespace"))
+		}
+		assert.True(t, warned)
+	})
+
+	t.Run("joined namespace left read-only", func(t *testing.T) {
+		p := newTestPlugin(nil)
+
+		adjust, _, err := p.CreateContainer(context.Background(), nil, newContainer(&api.LinuxNamespace{Type: "cgroup", Path: "/proc/4242/ns/cgroup"}))
+		require.NoError(t, err)
+		assert.Nil(t, findMount(adjust.Mounts, cgroupRoot))
+	})
+
+	t.Run("no name=systemd hierarchy on cgroup v1", func(t *testing.T) {
+		p := newCgroupV1TestPlugin(nil)
+
+		adjust, _, err := p.CreateContainer(context.Background(), nil, newContainer(&api.LinuxNamespace{Type: "cgroup", Path: "/proc/4242/ns/cgroup"}))
+		require.NoError(t, err)
+		assert.Nil(t, findMount(adjust.Mounts, cgroupRoot))
+		assert.Nil(t, findMount(adjust.Mounts, systemdCgroupDir))
+	})
+
+	t.Run("no cgroup namespace on cgroup v1", func(t *testing.T) {
+		// the default of runtimes on cgroup v1, not taken as shared
+		p := newCgroupV1TestPlugin(nil)
+
+		adjust, _, err := p.CreateContainer(context.Background(), nil, newContainer(hostNamespace...))
+		require.NoError(t, err)
+		m := findMount(adjust.Mounts, systemdCgroupDir)
+		require.NotNil(t, m)
+		assert.Contains(t, m.Options, "rw")
+	})
+
+	t.Run("override", func(t *testing.T) {
+		p := newTestPlugin(configWith(func(c *Config) { c.RemountSharedCgroupNamespace = true }))
+
+		adjust, _, err := p.CreateContainer(context.Background(), nil, newContainer(hostNamespace...))
+		require.NoError(t, err)
+		m := findMount(adjust.Mounts, cgroupRoot)
+		require.NotNil(t, m)
+		assert.Contains(t, m.Options, "rw")
+	})
+}
+
+func TestCgroupMountSymlink(t *testing.T) {
+	// /sys/fs/cgroup is a symlink on the host, the runtime mounts the cgroup
+	// filesystem at its target
+	newPlugin := func(cfg *Config) *plugin {
+		p := newTestPlugin(cfg)
+		p.prober = &fakeProber{
+			paths: map[string]bool{
+				"/sys/fs/cgroup":                    true,
+				"/sys/fs/cgroup/cgroup.controllers": true,
+			},
+			links: map[string]string{
+				"/sys/fs/cgroup": "/sys/fs/cgroup-unified",
+			},
+		}
+		return p
+	}
+	newContainer := func() *api.Container {
+		container := newProfileTestContainer(nil)
+		container.Mounts[0].Destination = "/sys/fs/cgroup-unified"
+		return container
+	}
+
+	t.Run("exact match by default", func(t *testing.T) {
+		p := newPlugin(configWith(func(c *Config) { c.AddMissingCgroupMount = false }))
+
+		_, _, err := p.CreateContainer(context.Background(), nil, newContainer())
+		assert.ErrorContains(t, err, "cgroup mount required")
+	})
+
+	t.Run("resolved", func(t *testing.T) {
+		p := newPlugin(configWith(func(c *Config) { c.ResolveCgroupMountSymlinks = true }))
+
+		adjust, _, err := p.CreateContainer(context.Background(), nil, newContainer())
+		require.NoError(t, err)
+
+		assert.NotNil(t, findMount(adjust.Mounts, "-/sys/fs/cgroup-unified"))
+		m := findMount(adjust.Mounts, "/sys/fs/cgroup-unified")
+		require.NotNil(t, m)
+		assert.Contains(t, m.Options, "rw")
+		assert.NotContains(t, m.Options, "ro")
+		assert.Nil(t, findMount(adjust.Mounts, "/sys/fs/cgroup"))
+	})
+}
+
+func TestCgroupMountMismatch(t *testing.T) {
+	newV2Plugin := func(cfg *Config) *plugin {
+		return newTestPlugin(cfg)
+	}
+	correct := configWith(func(c *Config) { c.CorrectCgroupMountType = true })
+	newContainer := func(mount *api.Mount) *api.Container {
+		container := newProfileTestContainer(nil)
+		container.Mounts = []*api.Mount{mount}
+		return container
+	}
+
+	tests := []struct {
+		name      string
+		newPlugin func(*Config) *plugin
+		mount     *api.Mount
+		expected  *api.Mount
+	}{
+		{
+			name:      "cgroup2 mount on v1 host",
+			newPlugin: newCgroupV1TestPlugin,
+			mount: &api.Mount{
+				Destination: "/sys/fs/cgroup", Type: "cgroup2", Source: "cgroup2",
+				Options: []string{"nosuid", "noexec", "nodev", "ro"},
+			},
+			// left read-only on cgroup v1
+			expected: &api.Mount{
+				Destination: "/sys/fs/cgroup", Type: "cgroup", Source: "cgroup",
+				Options: []string{"nosuid", "noexec", "nodev", "ro"},
+			},
+		},
+		{
+			name:      "v1 hierarchies on v2 host",
+			newPlugin: newV2Plugin,
+			mount: &api.Mount{
+				Destination: "/sys/fs/cgroup", Type: "cgroup", Source: "cgroup",
+				Options: []string{"nosuid", "noexec", "nodev", "none", "name=systemd", "rw"},
+			},
+			expected: &api.Mount{
+				Destination: "/sys/fs/cgroup", Type: "cgroup2", Source: "cgroup2",
+				Options: []string{"nosuid", "noexec", "nodev", "rw"},
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name+" warned", func(t *testing.T) {
+			p := tc.newPlugin(nil)
+			hook := logtest.NewLocal(p.logs.base)
+
+			adjust, _, err := p.CreateContainer(context.Background(), nil, newContainer(tc.mount))
+			require.NoError(t, err)
+
+			warned := false
+			for _, e := range hook.AllEntries() {
+				if e.Level == logrus.WarnLevel && strings.Contains(e.Message, "systemd will likely fail to boot") {
+					warned = true
+				}
+			}
+			assert.True(t, warned)
+
+			// only made writable, if needed
+			if m := findMount(adjust.Mounts, "/sys/fs/cgroup"); m != nil {
+				assert.Equal(t, tc.mount.Type, m.Type)
+			}
+		})
+
+		t.Run(tc.name+" corrected", func(t *testing.T) {
+			p := tc.newPlugin(correct)
+
+			adjust, _, err := p.CreateContainer(context.Background(), nil, newContainer(tc.mount))
+			require.NoError(t, err)
+
+			assert.NotNil(t, findMount(adjust.Mounts, "-/sys/fs/cgroup"))
+			assert.Equal(t, tc.expected, findMount(adjust.Mounts, "/sys/fs/cgroup"))
+		})
+	}
+
+	t.Run("plain cgroup mount on v2 host", func(t *testing.T) {
+		p := newV2Plugin(correct)
+		hook := logtest.NewLocal(p.logs.base)
+
+		adjust, _, err := p.CreateContainer(context.Background(), nil, newProfileTestContainer(nil))
+		require.NoError(t, err)
+
+		m := findMount(adjust.Mounts, "/sys/fs/cgroup")
+		require.NotNil(t, m)
+		assert.Equal(t, "cgroup", m.Type)
+		for _, e := range hook.AllEntries() {
+			assert.NotEqual(t, logrus.WarnLevel, e.Level, e.Message)
+		}
+	})
+}
+
+func TestCgroupLayout(t *testing.T) {
+	tests := []struct {
+		name     string
+		paths    []string
+		expected cgroupLayout
+	}{
+		{
+			name:     "v2",
+			paths:    []string{"/sys/fs/cgroup", "/sys/fs/cgroup/cgroup.controllers"},
+			expected: cgroupLayoutV2,
+		},
+		{
+			name:     "hybrid",
+			paths:    []string{"/sys/fs/cgroup", "/sys/fs/cgroup/systemd", "/sys/fs/cgroup/unified/cgroup.controllers"},
+			expected: cgroupLayoutHybrid,
+		},
+		{
+			name:     "v1 with systemd",
+			paths:    []string{"/sys/fs/cgroup", "/sys/fs/cgroup/systemd", "/sys/fs/cgroup/cpu"},
+			expected: cgroupLayoutV1,
+		},
+		{
+			name:     "v1 without systemd",
+			paths:    []string{"/sys/fs/cgroup", "/sys/fs/cgroup/memory"},
+			expected: cgroupLayoutV1,
+		},
+		{
+			name:     "empty cgroup root",
+			paths:    []string{"/sys/fs/cgroup"},
+			expected: cgroupLayoutUnknown,
+		},
+		{
+			name:     "no cgroup root",
+			expected: cgroupLayoutUnknown,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prober := &fakeProber{paths: map[string]bool{}}
+			for _, path := range tt.paths {
+				prober.paths[path] = true
+			}
+
+			layout, err := classifyCgroupLayout(context.Background(), prober)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, layout)
+
+			p := newTestPlugin(nil)
+			p.prober = prober
+			if tt.expected == cgroupLayoutUnknown {
+				assert.Error(t, p.checkCgroupLayout(context.Background(), true))
+			} else {
+				assert.NoError(t, p.checkCgroupLayout(context.Background(), true))
+			}
+			assert.NoError(t, p.checkCgroupLayout(context.Background(), false))
+			assert.Equal(t, tt.expected, p.hostInfo.Load().CgroupLayout)
+		})
+	}
+}
+
+func TestCgroupRemount(t *testing.T) {
+	removesCgroup := func(adjust *api.ContainerAdjustment) bool {
+		for _, m := range adjust.Mounts {
+			if dest, marked := m.IsMarkedForRemoval(); marked && dest == cgroupRoot {
+				return true
+			}
+		}
+		return false
+	}
+
+	tests := []struct {
+		remount CgroupRemount
+		removed bool
+		added   bool
+		failed  bool
+	}{
+		{remount: "", removed: true, added: true},
+		{remount: CgroupRemountReplace, removed: true, added: true},
+		{remount: CgroupRemountAdd, removed: false, added: true},
+		{remount: CgroupRemountFail, failed: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.remount), func(t *testing.T) {
+			p := newTestPlugin(configWith(func(c *Config) { c.CgroupRemount = tt.remount }))
+
+			adjust, _, err := p.CreateContainer(context.Background(), &api.PodSandbox{}, newProfileTestContainer(nil))
+			if tt.failed {
+				assert.ErrorContains(t, err, "cgroupRemount: fail")
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.removed, removesCgroup(adjust))
+			assert.Equal(t, tt.added, remountsCgroup(adjust))
+		})
+	}
+
+	t.Run("already writable", func(t *testing.T) {
+		p := newTestPlugin(configWith(func(c *Config) { c.CgroupRemount = CgroupRemountFail }))
+		container := newProfileTestContainer(nil)
+		container.Mounts[0].Options = []string{"nosuid", "noexec", "nodev", "relatime", "rw"}
+
+		adjust, _, err := p.CreateContainer(context.Background(), &api.PodSandbox{}, container)
+		require.NoError(t, err)
+		assert.False(t, remountsCgroup(adjust))
+	})
+}
+
+func TestPostCreateContainerReadOnlyCgroup(t *testing.T) {
+	p := newTestPlugin(nil)
+	logs := logtest.NewLocal(p.logs.base)
+	container := newProfileTestContainer(nil)
+
+	adjust, _, err := p.CreateContainer(context.Background(), &api.PodSandbox{}, container)
+	require.NoError(t, err)
+	require.True(t, p.state.get(container.Id).cgroupRemounted)
+
+	// honored
+	created := newProfileTestContainer(nil)
+	applyAdjustment(created, adjust)
+	require.NoError(t, p.PostCreateContainer(context.Background(), &api.PodSandbox{}, created))
+	assert.Empty(t, p.state.get(container.Id).drift)
+
+	// ignored, the runtime kept its read-only mount
+	ignored := newProfileTestContainer(nil)
+	applyAdjustment(ignored, adjust)
+	ignored.Mounts = append(ignored.Mounts, newProfileTestContainer(nil).Mounts[0])
+	require.NoError(t, p.PostCreateContainer(context.Background(), &api.PodSandbox{}, ignored))
+	assert.Equal(t, []string{"cgroup mount is read-only, the runtime ignored making it writable"}, p.state.get(container.Id).drift)
+	assert.Equal(t, 1.0, testutil.ToFloat64(p.metrics.remountIgnored))
+	if assert.NotNil(t, logs.LastEntry()) {
+		assert.Equal(t, logrus.WarnLevel, logs.LastEntry().Level)
+		assert.Contains(t, logs.LastEntry().Message, "set cgroupRemount to add or fail")
+	}
+
+	// untracked containers are left alone
+	other := newProfileTestContainer(nil)
+	other.Id = "other"
+	require.NoError(t, p.PostCreateContainer(context.Background(), &api.PodSandbox{}, other))
+	assert.Equal(t, 1.0, testutil.ToFloat64(p.metrics.remountIgnored))
+}
+
+func TestUpdateContainer(t *testing.T) {
+	p := newTestPlugin(nil)
+	logs := logtest.NewLocal(p.logs.base)
+	container := newProfileTestContainer(nil)
+
+	adjust, _, err := p.CreateContainer(context.Background(), &api.PodSandbox{}, container)
+	require.NoError(t, err)
+	created := newProfileTestContainer(nil)
+	applyAdjustment(created, adjust)
+	resources := &api.LinuxResources{Memory: &api.LinuxMemory{Limit: api.Int64(1 << 30)}}
+
+	// unchanged mounts
+	updates, err := p.UpdateContainer(context.Background(), &api.PodSandbox{}, created, resources)
+	require.NoError(t, err)
+	assert.Empty(t, updates)
+	assert.Empty(t, p.state.get(container.Id).drift)
+
+	// /tmp made read-only since, recorded once
+	created.Mounts = append(created.Mounts, &api.Mount{Destination: "/tmp", Type: "tmpfs", Source: "tmpfs", Options: []string{"ro"}})
+	for range 2 {
+		updates, err = p.UpdateContainer(context.Background(), &api.PodSandbox{}, created, resources)
+		require.NoError(t, err)
+		assert.Empty(t, updates)
+	}
+	assert.Equal(t, []string{"/tmp is read-only, found on update"}, p.state.get(container.Id).drift)
+	if assert.NotNil(t, logs.LastEntry()) {
+		assert.Equal(t, logrus.WarnLevel, logs.LastEntry().Level)
+	}
+
+	// containers without systemd are passed through
+	other := &api.Container{Id: "other", Name: "nginx", Args: []string{"/usr/sbin/nginx"}}
+	updates, err = p.UpdateContainer(context.Background(), &api.PodSandbox{}, other, resources)
+	require.NoError(t, err)
+	assert.Empty(t, updates)
+	assert.Nil(t, p.state.get(other.Id))
+}
+
+func TestAdjustmentViolations(t *testing.T) {
+	p := newTestPlugin(nil)
+	container := newProfileTestContainer(nil)
+	adjust, _, err := p.CreateContainer(context.Background(), &api.PodSandbox{}, container)
+	require.NoError(t, err)
+	s := p.state.get(container.Id)
+	assert.Equal(t, []string{"/run", "/run/lock", "/tmp", "/var/log/journal"}, s.writableMounts)
+
+	// merged returns the mounts of the container created with the
+	// adjustment, changed by a later plugin
+	merged := func(later ...*api.Mount) []*api.Mount {
+		created := newProfileTestContainer(nil)
+		applyAdjustment(created, adjust)
+		return append(created.Mounts, later...)
+	}
+
+	tests := []struct {
+		name     string
+		mounts   []*api.Mount
+		expected []string
+	}{
+		{
+			name:   "unchanged",
+			mounts: merged(),
+		},
+		{
+			name:   "unrelated mount added",
+			mounts: merged(&api.Mount{Destination: "/data", Type: "bind", Source: "/srv/data", Options: []string{"rbind", "ro"}}),
+		},
+		{
+			name:     "read-only cgroup mount added again",
+			mounts:   merged(&api.Mount{Destination: "/sys/fs/cgroup", Type: "cgroup", Source: "cgroup", Options: []string{"ro"}}),
+			expected: []string{"/sys/fs/cgroup is read-only"},
+		},
+		{
+			name: "/run removed",
+			mounts: slices.DeleteFunc(merged(), func(m *api.Mount) bool {
+				return m.Destination == "/run"
+			}),
+			expected: []string{"/run is not mounted"},
+		},
+		{
+			name:     "/tmp read-only",
+			mounts:   merged(&api.Mount{Destination: "/tmp", Type: "tmpfs", Source: "tmpfs", Options: []string{"ro"}}),
+			expected: []string{"/tmp is read-only"},
+		},
+		{
+			name:     "/var/log/journal bind-mounted",
+			mounts:   merged(&api.Mount{Destination: "/var/log/journal", Type: "bind", Source: "/var/log/journal", Options: []string{"rbind", "rw"}}),
+			expected: []string{"/var/log/journal is a bind mount instead of a tmpfs"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var found []string
+			for _, v := range adjustmentViolations(s, tt.mounts) {
+				found = append(found, v.String())
+			}
+			assert.Equal(t, tt.expected, found)
+
+			_, err := validateAdjustment(AdjustmentValidationWarn, s, tt.mounts)
+			assert.NoError(t, err)
+			_, err = validateAdjustment(AdjustmentValidationReject, s, tt.mounts)
+			if tt.expected == nil {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorContains(t, err, tt.expected[0])
+			}
+		})
+	}
+
+	t.Run("reported as drift", func(t *testing.T) {
+		created := newProfileTestContainer(nil)
+		created.Mounts = slices.DeleteFunc(merged(), func(m *api.Mount) bool {
+			return m.Destination == "/run"
+		})
+		require.NoError(t, p.PostCreateContainer(context.Background(), &api.PodSandbox{}, created))
+		assert.Equal(t, []string{"/run is not mounted, changed after the adjustment"}, p.state.get(container.Id).drift)
+		assert.Equal(t, 0.0, testutil.ToFloat64(p.metrics.remountIgnored))
+	})
+
+	t.Run("rejected", func(t *testing.T) {
+		p := newTestPlugin(configWith(func(c *Config) { c.AdjustmentValidation = AdjustmentValidationReject }))
+		logs := logtest.NewLocal(p.logs.base)
+		adjust, _, err := p.CreateContainer(context.Background(), &api.PodSandbox{}, newProfileTestContainer(nil))
+		require.NoError(t, err)
+
+		created := newProfileTestContainer(nil)
+		applyAdjustment(created, adjust)
+		require.NoError(t, p.PostCreateContainer(context.Background(), &api.PodSandbox{}, created))
+
+		created.Mounts = append(created.Mounts, &api.Mount{Destination: "/run", Type: "tmpfs", Source: "tmpfs", Options: []string{"ro"}})
+		err = p.PostCreateContainer(context.Background(), &api.PodSandbox{}, created)
+		assert.EqualError(t, err, "rejecting the final mounts, systemd cannot boot: /run is read-only")
+		assert.Equal(t, []string{"/run is read-only, changed after the adjustment"}, p.state.get(created.Id).drift)
+		if assert.NotNil(t, logs.LastEntry()) {
+			assert.Equal(t, logrus.ErrorLevel, logs.LastEntry().Level)
+		}
+	})
+}
@@ -0,0 +1,1386 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"math"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/containerd/nri/pkg/api"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// defaultHookTimeout stays comfortably below the 2s default plugin
+	// request timeout of containerd and CRI-O.
+	defaultHookTimeout = Duration(time.Second)
+
+	defaultMaxConcurrentAdjustments = 8
+
+	defaultStateDir = "/run/nri-plugin-systemd"
+
+	defaultContainerEnv = "other"
+
+	defaultRecentDecisions = 100
+
+	defaultMaxConfigAnnotationSize = 4096
+
+	defaultMaxDropInSize  = 8192
+	defaultMaxDropInsSize = 65536
+
+	defaultPreHookTimeout = Duration(30 * time.Second)
+
+	// defaultOrphanMinAge outlasts any container creation in flight while
+	// synchronizing.
+	defaultOrphanMinAge = Duration(10 * time.Minute)
+
+	defaultCrashReportSize      = 65536
+	defaultCrashReportRetention = Duration(7 * 24 * time.Hour)
+
+	defaultJournalCaptureWindow    = Duration(10 * time.Minute)
+	defaultJournalCaptureSize      = 1 << 20
+	defaultJournalCaptureRetention = Duration(7 * 24 * time.Hour)
+)
+
+// FailurePolicy decides what happens when processing a systemd container
+// fails.
+type FailurePolicy string
+
+const (
+	// FailOpen logs the failure and lets the container be created without
+	// systemd adjustments.
+	FailOpen FailurePolicy = "open"
+	// FailClosed returns the failure to the runtime, which fails the
+	// creation of the container.
+	FailClosed FailurePolicy = "closed"
+)
+
+// DuplicatePolicy decides what an instance of the plugin does while another
+// one on the node holds the instance lock.
+type DuplicatePolicy string
+
+const (
+	// DuplicateExit makes the instance exit with an error.
+	DuplicateExit DuplicatePolicy = "exit"
+	// DuplicateStandby makes the instance wait without connecting to the
+	// runtime, and take over once the other one exits.
+	DuplicateStandby DuplicatePolicy = "standby"
+)
+
+// EnvCasing decides which casings of the environment variables for systemd
+// (container, container_uuid) are set.
+type EnvCasing string
+
+const (
+	// EnvCasingLower only sets the lowercase variables systemd reads.
+	EnvCasingLower EnvCasing = "lower"
+	// EnvCasingBoth also sets uppercase variants, e.g. CONTAINER, for
+	// tools looking for those.
+	EnvCasingBoth EnvCasing = "both"
+)
+
+// MachineID decides how systemd containers get their machine ID. The modes
+// are mutually exclusive: a fresh ID is only generated if the plugin does
+// not pass a stable one in container_uuid.
+type MachineID string
+
+const (
+	// MachineIDStable passes a stable ID in container_uuid, which systemd
+	// initializes an empty /etc/machine-id of the image with.
+	MachineIDStable MachineID = "stable"
+	// MachineIDEmpty mounts an empty /etc/machine-id, so systemd generates
+	// a fresh ID on every boot, without first-boot semantics.
+	MachineIDEmpty MachineID = "empty"
+	// MachineIDFirstBoot mounts /etc/machine-id containing "uninitialized",
+	// so systemd generates a fresh ID and runs the units conditioned on
+	// ConditionFirstBoot=.
+	MachineIDFirstBoot MachineID = "first-boot"
+)
+
+// fresh tells whether systemd generates a fresh machine ID.
+func (m MachineID) fresh() bool {
+	return m == MachineIDEmpty || m == MachineIDFirstBoot
+}
+
+// CgroupRemount decides how the read-only cgroup mount of a systemd
+// container is made writable.
+type CgroupRemount string
+
+const (
+	// CgroupRemountReplace removes the mount and adds a writable one.
+	CgroupRemountReplace CgroupRemount = "replace"
+	// CgroupRemountAdd only adds the writable mount, for runtimes which
+	// reject removing mounts but replace mounts at the same destination.
+	CgroupRemountAdd CgroupRemount = "add"
+	// CgroupRemountFail leaves the mount alone and fails, for runtimes
+	// honoring neither, so that the container does not start with a
+	// read-only cgroup systemd cannot boot with.
+	CgroupRemountFail CgroupRemount = "fail"
+)
+
+// AdjustmentValidation decides what happens when the final mounts of a
+// systemd container break its adjustment, e.g. because a later plugin
+// mounted /run read-only again.
+type AdjustmentValidation string
+
+const (
+	// AdjustmentValidationWarn warns about the broken mounts.
+	AdjustmentValidationWarn AdjustmentValidation = "warn"
+	// AdjustmentValidationReject also fails the hook validating the
+	// mounts.
+	AdjustmentValidationReject AdjustmentValidation = "reject"
+)
+
+// EphemeralContainers decides whether ephemeral containers running systemd
+// are adjusted.
+type EphemeralContainers string
+
+const (
+	// EphemeralAdjust adjusts them like any other systemd container.
+	EphemeralAdjust EphemeralContainers = "adjust"
+	// EphemeralSkip leaves them alone, e.g. so that debug containers never
+	// run with a spec changed by the plugin.
+	EphemeralSkip EphemeralContainers = "skip"
+)
+
+// Duration is a time.Duration using the time.ParseDuration format ("1.5s")
+// in configuration files.
+type Duration time.Duration
+
+func (d Duration) Duration() time.Duration {
+	return time.Duration(d)
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("invalid duration %s: %w", data, err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// TmpfsMode is the mode of a tmpfs mount in its canonical mount option form
+// "mode=NNNN". Configuration files give it as a quoted octal string like
+// "755", "01777" or "mode=1777".
+type TmpfsMode string
+
+// parseTmpfsMode parses octal permission bits, optionally including the
+// setuid, setgid and sticky bits, and returns the canonical mount option.
+func parseTmpfsMode(s string) (TmpfsMode, error) {
+	v := strings.TrimPrefix(s, "mode=")
+	if v == "" || strings.Trim(v, "01234567") != "" {
+		return "", fmt.Errorf("invalid tmpfs mode %q, must be octal", s)
+	}
+	n, err := strconv.ParseUint(v, 8, 32)
+	if err != nil || n > 0o7777 {
+		return "", fmt.Errorf("invalid tmpfs mode %q, must not exceed 7777", s)
+	}
+	return TmpfsMode(fmt.Sprintf("mode=%04o", n)), nil
+}
+
+func (m *TmpfsMode) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("invalid tmpfs mode %s, must be a quoted octal string", data)
+	}
+	v, err := parseTmpfsMode(s)
+	if err != nil {
+		return err
+	}
+	*m = v
+	return nil
+}
+
+// TmpfsSize is the size of a tmpfs mount in its canonical mount option form
+// "size=N". Configuration files give it as a quoted string of a number with
+// an optional k, m, g or % suffix, like "512m".
+type TmpfsSize string
+
+var tmpfsSize = regexp.MustCompile(`^[1-9][0-9]{0,9}[kmg%]?$`)
+
+func (s *TmpfsSize) UnmarshalJSON(data []byte) error {
+	var v string
+	if err := json.Unmarshal(data, &v); err != nil {
+		return fmt.Errorf("invalid tmpfs size %s, must be a quoted string", data)
+	}
+	size, err := parseTmpfsSize(v)
+	if err != nil {
+		return err
+	}
+	*s = size
+	return nil
+}
+
+// parseTmpfsSize parses a size with an optional "size=" prefix and returns
+// the canonical mount option.
+func parseTmpfsSize(s string) (TmpfsSize, error) {
+	v := strings.TrimPrefix(s, "size=")
+	if !tmpfsSize.MatchString(v) {
+		return "", fmt.Errorf("invalid tmpfs size %q, must be a number with an optional k, m, g or %% suffix", v)
+	}
+	return TmpfsSize("size=" + v), nil
+}
+
+// bytes returns the size in bytes, false for a percentage.
+func (s TmpfsSize) bytes() (int64, bool) {
+	v := strings.TrimPrefix(string(s), "size=")
+	if v == "" || strings.HasSuffix(v, "%") {
+		return 0, false
+	}
+	unit := int64(1)
+	switch v[len(v)-1] {
+	case 'k':
+		unit = 1 << 10
+	case 'm':
+		unit = 1 << 20
+	case 'g':
+		unit = 1 << 30
+	}
+	n, err := strconv.ParseInt(strings.TrimRight(v, "kmg"), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return n * unit, true
+}
+
+// MemoryPercent sizes a tmpfs mount as a percentage of the memory limit of
+// the container. Configuration files give it as a quoted string like "5%".
+type MemoryPercent int
+
+func (p MemoryPercent) MarshalJSON() ([]byte, error) {
+	return json.Marshal(fmt.Sprintf("%d%%", p))
+}
+
+func (p *MemoryPercent) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("invalid memory percentage %s, must be a quoted string", data)
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(s, "%"))
+	if err != nil || !strings.HasSuffix(s, "%") || n < 1 || n > 100 {
+		return fmt.Errorf("invalid memory percentage %q, must be between 1%% and 100%%", s)
+	}
+	*p = MemoryPercent(n)
+	return nil
+}
+
+// ContainerEngineOptions configure the container-engine profile.
+type ContainerEngineOptions struct {
+	// RunSize is the size of the /run tmpfs, which holds the state and
+	// sockets of the inner engine. Runtimes limit /run for systemd
+	// containers, CRI-O e.g. to 64MiB.
+	RunSize TmpfsSize `json:"runSize,omitempty"`
+
+	// Env is added to the environment of the container unless it sets the
+	// variables itself, e.g. DOCKER_IPTABLES_LEGACY: "1" for docker:dind
+	// images on hosts without nftables.
+	Env map[string]string `json:"env,omitempty"`
+}
+
+// DetectionOptions configure how systemd containers are detected.
+type DetectionOptions struct {
+	// ShellExec also detects systemd containers whose entrypoint is a
+	// shell running a command which ends with exec of systemd, like
+	// "sh -c 'setup && exec /lib/systemd/systemd'". Off by default since
+	// the command is only matched textually.
+	ShellExec bool `json:"shellExec,omitempty"`
+
+	// Order lists the ways of detecting systemd containers by precedence,
+	// the first one deciding whether a container is one wins. Unlisted
+	// ones follow in the default order: annotation, entrypoint,
+	// shell-exec. Only the annotation decides that a container is none.
+	Order []string `json:"order,omitempty"`
+
+	// InitPaths are entrypoints of systemd containers besides the builtin
+	// /sbin/init, /usr/sbin/init, /lib/systemd/systemd and
+	// /usr/lib/systemd/systemd, e.g. /usr/bin/systemd. They are matched
+	// exactly.
+	InitPaths []string `json:"initPaths,omitempty"`
+
+	// MatchBasename detects entrypoints named init or systemd, or with the
+	// base name of a configured init path, in any directory, e.g.
+	// /opt/boot/systemd or a bare init resolved through PATH.
+	MatchBasename bool `json:"matchBasename,omitempty"`
+}
+
+// SharedRunOptions configure sharing /run within pods with the share-run
+// annotation.
+type SharedRunOptions struct {
+	// Enabled allows pods to share /run with the share-run annotation,
+	// which is rejected otherwise.
+	Enabled bool `json:"enabled,omitempty"`
+
+	// Paths are shared with the other containers of the pod, /run or
+	// below. Defaults to /run/dbus and /run/systemd.
+	Paths []string `json:"paths,omitempty"`
+
+	// ReadWrite mounts the shared paths writable into the other
+	// containers. They can connect to the sockets either way.
+	ReadWrite bool `json:"readWrite,omitempty"`
+}
+
+func (o SharedRunOptions) paths() []string {
+	if len(o.Paths) == 0 {
+		return defaultSharedRunPaths
+	}
+	return o.Paths
+}
+
+func (o SharedRunOptions) validate() error {
+	for _, p := range o.Paths {
+		if !path.IsAbs(p) || path.Clean(p) != p || (p != runDir && !strings.HasPrefix(p, runDir+"/")) {
+			return fmt.Errorf("invalid path %q, must be /run or a clean absolute path below it", p)
+		}
+	}
+	return nil
+}
+
+// LoginShellOptions configure the login-shell helper for kubectl exec.
+type LoginShellOptions struct {
+	// Enabled bind-mounts the helper into all systemd containers.
+	Enabled bool `json:"enabled,omitempty"`
+
+	// Helper is the helper binary, built for the architecture of the node.
+	// Defaults to the plugin binary, which acts as the helper when run as
+	// login-shell.
+	Helper string `json:"helper,omitempty"`
+}
+
+func (o LoginShellOptions) validate() error {
+	if o.Helper != "" && !path.IsAbs(o.Helper) {
+		return fmt.Errorf("invalid helper %q, must be an absolute path", o.Helper)
+	}
+	return nil
+}
+
+// CrashReportOptions configure the reports of systemd containers which
+// failed to boot, as found by the boot check.
+type CrashReportOptions struct {
+	// Enabled writes a report below stateDir/crash-reports for every
+	// failed boot. Needs bootCheckWindow.
+	Enabled bool `json:"enabled,omitempty"`
+
+	// MaxSize is the maximum size of a report in bytes, longer reports are
+	// truncated.
+	MaxSize int `json:"maxSize,omitempty"`
+
+	// Retention is how long reports are kept.
+	Retention Duration `json:"retention,omitempty"`
+}
+
+func (o CrashReportOptions) validate(bootCheckWindow Duration) error {
+	if o.MaxSize <= 0 {
+		return fmt.Errorf("invalid maxSize %d, must be positive", o.MaxSize)
+	}
+	if o.Retention <= 0 {
+		return fmt.Errorf("invalid retention %v, must be positive", o.Retention.Duration())
+	}
+	if o.Enabled && bootCheckWindow == 0 {
+		return fmt.Errorf("reports need bootCheckWindow")
+	}
+	return nil
+}
+
+// JournalCaptureOptions configure capturing the persistent journal of
+// systemd containers which died abnormally.
+type JournalCaptureOptions struct {
+	// Enabled captures the journal below stateDir/journals.
+	Enabled bool `json:"enabled,omitempty"`
+
+	// Window is how far back before the death entries are captured.
+	Window Duration `json:"window,omitempty"`
+
+	// MaxSize is the maximum size of the captured entries in bytes before
+	// compression, older entries are dropped.
+	MaxSize int `json:"maxSize,omitempty"`
+
+	// Retention is how long captures are kept.
+	Retention Duration `json:"retention,omitempty"`
+}
+
+func (o JournalCaptureOptions) validate() error {
+	if o.Window <= 0 {
+		return fmt.Errorf("invalid window %v, must be positive", o.Window.Duration())
+	}
+	if o.MaxSize <= 0 {
+		return fmt.Errorf("invalid maxSize %d, must be positive", o.MaxSize)
+	}
+	if o.Retention <= 0 {
+		return fmt.Errorf("invalid retention %v, must be positive", o.Retention.Duration())
+	}
+	return nil
+}
+
+// OrphanGCOptions configure how the rendered files of containers unknown
+// to the runtime are cleaned up when synchronizing with it.
+type OrphanGCOptions struct {
+	// MinAge keeps younger files, e.g. of containers being created while
+	// synchronizing. Defaults to 10 minutes, 0 removes them right away.
+	MinAge Duration `json:"minAge"`
+
+	// Quarantine moves the files below stateDir/quarantine instead of
+	// removing them.
+	Quarantine bool `json:"quarantine,omitempty"`
+}
+
+// PreHook is a command run at startup, before connecting to the runtime.
+type PreHook struct {
+	// Command is the command and its arguments, e.g. [/bin/sh, -c, ...].
+	Command []string `json:"command,omitempty"`
+
+	// Timeout bounds the run of the command. Defaults to 30s.
+	Timeout Duration `json:"timeout,omitempty"`
+
+	// IgnoreFailure starts the plugin even if the command fails.
+	IgnoreFailure bool `json:"ignoreFailure,omitempty"`
+}
+
+// OwnerID is a numeric user or group ID. Configuration files give it as a
+// number or a string of digits, e.g. from an environment variable.
+type OwnerID uint32
+
+func (id *OwnerID) UnmarshalJSON(data []byte) error {
+	s := strings.Trim(string(data), `"`)
+	n, err := strconv.ParseUint(s, 10, 32)
+	if err != nil || n == math.MaxUint32 {
+		return fmt.Errorf("invalid uid/gid %s, must be numeric", data)
+	}
+	*id = OwnerID(n)
+	return nil
+}
+
+// TmpfsOptions are the ownership, permissions and size of a tmpfs mount.
+// Unset fields keep the defaults: a mode and size depending on the
+// destination, and the uid and gid of the runtime.
+type TmpfsOptions struct {
+	Mode TmpfsMode `json:"mode,omitempty"`
+	UID  *OwnerID  `json:"uid,omitempty"`
+	GID  *OwnerID  `json:"gid,omitempty"`
+	Size TmpfsSize `json:"size,omitempty"`
+
+	// MemorySize sizes the mount relative to the memory limit of the
+	// container, bounded by MinSize and MaxSize. It takes precedence over
+	// Size, which remains in effect for containers without a limit.
+	MemorySize MemoryPercent `json:"memorySize,omitempty"`
+	MinSize    TmpfsSize     `json:"minSize,omitempty"`
+	MaxSize    TmpfsSize     `json:"maxSize,omitempty"`
+}
+
+// TmpfsMountSpec is a tmpfs mount for systemd in the configuration.
+type TmpfsMountSpec struct {
+	Destination string `json:"destination"`
+
+	// Mode and Size default to those of the default mount at Destination,
+	// or to 0755 and 64m.
+	Mode TmpfsMode `json:"mode,omitempty"`
+	Size TmpfsSize `json:"size,omitempty"`
+
+	// Options are further mount options, like "noexec". A "size=" option
+	// takes precedence over Size.
+	Options []string `json:"options,omitempty"`
+}
+
+// defaultTmpfsMountMode and defaultTmpfsMountSize are the mode and size of
+// configured tmpfs mounts without one, at destinations without a default
+// mount.
+const (
+	defaultTmpfsMountMode TmpfsMode = "mode=0755"
+	defaultTmpfsMountSize TmpfsSize = "size=64m"
+)
+
+// defaultTmpfsCopyUpMinSize is the size below which tmpfs mounts with
+// tmpcopyup are warned about, that of /run/lock.
+const defaultTmpfsCopyUpMinSize TmpfsSize = "size=8m"
+
+// NamespaceTmpfs are the tmpfs options of the systemd containers of a
+// namespace.
+type NamespaceTmpfs struct {
+	TmpfsOptions      TmpfsOptions            `json:"tmpfsOptions"`
+	TmpfsMountOptions map[string]TmpfsOptions `json:"tmpfsMountOptions,omitempty"`
+}
+
+// merge returns the options with unset fields taken from defaults.
+func (o TmpfsOptions) merge(defaults TmpfsOptions) TmpfsOptions {
+	if o.Mode == "" {
+		o.Mode = defaults.Mode
+	}
+	if o.UID == nil {
+		o.UID = defaults.UID
+	}
+	if o.GID == nil {
+		o.GID = defaults.GID
+	}
+	if o.Size == "" {
+		o.Size = defaults.Size
+	}
+	if o.MemorySize == 0 {
+		o.MemorySize = defaults.MemorySize
+	}
+	if o.MinSize == "" {
+		o.MinSize = defaults.MinSize
+	}
+	if o.MaxSize == "" {
+		o.MaxSize = defaults.MaxSize
+	}
+	return o
+}
+
+// validate checks that the bounds of MemorySize are absolute sizes.
+func (o TmpfsOptions) validate() error {
+	lower, lowerOK := o.MinSize.bytes()
+	if o.MinSize != "" && !lowerOK {
+		return fmt.Errorf("invalid minSize %q, must be an absolute size", strings.TrimPrefix(string(o.MinSize), "size="))
+	}
+	upper, upperOK := o.MaxSize.bytes()
+	if o.MaxSize != "" && !upperOK {
+		return fmt.Errorf("invalid maxSize %q, must be an absolute size", strings.TrimPrefix(string(o.MaxSize), "size="))
+	}
+	if lowerOK && upperOK && lower > upper {
+		return fmt.Errorf("minSize %s exceeds maxSize %s",
+			strings.TrimPrefix(string(o.MinSize), "size="), strings.TrimPrefix(string(o.MaxSize), "size="))
+	}
+	return nil
+}
+
+// sized returns the options with Size computed from MemorySize for a
+// container with the given memory limit in bytes. Without MemorySize or a
+// limit, Size is kept.
+func (o TmpfsOptions) sized(memoryLimit int64) TmpfsOptions {
+	if o.MemorySize == 0 || memoryLimit <= 0 {
+		return o
+	}
+	// split to not overflow with huge limits
+	percent := int64(o.MemorySize)
+	size := memoryLimit/100*percent + memoryLimit%100*percent/100
+	if lower, ok := o.MinSize.bytes(); ok && size < lower {
+		size = lower
+	}
+	if upper, ok := o.MaxSize.bytes(); ok && size > upper {
+		size = upper
+	}
+	// the kernel rounds up to whole pages anyway
+	o.Size = TmpfsSize(fmt.Sprintf("size=%dk", max(size>>10, 1)))
+	return o
+}
+
+// mountOptions returns the options as tmpfs mount options.
+func (o TmpfsOptions) mountOptions() []string {
+	var options []string
+	if o.Mode != "" {
+		options = append(options, string(o.Mode))
+	}
+	if o.UID != nil {
+		options = append(options, fmt.Sprintf("uid=%d", *o.UID))
+	}
+	if o.GID != nil {
+		options = append(options, fmt.Sprintf("gid=%d", *o.GID))
+	}
+	if o.Size != "" {
+		options = append(options, string(o.Size))
+	}
+	return options
+}
+
+// CgroupMount describes a mount of a cgroup hierarchy.
+type CgroupMount struct {
+	Type    string   `json:"type,omitempty"`
+	Source  string   `json:"source,omitempty"`
+	Options []string `json:"options,omitempty"`
+}
+
+// Config is the plugin configuration, loaded from the file given by -config.
+type Config struct {
+	// APIVersion is the schema of the configuration file. Files of older
+	// schemas are migrated when loaded, see migrateConfig.
+	APIVersion string `json:"apiVersion,omitempty"`
+
+	// Verbose enables (more) verbose logging, like the -verbose flag.
+	Verbose bool `json:"verbose,omitempty"`
+
+	// LogLevel sets the log levels of modules, like the -log-level flag,
+	// as comma-separated module=level pairs, e.g. "mounts=debug,default=info".
+	// Modules without a level get the one of default, else info, or debug
+	// with Verbose.
+	LogLevel string `json:"logLevel,omitempty"`
+
+	// Profile is applied to every systemd container which does not select
+	// a profile itself using the io.systemd.container/profile annotation.
+	Profile string `json:"profile,omitempty"`
+
+	// AllowedProfiles lists the gated profiles containers may select, like
+	// nested-containers. Profiles which are not gated are always allowed.
+	AllowedProfiles []string `json:"allowedProfiles,omitempty"`
+
+	// ContainerEngine configures the container-engine profile.
+	ContainerEngine ContainerEngineOptions `json:"containerEngine"`
+
+	// SharedRun configures sharing /run within pods with the share-run
+	// annotation.
+	SharedRun SharedRunOptions `json:"sharedRun"`
+
+	// LoginShell configures the login-shell helper starting shells of
+	// kubectl exec in a login session of the container's systemd.
+	LoginShell LoginShellOptions `json:"loginShell"`
+
+	// DisableAnnotations lists pod annotation keys whose presence disables
+	// the plugin for all containers of the pod, whatever their value, e.g.
+	// to leave pods managed by another system alone.
+	DisableAnnotations []string `json:"disableAnnotations,omitempty"`
+
+	// EphemeralContainers selects whether ephemeral containers, e.g. those
+	// of kubectl debug, are adjusted like other systemd containers, the
+	// default, or skipped.
+	EphemeralContainers EphemeralContainers `json:"ephemeralContainers,omitempty"`
+
+	// EphemeralAnnotations lists container annotation keys marking a
+	// container as ephemeral when set to true.
+	EphemeralAnnotations []string `json:"ephemeralAnnotations,omitempty"`
+
+	// Detection configures how systemd containers are detected.
+	Detection DetectionOptions `json:"detection"`
+
+	// SkipNonPID1 skips systemd containers whose entrypoint does not become
+	// PID 1, e.g. because the pod shares its process namespace. systemd
+	// only runs as an init system as PID 1. By default such containers
+	// are adjusted anyway, with a warning.
+	SkipNonPID1 bool `json:"skipNonPid1,omitempty"`
+
+	// RuntimeTmpfs leaves the tmpfs mounts systemd needs (/run, /tmp, ...)
+	// to the runtime, which mounts them itself for systemd containers.
+	// Defaults to true on CRI-O.
+	RuntimeTmpfs bool `json:"runtimeTmpfs,omitempty"`
+
+	// ReplaceReadOnlyMounts replaces read-only mounts at the destinations
+	// systemd needs writable (/run, /tmp, ...) with a tmpfs. By default such
+	// mounts are left alone with a warning.
+	ReplaceReadOnlyMounts bool `json:"replaceReadOnlyMounts,omitempty"`
+
+	// SkipNestedTmpfs skips the tmpfs mounts for systemd below another
+	// tmpfs of the container, like /run/lock below /run, leaving the
+	// directory to systemd in the parent tmpfs. By default both are
+	// mounted as separate tmpfs.
+	SkipNestedTmpfs bool `json:"skipNestedTmpfs,omitempty"`
+
+	// TmpfsCopyUp populates the tmpfs mounts for systemd with the image
+	// content they shadow, e.g. symlinks an image ships in /run. The copied
+	// content counts against the memory of the container.
+	TmpfsCopyUp bool `json:"tmpfsCopyUp,omitempty"`
+
+	// TmpfsCopyUpMinSize is the smallest size of a tmpfs mount with
+	// TmpfsCopyUp which is not warned about. The size of the copied image
+	// content is not known to the plugin, and a tmpfs too small for it
+	// fails the start of the container. Empty disables the warning.
+	TmpfsCopyUpMinSize TmpfsSize `json:"tmpfsCopyUpMinSize,omitempty"`
+
+	// TmpfsMounts replaces the tmpfs mounts systemd needs, /run, /run/lock,
+	// /tmp and /var/log/journal by default, e.g. to leave /tmp to the image
+	// or to add /run/user. The optional mounts remain available.
+	TmpfsMounts []TmpfsMountSpec `json:"tmpfsMounts,omitempty"`
+
+	// OptionalTmpfs enables optional tmpfs mounts for all systemd
+	// containers, out of /var/tmp and /var/cache. Containers enable them
+	// with the io.systemd.container/tmpfs annotation otherwise.
+	OptionalTmpfs []string `json:"optionalTmpfs,omitempty"`
+
+	// TmpfsOptions apply to all tmpfs mounts for systemd, e.g. to set the
+	// owner of /run for containers running systemd as a non-root user.
+	TmpfsOptions TmpfsOptions `json:"tmpfsOptions"`
+
+	// TmpfsMountOptions override TmpfsOptions for single destinations out
+	// of /run, /run/lock, /tmp, /var/log/journal, /var/tmp and /var/cache.
+	TmpfsMountOptions map[string]TmpfsOptions `json:"tmpfsMountOptions,omitempty"`
+
+	// NamespaceTmpfs overrides TmpfsOptions and TmpfsMountOptions for the
+	// systemd containers of a namespace, per field. The config annotation
+	// of a container overrides them in turn.
+	NamespaceTmpfs map[string]NamespaceTmpfs `json:"namespaceTmpfs,omitempty"`
+
+	// ContainerEnv is the value of the container environment variable,
+	// which tells systemd it runs in a container, unless the image or
+	// runtime sets it. Defaults to "other".
+	ContainerEnv string `json:"containerEnv,omitempty"`
+
+	// EnvCasing sets the uppercase variants of the environment variables
+	// for systemd as well if "both". Defaults to "lower".
+	EnvCasing EnvCasing `json:"envCasing,omitempty"`
+
+	// MachineID selects how systemd containers get their machine ID: a
+	// stable one, the default, or a fresh one from an empty or first-boot
+	// /etc/machine-id.
+	MachineID MachineID `json:"machineID,omitempty"`
+
+	// Watchdog, if set, is passed to systemd as WATCHDOG_USEC to enable
+	// keep-alive notifications to a supervisor expecting them.
+	Watchdog Duration `json:"watchdog,omitempty"`
+
+	// StrictCgroupLayout refuses to start on hosts with an unknown cgroup
+	// layout, instead of logging a warning.
+	StrictCgroupLayout bool `json:"strictCgroupLayout,omitempty"`
+
+	// SystemdCgroupMount is added at /sys/fs/cgroup/systemd on cgroup v1
+	// hosts, unless the container already mounts something there.
+	SystemdCgroupMount CgroupMount `json:"systemdCgroupMount"`
+
+	// ResolveCgroupMountSymlinks also recognizes the cgroup mount of a
+	// container at a destination which resolves to /sys/fs/cgroup through
+	// symlinks. Symlinks are resolved on the host. By default only a mount
+	// at exactly /sys/fs/cgroup counts.
+	ResolveCgroupMountSymlinks bool `json:"resolveCgroupMountSymlinks,omitempty"`
+
+	// CorrectCgroupMountType corrects a cgroup mount for the other cgroup
+	// version than the host's. By default such a mount is only warned
+	// about.
+	CorrectCgroupMountType bool `json:"correctCgroupMountType,omitempty"`
+
+	// CgroupRemount selects how a read-only cgroup mount is made writable,
+	// for runtimes which do not honor replacing it: replace (default),
+	// add or fail.
+	CgroupRemount CgroupRemount `json:"cgroupRemount,omitempty"`
+
+	// AdjustmentValidation selects what happens when the final mounts of
+	// a systemd container break its adjustment: warn (default) or reject.
+	AdjustmentValidation AdjustmentValidation `json:"adjustmentValidation,omitempty"`
+
+	// RemountSharedCgroupNamespace makes the cgroup mount writable, and on
+	// cgroup v1 hosts adds the name=systemd hierarchy, also for containers
+	// without a private cgroup namespace. This exposes the cgroup hierarchy
+	// of the host to the container, so by default the mount is left alone.
+	RemountSharedCgroupNamespace bool `json:"remountSharedCgroupNamespace,omitempty"`
+
+	// DeferCgroupWithoutMounts leaves the cgroup mount to the runtime for
+	// containers without any mounts in their spec, for runtimes adding the
+	// mounts after the adjustment. By default a missing cgroup mount is
+	// added, see AddMissingCgroupMount.
+	DeferCgroupWithoutMounts bool `json:"deferCgroupWithoutMounts,omitempty"`
+
+	// AddMissingCgroupMount adds a cgroup mount for the cgroup version of the
+	// host to containers without one in their spec, as with some sandboxed
+	// runtimes and minimal specs. Enabled by default; disabled, a missing
+	// cgroup mount is an error.
+	AddMissingCgroupMount bool `json:"addMissingCgroupMount"`
+
+	// ExcludeMounts lists destinations the plugin never adds, removes or
+	// changes mounts at, as absolute paths or path.Match patterns. A pattern
+	// also excludes everything below the paths it matches.
+	ExcludeMounts []string `json:"excludeMounts,omitempty"`
+
+	// StateDir is the host directory for files the plugin provides to
+	// containers, like the units enabled by annotation.
+	StateDir string `json:"stateDir,omitempty"`
+
+	// AllowedUnits lists the units containers may enable or disable with
+	// the io.systemd.container/enable-units and disable-units annotations,
+	// as names or path.Match patterns. Empty allows none.
+	AllowedUnits []string `json:"allowedUnits,omitempty"`
+
+	// AllowedTargets lists the targets containers may boot into with the
+	// io.systemd.container/default-target annotation, as names or
+	// path.Match patterns. Empty allows none.
+	AllowedTargets []string `json:"allowedTargets,omitempty"`
+
+	// AllowHostModules lets containers bind-mount the kernel modules of the
+	// host with the io.systemd.container/host-modules annotation.
+	AllowHostModules bool `json:"allowHostModules,omitempty"`
+
+	// AllowHostDBus lets containers bind-mount the system D-Bus socket of
+	// the host with the io.systemd.container/host-dbus annotation.
+	AllowHostDBus bool `json:"allowHostDBus,omitempty"`
+
+	// DisableDropIns rejects the io.systemd.container/dropin.* annotations
+	// injecting arbitrary systemd drop-ins. Drop-ins of specific
+	// annotations, like the runtime watchdog, remain in effect.
+	DisableDropIns bool `json:"disableDropIns,omitempty"`
+
+	// MaxDropInSize and MaxDropInsSize limit the size in bytes of a single
+	// drop-in annotation and of all drop-ins of a container.
+	MaxDropInSize  int `json:"maxDropInSize"`
+	MaxDropInsSize int `json:"maxDropInsSize"`
+
+	// MinSystemdVersionV2 is the oldest systemd version declared by the
+	// io.systemd.container/systemd-version annotation which is adjusted on
+	// cgroup v2 hosts. Older ones are handled according to FailurePolicy.
+	// 0 disables the check.
+	MinSystemdVersionV2 int `json:"minSystemdVersionCgroupV2"`
+
+	// HookTimeout bounds the time spent processing a single NRI event.
+	HookTimeout Duration `json:"hookTimeout,omitempty"`
+
+	// MaxConcurrentAdjustments limits how many containers are adjusted at
+	// the same time, e.g. during a node boot storm. Others wait for a free
+	// worker until the hook deadline. Changes require a restart.
+	MaxConcurrentAdjustments int `json:"maxConcurrentAdjustments,omitempty"`
+
+	// ContainerMetricLabels lists the labels of the nri_systemd_containers
+	// gauge, out of "namespace" and "profile". Drop labels to keep the
+	// cardinality in check.
+	ContainerMetricLabels []string `json:"containerMetricLabels"`
+
+	// PublishContract adds the contract annotations to adjusted systemd
+	// containers, a stable summary of the adjustment for NRI plugins
+	// running after this one.
+	PublishContract bool `json:"publishContract,omitempty"`
+
+	// IdentityMetricLabels lists the labels identifying the plugin added to
+	// all metrics, out of "node", "runtime" and "runtime_version". Drop those
+	// the scraper adds itself.
+	IdentityMetricLabels []string `json:"identityMetricLabels"`
+
+	// ExitOnDisconnect exits the plugin when the connection to the runtime
+	// is lost, instead of reconnecting. After dropping privileges with
+	// -run-as, the plugin exits anyway if the runtime recreated the NRI
+	// socket, which only root can open then.
+	ExitOnDisconnect bool `json:"exitOnDisconnect,omitempty"`
+
+	// PodSecurityLevel is the Pod Security Standards level assumed for pods
+	// without the pod-security.kubernetes.io/enforce annotation. Adjustment
+	// steps conflicting with the level of a pod are skipped with a warning.
+	// Defaults to privileged, which allows all of them.
+	PodSecurityLevel PodSecurityLevel `json:"podSecurityLevel,omitempty"`
+
+	// OverridePSSWarnings applies the steps conflicting with the Pod
+	// Security level of a pod anyway, still with a warning.
+	OverridePSSWarnings bool `json:"overridePSSWarnings,omitempty"`
+
+	// ExpectedControllers are the cgroup controllers systemd containers are
+	// expected to get on cgroup v2 hosts, e.g. cpu for CPUQuota= of their
+	// units. Missing controllers are reported when a container starts.
+	ExpectedControllers []string `json:"expectedControllers,omitempty"`
+
+	// FixParentDelegation enables missing expected controllers in the
+	// parent cgroups of a container, up to the root.
+	FixParentDelegation bool `json:"fixParentDelegation,omitempty"`
+
+	// HostSysctls are the host sysctls checked against the number of
+	// tracked systemd containers, e.g. the inotify limits shared by all of
+	// them. Violations are logged and reported by the drift checks.
+	HostSysctls []SysctlRequirement `json:"hostSysctls"`
+
+	// ManageHostSysctls raises the host sysctls below their requirement,
+	// recording their previous values for the restore-sysctls action.
+	ManageHostSysctls bool `json:"manageHostSysctls,omitempty"`
+
+	// OrphanGC configures the cleanup of files rendered for containers the
+	// runtime no longer knows about, e.g. removed while the plugin was not
+	// running.
+	OrphanGC OrphanGCOptions `json:"orphanGC"`
+
+	// OCIPlanDir, if set, is where the adjustment of every systemd
+	// container is written to as a partial OCI runtime spec, in
+	// <container ID>.json, for tooling consuming OCI specs.
+	OCIPlanDir string `json:"ociPlanDir,omitempty"`
+
+	// PreHook, if set, is run at startup before connecting to the runtime,
+	// e.g. to prepare host directories the containers depend on.
+	PreHook PreHook `json:"preHook"`
+
+	// DriftCheckInterval, if set, is the interval of checking the tracked
+	// systemd containers for drift: changes of the host, like the cgroup
+	// layout, and missing files rendered for them.
+	DriftCheckInterval Duration `json:"driftCheckInterval,omitempty"`
+
+	// BootCheckWindow, if set, reports systemd containers which exit right
+	// after starting, or stop within the window, as likely failed boots.
+	BootCheckWindow Duration `json:"bootCheckWindow,omitempty"`
+
+	// CrashReports configures the reports written for systemd containers
+	// which failed to boot.
+	CrashReports CrashReportOptions `json:"crashReports"`
+
+	// JournalCapture configures capturing the persistent journal of
+	// systemd containers which died abnormally.
+	JournalCapture JournalCaptureOptions `json:"journalCapture"`
+
+	// AutoRepair renders missing files for the tracked systemd containers
+	// again when checking for drift.
+	AutoRepair bool `json:"autoRepair,omitempty"`
+
+	// MaxConfigAnnotationSize is the maximum size in bytes of the
+	// io.systemd.container/config annotation. Containers with a larger one
+	// are handled according to FailurePolicy.
+	MaxConfigAnnotationSize int `json:"maxConfigAnnotationSize"`
+
+	// RecentDecisions is the number of decisions about containers kept in
+	// memory for the /recent endpoint of the debug API. 0 keeps none.
+	RecentDecisions int `json:"recentDecisions"`
+
+	// DuplicatePolicy selects what the plugin does at startup while another
+	// instance on the node holds the lock below StateDir: exit (default)
+	// or standby.
+	DuplicatePolicy DuplicatePolicy `json:"duplicatePolicy,omitempty"`
+
+	// FailurePolicy overrides what happens when processing a systemd
+	// container fails. By default problems with the container spec fail
+	// closed, while an expired hook deadline and problems which only keep
+	// systemd from booting, like a read-only tmpfs mount left in place,
+	// fail open. Open and closed apply to all of them.
+	FailurePolicy FailurePolicy `json:"failurePolicy,omitempty"`
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		APIVersion: configAPIVersion,
+		SystemdCgroupMount: CgroupMount{
+			Type:    "cgroup",
+			Source:  "cgroup",
+			Options: []string{"rw", "nosuid", "noexec", "nodev", "none", "name=systemd"},
+		},
+		ContainerEngine: ContainerEngineOptions{
+			RunSize: "size=512m",
+		},
+		ContainerEnv:             defaultContainerEnv,
+		TmpfsCopyUpMinSize:       defaultTmpfsCopyUpMinSize,
+		AddMissingCgroupMount:    true,
+		StateDir:                 defaultStateDir,
+		HookTimeout:              defaultHookTimeout,
+		MaxConcurrentAdjustments: defaultMaxConcurrentAdjustments,
+		ContainerMetricLabels:    []string{"namespace", "profile"},
+		IdentityMetricLabels:     slices.Clone(identityLabels),
+		HostSysctls:              slices.Clone(defaultHostSysctls),
+		EphemeralAnnotations:     []string{ephemeralAnnotation},
+		RecentDecisions:          defaultRecentDecisions,
+		MaxConfigAnnotationSize:  defaultMaxConfigAnnotationSize,
+		MaxDropInSize:            defaultMaxDropInSize,
+		MinSystemdVersionV2:      defaultMinSystemdVersionV2,
+		MaxDropInsSize:           defaultMaxDropInsSize,
+		CrashReports: CrashReportOptions{
+			MaxSize:   defaultCrashReportSize,
+			Retention: defaultCrashReportRetention,
+		},
+		OrphanGC: OrphanGCOptions{
+			MinAge: defaultOrphanMinAge,
+		},
+		JournalCapture: JournalCaptureOptions{
+			Window:    defaultJournalCaptureWindow,
+			MaxSize:   defaultJournalCaptureSize,
+			Retention: defaultJournalCaptureRetention,
+		},
+	}
+}
+
+// withTmpfsOptions returns the configuration with the given tmpfs options
+// overriding its own, per field.
+func (c *Config) withTmpfsOptions(general TmpfsOptions, mounts map[string]TmpfsOptions) *Config {
+	cfg := *c
+	cfg.TmpfsOptions = general.merge(c.TmpfsOptions)
+	if len(mounts) > 0 {
+		cfg.TmpfsMountOptions = maps.Clone(c.TmpfsMountOptions)
+		if cfg.TmpfsMountOptions == nil {
+			cfg.TmpfsMountOptions = map[string]TmpfsOptions{}
+		}
+		for dest, opts := range mounts {
+			cfg.TmpfsMountOptions[dest] = opts.merge(c.TmpfsMountOptions[dest])
+		}
+	}
+	return &cfg
+}
+
+// namespaceConfig returns the configuration with the tmpfs options of the
+// namespace of the pod applied.
+func namespaceConfig(cfg *Config, pod *api.PodSandbox) *Config {
+	if pod == nil {
+		return cfg
+	}
+	opts, ok := cfg.NamespaceTmpfs[pod.Namespace]
+	if !ok {
+		return cfg
+	}
+	return cfg.withTmpfsOptions(opts.TmpfsOptions, opts.TmpfsMountOptions)
+}
+
+// readConfig reads the configuration file with environment variables
+// expanded. Without a file, the configuration is empty.
+func readConfig(path string) ([]byte, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file %s: %w", path, err)
+	}
+
+	if data, err = interpolateConfig(data, os.LookupEnv); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+
+	return data, nil
+}
+
+func parseConfig(data []byte) (*Config, error) {
+	return parseConfigOver(defaultConfig(), data)
+}
+
+// parseConfigOver parses the configuration on top of the given defaults.
+// Files of older schemas are migrated first, without their deprecation
+// warnings, which are logged once by main.
+func parseConfigOver(defaults *Config, data []byte) (*Config, error) {
+	data, _, err := migrateConfig(data)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := defaults
+	if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+		return nil, err
+	}
+	cfg.APIVersion = configAPIVersion
+	cfg.normalize()
+
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// normalize cleans the values of a parsed configuration. validate must not
+// change the configuration, since it also validates the copies derived per
+// container, which share the slices of the configuration in effect.
+func (c *Config) normalize() {
+	if len(c.ExcludeMounts) == 0 {
+		return
+	}
+	excludes := make([]string, 0, len(c.ExcludeMounts))
+	for _, pattern := range c.ExcludeMounts {
+		excludes = append(excludes, path.Clean(pattern))
+	}
+	c.ExcludeMounts = excludes
+}
+
+// addInitPaths adds the comma-separated init paths, e.g. of -init-paths, to
+// those of the configuration.
+func (c *Config) addInitPaths(list string) error {
+	paths := slices.Clone(c.Detection.InitPaths)
+	for _, p := range strings.Split(list, ",") {
+		if p = strings.TrimSpace(p); p != "" && !slices.Contains(paths, p) {
+			paths = append(paths, p)
+		}
+	}
+	c.Detection.InitPaths = paths
+	return c.validate()
+}
+
+func (c *Config) validate() error {
+	if _, err := parseLogLevels(c.LogLevel); err != nil {
+		return fmt.Errorf("invalid logLevel: %w", err)
+	}
+	if c.Profile != "" {
+		if _, ok := profiles[c.Profile]; !ok {
+			return fmt.Errorf("unknown profile %q", c.Profile)
+		}
+	}
+	if c.ContainerEnv == "" || strings.ContainsAny(c.ContainerEnv, "\x00\n") {
+		return fmt.Errorf("invalid containerEnv %q", c.ContainerEnv)
+	}
+	for key := range c.ContainerEngine.Env {
+		if key == "" || strings.ContainsAny(key, "=\x00") {
+			return fmt.Errorf("invalid containerEngine env variable %q", key)
+		}
+	}
+	if _, ok := c.TmpfsCopyUpMinSize.bytes(); c.TmpfsCopyUpMinSize != "" && !ok {
+		return fmt.Errorf("invalid tmpfsCopyUpMinSize %q, must be an absolute size", strings.TrimPrefix(string(c.TmpfsCopyUpMinSize), "size="))
+	}
+	if err := c.SharedRun.validate(); err != nil {
+		return fmt.Errorf("invalid sharedRun: %w", err)
+	}
+	if err := c.LoginShell.validate(); err != nil {
+		return fmt.Errorf("invalid loginShell: %w", err)
+	}
+	for i, name := range c.Detection.Order {
+		known := false
+		for _, d := range systemdDetectors {
+			known = known || d.reason == name
+		}
+		if !known {
+			return fmt.Errorf("unknown detection %q in detection order", name)
+		}
+		for _, prev := range c.Detection.Order[:i] {
+			if prev == name {
+				return fmt.Errorf("duplicate detection %q in detection order", name)
+			}
+		}
+	}
+	for _, p := range c.Detection.InitPaths {
+		if !path.IsAbs(p) || path.Clean(p) != p {
+			return fmt.Errorf("invalid detection init path %q, must be a clean absolute path", p)
+		}
+	}
+	for _, name := range c.AllowedProfiles {
+		if _, ok := profiles[name]; !ok {
+			return fmt.Errorf("unknown profile %q in allowedProfiles", name)
+		}
+	}
+
+	if c.Watchdog < 0 {
+		return fmt.Errorf("invalid watchdog %v, must not be negative", c.Watchdog.Duration())
+	}
+
+	if !path.IsAbs(c.StateDir) || path.Clean(c.StateDir) == "/" {
+		return fmt.Errorf("invalid stateDir %q, must be an absolute path below /", c.StateDir)
+	}
+	if c.OrphanGC.MinAge < 0 {
+		return fmt.Errorf("invalid orphanGC minAge %v, must not be negative", c.OrphanGC.MinAge.Duration())
+	}
+
+	for _, pattern := range c.AllowedUnits {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid allowedUnits entry %q: %w", pattern, err)
+		}
+	}
+	for _, pattern := range c.AllowedTargets {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid allowedTargets entry %q: %w", pattern, err)
+		}
+	}
+
+	seen := make(map[string]bool, len(c.TmpfsMounts))
+	for _, spec := range c.TmpfsMounts {
+		if !path.IsAbs(spec.Destination) || path.Clean(spec.Destination) != spec.Destination || spec.Destination == "/" {
+			return fmt.Errorf("invalid tmpfsMounts destination %q, must be a clean absolute path other than /", spec.Destination)
+		}
+		if seen[spec.Destination] {
+			return fmt.Errorf("invalid tmpfsMounts destination %s, listed twice", spec.Destination)
+		}
+		seen[spec.Destination] = true
+		for _, opt := range spec.Options {
+			if opt == "" || strings.Contains(opt, ",") {
+				return fmt.Errorf("invalid tmpfsMounts option %q for %s, must be a single mount option", opt, spec.Destination)
+			}
+			if strings.HasPrefix(opt, "size=") {
+				if _, err := parseTmpfsSize(opt); err != nil {
+					return fmt.Errorf("invalid tmpfsMounts option for %s: %w", spec.Destination, err)
+				}
+			}
+		}
+	}
+	for _, dest := range c.OptionalTmpfs {
+		if m := c.findSystemdTmpfsMount(dest); m == nil || !m.optional {
+			return fmt.Errorf("invalid optionalTmpfs destination %s, must be one of the optional tmpfs mounts", dest)
+		}
+	}
+	if err := c.TmpfsOptions.validate(); err != nil {
+		return fmt.Errorf("invalid tmpfsOptions: %w", err)
+	}
+	for dest, opts := range c.TmpfsMountOptions {
+		if c.findSystemdTmpfsMount(dest) == nil {
+			return fmt.Errorf("invalid tmpfsMountOptions destination %s, must be one of the tmpfs mounts for systemd", dest)
+		}
+		if err := opts.validate(); err != nil {
+			return fmt.Errorf("invalid tmpfsMountOptions for %s: %w", dest, err)
+		}
+	}
+	for ns, opts := range c.NamespaceTmpfs {
+		if err := opts.TmpfsOptions.validate(); err != nil {
+			return fmt.Errorf("invalid namespaceTmpfs %s tmpfsOptions: %w", ns, err)
+		}
+		for dest, mountOpts := range opts.TmpfsMountOptions {
+			if c.findSystemdTmpfsMount(dest) == nil {
+				return fmt.Errorf("invalid namespaceTmpfs %s tmpfsMountOptions destination %s, must be one of the tmpfs mounts for systemd", ns, dest)
+			}
+			if err := mountOpts.validate(); err != nil {
+				return fmt.Errorf("invalid namespaceTmpfs %s tmpfsMountOptions for %s: %w", ns, dest, err)
+			}
+		}
+	}
+
+	if err := c.SystemdCgroupMount.validate(); err != nil {
+		return fmt.Errorf("invalid systemdCgroupMount: %w", err)
+	}
+
+	for _, pattern := range c.ExcludeMounts {
+		if !path.IsAbs(pattern) {
+			return fmt.Errorf("invalid excludeMounts entry %q, must be an absolute path", pattern)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid excludeMounts entry %q: %w", pattern, err)
+		}
+	}
+
+	if c.HookTimeout <= 0 {
+		return fmt.Errorf("invalid hookTimeout %v, must be positive", c.HookTimeout.Duration())
+	}
+
+	if c.MaxConcurrentAdjustments <= 0 {
+		return fmt.Errorf("invalid maxConcurrentAdjustments %d, must be positive", c.MaxConcurrentAdjustments)
+	}
+
+	for _, label := range c.ContainerMetricLabels {
+		if label != "namespace" && label != "profile" {
+			return fmt.Errorf("invalid containerMetricLabels entry %q, must be %q or %q", label, "namespace", "profile")
+		}
+	}
+
+	for _, label := range c.IdentityMetricLabels {
+		if !slices.Contains(identityLabels, label) {
+			return fmt.Errorf("invalid identityMetricLabels entry %q, must be one of %s", label, strings.Join(identityLabels, ", "))
+		}
+	}
+
+	for _, controller := range c.ExpectedControllers {
+		if controller == "" || strings.ContainsAny(controller, " \t\n/+-") {
+			return fmt.Errorf("invalid expectedControllers entry %q", controller)
+		}
+	}
+
+	for _, r := range c.HostSysctls {
+		if err := r.validate(); err != nil {
+			return err
+		}
+	}
+
+	if c.OCIPlanDir != "" && !path.IsAbs(c.OCIPlanDir) {
+		return fmt.Errorf("invalid ociPlanDir %q, must be an absolute path", c.OCIPlanDir)
+	}
+
+	if c.PreHook.Timeout < 0 {
+		return fmt.Errorf("invalid preHook timeout %v, must not be negative", c.PreHook.Timeout.Duration())
+	}
+
+	if c.DriftCheckInterval < 0 {
+		return fmt.Errorf("invalid driftCheckInterval %v, must not be negative", c.DriftCheckInterval.Duration())
+	}
+
+	if c.BootCheckWindow < 0 {
+		return fmt.Errorf("invalid bootCheckWindow %v, must not be negative", c.BootCheckWindow.Duration())
+	}
+	if err := c.CrashReports.validate(c.BootCheckWindow); err != nil {
+		return fmt.Errorf("invalid crashReports: %w", err)
+	}
+	if err := c.JournalCapture.validate(); err != nil {
+		return fmt.Errorf("invalid journalCapture: %w", err)
+	}
+
+	if c.MinSystemdVersionV2 < 0 {
+		return fmt.Errorf("invalid minSystemdVersionCgroupV2 %d, must not be negative", c.MinSystemdVersionV2)
+	}
+	if c.MaxDropInSize < 0 {
+		return fmt.Errorf("invalid maxDropInSize %d, must not be negative", c.MaxDropInSize)
+	}
+	if c.MaxDropInsSize < 0 {
+		return fmt.Errorf("invalid maxDropInsSize %d, must not be negative", c.MaxDropInsSize)
+	}
+	if c.MaxConfigAnnotationSize < 0 {
+		return fmt.Errorf("invalid maxConfigAnnotationSize %d, must not be negative", c.MaxConfigAnnotationSize)
+	}
+
+	if c.RecentDecisions < 0 {
+		return fmt.Errorf("invalid recentDecisions %d, must not be negative", c.RecentDecisions)
+	}
+
+	if err := c.PodSecurityLevel.validate(); err != nil {
+		return err
+	}
+
+	switch c.EphemeralContainers {
+	case "", EphemeralAdjust, EphemeralSkip:
+	default:
+		return fmt.Errorf("invalid ephemeralContainers %q, must be %q or %q", c.EphemeralContainers, EphemeralAdjust, EphemeralSkip)
+	}
+
+	switch c.CgroupRemount {
+	case "", CgroupRemountReplace, CgroupRemountAdd, CgroupRemountFail:
+	default:
+		return fmt.Errorf("invalid cgroupRemount %q, must be %q, %q or %q",
+			c.CgroupRemount, CgroupRemountReplace, CgroupRemountAdd, CgroupRemountFail)
+	}
+	switch c.AdjustmentValidation {
+	case "", AdjustmentValidationWarn, AdjustmentValidationReject:
+	default:
+		return fmt.Errorf("invalid adjustmentValidation %q, must be %q or %q",
+			c.AdjustmentValidation, AdjustmentValidationWarn, AdjustmentValidationReject)
+	}
+	switch c.EnvCasing {
+	case "", EnvCasingLower, EnvCasingBoth:
+	default:
+		return fmt.Errorf("invalid envCasing %q, must be %q or %q", c.EnvCasing, EnvCasingLower, EnvCasingBoth)
+	}
+
+	switch c.MachineID {
+	case "", MachineIDStable, MachineIDEmpty, MachineIDFirstBoot:
+	default:
+		return fmt.Errorf("invalid machineID %q, must be %q, %q or %q", c.MachineID, MachineIDStable, MachineIDEmpty, MachineIDFirstBoot)
+	}
+
+	switch c.DuplicatePolicy {
+	case "", DuplicateExit, DuplicateStandby:
+	default:
+		return fmt.Errorf("invalid duplicatePolicy %q, must be %q or %q", c.DuplicatePolicy, DuplicateExit, DuplicateStandby)
+	}
+
+	switch c.FailurePolicy {
+	case "", FailOpen, FailClosed:
+	default:
+		return fmt.Errorf("invalid failurePolicy %q, must be %q or %q", c.FailurePolicy, FailOpen, FailClosed)
+	}
+
+	return nil
+}
+
+func (m CgroupMount) validate() error {
+	if m.Type == "" || m.Source == "" {
+		return fmt.Errorf("type and source are required")
+	}
+
+	named := false
+	for _, opt := range m.Options {
+		switch opt {
+		case "ro":
+			return fmt.Errorf("systemd needs the hierarchy writable")
+		case "name=systemd":
+			named = true
+		}
+	}
+	if m.Type == "cgroup" && !named {
+		return fmt.Errorf("cgroup mounts need the name=systemd option")
+	}
+
+	return nil
+}
+
+// excludedMount returns the excludeMounts pattern matching the destination
+// or one of its parent directories, if any.
+func (c *Config) excludedMount(dest string) (string, bool) {
+	for _, pattern := range c.ExcludeMounts {
+		for d := path.Clean(dest); ; d = path.Dir(d) {
+			if ok, _ := path.Match(pattern, d); ok {
+				return pattern, true
+			}
+			if d == "/" || d == "." {
+				break
+			}
+		}
+	}
+	return "", false
+}
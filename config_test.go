@@ -0,0 +1,768 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sigs.k8s.io/yaml"
+)
+
+// configWith returns the default configuration modified by fn.
+func configWith(fn func(*Config)) *Config {
+	cfg := defaultConfig()
+	fn(cfg)
+	return cfg
+}
+
+func TestParseConfig(t *testing.T) {
+	tests := []struct {
+		name      string
+		data      string
+		expected  *Config
+		expectErr bool
+	}{
+		{
+			name:     "empty",
+			data:     "",
+			expected: defaultConfig(),
+		},
+		{
+			name:     "default profile",
+			data:     "profile: nested-runtime\n",
+			expected: configWith(func(c *Config) { c.Profile = profileNestedRuntime }),
+		},
+		{
+			name: "hook timeout and failure policy",
+			data: "hookTimeout: 500ms\nfailurePolicy: closed\n",
+			expected: configWith(func(c *Config) {
+				c.HookTimeout = Duration(500 * time.Millisecond)
+				c.FailurePolicy = FailClosed
+			}),
+		},
+		{
+			name:     "minimum systemd version",
+			data:     "minSystemdVersionCgroupV2: 245\n",
+			expected: configWith(func(c *Config) { c.MinSystemdVersionV2 = 245 }),
+		},
+		{
+			name:      "negative minimum systemd version",
+			data:      "minSystemdVersionCgroupV2: -1\n",
+			expectErr: true,
+		},
+		{
+			name:     "remount in shared cgroup namespace",
+			data:     "remountSharedCgroupNamespace: true\n",
+			expected: configWith(func(c *Config) { c.RemountSharedCgroupNamespace = true }),
+		},
+		{
+			name:     "duplicate policy",
+			data:     "duplicatePolicy: standby\n",
+			expected: configWith(func(c *Config) { c.DuplicatePolicy = DuplicateStandby }),
+		},
+		{
+			name:      "invalid duplicate policy",
+			data:      "duplicatePolicy: ignore\n",
+			expectErr: true,
+		},
+		{
+			name: "shared run",
+			data: "sharedRun:\n  enabled: true\n  paths: [/run/dbus]\n  readWrite: true\n",
+			expected: configWith(func(c *Config) {
+				c.SharedRun = SharedRunOptions{Enabled: true, Paths: []string{"/run/dbus"}, ReadWrite: true}
+			}),
+		},
+		{
+			name:      "shared run path outside of /run",
+			data:      "sharedRun:\n  paths: [/var/run/dbus]\n",
+			expectErr: true,
+		},
+		{
+			name: "login shell",
+			data: "loginShell:\n  enabled: true\n  helper: /opt/nri-plugin-systemd/login-shell-arm64\n",
+			expected: configWith(func(c *Config) {
+				c.LoginShell = LoginShellOptions{Enabled: true, Helper: "/opt/nri-plugin-systemd/login-shell-arm64"}
+			}),
+		},
+		{
+			name:      "relative login shell helper",
+			data:      "loginShell:\n  helper: login-shell\n",
+			expectErr: true,
+		},
+		{
+			name: "crash reports",
+			data: "bootCheckWindow: 30s\ncrashReports:\n  enabled: true\n  maxSize: 16384\n  retention: 72h\n",
+			expected: configWith(func(c *Config) {
+				c.BootCheckWindow = Duration(30 * time.Second)
+				c.CrashReports = CrashReportOptions{Enabled: true, MaxSize: 16384, Retention: Duration(72 * time.Hour)}
+			}),
+		},
+		{
+			name:      "crash reports without boot check",
+			data:      "crashReports:\n  enabled: true\n",
+			expectErr: true,
+		},
+		{
+			name:     "copy-up floor",
+			data:     "tmpfsCopyUpMinSize: 32m\n",
+			expected: configWith(func(c *Config) { c.TmpfsCopyUpMinSize = "size=32m" }),
+		},
+		{
+			name:      "relative copy-up floor",
+			data:      "tmpfsCopyUpMinSize: 10%\n",
+			expectErr: true,
+		},
+		{
+			name:      "negative crash report size",
+			data:      "crashReports:\n  maxSize: -1\n",
+			expectErr: true,
+		},
+		{
+			name: "journal capture",
+			data: "journalCapture:\n  enabled: true\n  window: 5m\n  maxSize: 262144\n  retention: 24h\n",
+			expected: configWith(func(c *Config) {
+				c.JournalCapture = JournalCaptureOptions{Enabled: true, Window: Duration(5 * time.Minute), MaxSize: 262144, Retention: Duration(24 * time.Hour)}
+			}),
+		},
+		{
+			name:      "zero journal capture window",
+			data:      "journalCapture:\n  window: 0s\n",
+			expectErr: true,
+		},
+		{
+			name: "init paths",
+			data: "detection:\n  initPaths: [/usr/bin/systemd]\n  matchBasename: true\n",
+			expected: configWith(func(c *Config) {
+				c.Detection.InitPaths = []string{"/usr/bin/systemd"}
+				c.Detection.MatchBasename = true
+			}),
+		},
+		{
+			name:      "relative init path",
+			data:      "detection:\n  initPaths: [usr/bin/systemd]\n",
+			expectErr: true,
+		},
+		{
+			name:     "identity metric labels",
+			data:     "identityMetricLabels: []\n",
+			expected: configWith(func(c *Config) { c.IdentityMetricLabels = []string{} }),
+		},
+		{
+			name:      "invalid identity metric label",
+			data:      "identityMetricLabels: [pod]\n",
+			expectErr: true,
+		},
+		{
+			name:     "container metric labels",
+			data:     "containerMetricLabels: [namespace]\n",
+			expected: configWith(func(c *Config) { c.ContainerMetricLabels = []string{"namespace"} }),
+		},
+		{
+			name:      "invalid container metric label",
+			data:      "containerMetricLabels: [pod]\n",
+			expectErr: true,
+		},
+		{
+			name: "systemd cgroup mount options",
+			data: "systemdCgroupMount:\n  options: [rw, nosuid, name=systemd]\n",
+			expected: configWith(func(c *Config) {
+				c.SystemdCgroupMount.Options = []string{"rw", "nosuid", "name=systemd"}
+			}),
+		},
+		{
+			name:      "read-only systemd cgroup mount",
+			data:      "systemdCgroupMount:\n  options: [ro, name=systemd]\n",
+			expectErr: true,
+		},
+		{
+			name:      "systemd cgroup mount without name",
+			data:      "systemdCgroupMount:\n  options: [rw]\n",
+			expectErr: true,
+		},
+		{
+			name:     "exclude mounts",
+			data:     "excludeMounts: [/var/run/secrets/, /opt/*/data]\n",
+			expected: configWith(func(c *Config) { c.ExcludeMounts = []string{"/var/run/secrets", "/opt/*/data"} }),
+		},
+		{
+			name:      "relative exclude mount",
+			data:      "excludeMounts: [tmp]\n",
+			expectErr: true,
+		},
+		{
+			name:      "malformed exclude mount pattern",
+			data:      "excludeMounts: [\"/run/[\"]\n",
+			expectErr: true,
+		},
+		{
+			name: "tmpfs options",
+			data: "tmpfsOptions:\n  uid: 1000\n  gid: \"100\"\ntmpfsMountOptions:\n  /run:\n    mode: \"700\"\n",
+			expected: configWith(func(c *Config) {
+				uid, gid := OwnerID(1000), OwnerID(100)
+				c.TmpfsOptions = TmpfsOptions{UID: &uid, GID: &gid}
+				c.TmpfsMountOptions = map[string]TmpfsOptions{"/run": {Mode: "mode=0700"}}
+			}),
+		},
+		{
+			name: "container engine options",
+			data: "containerEngine:\n  runSize: 1g\n  env:\n    DOCKER_IPTABLES_LEGACY: \"1\"\n",
+			expected: configWith(func(c *Config) {
+				c.ContainerEngine = ContainerEngineOptions{
+					RunSize: "size=1g",
+					Env:     map[string]string{"DOCKER_IPTABLES_LEGACY": "1"},
+				}
+			}),
+		},
+		{
+			name:      "invalid container engine run size",
+			data:      "containerEngine:\n  runSize: 1t\n",
+			expectErr: true,
+		},
+		{
+			name: "optional tmpfs",
+			data: "optionalTmpfs: [/var/tmp]\ntmpfsMountOptions:\n  /var/cache:\n    size: 50%\n",
+			expected: configWith(func(c *Config) {
+				c.OptionalTmpfs = []string{"/var/tmp"}
+				c.TmpfsMountOptions = map[string]TmpfsOptions{"/var/cache": {Size: "size=50%"}}
+			}),
+		},
+		{
+			name:      "required tmpfs as optional",
+			data:      "optionalTmpfs: [/run]\n",
+			expectErr: true,
+		},
+		{
+			name:      "unknown optional tmpfs",
+			data:      "optionalTmpfs: [/srv]\n",
+			expectErr: true,
+		},
+		{
+			name: "pod security level",
+			data: "podSecurityLevel: baseline\noverridePSSWarnings: true\n",
+			expected: configWith(func(c *Config) {
+				c.PodSecurityLevel = PodSecurityBaseline
+				c.OverridePSSWarnings = true
+			}),
+		},
+		{
+			name:      "invalid pod security level",
+			data:      "podSecurityLevel: strict\n",
+			expectErr: true,
+		},
+		{
+			name:     "env casing",
+			data:     "envCasing: both\n",
+			expected: configWith(func(c *Config) { c.EnvCasing = EnvCasingBoth }),
+		},
+		{
+			name:      "invalid env casing",
+			data:      "envCasing: upper\n",
+			expectErr: true,
+		},
+		{
+			name: "pre-hook",
+			data: "preHook:\n  command: [/bin/true]\n  timeout: 5s\n",
+			expected: configWith(func(c *Config) {
+				c.PreHook = PreHook{Command: []string{"/bin/true"}, Timeout: Duration(5 * time.Second)}
+			}),
+		},
+		{
+			name: "expected controllers",
+			data: "expectedControllers: [cpu, memory]\nfixParentDelegation: true\n",
+			expected: configWith(func(c *Config) {
+				c.ExpectedControllers = []string{"cpu", "memory"}
+				c.FixParentDelegation = true
+			}),
+		},
+		{
+			name: "orphan gc",
+			data: "orphanGC:\n  minAge: 10m\n  quarantine: true\n",
+			expected: configWith(func(c *Config) {
+				c.OrphanGC = OrphanGCOptions{MinAge: Duration(10 * time.Minute), Quarantine: true}
+			}),
+		},
+		{
+			name:      "negative orphan gc age",
+			data:      "orphanGC:\n  minAge: -1m\n",
+			expectErr: true,
+		},
+		{
+			name:      "root state dir",
+			data:      "stateDir: /\n",
+			expectErr: true,
+		},
+		{
+			name:     "detection order",
+			data:     "detection:\n  order: [entrypoint, annotation]\n",
+			expected: configWith(func(c *Config) { c.Detection.Order = []string{"entrypoint", "annotation"} }),
+		},
+		{
+			name:      "unknown detection",
+			data:      "detection:\n  order: [label]\n",
+			expectErr: true,
+		},
+		{
+			name:      "duplicate detection",
+			data:      "detection:\n  order: [entrypoint, entrypoint]\n",
+			expectErr: true,
+		},
+		{
+			name:     "cgroup remount",
+			data:     "cgroupRemount: add\n",
+			expected: configWith(func(c *Config) { c.CgroupRemount = CgroupRemountAdd }),
+		},
+		{
+			name:      "invalid cgroup remount",
+			data:      "cgroupRemount: bind\n",
+			expectErr: true,
+		},
+		{
+			name:     "adjustment validation",
+			data:     "adjustmentValidation: reject\n",
+			expected: configWith(func(c *Config) { c.AdjustmentValidation = AdjustmentValidationReject }),
+		},
+		{
+			name:      "invalid adjustment validation",
+			data:      "adjustmentValidation: fail\n",
+			expectErr: true,
+		},
+		{
+			name: "namespace tmpfs",
+			data: "namespaceTmpfs:\n  batch:\n    tmpfsOptions:\n      size: 2g\n",
+			expected: configWith(func(c *Config) {
+				c.NamespaceTmpfs = map[string]NamespaceTmpfs{"batch": {TmpfsOptions: TmpfsOptions{Size: "size=2g"}}}
+			}),
+		},
+		{
+			name:      "namespace tmpfs for other destination",
+			data:      "namespaceTmpfs:\n  batch:\n    tmpfsMountOptions:\n      /srv:\n        size: 2g\n",
+			expectErr: true,
+		},
+		{
+			name: "host sysctls",
+			data: "hostSysctls:\n- name: fs.inotify.max_user_watches\n  min: 65536\n  perContainer: 8192\nmanageHostSysctls: true\n",
+			expected: configWith(func(c *Config) {
+				c.HostSysctls = []SysctlRequirement{{Name: "fs.inotify.max_user_watches", Min: 65536, PerContainer: 8192}}
+				c.ManageHostSysctls = true
+			}),
+		},
+		{
+			name:      "host sysctl path",
+			data:      "hostSysctls:\n- name: ../kernel/pid_max\n",
+			expectErr: true,
+		},
+		{
+			name:      "negative host sysctl",
+			data:      "hostSysctls:\n- name: kernel.pid_max\n  perContainer: -1\n",
+			expectErr: true,
+		},
+		{
+			name: "ephemeral containers",
+			data: "ephemeralContainers: skip\nephemeralAnnotations: [example.com/debug]\n",
+			expected: configWith(func(c *Config) {
+				c.EphemeralContainers = EphemeralSkip
+				c.EphemeralAnnotations = []string{"example.com/debug"}
+			}),
+		},
+		{
+			name:      "invalid ephemeral containers",
+			data:      "ephemeralContainers: mutate\n",
+			expectErr: true,
+		},
+		{
+			name:     "first-boot machine ID",
+			data:     "machineID: first-boot\n",
+			expected: configWith(func(c *Config) { c.MachineID = MachineIDFirstBoot }),
+		},
+		{
+			name:      "invalid machine ID",
+			data:      "machineID: random\n",
+			expectErr: true,
+		},
+		{
+			name:      "negative boot check window",
+			data:      "bootCheckWindow: -1s\n",
+			expectErr: true,
+		},
+		{
+			name: "drop-in limits",
+			data: "disableDropIns: true\nmaxDropInSize: 1024\nmaxDropInsSize: 4096\n",
+			expected: configWith(func(c *Config) {
+				c.DisableDropIns = true
+				c.MaxDropInSize = 1024
+				c.MaxDropInsSize = 4096
+			}),
+		},
+		{
+			name:      "negative drop-in size",
+			data:      "maxDropInSize: -1\n",
+			expectErr: true,
+		},
+		{
+			name: "log levels",
+			data: "logLevel: mounts=debug,default=warn\n",
+			expected: configWith(func(c *Config) {
+				c.LogLevel = "mounts=debug,default=warn"
+			}),
+		},
+		{
+			name:      "unknown log module",
+			data:      "logLevel: cgroups=debug\n",
+			expectErr: true,
+		},
+		{
+			name:      "invalid expected controller",
+			data:      "expectedControllers: [+cpu]\n",
+			expectErr: true,
+		},
+		{
+			name:      "unknown allowed profile",
+			data:      "allowedProfiles: [nested-vms]\n",
+			expectErr: true,
+		},
+		{
+			name:      "negative tmpfs uid",
+			data:      "tmpfsOptions:\n  uid: -1\n",
+			expectErr: true,
+		},
+		{
+			name: "tmpfs mounts",
+			data: "tmpfsMounts:\n- destination: /run\n- destination: /run/user\n  mode: \"700\"\n  options: [noexec]\n",
+			expected: configWith(func(c *Config) {
+				c.TmpfsMounts = []TmpfsMountSpec{
+					{Destination: "/run"},
+					{Destination: "/run/user", Mode: "mode=0700", Options: []string{"noexec"}},
+				}
+			}),
+		},
+		{
+			name:      "relative tmpfs mount",
+			data:      "tmpfsMounts:\n- destination: run/user\n",
+			expectErr: true,
+		},
+		{
+			name:      "duplicate tmpfs mount",
+			data:      "tmpfsMounts:\n- destination: /run\n- destination: /run\n",
+			expectErr: true,
+		},
+		{
+			name:      "tmpfs mount option list",
+			data:      "tmpfsMounts:\n- destination: /run\n  options: [\"noexec,nosuid\"]\n",
+			expectErr: true,
+		},
+		{
+			name:      "invalid tmpfs mount size option",
+			data:      "tmpfsMounts:\n- destination: /run\n  options: [size=lots]\n",
+			expectErr: true,
+		},
+		{
+			name:      "tmpfs options for unconfigured mount",
+			data:      "tmpfsMounts:\n- destination: /run\ntmpfsMountOptions:\n  /tmp:\n    size: 1g\n",
+			expectErr: true,
+		},
+		{
+			name:      "non-numeric tmpfs gid",
+			data:      "tmpfsOptions:\n  gid: wheel\n",
+			expectErr: true,
+		},
+		{
+			name:      "tmpfs options for other destination",
+			data:      "tmpfsMountOptions:\n  /srv:\n    uid: 0\n",
+			expectErr: true,
+		},
+		{
+			name:      "invalid hook timeout",
+			data:      "hookTimeout: 0s\n",
+			expectErr: true,
+		},
+		{
+			name:      "invalid failure policy",
+			data:      "failurePolicy: maybe\n",
+			expectErr: true,
+		},
+		{
+			name:      "unknown profile",
+			data:      "profile: no-such-profile\n",
+			expectErr: true,
+		},
+		{
+			name:      "unknown field",
+			data:      "profiles: nested-runtime\n",
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := parseConfig([]byte(tt.data))
+			if tt.expectErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, cfg)
+		})
+	}
+}
+
+func TestMemorySizedTmpfs(t *testing.T) {
+	const gib = 1 << 30
+	opts := TmpfsOptions{Size: "size=64m", MemorySize: 5, MinSize: "size=16m", MaxSize: "size=256m"}
+
+	tests := []struct {
+		name  string
+		opts  TmpfsOptions
+		limit int64
+		size  TmpfsSize
+	}{
+		{name: "percentage", opts: opts, limit: 2 * gib, size: "size=104857k"},
+		{name: "clamped to min", opts: opts, limit: 128 << 20, size: "size=16384k"},
+		{name: "clamped to max", opts: opts, limit: 64 * gib, size: "size=262144k"},
+		{name: "no limit", opts: opts, limit: 0, size: "size=64m"},
+		{name: "unlimited", opts: opts, limit: -1, size: "size=64m"},
+		{name: "no bounds", opts: TmpfsOptions{MemorySize: 50}, limit: gib, size: "size=524288k"},
+		{name: "no memory size", opts: TmpfsOptions{Size: "size=64m"}, limit: gib, size: "size=64m"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.size, tt.opts.sized(tt.limit).Size)
+		})
+	}
+
+	t.Run("config", func(t *testing.T) {
+		cfg, err := parseConfig([]byte("tmpfsMountOptions:\n  /run:\n    memorySize: \"5%\"\n    minSize: 16m\n    maxSize: 1g\n"))
+		require.NoError(t, err)
+		assert.Equal(t, TmpfsOptions{MemorySize: 5, MinSize: "size=16m", MaxSize: "size=1g"}, cfg.TmpfsMountOptions["/run"])
+
+		for _, data := range []string{
+			"tmpfsOptions:\n  memorySize: \"0%\"\n",
+			"tmpfsOptions:\n  memorySize: \"150%\"\n",
+			"tmpfsOptions:\n  memorySize: \"5\"\n",
+			"tmpfsOptions:\n  minSize: \"10%\"\n",
+			"tmpfsMountOptions:\n  /tmp:\n    minSize: 1g\n    maxSize: 16m\n",
+		} {
+			_, err := parseConfig([]byte(data))
+			assert.Error(t, err, data)
+		}
+	})
+}
+
+func TestParseTmpfsMode(t *testing.T) {
+	tests := []struct {
+		mode      string
+		expected  TmpfsMode
+		expectErr bool
+	}{
+		{mode: "755", expected: "mode=0755"},
+		{mode: "0755", expected: "mode=0755"},
+		{mode: "mode=755", expected: "mode=0755"},
+		{mode: "1777", expected: "mode=1777"},
+		{mode: "mode=01777", expected: "mode=1777"},
+		{mode: "4750", expected: "mode=4750"},
+		{mode: "0", expected: "mode=0000"},
+		{mode: "", expectErr: true},
+		{mode: "mode=", expectErr: true},
+		{mode: "mode=0x777", expectErr: true},
+		{mode: "9999", expectErr: true},
+		{mode: "17777", expectErr: true},
+		{mode: "-755", expectErr: true},
+		{mode: "rwxr-xr-x", expectErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			mode, err := parseTmpfsMode(tt.mode)
+			if tt.expectErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, mode)
+		})
+	}
+}
+
+func TestTmpfsModeUnmarshal(t *testing.T) {
+	var v struct {
+		Mode TmpfsMode `json:"mode"`
+	}
+
+	assert.NoError(t, yaml.UnmarshalStrict([]byte(`mode: "755"`), &v))
+	assert.Equal(t, TmpfsMode("mode=0755"), v.Mode)
+
+	// unquoted YAML octal numbers are ambiguous
+	assert.Error(t, yaml.UnmarshalStrict([]byte(`mode: 0755`), &v))
+	assert.Error(t, yaml.UnmarshalStrict([]byte(`mode: "0x777"`), &v))
+}
+
+func TestExcludedMount(t *testing.T) {
+	cfg := configWith(func(c *Config) {
+		c.ExcludeMounts = []string{"/var/run/secrets", "/opt/*/data"}
+	})
+
+	for dest, excluded := range map[string]bool{
+		"/var/run/secrets": true,
+		"/var/run/secrets/kubernetes.io/serviceaccount": true,
+		"/var/run/secrets/":                             true,
+		"/var/run/secretsx":                             false,
+		"/var/run":                                      false,
+		"/opt/app/data":                                 true,
+		"/opt/app/data/cache":                           true,
+		"/opt/app/logs":                                 false,
+	} {
+		_, ok := cfg.excludedMount(dest)
+		assert.Equal(t, excluded, ok, dest)
+	}
+}
+
+func TestInterpolate(t *testing.T) {
+	env := map[string]string{
+		"NODE_NAME": "node-1",
+		"ROOT":      "/var/lib/nodes",
+		"EMPTY":     "",
+		"DOLLAR":    "${NODE_NAME}",
+	}
+	lookup := func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	}
+
+	tests := []struct {
+		in        string
+		expected  string
+		expectErr bool
+	}{
+		{in: "plain", expected: "plain"},
+		{in: "${NODE_NAME}", expected: "node-1"},
+		{in: "${ROOT}/${NODE_NAME}/state", expected: "/var/lib/nodes/node-1/state"},
+		{in: "${UNSET:-fallback}", expected: "fallback"},
+		{in: "${EMPTY:-fallback}", expected: "fallback"},
+		{in: "${NODE_NAME:-fallback}", expected: "node-1"},
+		{in: "${UNSET:-${ROOT}/default}", expected: "/var/lib/nodes/default"},
+		{in: "${UNSET:-${ALSO_UNSET:-${NODE_NAME}}}", expected: "node-1"},
+		{in: "${UNSET:-}", expected: ""},
+		{in: "${EMPTY}", expected: ""},
+		{in: "$${NODE_NAME}", expected: "${NODE_NAME}"},
+		{in: "cost: $$5", expected: "cost: $5"},
+		{in: "${UNSET:-$${literal}}", expected: "${literal}"},
+		{in: "$NODE_NAME and $", expected: "$NODE_NAME and $"},
+		{in: "${DOLLAR}", expected: "${NODE_NAME}"},
+		{in: "${UNSET}", expectErr: true},
+		{in: "${UNSET:-${ALSO_UNSET}}", expectErr: true},
+		{in: "${NODE_NAME", expectErr: true},
+		{in: "${}", expectErr: true},
+		{in: "${1NODE}", expectErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			out, err := interpolate(tt.in, lookup)
+			if tt.expectErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, out)
+		})
+	}
+}
+
+func TestInterpolateConfig(t *testing.T) {
+	lookup := func(name string) (string, bool) {
+		v, ok := map[string]string{"PROFILE": "nested-runtime", "EXCLUDE": "/opt/data/"}[name]
+		return v, ok
+	}
+
+	data, err := interpolateConfig([]byte("profile: ${PROFILE}\nexcludeMounts: [\"${EXCLUDE}\"]\nhookTimeout: ${TIMEOUT:-500ms}\n"), lookup)
+	assert.NoError(t, err)
+	cfg, err := parseConfig(data)
+	assert.NoError(t, err)
+	assert.Equal(t, configWith(func(c *Config) {
+		c.Profile = profileNestedRuntime
+		c.ExcludeMounts = []string{"/opt/data"}
+		c.HookTimeout = Duration(500 * time.Millisecond)
+	}), cfg)
+
+	// validation sees the resolved value
+	data, err = interpolateConfig([]byte("profile: ${UNKNOWN:-no-such-profile}\n"), lookup)
+	assert.NoError(t, err)
+	_, err = parseConfig(data)
+	assert.ErrorContains(t, err, `unknown profile "no-such-profile"`)
+
+	_, err = interpolateConfig([]byte("excludeMounts: [/run, \"${UNSET}\"]\n"), lookup)
+	assert.EqualError(t, err, "excludeMounts[1]: variable UNSET is not set")
+
+	data, err = interpolateConfig(nil, lookup)
+	assert.NoError(t, err)
+	cfg, err = parseConfig(data)
+	assert.NoError(t, err)
+	assert.Equal(t, defaultConfig(), cfg)
+}
+
+func TestMigrateConfig(t *testing.T) {
+	v1 := "profile: nested-runtime\ndetectShellExec: true\ndetectionOrder: [entrypoint]\nhookTimeout: 500ms\nmaxConcurrentAdjustments: 4\n"
+	v2 := "apiVersion: v2\nprofile: nested-runtime\ndetection:\n  shellExec: true\n  order: [entrypoint]\nhookTimeout: 500ms\nmaxConcurrentAdjustments: 4\n"
+
+	expected, err := parseConfig([]byte(v2))
+	require.NoError(t, err)
+
+	for _, data := range []string{v1, "apiVersion: v1\n" + v1} {
+		migrated, warnings, err := migrateConfig([]byte(data))
+		require.NoError(t, err)
+		assert.Equal(t, []string{
+			"config field detectShellExec is deprecated, migrated to detection.shellExec",
+			"config field detectionOrder is deprecated, migrated to detection.order",
+		}, warnings)
+
+		cfg, err := parseConfig(migrated)
+		require.NoError(t, err)
+		assert.Equal(t, expected, cfg)
+
+		// parseConfig migrates by itself
+		cfg, err = parseConfig([]byte(data))
+		require.NoError(t, err)
+		assert.Equal(t, expected, cfg)
+	}
+
+	// the current schema is left alone
+	migrated, warnings, err := migrateConfig([]byte(v2))
+	require.NoError(t, err)
+	assert.Empty(t, warnings)
+	cfg, err := parseConfig(migrated)
+	require.NoError(t, err)
+	assert.Equal(t, expected, cfg)
+
+	// so are v1 files without deprecated fields
+	_, warnings, err = migrateConfig([]byte("profile: nested-runtime\n"))
+	require.NoError(t, err)
+	assert.Empty(t, warnings)
+
+	_, _, err = migrateConfig([]byte("detectShellExec: true\ndetection:\n  shellExec: false\n"))
+	assert.EqualError(t, err, "both detectShellExec and its replacement detection.shellExec are set")
+
+	_, _, err = migrateConfig([]byte("apiVersion: v3\n"))
+	assert.EqualError(t, err, `unsupported apiVersion "v3", must be v1 or v2`)
+	_, err = parseConfig([]byte("apiVersion: v3\n"))
+	assert.Error(t, err)
+
+	// v2 no longer knows the v1 fields
+	_, err = parseConfig([]byte("apiVersion: v2\ndetectShellExec: true\n"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,201 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"sync"
+	"time"
+
+	"github.com/containerd/nri/pkg/stub"
+)
+
+const (
+	minReconnectDelay = time.Second
+	maxReconnectDelay = 30 * time.Second
+)
+
+// connection tracks the health of the connection to the runtime. While
+// the plugin is disconnected, systemd containers start without adjustments.
+// All updates happen under a single lock, so the metrics and the /readyz
+// payload always describe the same state.
+type connection struct {
+	metrics *metrics
+
+	mu              sync.Mutex
+	connected       bool
+	reconnects      int
+	lastEvent       time.Time
+	lastSynchronize time.Time
+}
+
+// connectionStatus is the /readyz payload.
+type connectionStatus struct {
+	Connected             bool       `json:"connected"`
+	Reconnects            int        `json:"reconnects"`
+	LastEvent             *time.Time `json:"lastEvent,omitempty"`
+	SecondsSinceLastEvent *float64   `json:"secondsSinceLastEvent,omitempty"`
+	LastSynchronize       *time.Time `json:"lastSynchronize,omitempty"`
+}
+
+func newConnection(m *metrics) *connection {
+	return &connection{metrics: m}
+}
+
+func (c *connection) setConnected(connected bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.connected = connected
+	if connected {
+		c.metrics.connected.Set(1)
+	} else {
+		c.metrics.connected.Set(0)
+	}
+}
+
+func (c *connection) reconnecting() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.reconnects++
+	c.metrics.reconnects.Inc()
+}
+
+// eventHandled records the successful handling of an event.
+func (c *connection) eventHandled() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.lastEvent = time.Now()
+	c.metrics.lastEvent.Set(float64(c.lastEvent.UnixNano()) / 1e9)
+}
+
+func (c *connection) synchronized() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.lastSynchronize = time.Now()
+	c.metrics.lastSynchronize.Set(float64(c.lastSynchronize.UnixNano()) / 1e9)
+}
+
+func (c *connection) status() connectionStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s := connectionStatus{
+		Connected:  c.connected,
+		Reconnects: c.reconnects,
+	}
+	if !c.lastEvent.IsZero() {
+		lastEvent := c.lastEvent
+		since := time.Since(lastEvent).Seconds()
+		s.LastEvent = &lastEvent
+		s.SecondsSinceLastEvent = &since
+	}
+	if !c.lastSynchronize.IsZero() {
+		lastSynchronize := c.lastSynchronize
+		s.LastSynchronize = &lastSynchronize
+	}
+	return s
+}
+
+// drainHooks lets the hooks in flight answer the runtime before the plugin
+// disconnects when stopping, waiting at most for their deadline.
+func (p *plugin) drainHooks() {
+	ctx, cancel := context.WithTimeout(context.Background(), p.config().HookTimeout.Duration())
+	defer cancel()
+	if err := p.queue.drain(ctx); err != nil {
+		p.log.Warnf("stopping while containers are still being adjusted: %v", err)
+	}
+}
+
+// stubFactory creates a stub for a single connection to the runtime. The
+// stub must call onClose when the connection is lost.
+type stubFactory func(onClose func()) (stub.Stub, error)
+
+// run keeps the plugin connected to the runtime, reconnecting with an
+// exponential backoff whenever the connection is lost or cannot be
+// established, unless configured to exit instead. It returns once ctx is
+// done.
+func (p *plugin) run(ctx context.Context, newStub stubFactory) error {
+	delay := p.reconnectDelay
+
+	for {
+		closed := make(chan struct{})
+		var once sync.Once
+		s, err := newStub(func() {
+			once.Do(func() { close(closed) })
+		})
+		if err != nil {
+			return fmt.Errorf("failed to create plugin stub: %w", err)
+		}
+		p.stub = s
+
+		if err := s.Start(ctx); err != nil && p.retainedCaps.Load() != nil && errors.Is(err, fs.ErrPermission) {
+			// the runtime recreated the socket, only root can open it
+			s.Stop()
+			return fmt.Errorf("no access to the NRI socket after dropping privileges: %w", err)
+		} else if err != nil {
+			p.log.Errorf("failed to connect to the runtime: %v", err)
+			s.Stop()
+		} else {
+			p.conn.setConnected(true)
+			p.log.Infof("connected to the runtime")
+			delay = p.reconnectDelay
+
+			if p.afterConnect != nil {
+				err := p.afterConnect()
+				p.afterConnect = nil
+				if err != nil {
+					s.Stop()
+					p.conn.setConnected(false)
+					return err
+				}
+			}
+
+			select {
+			case <-closed:
+			case <-ctx.Done():
+				p.drainHooks()
+			}
+			s.Stop()
+			p.conn.setConnected(false)
+
+			if ctx.Err() != nil {
+				return nil
+			}
+			if p.config().ExitOnDisconnect {
+				return errors.New("lost connection to the runtime")
+			}
+			p.log.Warnf("lost connection to the runtime, systemd containers start without adjustments until reconnected")
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(delay):
+		}
+
+		delay = min(2*delay, maxReconnectDelay)
+		p.conn.reconnecting()
+		p.log.Infof("reconnecting to the runtime")
+	}
+}
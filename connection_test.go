@@ -0,0 +1,276 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/containerd/nri/pkg/api"
+	"github.com/containerd/nri/pkg/stub"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeStub is a stub.Stub whose connection is controlled by the test.
+type fakeStub struct {
+	startErr error
+	// onStart simulates the runtime's requests after connecting.
+	onStart func()
+	// onStop is called when disconnecting.
+	onStop func()
+
+	mu      sync.Mutex
+	onClose func()
+}
+
+func (s *fakeStub) Run(ctx context.Context) error {
+	return s.Start(ctx)
+}
+
+func (s *fakeStub) Start(context.Context) error {
+	if s.startErr == nil && s.onStart != nil {
+		s.onStart()
+	}
+	return s.startErr
+}
+
+func (s *fakeStub) Stop() {
+	if s.onStop != nil {
+		s.onStop()
+	}
+}
+
+func (s *fakeStub) Wait() {}
+
+func (s *fakeStub) UpdateContainers([]*api.ContainerUpdate) ([]*api.ContainerUpdate, error) {
+	return nil, stub.ErrNoService
+}
+
+// disconnect simulates the runtime closing the connection.
+func (s *fakeStub) disconnect() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onClose()
+}
+
+func readyz(t *testing.T, p *plugin) (int, connectionStatus) {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	p.serveReadyz(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+	var status connectionStatus
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &status))
+	return rec.Code, status
+}
+
+func TestConnectionHealth(t *testing.T) {
+	p := newTestPlugin(nil)
+	p.reconnectDelay = time.Millisecond
+
+	stubs := make(chan *fakeStub)
+	newStub := func(onClose func()) (stub.Stub, error) {
+		s := <-stubs
+		s.mu.Lock()
+		s.onClose = onClose
+		s.mu.Unlock()
+		return s, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- p.run(ctx, newStub)
+	}()
+
+	waitFor := func(connected, reconnects float64) {
+		t.Helper()
+		assert.Eventually(t, func() bool {
+			return testutil.ToFloat64(p.metrics.connected) == connected &&
+				testutil.ToFloat64(p.metrics.reconnects) == reconnects
+		}, 5*time.Second, time.Millisecond)
+	}
+
+	code, status := readyz(t, p)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.False(t, status.Connected)
+
+	first := &fakeStub{}
+	stubs <- first
+	waitFor(1, 0)
+
+	_, err := p.Synchronize(context.Background(), nil, nil)
+	require.NoError(t, err)
+	assert.NotZero(t, testutil.ToFloat64(p.metrics.lastSynchronize))
+	assert.NotZero(t, testutil.ToFloat64(p.metrics.lastEvent))
+
+	code, status = readyz(t, p)
+	assert.Equal(t, http.StatusOK, code)
+	assert.True(t, status.Connected)
+	assert.NotNil(t, status.LastSynchronize)
+	assert.NotNil(t, status.SecondsSinceLastEvent)
+
+	first.disconnect()
+	waitFor(0, 1)
+
+	code, status = readyz(t, p)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, 1, status.Reconnects)
+
+	// the runtime is not back yet
+	stubs <- &fakeStub{startErr: errors.New("connection refused")}
+	waitFor(0, 2)
+
+	stubs <- &fakeStub{}
+	waitFor(1, 2)
+
+	code, status = readyz(t, p)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 2, status.Reconnects)
+
+	cancel()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("plugin did not stop")
+	}
+	assert.Equal(t, 0.0, testutil.ToFloat64(p.metrics.connected))
+}
+
+func TestStop(t *testing.T) {
+	// start runs the plugin with a hook in flight, until stopped
+	start := func(t *testing.T, p *plugin) (release func(), stopped chan struct{}, done chan error) {
+		release, err := p.queue.acquire(context.Background(), "ctr")
+		require.NoError(t, err)
+
+		stopped = make(chan struct{})
+		var once sync.Once
+		newStub := func(onClose func()) (stub.Stub, error) {
+			return &fakeStub{onClose: onClose, onStop: func() { once.Do(func() { close(stopped) }) }}, nil
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		done = make(chan error)
+		go func() {
+			done <- p.run(ctx, newStub)
+		}()
+		require.Eventually(t, func() bool {
+			return testutil.ToFloat64(p.metrics.connected) == 1
+		}, 5*time.Second, time.Millisecond)
+		cancel()
+		return release, stopped, done
+	}
+
+	t.Run("waits for hooks in flight", func(t *testing.T) {
+		p := newTestPlugin(configWith(func(c *Config) { c.HookTimeout = Duration(time.Minute) }))
+		logs := logtest.NewLocal(p.logs.base)
+		release, stopped, done := start(t, p)
+
+		assert.Never(t, func() bool {
+			select {
+			case <-stopped:
+				return true
+			default:
+				return false
+			}
+		}, 50*time.Millisecond, time.Millisecond)
+		release()
+
+		select {
+		case err := <-done:
+			assert.NoError(t, err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("plugin did not stop")
+		}
+		for _, e := range logs.AllEntries() {
+			assert.NotContains(t, e.Message, "lost connection")
+		}
+	})
+
+	t.Run("bounded by the hook timeout", func(t *testing.T) {
+		p := newTestPlugin(configWith(func(c *Config) { c.HookTimeout = Duration(10 * time.Millisecond) }))
+		logs := logtest.NewLocal(p.logs.base)
+		release, _, done := start(t, p)
+		defer release()
+
+		select {
+		case err := <-done:
+			assert.NoError(t, err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("plugin did not stop")
+		}
+		if assert.NotNil(t, logs.LastEntry()) {
+			assert.Contains(t, logs.LastEntry().Message, "stopping while containers are still being adjusted")
+		}
+	})
+}
+
+func TestReconnectAfterPrivilegeDrop(t *testing.T) {
+	p := newTestPlugin(nil)
+	p.reconnectDelay = time.Millisecond
+	p.afterConnect = func() error {
+		var retained uint64
+		p.retainedCaps.Store(&retained)
+		return nil
+	}
+
+	first := &fakeStub{}
+	stubs := []*fakeStub{
+		first,
+		{startErr: fmt.Errorf("failed to connect to NRI service: %w", syscall.ECONNREFUSED)},
+		// the restarted runtime recreated the socket
+		{startErr: fmt.Errorf("failed to connect to NRI service: %w", syscall.EACCES)},
+	}
+	var mu sync.Mutex
+	newStub := func(onClose func()) (stub.Stub, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		s := stubs[0]
+		stubs = stubs[1:]
+		s.mu.Lock()
+		s.onClose = onClose
+		s.mu.Unlock()
+		return s, nil
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- p.run(context.Background(), newStub)
+	}()
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(p.metrics.connected) == 1
+	}, 5*time.Second, time.Millisecond)
+	first.disconnect()
+
+	select {
+	case err := <-done:
+		assert.ErrorContains(t, err, "no access to the NRI socket after dropping privileges")
+	case <-time.After(5 * time.Second):
+		t.Fatal("plugin did not exit")
+	}
+}
@@ -0,0 +1,71 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+// The contract annotations are a stable, machine-readable summary of how a
+// systemd container was adjusted, for other NRI plugins running after this
+// one, e.g. resource policies treating systemd containers differently.
+// Unlike provenanceAnnotation, meant for humans, keys and value formats
+// never change within a contract version. Changes get a new version.
+const (
+	contractPrefix = "contract.systemd.container.io/"
+
+	// contractVersionAnnotation is the version of the contract, "1".
+	contractVersionAnnotation = contractPrefix + "version"
+	// contractSystemdAnnotation is "true" on systemd containers.
+	contractSystemdAnnotation = contractPrefix + "systemd"
+	// contractProfileAnnotation is the name of the applied profile, missing
+	// without one.
+	contractProfileAnnotation = contractPrefix + "profile"
+	// contractCgroupModeAnnotation is the cgroup version of the host, "v1"
+	// or "v2".
+	contractCgroupModeAnnotation = contractPrefix + "cgroup-mode"
+
+	contractVersion = "1"
+)
+
+// contractAnnotation is an annotation of the contract.
+type contractAnnotation struct {
+	key   string
+	value string
+}
+
+// contract returns the contract annotations of an adjusted systemd
+// container, in a fixed order.
+func contract(profile string, host *hostInfo) []contractAnnotation {
+	annotations := []contractAnnotation{
+		{contractVersionAnnotation, contractVersion},
+		{contractSystemdAnnotation, "true"},
+	}
+	if profile != "" {
+		annotations = append(annotations, contractAnnotation{contractProfileAnnotation, profile})
+	}
+	if host != nil {
+		annotations = append(annotations, contractAnnotation{contractCgroupModeAnnotation, host.CgroupMode.String()})
+	}
+	return annotations
+}
+
+// contractMap returns the contract annotations by key, as shown by the
+// debug API.
+func contractMap(annotations []contractAnnotation) map[string]string {
+	m := make(map[string]string, len(annotations))
+	for _, a := range annotations {
+		m[a.key] = a.value
+	}
+	return m
+}
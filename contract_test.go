@@ -0,0 +1,128 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/containerd/nri/pkg/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// contractAnnotations returns the contract annotations of the adjustment.
+func contractAnnotations(adjust *api.ContainerAdjustment) map[string]string {
+	annotations := map[string]string{}
+	for key, value := range adjust.GetAnnotations() {
+		if strings.HasPrefix(key, contractPrefix) {
+			annotations[key] = value
+		}
+	}
+	return annotations
+}
+
+// TestContractStable pins the contract: other plugins depend on the keys
+// and the formats of their values. Changing them needs a new contract
+// version, not a change of this test.
+func TestContractStable(t *testing.T) {
+	assert.Equal(t, "contract.systemd.container.io/version", contractVersionAnnotation)
+	assert.Equal(t, "contract.systemd.container.io/systemd", contractSystemdAnnotation)
+	assert.Equal(t, "contract.systemd.container.io/profile", contractProfileAnnotation)
+	assert.Equal(t, "contract.systemd.container.io/cgroup-mode", contractCgroupModeAnnotation)
+
+	for _, tt := range []struct {
+		name     string
+		profile  string
+		v1       bool
+		expected map[string]string
+	}{
+		{
+			name: "cgroup v2",
+			expected: map[string]string{
+				"contract.systemd.container.io/version":     "1",
+				"contract.systemd.container.io/systemd":     "true",
+				"contract.systemd.container.io/cgroup-mode": "v2",
+			},
+		},
+		{
+			name: "cgroup v1",
+			v1:   true,
+			expected: map[string]string{
+				"contract.systemd.container.io/version":     "1",
+				"contract.systemd.container.io/systemd":     "true",
+				"contract.systemd.container.io/cgroup-mode": "v1",
+			},
+		},
+		{
+			name:    "profile",
+			profile: profileNestedRuntime,
+			expected: map[string]string{
+				"contract.systemd.container.io/version":     "1",
+				"contract.systemd.container.io/systemd":     "true",
+				"contract.systemd.container.io/profile":     "nested-runtime",
+				"contract.systemd.container.io/cgroup-mode": "v2",
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestPlugin(configWith(func(c *Config) {
+				c.PublishContract = true
+				c.Profile = tt.profile
+			}))
+			if tt.v1 {
+				delete(p.prober.(*fakeProber).paths, "/sys/fs/cgroup/cgroup.controllers")
+			}
+
+			adjust, _, err := p.CreateContainer(context.Background(), &api.PodSandbox{}, newProfileTestContainer(nil))
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, contractAnnotations(adjust))
+		})
+	}
+}
+
+func TestContractDisabled(t *testing.T) {
+	p := newTestPlugin(nil)
+	adjust, _, err := p.CreateContainer(context.Background(), &api.PodSandbox{}, newProfileTestContainer(nil))
+	require.NoError(t, err)
+	assert.Empty(t, contractAnnotations(adjust))
+
+	var containers []struct {
+		Contract map[string]string `json:"contract"`
+	}
+	require.Equal(t, http.StatusOK, debugRequest(t, p, http.MethodGet, "/containers", 0, &containers))
+	require.Len(t, containers, 1)
+	assert.Nil(t, containers[0].Contract)
+}
+
+func TestContractDebugAPI(t *testing.T) {
+	p := newTestPlugin(configWith(func(c *Config) {
+		c.PublishContract = true
+		c.Profile = profileNestedRuntime
+	}))
+	adjust, _, err := p.CreateContainer(context.Background(), &api.PodSandbox{}, newProfileTestContainer(nil))
+	require.NoError(t, err)
+
+	var containers []struct {
+		Contract map[string]string `json:"contract"`
+	}
+	require.Equal(t, http.StatusOK, debugRequest(t, p, http.MethodGet, "/containers", 0, &containers))
+	require.Len(t, containers, 1)
+	assert.Equal(t, contractAnnotations(adjust), containers[0].Contract)
+}
@@ -0,0 +1,219 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/containerd/nri/pkg/api"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// containerCgroupDir returns the cgroup directory of a container, relative
+// to the root of the cgroup v2 hierarchy, from the cgroups path in its
+// spec. The systemd cgroup driver uses "slice:prefix:name", which systemd
+// turns into a scope below the nested slices, e.g. kubepods-pod1.slice
+// into kubepods.slice/kubepods-pod1.slice.
+func containerCgroupDir(cgroupsPath string) (string, error) {
+	if cgroupsPath == "" {
+		return "", fmt.Errorf("no cgroups path")
+	}
+	if strings.HasPrefix(cgroupsPath, "/") {
+		return path.Clean(cgroupsPath), nil
+	}
+
+	parts := strings.Split(cgroupsPath, ":")
+	if len(parts) != 3 || !strings.HasSuffix(parts[0], ".slice") {
+		return "", fmt.Errorf("unsupported cgroups path %q", cgroupsPath)
+	}
+	slice, prefix, name := parts[0], parts[1], parts[2]
+
+	dir := "/"
+	if slice != "-.slice" {
+		units := strings.Split(strings.TrimSuffix(slice, ".slice"), "-")
+		for i := range units {
+			dir = path.Join(dir, strings.Join(units[:i+1], "-")+".slice")
+		}
+	}
+	scope := name + ".scope"
+	if prefix != "" {
+		scope = prefix + "-" + scope
+	}
+	return path.Join(dir, scope), nil
+}
+
+// missingControllers returns the expected controllers not available in the
+// cgroup of the container on a cgroup v2 host. With fixParentDelegation,
+// they are enabled in the subtree_control of the parent cgroups first.
+func (p *plugin) missingControllers(ctx context.Context, cfg *Config, container *api.Container, ctrName string) ([]string, error) {
+	if len(cfg.ExpectedControllers) == 0 {
+		return nil, nil
+	}
+	host, err := p.host(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if host.CgroupMode != cgroupV2 {
+		return nil, nil
+	}
+
+	dir, err := containerCgroupDir(container.GetLinux().GetCgroupsPath())
+	if err != nil {
+		return nil, err
+	}
+
+	missing, err := p.unavailableControllers(ctx, dir, cfg.ExpectedControllers)
+	if err != nil || len(missing) == 0 || !cfg.FixParentDelegation {
+		return missing, err
+	}
+
+	if err := p.delegateControllers(ctx, dir, missing); err != nil {
+		p.hostLog.Warnf("%s: failed to enable cgroup controllers %s in the parent cgroups: %v",
+			ctrName, strings.Join(missing, ","), err)
+	} else {
+		p.hostLog.Infof("%s: enabled cgroup controllers %s in the parent cgroups", ctrName, strings.Join(missing, ","))
+	}
+	return p.unavailableControllers(ctx, dir, cfg.ExpectedControllers)
+}
+
+// unavailableControllers returns the given controllers not listed in
+// cgroup.controllers of the cgroup directory.
+func (p *plugin) unavailableControllers(ctx context.Context, dir string, expected []string) ([]string, error) {
+	available, err := p.readControllers(ctx, path.Join(dir, "cgroup.controllers"))
+	if err != nil {
+		return nil, err
+	}
+
+	var missing []string
+	for _, c := range expected {
+		if !slices.Contains(available, c) {
+			missing = append(missing, c)
+		}
+	}
+	return missing, nil
+}
+
+// delegateControllers enables the controllers in cgroup.subtree_control of
+// every ancestor of the cgroup directory, from the root down, which makes
+// them available in the cgroup.
+func (p *plugin) delegateControllers(ctx context.Context, dir string, controllers []string) error {
+	var ancestors []string
+	for d := path.Dir(dir); ; d = path.Dir(d) {
+		ancestors = append(ancestors, d)
+		if d == "/" {
+			break
+		}
+	}
+	slices.Reverse(ancestors)
+
+	for _, d := range ancestors {
+		file := path.Join(d, "cgroup.subtree_control")
+		enabled, err := p.readControllers(ctx, file)
+		if err != nil {
+			return err
+		}
+		for _, c := range controllers {
+			if slices.Contains(enabled, c) {
+				continue
+			}
+			_, err := withContext(ctx, func() (struct{}, error) {
+				return struct{}{}, os.WriteFile(filepath.Join(p.cgroupFS, file), []byte("+"+c), 0o644)
+			})
+			if err != nil {
+				return fmt.Errorf("failed to enable %s in %s: %w", c, file, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (p *plugin) readControllers(ctx context.Context, file string) ([]string, error) {
+	data, err := withContext(ctx, func() ([]byte, error) {
+		return os.ReadFile(filepath.Join(p.cgroupFS, file))
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", file, err)
+	}
+	return strings.Fields(string(data)), nil
+}
+
+// StartContainer checks the cgroup controllers available to a started
+// systemd container. Containers are started either way.
+func (p *plugin) StartContainer(ctx context.Context, pod *api.PodSandbox, container *api.Container) error {
+	defer p.observeHook("StartContainer", time.Now())
+	defer p.conn.eventHandled()
+
+	s := p.state.get(container.Id)
+	if s == nil {
+		return nil
+	}
+
+	cfg := p.config()
+	ctx, cancel := context.WithTimeout(ctx, cfg.HookTimeout.Duration())
+	defer cancel()
+
+	missing, err := p.missingControllers(ctx, cfg, container, s.name)
+	if err != nil {
+		p.hostLog.Warnf("%s: failed to check cgroup controllers: %v", s.name, err)
+		return nil
+	}
+	if len(missing) > 0 {
+		p.hostLog.Warnf("%s: cgroup controllers %s are missing, systemd units using them will fail or be ignored",
+			s.name, strings.Join(missing, ","))
+	}
+	p.state.update(container.Id, func(updated *containerState) {
+		updated.missingControllers = missing
+	})
+	return nil
+}
+
+// controllerCollector reports the cgroup controllers missing in tracked
+// containers, computed from the state cache at scrape time.
+type controllerCollector struct {
+	p    *plugin
+	desc *prometheus.Desc
+}
+
+func newControllerCollector(p *plugin) *controllerCollector {
+	return &controllerCollector{
+		p: p,
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "", "missing_cgroup_controllers"),
+			"Expected cgroup controllers missing in systemd containers, 1 per missing controller.",
+			[]string{"container", "controller"}, nil,
+		),
+	}
+}
+
+func (c *controllerCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *controllerCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, s := range c.p.state.list() {
+		for _, controller := range s.missingControllers {
+			ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, 1, s.name, controller)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/containerd/nri/pkg/api"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestContainerCgroupDir(t *testing.T) {
+	for cgroupsPath, expected := range map[string]string{
+		"kubepods-burstable-pod12.slice:cri-containerd:abc": "/kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod12.slice/cri-containerd-abc.scope",
+		"kubepods-pod12.slice:crio:abc":                     "/kubepods.slice/kubepods-pod12.slice/crio-abc.scope",
+		"-.slice::abc":                                      "/abc.scope",
+		"/kubepods/besteffort/pod12/abc":                    "/kubepods/besteffort/pod12/abc",
+	} {
+		dir, err := containerCgroupDir(cgroupsPath)
+		require.NoError(t, err, cgroupsPath)
+		assert.Equal(t, expected, dir, cgroupsPath)
+	}
+
+	for _, cgroupsPath := range []string{"", "kubepods:abc", "kubepods:cri-containerd:abc"} {
+		_, err := containerCgroupDir(cgroupsPath)
+		assert.Error(t, err, cgroupsPath)
+	}
+}
+
+// fakeCgroupTree creates a cgroup v2 hierarchy down to the container's
+// cgroup, with the given controllers enabled in the subtree_control of
+// each level. The controllers of a cgroup are those enabled in its
+// parent, like in the kernel, which the fake tree does not update.
+func fakeCgroupTree(t *testing.T, root string, levels []string, subtreeControl []string) {
+	t.Helper()
+
+	dir := root
+	available := "cpu memory pids"
+	for i, level := range levels {
+		if i > 0 {
+			dir = filepath.Join(dir, level)
+		}
+		require.NoError(t, os.MkdirAll(dir, 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "cgroup.controllers"), []byte(available+"\n"), 0o644))
+		if i < len(levels)-1 {
+			require.NoError(t, os.WriteFile(filepath.Join(dir, "cgroup.subtree_control"), []byte(subtreeControl[i]+"\n"), 0o644))
+			available = subtreeControl[i]
+		}
+	}
+}
+
+func TestMissingControllers(t *testing.T) {
+	levels := []string{"/", "kubepods", "pod12", "abc"}
+	container := newProfileTestContainer(nil)
+	container.Linux = &api.LinuxContainer{CgroupsPath: "/kubepods/pod12/abc"}
+
+	newControllerTestPlugin := func(fix bool) *plugin {
+		p := newTestPlugin(configWith(func(c *Config) {
+			c.ExpectedControllers = []string{"cpu", "memory", "pids"}
+			c.FixParentDelegation = fix
+		}))
+		p.cgroupFS = t.TempDir()
+		// the pod cgroup does not delegate cpu
+		fakeCgroupTree(t, p.cgroupFS, levels, []string{"cpu memory pids", "cpu memory pids", "memory pids"})
+		return p
+	}
+
+	t.Run("reported", func(t *testing.T) {
+		p := newControllerTestPlugin(false)
+		_, _, err := p.CreateContainer(context.Background(), nil, container)
+		require.NoError(t, err)
+
+		require.NoError(t, p.StartContainer(context.Background(), nil, container))
+		assert.Equal(t, []string{"cpu"}, p.state.get(container.Id).missingControllers)
+		assert.NoError(t, testutil.GatherAndCompare(p.metrics.registry, strings.NewReader(`
+# HELP nri_systemd_missing_cgroup_controllers Expected cgroup controllers missing in systemd containers, 1 per missing controller.
+# TYPE nri_systemd_missing_cgroup_controllers gauge
+nri_systemd_missing_cgroup_controllers{container="test-container-systemd",controller="cpu"} 1
+`), "nri_systemd_missing_cgroup_controllers"))
+
+		// and by the drift check
+		require.NoError(t, p.checkDrift(context.Background()))
+		assert.Contains(t, p.state.get(container.Id).artifactDrift, "cgroup controllers cpu are missing")
+	})
+
+	t.Run("fixed", func(t *testing.T) {
+		p := newControllerTestPlugin(true)
+		_, _, err := p.CreateContainer(context.Background(), nil, container)
+		require.NoError(t, err)
+
+		require.NoError(t, p.StartContainer(context.Background(), nil, container))
+
+		// only the pod cgroup is written to, the fake tree does not make the
+		// controller available, so it is still reported
+		data, err := os.ReadFile(filepath.Join(p.cgroupFS, "kubepods/pod12/cgroup.subtree_control"))
+		require.NoError(t, err)
+		assert.Equal(t, "+cpu", string(data))
+		data, err = os.ReadFile(filepath.Join(p.cgroupFS, "kubepods/cgroup.subtree_control"))
+		require.NoError(t, err)
+		assert.Equal(t, "cpu memory pids\n", string(data))
+	})
+
+	t.Run("not a systemd container", func(t *testing.T) {
+		p := newControllerTestPlugin(false)
+		require.NoError(t, p.StartContainer(context.Background(), nil, container))
+		assert.Nil(t, p.state.get(container.Id))
+	})
+}
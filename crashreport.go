@@ -0,0 +1,193 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// crashReportDir is the directory below stateDir the crash reports
+	// are written to, one file per failed boot.
+	crashReportDir = "crash-reports"
+
+	// crashReportJournalLines is the number of journal lines in a report.
+	crashReportJournalLines = 100
+
+	crashReportTruncated = "\n[report truncated]\n"
+)
+
+// cgroupReportFiles are the files of the cgroup of a container in a crash
+// report: what was still running, whether the cgroup was empty and why the
+// kernel killed processes.
+var cgroupReportFiles = []string{"cgroup.procs", "cgroup.events", "memory.events", "pids.events"}
+
+// crashReport collects the sections of a report, in order.
+type crashReport struct {
+	buf bytes.Buffer
+}
+
+func (r *crashReport) section(title string) {
+	if r.buf.Len() > 0 {
+		r.buf.WriteByte('\n')
+	}
+	fmt.Fprintf(&r.buf, "== %s ==\n", title)
+}
+
+func (r *crashReport) line(format string, args ...interface{}) {
+	fmt.Fprintf(&r.buf, format+"\n", args...)
+}
+
+func (r *crashReport) text(data []byte) {
+	r.buf.Write(data)
+	if len(data) > 0 && data[len(data)-1] != '\n' {
+		r.buf.WriteByte('\n')
+	}
+}
+
+// bytes returns the report, truncated to maxSize bytes.
+func (r *crashReport) bytes(maxSize int) []byte {
+	data := r.buf.Bytes()
+	if len(data) <= maxSize {
+		return data
+	}
+	keep := max(maxSize-len(crashReportTruncated), 0)
+	return append(data[:keep:keep], crashReportTruncated[:min(len(crashReportTruncated), maxSize)]...)
+}
+
+// writeCrashReport collects what is left of a systemd container which
+// failed to boot, before the runtime restarts it with a fresh tmpfs
+// journal: the final state of its cgroup, the tail of its persistent
+// journal, if it has one, and how it was adjusted. The report is written
+// below stateDir/crash-reports, reports older than the retention are
+// removed first.
+func (p *plugin) writeCrashReport(ctx context.Context, cfg *Config, s *containerState, what string, now time.Time) (string, error) {
+	if err := pruneCrashReports(cfg, now); err != nil {
+		p.stateLog.Warnf("failed to remove old crash reports: %v", err)
+	}
+
+	var r crashReport
+	r.section("container")
+	r.line("name: %s", s.name)
+	r.line("id: %s", s.id)
+	if s.profile != "" {
+		r.line("profile: %s", s.profile)
+	}
+	r.line("failure: %s", what)
+	id := p.identity()
+	if id.node != "" {
+		r.line("node: %s", id.node)
+	}
+	if id.runtime != "" {
+		r.line("runtime: %s %s", id.runtime, id.runtimeVersion)
+	}
+	if !s.started.IsZero() {
+		r.line("started: %s", s.started.UTC().Format(time.RFC3339Nano))
+	}
+	r.line("reported: %s", now.UTC().Format(time.RFC3339Nano))
+
+	r.section("adjustment")
+	if s.adjusted != nil {
+		data, err := json.MarshalIndent(s.adjusted, "", "  ")
+		if err != nil {
+			return "", err
+		}
+		r.text(data)
+	} else {
+		r.line("not recorded, the container was adjusted before the plugin started")
+	}
+	for _, d := range s.drift {
+		r.line("drift: %s", d)
+	}
+
+	p.reportCgroup(ctx, &r, s)
+	p.reportJournal(ctx, &r, s)
+
+	dir, err := renderedDir(cfg, crashReportDir, s.id)
+	if err != nil {
+		return "", err
+	}
+	file := dir + ".txt"
+	if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(file, r.bytes(cfg.CrashReports.MaxSize), 0o644); err != nil {
+		return "", err
+	}
+	return file, nil
+}
+
+// reportCgroup adds the final state of the cgroup of the container on a
+// cgroup v2 host. The runtime may have removed the cgroup already.
+func (p *plugin) reportCgroup(ctx context.Context, r *crashReport, s *containerState) {
+	dir, err := containerCgroupDir(s.container.GetLinux().GetCgroupsPath())
+	if err == nil && (s.host == nil || s.host.CgroupMode != cgroupV2) {
+		err = errors.New("only collected on cgroup v2 hosts")
+	}
+	if err != nil {
+		r.section("cgroup")
+		r.line("not collected: %v", err)
+		return
+	}
+
+	r.section("cgroup " + dir)
+	for _, name := range cgroupReportFiles {
+		data, err := withContext(ctx, func() ([]byte, error) {
+			return os.ReadFile(filepath.Join(p.cgroupFS, dir, name))
+		})
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			r.line("%s: missing", name)
+		case err != nil:
+			r.line("%s: %v", name, err)
+		default:
+			r.line("%s:", name)
+			r.text(data)
+		}
+	}
+}
+
+// reportJournal adds the tail of the persistent journal of the container,
+// if /var/log/journal is bind-mounted from the host. The default tmpfs is
+// gone with the container.
+func (p *plugin) reportJournal(ctx context.Context, r *crashReport, s *containerState) {
+	r.section("journal")
+	dir := persistentJournalDir(s.container)
+	if dir == "" {
+		r.line("not collected: %s is not mounted from the host", journalDir)
+		return
+	}
+
+	data, err := p.readJournal(ctx, journalQuery{dir: dir, lines: crashReportJournalLines})
+	if err != nil {
+		r.line("not collected from %s: %v", dir, err)
+		return
+	}
+	r.text(data)
+}
+
+// pruneCrashReports removes the reports older than the retention.
+func pruneCrashReports(cfg *Config, now time.Time) error {
+	return pruneOlder(filepath.Join(cfg.StateDir, crashReportDir), now.Add(-cfg.CrashReports.Retention.Duration()))
+}
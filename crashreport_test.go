@@ -0,0 +1,173 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/containerd/nri/pkg/api"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCrashReports(t *testing.T) {
+	// crashTestPlugin returns a plugin with crash reports, tracking a
+	// started systemd container.
+	crashTestPlugin := func(t *testing.T, fn func(*Config)) (*plugin, *api.Container) {
+		p := newTestPlugin(configWith(func(c *Config) {
+			c.StateDir = t.TempDir()
+			c.BootCheckWindow = Duration(time.Minute)
+			c.CrashReports.Enabled = true
+			if fn != nil {
+				fn(c)
+			}
+		}))
+		p.cgroupFS = t.TempDir()
+		p.readJournal = func(context.Context, journalQuery) ([]byte, error) {
+			return []byte("Oct 16 10:00:00 web systemd[1]: Freezing execution.\n"), nil
+		}
+
+		container := newProfileTestContainer(nil, &api.Mount{Destination: "/var/log/journal", Type: "bind", Source: "/var/lib/journals/web-0"})
+		container.Linux.CgroupsPath = "kubepods-pod1.slice:cri-containerd:test-container-id-12345"
+		_, _, err := p.CreateContainer(context.Background(), &api.PodSandbox{}, container)
+		require.NoError(t, err)
+
+		container.State = api.ContainerState_CONTAINER_RUNNING
+		container.Pid = 4242
+		require.NoError(t, p.PostStartContainer(context.Background(), &api.PodSandbox{}, container))
+		return p, container
+	}
+	reportFile := func(p *plugin) string {
+		return filepath.Join(p.config().StateDir, "crash-reports", "test-container-id-12345.txt")
+	}
+
+	t.Run("early stop", func(t *testing.T) {
+		p, container := crashTestPlugin(t, nil)
+		logs := logtest.NewLocal(p.logs.base)
+		scope := filepath.Join(p.cgroupFS, "kubepods.slice/kubepods-pod1.slice/cri-containerd-test-container-id-12345.scope")
+		require.NoError(t, os.MkdirAll(scope, 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(scope, "cgroup.procs"), []byte("4242\n"), 0o644))
+		require.NoError(t, os.WriteFile(filepath.Join(scope, "cgroup.events"), []byte("populated 1\nfrozen 0\n"), 0o644))
+		require.NoError(t, os.WriteFile(filepath.Join(scope, "memory.events"), []byte("oom 0\noom_kill 1\n"), 0o644))
+
+		container.State = api.ContainerState_CONTAINER_STOPPED
+		_, err := p.StopContainer(context.Background(), &api.PodSandbox{}, container)
+		require.NoError(t, err)
+
+		data, err := os.ReadFile(reportFile(p))
+		require.NoError(t, err)
+		report := string(data)
+		assert.Contains(t, report, "== container ==\nname: /test-container-systemd\nid: test-container-id-12345\n")
+		assert.Contains(t, report, "failure: stopped ")
+		assert.Contains(t, report, "== adjustment ==\n{\n  \"event\": \"adjusted\",")
+		assert.Contains(t, report, `"/sys/fs/cgroup"`)
+		assert.Contains(t, report, "== cgroup /kubepods.slice/kubepods-pod1.slice/cri-containerd-test-container-id-12345.scope ==\n"+
+			"cgroup.procs:\n4242\ncgroup.events:\npopulated 1\nfrozen 0\nmemory.events:\noom 0\noom_kill 1\npids.events: missing\n")
+		assert.Contains(t, report, "== journal ==\nOct 16 10:00:00 web systemd[1]: Freezing execution.\n")
+
+		require.NotNil(t, logs.LastEntry())
+		assert.Contains(t, logs.LastEntry().Message, "systemd likely failed to boot; check the container logs and the crash report "+reportFile(p))
+	})
+
+	t.Run("identity", func(t *testing.T) {
+		p, container := crashTestPlugin(t, nil)
+		p.setNode("node-1")
+		p.setRuntime("containerd", "v1.7.20")
+		container.State = api.ContainerState_CONTAINER_STOPPED
+		_, err := p.StopContainer(context.Background(), &api.PodSandbox{}, container)
+		require.NoError(t, err)
+
+		data, err := os.ReadFile(reportFile(p))
+		require.NoError(t, err)
+		assert.Contains(t, string(data), "\nnode: node-1\nruntime: containerd v1.7.20\n")
+	})
+
+	t.Run("exited right away", func(t *testing.T) {
+		p, container := crashTestPlugin(t, nil)
+		p.readJournal = func(context.Context, journalQuery) ([]byte, error) {
+			return nil, errors.New("executable file not found in $PATH")
+		}
+		container.State = api.ContainerState_CONTAINER_STOPPED
+		container.Pid = 0
+
+		require.NoError(t, p.PostStartContainer(context.Background(), &api.PodSandbox{}, container))
+		data, err := os.ReadFile(reportFile(p))
+		require.NoError(t, err)
+		assert.Contains(t, string(data), "failure: exited right after starting\n")
+		assert.Contains(t, string(data), "cgroup.procs: missing\n")
+		assert.Contains(t, string(data), "== journal ==\nnot collected from /var/lib/journals/web-0: executable file not found in $PATH\n")
+	})
+
+	t.Run("stopped after the window", func(t *testing.T) {
+		p, container := crashTestPlugin(t, nil)
+		p.state.update(container.Id, func(s *containerState) { s.started = time.Now().Add(-time.Hour) })
+
+		_, err := p.StopContainer(context.Background(), &api.PodSandbox{}, container)
+		require.NoError(t, err)
+		assert.NoFileExists(t, reportFile(p))
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		p, container := crashTestPlugin(t, func(c *Config) { c.CrashReports.Enabled = false })
+
+		_, err := p.StopContainer(context.Background(), &api.PodSandbox{}, container)
+		require.NoError(t, err)
+		assert.NoDirExists(t, filepath.Join(p.config().StateDir, "crash-reports"))
+	})
+
+	t.Run("capped in size", func(t *testing.T) {
+		p, container := crashTestPlugin(t, func(c *Config) { c.CrashReports.MaxSize = 512 })
+		p.readJournal = func(context.Context, journalQuery) ([]byte, error) {
+			return []byte(strings.Repeat("systemd[1]: Failed to mount API filesystems.\n", 100)), nil
+		}
+
+		_, err := p.StopContainer(context.Background(), &api.PodSandbox{}, container)
+		require.NoError(t, err)
+		data, err := os.ReadFile(reportFile(p))
+		require.NoError(t, err)
+		assert.Len(t, data, 512)
+		assert.True(t, strings.HasSuffix(string(data), "\n[report truncated]\n"))
+	})
+
+	t.Run("retention", func(t *testing.T) {
+		p, container := crashTestPlugin(t, func(c *Config) { c.CrashReports.Retention = Duration(24 * time.Hour) })
+		dir := filepath.Join(p.config().StateDir, "crash-reports")
+		require.NoError(t, os.MkdirAll(dir, 0o755))
+		old, recent := filepath.Join(dir, "old.txt"), filepath.Join(dir, "recent.txt")
+		require.NoError(t, os.WriteFile(old, nil, 0o644))
+		require.NoError(t, os.WriteFile(recent, nil, 0o644))
+		require.NoError(t, os.Chtimes(old, time.Now().Add(-48*time.Hour), time.Now().Add(-48*time.Hour)))
+		require.NoError(t, os.Chtimes(recent, time.Now().Add(-time.Hour), time.Now().Add(-time.Hour)))
+
+		_, err := p.StopContainer(context.Background(), &api.PodSandbox{}, container)
+		require.NoError(t, err)
+		assert.NoFileExists(t, old)
+		assert.FileExists(t, recent)
+		assert.FileExists(t, reportFile(p))
+
+		require.NoError(t, pruneCrashReports(p.config(), time.Now().Add(25*time.Hour)))
+		assert.NoFileExists(t, recent)
+		assert.NoFileExists(t, reportFile(p))
+	})
+}
@@ -0,0 +1,87 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/containerd/nri/pkg/api"
+)
+
+const (
+	// hostDBusAnnotation, set to "true", bind-mounts the system D-Bus socket
+	// of the host, e.g. for node management containers talking to systemd
+	// or logind of the host. It needs allowHostDBus. Set on the pod it
+	// applies to all containers of the pod without their own annotation.
+	hostDBusAnnotation = "io.systemd.container/host-dbus"
+
+	hostDBusSocket = "/run/dbus/system_bus_socket"
+)
+
+// wantsHostDBus tells whether the container asks for the system D-Bus of
+// the host.
+func wantsHostDBus(pod *api.PodSandbox, container *api.Container) (bool, error) {
+	value, ok := lookupAnnotation(pod, container, hostDBusAnnotation)
+	if !ok {
+		return false, nil
+	}
+	want, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s annotation %q: %w", hostDBusAnnotation, value, err)
+	}
+	return want, nil
+}
+
+// addHostDBusMount bind-mounts the system D-Bus socket of the host
+// read-write at the same path. Only the socket is mounted, so the D-Bus
+// daemon of the container, if any, keeps its own /run/dbus otherwise. A
+// missing socket fails the step, as the container asked for a bus it would
+// not get.
+func (p *plugin) addHostDBusMount(ctx context.Context, cfg *Config, adjust *api.ContainerAdjustment, container *api.Container, ctrName string) error {
+	if !cfg.AllowHostDBus {
+		return fmt.Errorf("%s annotation is not allowed, allowHostDBus is off", hostDBusAnnotation)
+	}
+
+	if hasMount(container, "/run/dbus") || hasMount(container, hostDBusSocket) {
+		p.mountLog.Debugf("%s: %s already mounted, skipping", ctrName, hostDBusSocket)
+		return nil
+	}
+
+	_, err := p.prober.Stat(ctx, hostDBusSocket)
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%s does not exist on the host, is D-Bus running?", hostDBusSocket)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to probe %s: %w", hostDBusSocket, err)
+	}
+
+	adjust.AddMount(&api.Mount{
+		Destination: hostDBusSocket,
+		Type:        "bind",
+		Source:      hostDBusSocket,
+		Options:     []string{"bind", "rw", "nosuid", "nodev", "noexec"},
+	})
+	p.mountLog.Debugf("%s: mounted the system D-Bus socket of the host at %s", ctrName, hostDBusSocket)
+
+	return nil
+}
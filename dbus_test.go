@@ -0,0 +1,119 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/containerd/nri/pkg/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHostDBus(t *testing.T) {
+	newDBusTestPlugin := func(allow bool, policy ...FailurePolicy) *plugin {
+		p := newTestPlugin(configWith(func(c *Config) {
+			c.AllowHostDBus = allow
+			if len(policy) > 0 {
+				c.FailurePolicy = policy[0]
+			}
+		}))
+		p.prober.(*fakeProber).paths[hostDBusSocket] = true
+		return p
+	}
+	annotated := func(value string) *api.Container {
+		return newProfileTestContainer(map[string]string{hostDBusAnnotation: value})
+	}
+
+	t.Run("allowed", func(t *testing.T) {
+		p := newDBusTestPlugin(true)
+
+		adjust, _, err := p.CreateContainer(context.Background(), &api.PodSandbox{}, annotated("true"))
+		require.NoError(t, err)
+		assert.Equal(t, &api.Mount{
+			Destination: hostDBusSocket,
+			Type:        "bind",
+			Source:      hostDBusSocket,
+			Options:     []string{"bind", "rw", "nosuid", "nodev", "noexec"},
+		}, findMount(adjust.Mounts, hostDBusSocket))
+		assert.Contains(t, adjust.Annotations[provenanceAnnotation], "host-dbus")
+	})
+
+	t.Run("denied by policy", func(t *testing.T) {
+		p := newDBusTestPlugin(false)
+
+		adjust, _, err := p.CreateContainer(context.Background(), &api.PodSandbox{}, annotated("true"))
+		assert.ErrorContains(t, err, "io.systemd.container/host-dbus annotation is not allowed, allowHostDBus is off")
+		assert.Nil(t, adjust)
+	})
+
+	t.Run("socket missing", func(t *testing.T) {
+		p := newDBusTestPlugin(true)
+		delete(p.prober.(*fakeProber).paths, hostDBusSocket)
+
+		adjust, _, err := p.CreateContainer(context.Background(), &api.PodSandbox{}, annotated("true"))
+		assert.ErrorContains(t, err, "/run/dbus/system_bus_socket does not exist on the host")
+		assert.Nil(t, adjust)
+	})
+
+	t.Run("socket missing, failing open", func(t *testing.T) {
+		p := newDBusTestPlugin(true, FailOpen)
+		delete(p.prober.(*fakeProber).paths, hostDBusSocket)
+
+		adjust, _, err := p.CreateContainer(context.Background(), &api.PodSandbox{}, annotated("true"))
+		require.NoError(t, err)
+		assert.Nil(t, adjust)
+	})
+
+	t.Run("not requested", func(t *testing.T) {
+		for _, container := range []*api.Container{newProfileTestContainer(nil), annotated("false")} {
+			p := newDBusTestPlugin(true)
+
+			adjust, _, err := p.CreateContainer(context.Background(), &api.PodSandbox{}, container)
+			require.NoError(t, err)
+			assert.Nil(t, findMount(adjust.Mounts, hostDBusSocket))
+			assert.NotContains(t, adjust.Annotations[provenanceAnnotation], "host-dbus")
+		}
+	})
+
+	t.Run("pod annotation", func(t *testing.T) {
+		p := newDBusTestPlugin(true)
+		pod := &api.PodSandbox{Annotations: map[string]string{hostDBusAnnotation: "true"}}
+
+		adjust, _, err := p.CreateContainer(context.Background(), pod, newProfileTestContainer(nil))
+		require.NoError(t, err)
+		assert.NotNil(t, findMount(adjust.Mounts, hostDBusSocket))
+	})
+
+	t.Run("invalid value", func(t *testing.T) {
+		p := newDBusTestPlugin(true)
+
+		_, _, err := p.CreateContainer(context.Background(), &api.PodSandbox{}, annotated("yes please"))
+		assert.ErrorContains(t, err, `invalid io.systemd.container/host-dbus annotation "yes please"`)
+	})
+
+	t.Run("already mounted", func(t *testing.T) {
+		p := newDBusTestPlugin(true)
+		container := annotated("true")
+		container.Mounts = append(container.Mounts, &api.Mount{Destination: "/run/dbus", Type: "bind", Source: "/run/dbus"})
+
+		adjust, _, err := p.CreateContainer(context.Background(), &api.PodSandbox{}, container)
+		require.NoError(t, err)
+		assert.Nil(t, findMount(adjust.Mounts, hostDBusSocket))
+	})
+}
@@ -0,0 +1,280 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"syscall"
+)
+
+// peerUIDKey is the context key of the uid of the process connected to
+// the debug socket.
+type peerUIDKey struct{}
+
+// serveDebug serves the debug API on a Unix socket. The socket is only
+// accessible by its owner, and actions are additionally restricted to
+// root and the user the plugin runs as. The returned function stops the
+// server and removes the socket.
+func (p *plugin) serveDebug(path string) (func(), error) {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		// left behind by a previous instance
+		_ = os.Remove(path)
+	}
+
+	// the socket must never be accessible by others, not even briefly
+	umask := syscall.Umask(0o177)
+	l, err := net.Listen("unix", path)
+	syscall.Umask(umask)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serve debug socket: %w", err)
+	}
+
+	srv := &http.Server{
+		Handler:     p.debugHandler(),
+		ConnContext: withPeerUID,
+	}
+	go func() {
+		if err := srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			p.log.Errorf("debug server on %s failed: %v", path, err)
+		}
+	}()
+
+	// closing the listener removes the socket
+	return func() { _ = srv.Close() }, nil
+}
+
+func (p *plugin) debugHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", p.serveDebugStatus)
+	mux.HandleFunc("GET /config", p.serveDebugConfig)
+	mux.HandleFunc("GET /containers", p.serveDebugContainers)
+	mux.HandleFunc("GET /skipped", p.serveDebugSkipped)
+	mux.HandleFunc("GET /recent", p.serveDebugRecent)
+	mux.HandleFunc("GET /slowest-step", p.serveDebugSlowestStep)
+	mux.HandleFunc("POST /actions/{action}", p.serveStartAction)
+	mux.HandleFunc("GET /actions/{id}", p.serveJob)
+	mux.HandleFunc("GET /log-level", p.serveLogLevel)
+	mux.HandleFunc("PUT /log-level", p.serveSetLogLevel)
+	return mux
+}
+
+// withPeerUID records the uid of the peer process of a Unix socket
+// connection in the connection context.
+func withPeerUID(ctx context.Context, c net.Conn) context.Context {
+	uc, ok := c.(*net.UnixConn)
+	if !ok {
+		return ctx
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return ctx
+	}
+
+	uid, ok := peerUID(raw)
+	if !ok {
+		return ctx
+	}
+
+	return context.WithValue(ctx, peerUIDKey{}, uid)
+}
+
+// actionAllowed tells whether the peer of the request may run actions.
+func actionAllowed(r *http.Request) bool {
+	uid, ok := r.Context().Value(peerUIDKey{}).(uint32)
+	return ok && (uid == 0 || int(uid) == os.Geteuid())
+}
+
+type debugStatus struct {
+	Connection connectionStatus `json:"connection"`
+	Host       *hostInfo        `json:"host,omitempty"`
+}
+
+func (p *plugin) serveDebugStatus(w http.ResponseWriter, _ *http.Request) {
+	p.writeJSON(w, http.StatusOK, debugStatus{
+		Connection: p.conn.status(),
+		Host:       p.hostInfo.Load(),
+	})
+}
+
+// effectiveConfig is the configuration in effect, with the runtime whose
+// defaults it is based on.
+type effectiveConfig struct {
+	Runtime *runtimeInfo `json:"runtime,omitempty"`
+	Config  *Config      `json:"config"`
+}
+
+func (p *plugin) serveDebugConfig(w http.ResponseWriter, _ *http.Request) {
+	p.writeJSON(w, http.StatusOK, effectiveConfig{
+		Runtime: p.runtime.Load(),
+		Config:  p.config(),
+	})
+}
+
+// debugContainer is the debug API view of a tracked container.
+type debugContainer struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Namespace string    `json:"namespace,omitempty"`
+	Profile   string    `json:"profile,omitempty"`
+	Host      *hostInfo `json:"host,omitempty"`
+	Drift     []string  `json:"drift,omitempty"`
+	// Contract are the contract annotations of the container, with
+	// publishContract.
+	Contract map[string]string `json:"contract,omitempty"`
+}
+
+func (p *plugin) serveDebugContainers(w http.ResponseWriter, _ *http.Request) {
+	publishContract := p.config().PublishContract
+	containers := []debugContainer{}
+	for _, s := range p.state.list() {
+		c := debugContainer{
+			ID:        s.id,
+			Name:      s.name,
+			Namespace: s.namespace,
+			Profile:   s.profile,
+			Host:      s.host,
+			Drift:     slices.Concat(s.drift, s.artifactDrift),
+		}
+		if publishContract {
+			c.Contract = contractMap(contract(s.profile, s.host))
+		}
+		containers = append(containers, c)
+	}
+	slices.SortFunc(containers, func(a, b debugContainer) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	p.writeJSON(w, http.StatusOK, containers)
+}
+
+// serveDebugSkipped returns the likely systemd containers the plugin did
+// not adjust, with the rule which kept it from doing so.
+func (p *plugin) serveDebugSkipped(w http.ResponseWriter, _ *http.Request) {
+	skipped := p.state.listSkipped()
+	slices.SortFunc(skipped, func(a, b *skippedContainer) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	p.writeJSON(w, http.StatusOK, skipped)
+}
+
+// serveDebugRecent returns the recent decisions about containers, the most
+// recent first.
+func (p *plugin) serveDebugRecent(w http.ResponseWriter, _ *http.Request) {
+	p.writeJSON(w, http.StatusOK, p.recent.list())
+}
+
+// debugSlowestStep is the slowest step of the recent adjustments.
+type debugSlowestStep struct {
+	// Adjustments is the number of recent adjustments looked at.
+	Adjustments int         `json:"adjustments"`
+	Slowest     *stepTiming `json:"slowest,omitempty"`
+}
+
+// serveDebugSlowestStep returns the slowest step of the recent adjustments,
+// to tell which step is responsible for slow container creation.
+func (p *plugin) serveDebugSlowestStep(w http.ResponseWriter, _ *http.Request) {
+	slowest, n := p.stepTimings.slowest()
+	resp := debugSlowestStep{Adjustments: n}
+	if n > 0 {
+		resp.Slowest = &slowest
+	}
+	p.writeJSON(w, http.StatusOK, resp)
+}
+
+// serveStartAction starts an action and returns its job. The action runs
+// in the background, its result is retrieved from /actions/<job id>.
+func (p *plugin) serveStartAction(w http.ResponseWriter, r *http.Request) {
+	if !actionAllowed(r) {
+		p.writeError(w, http.StatusForbidden, errors.New("actions are restricted to root"))
+		return
+	}
+
+	action := r.PathValue("action")
+	job, err := p.actions.start(action)
+	if err != nil {
+		p.writeError(w, http.StatusNotFound, err)
+		return
+	}
+	p.log.Infof("started %s action, job %s", action, job.ID)
+
+	p.writeJSON(w, http.StatusAccepted, job)
+}
+
+func (p *plugin) serveJob(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	job, ok := p.actions.get(id)
+	if !ok {
+		p.writeError(w, http.StatusNotFound, fmt.Errorf("unknown job %q", id))
+		return
+	}
+
+	p.writeJSON(w, http.StatusOK, job)
+}
+
+func (p *plugin) writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		p.log.Errorf("failed to write debug response: %v", err)
+	}
+}
+
+func (p *plugin) writeError(w http.ResponseWriter, code int, err error) {
+	p.writeJSON(w, code, map[string]string{"error": err.Error()})
+}
+
+func (p *plugin) serveLogLevel(w http.ResponseWriter, _ *http.Request) {
+	p.writeJSON(w, http.StatusOK, p.logs.list())
+}
+
+// serveSetLogLevel changes the log levels of modules to those given in the
+// body, in the syntax of -log-level, until the configuration is loaded
+// again.
+func (p *plugin) serveSetLogLevel(w http.ResponseWriter, r *http.Request) {
+	if !actionAllowed(r) {
+		p.writeError(w, http.StatusForbidden, errors.New("changing log levels is restricted to root"))
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxLogLevelBody))
+	if err != nil {
+		p.writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	levels, err := parseLogLevels(string(body))
+	if err != nil {
+		p.writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	p.logs.set(levels)
+	p.log.Infof("log levels changed to %s by the debug API", strings.TrimSpace(string(body)))
+
+	p.writeJSON(w, http.StatusOK, p.logs.list())
+}
+
+// maxLogLevelBody bounds the body of a log level change.
+const maxLogLevelBody = 4096
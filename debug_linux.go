@@ -0,0 +1,32 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import "syscall"
+
+// peerUID returns the uid of the peer process of a Unix socket.
+func peerUID(raw syscall.RawConn) (uint32, bool) {
+	var cred *syscall.Ucred
+	var err error
+	ctrlErr := raw.Control(func(fd uintptr) {
+		cred, err = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if ctrlErr != nil || err != nil || cred == nil {
+		return 0, false
+	}
+	return cred.Uid, true
+}
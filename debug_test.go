@@ -0,0 +1,197 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// debugRequest sends a request to the debug API as if made by uid.
+func debugRequest(t *testing.T, p *plugin, method, path string, uid uint32, v any) int {
+	t.Helper()
+
+	req := httptest.NewRequest(method, path, nil)
+	req = req.WithContext(context.WithValue(req.Context(), peerUIDKey{}, uid))
+	rec := httptest.NewRecorder()
+	p.debugHandler().ServeHTTP(rec, req)
+
+	if v != nil {
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), v), rec.Body.String())
+	}
+	return rec.Code
+}
+
+// waitForJob polls the job until it is finished.
+func waitForJob(t *testing.T, p *plugin, id string) job {
+	t.Helper()
+
+	var j job
+	require.Eventually(t, func() bool {
+		code := debugRequest(t, p, http.MethodGet, "/actions/"+id, 0, &j)
+		return code == http.StatusOK && j.State != jobRunning
+	}, time.Second, time.Millisecond)
+	return j
+}
+
+func TestDebugActions(t *testing.T) {
+	t.Run("concurrent actions coalesce", func(t *testing.T) {
+		p := newTestPlugin(nil)
+		gate := &gateProber{gate: make(chan struct{}), prober: p.prober}
+		p.prober = gate
+
+		var first, second job
+		assert.Equal(t, http.StatusAccepted, debugRequest(t, p, http.MethodPost, "/actions/reprobe", 0, &first))
+		assert.Equal(t, http.StatusAccepted, debugRequest(t, p, http.MethodPost, "/actions/reprobe", 0, &second))
+		assert.Equal(t, first.ID, second.ID)
+		assert.Equal(t, jobRunning, second.State)
+
+		close(gate.gate)
+		j := waitForJob(t, p, first.ID)
+		assert.Equal(t, jobSucceeded, j.State)
+		assert.Equal(t, map[string]any{
+			"cgroupRoot":   true,
+			"cgroupMode":   "v2",
+			"cgroupLayout": "v2",
+			"probed":       p.hostInfo.Load().Probed.Format(time.RFC3339Nano),
+		}, j.Result)
+
+		// a finished action runs again
+		var third job
+		assert.Equal(t, http.StatusAccepted, debugRequest(t, p, http.MethodPost, "/actions/reprobe", 0, &third))
+		assert.NotEqual(t, first.ID, third.ID)
+		waitForJob(t, p, third.ID)
+	})
+
+	t.Run("reconcile reports drift", func(t *testing.T) {
+		p := newTestPlugin(nil)
+		p.state.add(&containerState{id: "c1", name: "default/pod/c1", host: &hostInfo{CgroupRoot: true, CgroupMode: cgroupV1}})
+		p.state.add(&containerState{id: "c2", name: "default/pod/c2", host: &hostInfo{CgroupRoot: true, CgroupMode: cgroupV2}})
+		p.state.add(&containerState{id: "c3", name: "default/pod/c3"})
+
+		var started job
+		assert.Equal(t, http.StatusAccepted, debugRequest(t, p, http.MethodPost, "/actions/reconcile", 0, &started))
+		j := waitForJob(t, p, started.ID)
+
+		assert.Equal(t, jobSucceeded, j.State)
+		assert.Equal(t, map[string]any{
+			"containers": []any{
+				map[string]any{"id": "c1", "name": "default/pod/c1", "drift": []any{"adjusted for cgroup v1, host now has cgroup v2"}},
+				map[string]any{"id": "c2", "name": "default/pod/c2"},
+				map[string]any{"id": "c3", "name": "default/pod/c3"},
+			},
+			"drifted": float64(1),
+		}, j.Result)
+	})
+
+	t.Run("rotate audit log", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "audit.log")
+		p := newTestPlugin(nil)
+		var err error
+		p.audit, err = openAuditLog(path)
+		require.NoError(t, err)
+		defer p.audit.Close()
+
+		_, _, err = p.CreateContainer(context.Background(), nil, newProfileTestContainer(nil))
+		require.NoError(t, err)
+
+		var started job
+		assert.Equal(t, http.StatusAccepted, debugRequest(t, p, http.MethodPost, "/actions/rotate-audit", 0, &started))
+		j := waitForJob(t, p, started.ID)
+		assert.Equal(t, jobSucceeded, j.State)
+		assert.Equal(t, map[string]any{"rotated": path + ".1"}, j.Result)
+
+		rotated, err := os.ReadFile(path + ".1")
+		require.NoError(t, err)
+		assert.Contains(t, string(rotated), `"containerId":"`)
+
+		current, err := os.ReadFile(path)
+		require.NoError(t, err)
+		assert.Empty(t, current)
+	})
+
+	t.Run("rotate without audit log fails", func(t *testing.T) {
+		p := newTestPlugin(nil)
+
+		var started job
+		assert.Equal(t, http.StatusAccepted, debugRequest(t, p, http.MethodPost, "/actions/rotate-audit", 0, &started))
+		j := waitForJob(t, p, started.ID)
+		assert.Equal(t, jobFailed, j.State)
+		assert.Equal(t, "the audit log is disabled", j.Error)
+	})
+
+	t.Run("actions restricted to root", func(t *testing.T) {
+		p := newTestPlugin(nil)
+		assert.Equal(t, http.StatusForbidden, debugRequest(t, p, http.MethodPost, "/actions/reprobe", 65534, nil))
+		assert.Nil(t, p.hostInfo.Load())
+	})
+
+	t.Run("unknown action and job", func(t *testing.T) {
+		p := newTestPlugin(nil)
+		assert.Equal(t, http.StatusNotFound, debugRequest(t, p, http.MethodPost, "/actions/reboot", 0, nil))
+		assert.Equal(t, http.StatusNotFound, debugRequest(t, p, http.MethodGet, "/actions/42", 0, nil))
+	})
+}
+
+func TestServeDebug(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "debug.sock")
+	p := newTestPlugin(nil)
+	stopDebug, err := p.serveDebug(path)
+	require.NoError(t, err)
+
+	fi, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), fi.Mode().Perm())
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+
+	// the test runs as the owner of the socket, so actions are allowed
+	resp, err := client.Post("http://plugin/actions/reprobe", "", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+	require.Eventually(t, func() bool { return p.hostInfo.Load() != nil }, time.Second, time.Millisecond)
+
+	resp, err = client.Get("http://plugin/status")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	var status struct {
+		Host map[string]any `json:"host"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&status))
+	assert.Equal(t, true, status.Host["cgroupRoot"])
+	assert.Equal(t, "v2", status.Host["cgroupMode"])
+
+	stopDebug()
+	assert.NoFileExists(t, path)
+}
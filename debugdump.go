@@ -0,0 +1,248 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerd/nri/pkg/api"
+	"google.golang.org/protobuf/proto"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// debugDumpAnnotation selects a container or all containers of a pod
+	// for debug dumps, with "true".
+	debugDumpAnnotation = "io.systemd.container/debug-dump"
+
+	defaultDebugDumpMaxFiles = 100
+	defaultDebugDumpMaxSize  = 64 << 20
+
+	redacted = "<redacted>"
+)
+
+// secretEnv matches the names of environment variables whose values are
+// redacted in debug dumps.
+var secretEnv = regexp.MustCompile(`(?i)(passw(or)?d|secret|token|credential|api_?key|private_?key|access_?key)`)
+
+// debugDumpOptions configure writing the objects the plugin receives and
+// produces to files, for diagnosing disagreements with the runtime.
+type debugDumpOptions struct {
+	// dir is the directory of the dumps, disabled if empty.
+	dir string
+	// namespaces are the namespaces whose containers are dumped, besides
+	// those with debugDumpAnnotation.
+	namespaces []string
+	// maxFiles and maxSize bound the dumps kept in dir, removing the
+	// oldest ones first.
+	maxFiles int
+	maxSize  int64
+}
+
+// parseNamespace adds a namespace given on the command line.
+func (o *debugDumpOptions) parseNamespace(s string) error {
+	if s == "" {
+		return errors.New("empty namespace")
+	}
+	o.namespaces = append(o.namespaces, s)
+	return nil
+}
+
+// debugDump is a single dump of a hook.
+type debugDump struct {
+	Hook       string                   `json:"hook"`
+	Time       time.Time                `json:"time"`
+	Pod        *api.PodSandbox          `json:"pod,omitempty"`
+	Container  *api.Container           `json:"container"`
+	Adjustment *api.ContainerAdjustment `json:"adjustment,omitempty"`
+	Error      string                   `json:"error,omitempty"`
+}
+
+// debugDumper writes debug dumps of the selected containers.
+type debugDumper struct {
+	opts debugDumpOptions
+
+	// mu serializes writing and pruning the dumps.
+	mu sync.Mutex
+}
+
+func newDebugDumper(opts debugDumpOptions) (*debugDumper, error) {
+	if opts.maxFiles <= 0 {
+		return nil, fmt.Errorf("invalid debug dump file limit %d, must be positive", opts.maxFiles)
+	}
+	if opts.maxSize <= 0 {
+		return nil, fmt.Errorf("invalid debug dump size limit %d, must be positive", opts.maxSize)
+	}
+	if err := os.MkdirAll(opts.dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create debug dump directory: %w", err)
+	}
+	return &debugDumper{opts: opts}, nil
+}
+
+// selected tells whether the container is dumped.
+func (d *debugDumper) selected(pod *api.PodSandbox, container *api.Container) bool {
+	if pod != nil && slices.Contains(d.opts.namespaces, pod.Namespace) {
+		return true
+	}
+	value, _ := lookupAnnotation(pod, container, debugDumpAnnotation)
+	return value == "true"
+}
+
+// write dumps what a hook received and produced for the container, if it
+// is selected. Secrets in the environment are redacted.
+func (d *debugDumper) write(hook string, pod *api.PodSandbox, container *api.Container, adjust *api.ContainerAdjustment, hookErr error, now time.Time) (string, error) {
+	if !d.selected(pod, container) {
+		return "", nil
+	}
+
+	dump := debugDump{
+		Hook:      hook,
+		Time:      now.UTC(),
+		Pod:       pod,
+		Container: redactContainer(container),
+	}
+	if adjust != nil {
+		dump.Adjustment = redactAdjustment(adjust)
+	}
+	if hookErr != nil {
+		dump.Error = hookErr.Error()
+	}
+	data, err := yaml.Marshal(dump)
+	if err != nil {
+		return "", err
+	}
+
+	podName := "none"
+	if pod != nil && pod.Name != "" {
+		podName = pod.Name
+	}
+	file := filepath.Join(d.opts.dir, debugDumpName(podName)+"_"+debugDumpName(container.Name)+"_"+hook+".yaml")
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := os.WriteFile(file, data, 0o600); err != nil {
+		return "", err
+	}
+	if err := os.Chtimes(file, now, now); err != nil {
+		return "", err
+	}
+	return file, d.prune(file)
+}
+
+// prune removes the oldest dumps until at most maxFiles of at most maxSize
+// bytes together are left, always keeping the latest one.
+func (d *debugDumper) prune(latest string) error {
+	entries, err := os.ReadDir(d.opts.dir)
+	if err != nil {
+		return err
+	}
+
+	type dumpFile struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	var (
+		files []dumpFile
+		total int64
+	)
+	for _, e := range entries {
+		if e.IsDir() || filepath.Ext(e.Name()) != ".yaml" {
+			continue
+		}
+		info, err := e.Info()
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		files = append(files, dumpFile{filepath.Join(d.opts.dir, e.Name()), info.Size(), info.ModTime()})
+		total += info.Size()
+	}
+	slices.SortFunc(files, func(a, b dumpFile) int { return a.modTime.Compare(b.modTime) })
+
+	count := len(files)
+	for _, f := range files {
+		if count <= d.opts.maxFiles && total <= d.opts.maxSize {
+			break
+		}
+		if f.path == latest {
+			continue
+		}
+		if err := os.Remove(f.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		count--
+		total -= f.size
+	}
+	return nil
+}
+
+// debugDumpName makes a pod or container name safe for a file name.
+func debugDumpName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-':
+			return r
+		}
+		return '-'
+	}, strings.TrimPrefix(name, "/"))
+}
+
+func redactContainer(container *api.Container) *api.Container {
+	redactedCtr := proto.Clone(container).(*api.Container)
+	for i, env := range redactedCtr.Env {
+		if key, _, ok := strings.Cut(env, "="); ok && secretEnv.MatchString(key) {
+			redactedCtr.Env[i] = key + "=" + redacted
+		}
+	}
+	return redactedCtr
+}
+
+func redactAdjustment(adjust *api.ContainerAdjustment) *api.ContainerAdjustment {
+	redactedAdjust := proto.Clone(adjust).(*api.ContainerAdjustment)
+	for _, env := range redactedAdjust.Env {
+		if secretEnv.MatchString(env.Key) {
+			env.Value = redacted
+		}
+	}
+	return redactedAdjust
+}
+
+// dumpHook writes a debug dump of the hook, if enabled.
+func (p *plugin) dumpHook(hook string, pod *api.PodSandbox, container *api.Container, adjust *api.ContainerAdjustment, hookErr error) {
+	if p.debugDump == nil {
+		return
+	}
+	file, err := p.debugDump.write(hook, pod, container, adjust, hookErr, time.Now())
+	if err != nil {
+		p.log.Warnf("%s: failed to write debug dump of %s: %v", containerName(pod, container), hook, err)
+		return
+	}
+	if file != "" {
+		p.log.Debugf("%s: wrote debug dump of %s to %s", containerName(pod, container), hook, file)
+	}
+}
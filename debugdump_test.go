@@ -0,0 +1,170 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/containerd/nri/pkg/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sigs.k8s.io/yaml"
+)
+
+func newTestDebugDumper(t *testing.T, opts debugDumpOptions) *debugDumper {
+	t.Helper()
+	opts.dir = t.TempDir()
+	if opts.maxFiles == 0 {
+		opts.maxFiles = defaultDebugDumpMaxFiles
+	}
+	if opts.maxSize == 0 {
+		opts.maxSize = defaultDebugDumpMaxSize
+	}
+	d, err := newDebugDumper(opts)
+	require.NoError(t, err)
+	return d
+}
+
+func TestDebugDump(t *testing.T) {
+	d := newTestDebugDumper(t, debugDumpOptions{namespaces: []string{"apps"}})
+	p := newTestPlugin(nil)
+	p.debugDump = d
+
+	pod := &api.PodSandbox{Name: "web-0", Namespace: "apps"}
+	container := newProfileTestContainer(nil)
+	container.Name = "app"
+	container.Env = []string{"PATH=/usr/bin", "DB_PASSWORD=hunter2", "API_TOKEN=abc"}
+
+	_, _, err := p.CreateContainer(context.Background(), pod, container)
+	require.NoError(t, err)
+
+	data, err := os.ReadFile(filepath.Join(d.opts.dir, "web-0_app_CreateContainer.yaml"))
+	require.NoError(t, err)
+	var dump debugDump
+	require.NoError(t, yaml.Unmarshal(data, &dump))
+	assert.Equal(t, "CreateContainer", dump.Hook)
+	assert.Equal(t, "web-0", dump.Pod.Name)
+	assert.Equal(t, []string{"PATH=/usr/bin", "DB_PASSWORD=<redacted>", "API_TOKEN=<redacted>"}, dump.Container.Env)
+	assert.NotNil(t, dump.Adjustment)
+	assert.NotContains(t, string(data), "hunter2")
+
+	// the container itself is left alone
+	assert.Equal(t, "DB_PASSWORD=hunter2", container.Env[1])
+
+	require.NoError(t, p.PostCreateContainer(context.Background(), pod, container))
+	assert.FileExists(t, filepath.Join(d.opts.dir, "web-0_app_PostCreateContainer.yaml"))
+}
+
+func TestDebugDumpRedactsAdjustment(t *testing.T) {
+	adjust := &api.ContainerAdjustment{}
+	adjust.AddEnv("container", "other")
+	adjust.AddEnv("SECRET_KEY", "s3cr3t")
+
+	redactedAdjust := redactAdjustment(adjust)
+	assert.Equal(t, "other", redactedAdjust.Env[0].Value)
+	assert.Equal(t, redacted, redactedAdjust.Env[1].Value)
+	assert.Equal(t, "s3cr3t", adjust.Env[1].Value)
+}
+
+func TestDebugDumpSelection(t *testing.T) {
+	d := newTestDebugDumper(t, debugDumpOptions{namespaces: []string{"apps"}})
+	annotated := map[string]string{debugDumpAnnotation: "true"}
+
+	for _, tt := range []struct {
+		name      string
+		pod       *api.PodSandbox
+		container *api.Container
+		selected  bool
+	}{
+		{"namespace", &api.PodSandbox{Namespace: "apps"}, newProfileTestContainer(nil), true},
+		{"other namespace", &api.PodSandbox{Namespace: "batch"}, newProfileTestContainer(nil), false},
+		{"annotated container", &api.PodSandbox{Namespace: "batch"}, newProfileTestContainer(annotated), true},
+		{"annotated pod", &api.PodSandbox{Namespace: "batch", Annotations: annotated}, newProfileTestContainer(nil), true},
+		{"no pod", nil, newProfileTestContainer(nil), false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.selected, d.selected(tt.pod, tt.container))
+		})
+	}
+
+	// nothing is written for unselected containers
+	file, err := d.write("CreateContainer", &api.PodSandbox{Namespace: "batch"}, newProfileTestContainer(nil), nil, nil, time.Now())
+	require.NoError(t, err)
+	assert.Empty(t, file)
+}
+
+func TestDebugDumpNames(t *testing.T) {
+	d := newTestDebugDumper(t, debugDumpOptions{})
+	container := newProfileTestContainer(map[string]string{debugDumpAnnotation: "true"})
+
+	file, err := d.write("CreateContainer", nil, container, nil, errors.New("failed"), time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(d.opts.dir, "none_test-container-systemd_CreateContainer.yaml"), file)
+
+	container.Name = "../evil/name"
+	file, err = d.write("CreateContainer", &api.PodSandbox{Name: "web-0"}, container, nil, nil, time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(d.opts.dir, "web-0_..-evil-name_CreateContainer.yaml"), file)
+}
+
+func TestDebugDumpRetention(t *testing.T) {
+	write := func(d *debugDumper, name string, at time.Time) {
+		t.Helper()
+		container := newProfileTestContainer(map[string]string{debugDumpAnnotation: "true"})
+		container.Name = name
+		_, err := d.write("CreateContainer", nil, container, nil, nil, at)
+		require.NoError(t, err)
+	}
+	dumps := func(d *debugDumper) []string {
+		t.Helper()
+		files, err := filepath.Glob(filepath.Join(d.opts.dir, "*.yaml"))
+		require.NoError(t, err)
+		for i, f := range files {
+			files[i] = filepath.Base(f)
+		}
+		return files
+	}
+	now := time.Now()
+
+	t.Run("files", func(t *testing.T) {
+		d := newTestDebugDumper(t, debugDumpOptions{maxFiles: 2})
+		write(d, "a", now.Add(-3*time.Minute))
+		write(d, "b", now.Add(-2*time.Minute))
+		write(d, "c", now.Add(-time.Minute))
+		assert.Equal(t, []string{"none_b_CreateContainer.yaml", "none_c_CreateContainer.yaml"}, dumps(d))
+	})
+
+	t.Run("size", func(t *testing.T) {
+		d := newTestDebugDumper(t, debugDumpOptions{maxSize: 1})
+		write(d, "a", now.Add(-2*time.Minute))
+		write(d, "b", now.Add(-time.Minute))
+		// the latest dump is kept even if larger
+		assert.Equal(t, []string{"none_b_CreateContainer.yaml"}, dumps(d))
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := newDebugDumper(debugDumpOptions{dir: t.TempDir(), maxFiles: 0, maxSize: 1})
+		assert.Error(t, err)
+		_, err = newDebugDumper(debugDumpOptions{dir: t.TempDir(), maxFiles: 1, maxSize: -1})
+		assert.Error(t, err)
+	})
+}
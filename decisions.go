@@ -0,0 +1,115 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	decisionAdjusted = "adjusted"
+	decisionDryRun   = "dry-run"
+	decisionSkipped  = "skipped"
+	decisionFailed   = "failed"
+)
+
+// decision is what the plugin decided for a container, kept in memory for
+// the debug API.
+type decision struct {
+	Time      time.Time `json:"time"`
+	Container string    `json:"container"`
+	Decision  string    `json:"decision"`
+	Reason    string    `json:"reason,omitempty"`
+	Summary   string    `json:"summary,omitempty"`
+}
+
+// decisionRing keeps the most recent decisions, dropping the oldest ones
+// once it is full. A size of 0 keeps none.
+type decisionRing struct {
+	mu      sync.Mutex
+	entries []decision
+	// next is where the next decision goes once the ring is full.
+	next int
+	size int
+}
+
+func newDecisionRing(size int) *decisionRing {
+	return &decisionRing{size: size}
+}
+
+func (r *decisionRing) add(d decision) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.size == 0 {
+		return
+	}
+	if len(r.entries) < r.size {
+		r.entries = append(r.entries, d)
+		return
+	}
+	r.entries[r.next] = d
+	r.next = (r.next + 1) % r.size
+}
+
+// list returns the decisions, the most recent first.
+func (r *decisionRing) list() []decision {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.listLocked()
+}
+
+func (r *decisionRing) listLocked() []decision {
+	decisions := make([]decision, 0, len(r.entries))
+	for i := len(r.entries) - 1; i >= 0; i-- {
+		decisions = append(decisions, r.entries[(r.next+i)%len(r.entries)])
+	}
+	return decisions
+}
+
+// resize changes the size of the ring, keeping the most recent decisions
+// which still fit.
+func (r *decisionRing) resize(size int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if size == r.size {
+		return
+	}
+	recent := r.listLocked()
+	if len(recent) > size {
+		recent = recent[:size]
+	}
+	r.entries = make([]decision, 0, size)
+	for i := len(recent) - 1; i >= 0; i-- {
+		r.entries = append(r.entries, recent[i])
+	}
+	r.next = 0
+	r.size = size
+}
+
+// decide records a decision for the container.
+func (p *plugin) decide(ctrName, what, reason, summary string) {
+	p.recent.add(decision{
+		Time:      time.Now().UTC(),
+		Container: ctrName,
+		Decision:  what,
+		Reason:    reason,
+		Summary:   summary,
+	})
+}
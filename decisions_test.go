@@ -0,0 +1,96 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecisionRing(t *testing.T) {
+	containers := func(decisions []decision) []string {
+		names := []string{}
+		for _, d := range decisions {
+			names = append(names, d.Container)
+		}
+		return names
+	}
+	fill := func(r *decisionRing, n int) {
+		for i := 1; i <= n; i++ {
+			r.add(decision{Container: fmt.Sprintf("c%d", i)})
+		}
+	}
+
+	r := newDecisionRing(3)
+	assert.Empty(t, r.list())
+	fill(r, 2)
+	assert.Equal(t, []string{"c2", "c1"}, containers(r.list()))
+	fill(r, 5)
+	assert.Equal(t, []string{"c5", "c4", "c3"}, containers(r.list()))
+
+	r.resize(2)
+	assert.Equal(t, []string{"c5", "c4"}, containers(r.list()))
+	r.resize(4)
+	r.add(decision{Container: "c6"})
+	r.add(decision{Container: "c7"})
+	r.add(decision{Container: "c8"})
+	assert.Equal(t, []string{"c8", "c7", "c6", "c5"}, containers(r.list()))
+
+	r.resize(0)
+	r.add(decision{Container: "c9"})
+	assert.Empty(t, r.list())
+
+	r = newDecisionRing(10)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			fill(r, 100)
+			r.list()
+		}()
+	}
+	wg.Wait()
+	assert.Len(t, r.list(), 10)
+}
+
+func TestRecentDecisions(t *testing.T) {
+	p := newTestPlugin(nil)
+
+	_, _, err := p.CreateContainer(context.Background(), nil, newProfileTestContainer(nil))
+	require.NoError(t, err)
+	other := newProfileTestContainer(nil)
+	other.Args = []string{"/bin/app"}
+	_, _, err = p.CreateContainer(context.Background(), nil, other)
+	require.NoError(t, err)
+
+	var recent []decision
+	require.Equal(t, http.StatusOK, debugRequest(t, p, http.MethodGet, "/recent", 1000, &recent))
+	require.Len(t, recent, 2)
+	assert.Equal(t, decisionSkipped, recent[0].Decision)
+	assert.Equal(t, "not a systemd container", recent[0].Reason)
+	assert.Equal(t, decisionAdjusted, recent[1].Decision)
+	assert.Equal(t, "entrypoint", recent[1].Reason)
+	assert.Equal(t, "cgroup,tmpfs,env", recent[1].Summary)
+	assert.False(t, recent[1].Time.IsZero())
+}
@@ -0,0 +1,141 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// runDriftChecks checks the tracked containers for drift every
+// driftCheckInterval until the context is done.
+func (p *plugin) runDriftChecks(ctx context.Context) {
+	for {
+		interval := p.config().DriftCheckInterval.Duration()
+		if interval <= 0 {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+
+		if err := p.checkDrift(ctx); err != nil && ctx.Err() == nil {
+			p.stateLog.Warnf("drift check failed: %v", err)
+		}
+	}
+}
+
+// checkDrift probes the host again, checks the files rendered for and the
+// cgroup controllers of the tracked containers and the host sysctls, and
+// reports the containers which drifted. With autoRepair, missing files are
+// rendered again, and with manageHostSysctls, sysctls are raised. The
+// check is bounded by hookTimeout, since it uses the same probes as the
+// hooks.
+func (p *plugin) checkDrift(ctx context.Context) error {
+	cfg := p.config()
+	ctx, cancel := context.WithTimeout(ctx, cfg.HookTimeout.Duration())
+	defer cancel()
+
+	if _, err := p.reprobe(ctx); err != nil {
+		return fmt.Errorf("failed to probe the host: %w", err)
+	}
+
+	for _, s := range p.state.list() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		drift := p.checkArtifacts(ctx, cfg, s)
+		missing, err := p.missingControllers(ctx, cfg, s.container, s.name)
+		if err != nil {
+			p.stateLog.Debugf("%s: failed to check cgroup controllers: %v", s.name, err)
+			missing = s.missingControllers
+		} else if len(missing) > 0 {
+			drift = append(drift, fmt.Sprintf("cgroup controllers %s are missing", strings.Join(missing, ",")))
+		}
+		if !slices.Equal(drift, s.artifactDrift) {
+			for _, d := range drift {
+				p.stateLog.Warnf("%s: %s", s.name, d)
+			}
+		}
+		p.state.update(s.id, func(updated *containerState) {
+			updated.artifactDrift = drift
+			updated.missingControllers = missing
+		})
+	}
+
+	p.reportSysctls(p.checkSysctls(ctx, cfg, cfg.ManageHostSysctls))
+
+	report, err := p.reconcile(ctx)
+	if err != nil {
+		return err
+	}
+	p.metrics.drifted.Set(float64(report.Drifted))
+
+	return nil
+}
+
+// checkArtifacts returns what is wrong with the files rendered for the
+// container, repairing it with autoRepair.
+func (p *plugin) checkArtifacts(ctx context.Context, cfg *Config, s *containerState) []string {
+	var drift []string
+	for _, kind := range s.rendered {
+		dir, err := renderedDir(cfg, kind, s.id)
+		if err != nil {
+			drift = append(drift, err.Error())
+			continue
+		}
+		if _, err := os.Stat(dir); err == nil {
+			continue
+		} else if !os.IsNotExist(err) {
+			drift = append(drift, fmt.Sprintf("failed to check rendered %s directory %s: %v", kind, dir, err))
+			continue
+		}
+
+		if cfg.AutoRepair {
+			if err := p.renderAgain(ctx, cfg, s, kind); err != nil {
+				p.stateLog.Warnf("%s: failed to render %s again: %v", s.name, dir, err)
+			} else {
+				p.stateLog.Infof("%s: rendered missing %s directory %s again", s.name, kind, dir)
+				p.metrics.repairs.Inc()
+				continue
+			}
+		}
+		drift = append(drift, fmt.Sprintf("rendered %s directory %s is missing", kind, dir))
+	}
+	return drift
+}
+
+// renderAgain renders the files of the given kind for the container again,
+// from the pod and container it was adjusted for.
+func (p *plugin) renderAgain(ctx context.Context, cfg *Config, s *containerState, kind string) error {
+	r, ok := rendererOf(kind)
+	if !ok || s.container == nil {
+		return fmt.Errorf("no way to render %s", kind)
+	}
+	cfg, container, err := applyConfigAnnotation(cfg, s.pod, s.container)
+	if err != nil {
+		return err
+	}
+	return r.render(ctx, cfg, s.pod, container)
+}
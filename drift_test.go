@@ -0,0 +1,96 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDriftCheck(t *testing.T) {
+	stateDir := t.TempDir()
+	p := newTestPlugin(configWith(func(c *Config) {
+		c.StateDir = stateDir
+		c.AllowedUnits = []string{"*"}
+	}))
+
+	container := newProfileTestContainer(map[string]string{enableUnitsAnnotation: "sshd.service"})
+	_, _, err := p.CreateContainer(context.Background(), nil, container)
+	require.NoError(t, err)
+	dir := filepath.Join(stateDir, renderedUnits, container.Id)
+	require.DirExists(t, dir)
+
+	require.NoError(t, p.checkDrift(context.Background()))
+	assert.Empty(t, p.state.list()[0].artifactDrift)
+	assert.Equal(t, 0.0, testutil.ToFloat64(p.metrics.drifted))
+
+	// someone cleans up the state directory
+	require.NoError(t, os.RemoveAll(filepath.Join(stateDir, renderedUnits)))
+
+	require.NoError(t, p.checkDrift(context.Background()))
+	assert.Equal(t, []string{"rendered units directory " + dir + " is missing"}, p.state.list()[0].artifactDrift)
+	assert.Equal(t, 1.0, testutil.ToFloat64(p.metrics.drifted))
+	report, err := p.reconcile(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 1, report.Drifted)
+
+	require.NoError(t, p.setConfig(configWith(func(c *Config) {
+		c.StateDir = stateDir
+		c.AllowedUnits = []string{"*"}
+		c.AutoRepair = true
+	})))
+	require.NoError(t, p.checkDrift(context.Background()))
+	assert.Empty(t, p.state.list()[0].artifactDrift)
+	assert.Equal(t, 0.0, testutil.ToFloat64(p.metrics.drifted))
+	assert.Equal(t, 1.0, testutil.ToFloat64(p.metrics.repairs))
+	assert.Contains(t, readLinks(t, filepath.Join(dir, "multi-user.target.wants")), "sshd.service")
+}
+
+func TestDriftCheckLoop(t *testing.T) {
+	p := newTestPlugin(configWith(func(c *Config) { c.DriftCheckInterval = Duration(time.Millisecond) }))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		p.runDriftChecks(ctx)
+		close(done)
+	}()
+
+	// the loop probes the host on every check
+	first := p.hostInfo.Load()
+	require.Eventually(t, func() bool {
+		return p.hostInfo.Load() != first
+	}, time.Second, time.Millisecond)
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("drift check loop did not stop")
+	}
+
+	// without an interval, there is no loop
+	p = newTestPlugin(nil)
+	p.runDriftChecks(context.Background())
+}
@@ -0,0 +1,254 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/containerd/nri/pkg/api"
+)
+
+const (
+	// dropInAnnotationPrefix prefixes annotations injecting a systemd
+	// drop-in, whose value is the content of the drop-in. The rest of the
+	// key names it as <dir>.d/<file>.conf, relative to /etc/systemd, like
+	// system.conf.d/50-custom.conf or myservice.service.d/override.conf
+	// for /etc/systemd/system/myservice.service.d. Kubernetes does not
+	// allow a second slash in annotation keys, so the directory may also
+	// be separated by an underscore, as in system.conf.d_50-custom.conf.
+	// Set on the pod, a drop-in applies to all containers of the pod
+	// without their own annotation with the same key.
+	dropInAnnotationPrefix = "io.systemd.container/dropin."
+
+	// dropInRoot is the directory all drop-ins are mounted below.
+	dropInRoot = "/etc/systemd"
+)
+
+var (
+	// confDropInDir matches drop-in directories of systemd configuration
+	// files, like system.conf.d or journald.conf.d.
+	confDropInDir = regexp.MustCompile(`^[a-z][a-z-]*\.conf\.d$`)
+
+	// dropInFile matches the names of drop-ins, which systemd only reads
+	// with a .conf suffix.
+	dropInFile = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9:_.@-]*\.conf$`)
+)
+
+// dropIn is a drop-in rendered for a container.
+type dropIn struct {
+	// dir is the directory of the drop-in relative to /etc/systemd, e.g.
+	// system.conf.d or system/myservice.service.d.
+	dir     string
+	name    string
+	content string
+
+	// source is the annotation selecting the drop-in.
+	source string
+}
+
+func (d dropIn) path() string {
+	return path.Join(d.dir, d.name)
+}
+
+// parseDropInTarget returns the directory relative to /etc/systemd and the
+// file name of the drop-in named by the rest of an annotation key.
+func parseDropInTarget(name string) (string, string, error) {
+	i := strings.Index(name, ".d/")
+	if i < 0 {
+		i = strings.Index(name, ".d_")
+	}
+	if i < 0 {
+		return "", "", fmt.Errorf("invalid drop-in %q, must be <dir>.d/<file>.conf", name)
+	}
+	dir, file := name[:i+2], name[i+3:]
+
+	switch {
+	case confDropInDir.MatchString(dir):
+	case unitName.MatchString(strings.TrimSuffix(dir, ".d")) && len(dir) <= 255:
+		dir = path.Join("system", dir)
+	default:
+		return "", "", fmt.Errorf("invalid drop-in directory %q, must be a unit or configuration file followed by .d", dir)
+	}
+	if !dropInFile.MatchString(file) || len(file) > 255 {
+		return "", "", fmt.Errorf("invalid drop-in file name %q, must end with .conf", file)
+	}
+
+	// the patterns exclude them already, but never leave /etc/systemd
+	target := path.Join(dropInRoot, dir, file)
+	if target != dropInRoot+"/"+dir+"/"+file || !strings.HasPrefix(target, dropInRoot+"/") {
+		return "", "", fmt.Errorf("invalid drop-in %q, must be below %s", name, dropInRoot)
+	}
+	return dir, file, nil
+}
+
+// dropInAnnotations returns the drop-in annotations of the container and
+// its pod, with those of the container taking precedence.
+func dropInAnnotations(pod *api.PodSandbox, container *api.Container) map[string]string {
+	annotations := map[string]string{}
+	if pod != nil {
+		for key, value := range pod.Annotations {
+			if strings.HasPrefix(key, dropInAnnotationPrefix) {
+				annotations[key] = value
+			}
+		}
+	}
+	for key, value := range container.Annotations {
+		if strings.HasPrefix(key, dropInAnnotationPrefix) {
+			annotations[key] = value
+		}
+	}
+	return annotations
+}
+
+// hasDropInAnnotations tells whether the container might select drop-ins.
+func hasDropInAnnotations(pod *api.PodSandbox, container *api.Container) bool {
+	if _, ok := lookupAnnotation(pod, container, runtimeWatchdogAnnotation); ok {
+		return true
+	}
+	if pod != nil && hasAnnotationPrefix(pod.Annotations, dropInAnnotationPrefix) {
+		return true
+	}
+	return hasAnnotationPrefix(container.Annotations, dropInAnnotationPrefix)
+}
+
+func hasAnnotationPrefix(annotations map[string]string, prefix string) bool {
+	for key := range annotations {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// selectDropIns returns the drop-ins selected by the annotations of the
+// container, sorted by path, nil if there are none. Besides the generic
+// drop-in annotations, these are the drop-ins of specific annotations like
+// the runtime watchdog.
+func selectDropIns(cfg *Config, pod *api.PodSandbox, container *api.Container) ([]dropIn, error) {
+	var dropIns []dropIn
+
+	watchdog, err := runtimeWatchdogDropIn(pod, container)
+	if err != nil {
+		return nil, err
+	}
+	if watchdog != nil {
+		dropIns = append(dropIns, *watchdog)
+	}
+
+	annotations := dropInAnnotations(pod, container)
+	if len(annotations) > 0 && cfg.DisableDropIns {
+		return nil, fmt.Errorf("%s annotations are not allowed, disableDropIns is set", dropInAnnotationPrefix+"*")
+	}
+	for key, value := range annotations {
+		dir, file, err := parseDropInTarget(strings.TrimPrefix(key, dropInAnnotationPrefix))
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s annotation: %w", key, err)
+		}
+		if len(value) > cfg.MaxDropInSize {
+			return nil, fmt.Errorf("%s annotation has %d bytes, more than maxDropInSize (%d)", key, len(value), cfg.MaxDropInSize)
+		}
+		dropIns = append(dropIns, dropIn{dir: dir, name: file, content: value, source: key})
+	}
+
+	slices.SortFunc(dropIns, func(a, b dropIn) int {
+		return strings.Compare(a.path(), b.path())
+	})
+	total := 0
+	for i, d := range dropIns {
+		if i > 0 && dropIns[i-1].path() == d.path() {
+			return nil, fmt.Errorf("drop-in %s selected by both %s and %s annotations", d.path(), dropIns[i-1].source, d.source)
+		}
+		total += len(d.content)
+	}
+	if total > cfg.MaxDropInsSize {
+		return nil, fmt.Errorf("drop-ins have %d bytes, more than maxDropInsSize (%d)", total, cfg.MaxDropInsSize)
+	}
+
+	return dropIns, nil
+}
+
+// dropInDirs returns the directories of the drop-ins, in order.
+func dropInDirs(dropIns []dropIn) []string {
+	var dirs []string
+	for _, d := range dropIns {
+		if !slices.Contains(dirs, d.dir) {
+			dirs = append(dirs, d.dir)
+		}
+	}
+	return dirs
+}
+
+// addDropInsMount mounts the rendered drop-ins of the container, if it
+// selects any. Every drop-in directory is mounted read-only at its place
+// below /etc/systemd, hiding the drop-ins of the image in that directory
+// only.
+func (p *plugin) addDropInsMount(cfg *Config, adjust *api.ContainerAdjustment, pod *api.PodSandbox, container *api.Container, ctrName string) error {
+	dropIns, err := selectDropIns(cfg, pod, container)
+	if err != nil || len(dropIns) == 0 {
+		return err
+	}
+	dir, err := renderedDir(cfg, renderedDropIns, container.Id)
+	if err != nil {
+		return err
+	}
+
+	for _, d := range dropInDirs(dropIns) {
+		adjust.AddMount(&api.Mount{
+			Destination: path.Join(dropInRoot, d),
+			Type:        "bind",
+			Source:      filepath.Join(dir, d),
+			Options:     []string{"rbind", "ro", "nosuid", "nodev"},
+		})
+	}
+	for _, d := range dropIns {
+		p.mountLog.Debugf("%s: adding drop-in %s", ctrName, path.Join(dropInRoot, d.path()))
+	}
+
+	return nil
+}
+
+// renderDropIns renders the drop-ins selected by the container, replacing
+// an earlier rendering.
+func renderDropIns(ctx context.Context, cfg *Config, pod *api.PodSandbox, container *api.Container) error {
+	dropIns, err := selectDropIns(cfg, pod, container)
+	if err != nil || len(dropIns) == 0 {
+		return err
+	}
+	dir, err := renderedDir(cfg, renderedDropIns, container.Id)
+	if err != nil {
+		return err
+	}
+
+	return renderDir(ctx, dir, func(tmp string) error {
+		for _, d := range dropIns {
+			if err := os.MkdirAll(filepath.Join(tmp, d.dir), 0o755); err != nil {
+				return fmt.Errorf("failed to render drop-in %s: %w", d.path(), err)
+			}
+			if err := os.WriteFile(filepath.Join(tmp, d.dir, d.name), []byte(d.content), 0o644); err != nil {
+				return fmt.Errorf("failed to render drop-in %s: %w", d.path(), err)
+			}
+		}
+		return nil
+	})
+}
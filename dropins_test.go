@@ -0,0 +1,190 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/containerd/nri/pkg/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseDropInTarget(t *testing.T) {
+	for name, expected := range map[string]string{
+		"system.conf.d/50-custom.conf":            "system.conf.d/50-custom.conf",
+		"system.conf.d_50-custom.conf":            "system.conf.d/50-custom.conf",
+		"journald.conf.d/10-storage.conf":         "journald.conf.d/10-storage.conf",
+		"myservice.service.d/override.conf":       "system/myservice.service.d/override.conf",
+		"getty@.service.d_autologin.conf":         "system/getty@.service.d/autologin.conf",
+		"user.slice.d/limits.d_with_suffix.conf":  "system/user.slice.d/limits.d_with_suffix.conf",
+		"multi-user.target.d/50-wants.conf":       "system/multi-user.target.d/50-wants.conf",
+		"logind.conf.d/50-no-idle-action.conf":    "logind.conf.d/50-no-idle-action.conf",
+		"system.conf.d/50-my.custom.setting.conf": "system.conf.d/50-my.custom.setting.conf",
+	} {
+		dir, file, err := parseDropInTarget(name)
+		if assert.NoError(t, err, name) {
+			assert.Equal(t, expected, dir+"/"+file, name)
+		}
+	}
+
+	for _, name := range []string{
+		"",
+		"50-custom.conf",
+		"system.conf.d/",
+		"system.conf.d/50-custom",
+		"system.conf.d/.conf",
+		"system.conf.d/../../shadow.conf",
+		"system.conf.d/sub/50-custom.conf",
+		"../system.conf.d/50-custom.conf",
+		"..d/50-custom.conf",
+		"system.conf.d/..conf",
+		"System.Conf.d/50-custom.conf",
+		"myservice.d/override.conf",
+		"myservice.service/override.conf",
+		"/etc/systemd/system.conf.d/50-custom.conf",
+	} {
+		_, _, err := parseDropInTarget(name)
+		assert.Error(t, err, name)
+	}
+}
+
+func TestDropIns(t *testing.T) {
+	newPlugin := func(fn func(*Config)) *plugin {
+		return newTestPlugin(configWith(func(c *Config) {
+			c.StateDir = t.TempDir()
+			if fn != nil {
+				fn(c)
+			}
+		}))
+	}
+
+	t.Run("rendered", func(t *testing.T) {
+		p := newPlugin(nil)
+		pod := &api.PodSandbox{Annotations: map[string]string{
+			dropInAnnotationPrefix + "journald.conf.d_10-storage.conf": "[Journal]\nStorage=volatile\n",
+			dropInAnnotationPrefix + "system.conf.d/60-custom.conf":    "[Manager]\nDefaultTimeoutStopSec=10s\n",
+		}}
+		container := newProfileTestContainer(map[string]string{
+			dropInAnnotationPrefix + "system.conf.d/60-custom.conf":      "[Manager]\nDefaultTimeoutStopSec=5s\n",
+			dropInAnnotationPrefix + "myservice.service.d/override.conf": "[Service]\nRestart=always\n",
+			runtimeWatchdogAnnotation:                                    "30s",
+		})
+
+		adjust, _, err := p.CreateContainer(context.Background(), pod, container)
+		require.NoError(t, err)
+		assert.Equal(t, "cgroup,tmpfs,env,drop-ins", adjust.Annotations[provenanceAnnotation])
+
+		dir := filepath.Join(p.config().StateDir, "drop-ins", container.Id)
+		for _, d := range []string{"journald.conf.d", "system.conf.d", "system/myservice.service.d"} {
+			assert.Equal(t, &api.Mount{
+				Destination: "/etc/systemd/" + d,
+				Type:        "bind",
+				Source:      filepath.Join(dir, d),
+				Options:     []string{"rbind", "ro", "nosuid", "nodev"},
+			}, findMount(adjust.Mounts, "/etc/systemd/"+d), d)
+		}
+		assert.Nil(t, findMount(adjust.Mounts, "/etc/systemd/system"))
+
+		for file, expected := range map[string]string{
+			"journald.conf.d/10-storage.conf":          "[Journal]\nStorage=volatile\n",
+			"system.conf.d/50-runtime-watchdog.conf":   "[Manager]\nRuntimeWatchdogSec=30s\nShutdownWatchdogSec=30s\n",
+			"system.conf.d/60-custom.conf":             "[Manager]\nDefaultTimeoutStopSec=5s\n",
+			"system/myservice.service.d/override.conf": "[Service]\nRestart=always\n",
+		} {
+			content, err := os.ReadFile(filepath.Join(dir, file))
+			if assert.NoError(t, err, file) {
+				assert.Equal(t, expected, string(content), file)
+			}
+		}
+
+		require.NoError(t, p.RemoveContainer(context.Background(), pod, container))
+		assert.NoDirExists(t, dir)
+	})
+
+	t.Run("duplicate", func(t *testing.T) {
+		p := newPlugin(nil)
+		container := newProfileTestContainer(map[string]string{
+			dropInAnnotationPrefix + "system.conf.d/50-runtime-watchdog.conf": "[Manager]\n",
+			runtimeWatchdogAnnotation: "30s",
+		})
+
+		_, _, err := p.CreateContainer(context.Background(), nil, container)
+		assert.ErrorContains(t, err, "selected by both")
+		assert.NoDirExists(t, filepath.Join(p.config().StateDir, "drop-ins"))
+	})
+
+	t.Run("invalid target", func(t *testing.T) {
+		p := newPlugin(nil)
+		container := newProfileTestContainer(map[string]string{
+			dropInAnnotationPrefix + "system.conf.d/../../passwd.conf": "root::0:0::/root:/bin/sh\n",
+		})
+
+		_, _, err := p.CreateContainer(context.Background(), nil, container)
+		assert.Error(t, err)
+		assert.NoDirExists(t, filepath.Join(p.config().StateDir, "drop-ins"))
+	})
+
+	t.Run("size limits", func(t *testing.T) {
+		p := newPlugin(func(c *Config) {
+			c.MaxDropInSize = 16
+			c.MaxDropInsSize = 24
+		})
+
+		container := newProfileTestContainer(map[string]string{
+			dropInAnnotationPrefix + "system.conf.d/50-a.conf": strings.Repeat("#", 17),
+		})
+		_, _, err := p.CreateContainer(context.Background(), nil, container)
+		assert.ErrorContains(t, err, "maxDropInSize")
+
+		container = newProfileTestContainer(map[string]string{
+			dropInAnnotationPrefix + "system.conf.d/50-a.conf": strings.Repeat("#", 16),
+			dropInAnnotationPrefix + "system.conf.d/50-b.conf": strings.Repeat("#", 16),
+		})
+		_, _, err = p.CreateContainer(context.Background(), nil, container)
+		assert.ErrorContains(t, err, "maxDropInsSize")
+
+		container = newProfileTestContainer(map[string]string{
+			dropInAnnotationPrefix + "system.conf.d/50-a.conf": strings.Repeat("#", 16),
+			dropInAnnotationPrefix + "system.conf.d/50-b.conf": strings.Repeat("#", 8),
+		})
+		_, _, err = p.CreateContainer(context.Background(), nil, container)
+		assert.NoError(t, err)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		p := newPlugin(func(c *Config) {
+			c.DisableDropIns = true
+		})
+
+		container := newProfileTestContainer(map[string]string{
+			dropInAnnotationPrefix + "system.conf.d/50-custom.conf": "[Manager]\n",
+		})
+		_, _, err := p.CreateContainer(context.Background(), nil, container)
+		assert.ErrorContains(t, err, "disableDropIns")
+		assert.NoDirExists(t, filepath.Join(p.config().StateDir, "drop-ins"))
+
+		container = newProfileTestContainer(map[string]string{runtimeWatchdogAnnotation: "30s"})
+		adjust, _, err := p.CreateContainer(context.Background(), nil, container)
+		require.NoError(t, err)
+		assert.NotNil(t, findMount(adjust.Mounts, "/etc/systemd/system.conf.d"))
+	})
+}
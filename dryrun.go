@@ -0,0 +1,84 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/containerd/nri/pkg/api"
+)
+
+// Actions of mount results.
+const (
+	mountAdded    = "add"
+	mountSkipped  = "skip"
+	mountModified = "modify"
+)
+
+// mountResult tells what adjusting a container does at a destination, and
+// why.
+type mountResult struct {
+	Destination string `json:"destination"`
+	Action      string `json:"action"`
+	Reason      string `json:"reason"`
+}
+
+// mountResults collects the mount results of adjusting a container. A nil
+// collection discards them.
+type mountResults struct {
+	results []mountResult
+}
+
+func (r *mountResults) add(dest, action, format string, args ...interface{}) {
+	if r == nil {
+		return
+	}
+	r.results = append(r.results, mountResult{
+		Destination: dest,
+		Action:      action,
+		Reason:      fmt.Sprintf(format, args...),
+	})
+}
+
+// exclude turns the results at destinations excluded by the configuration
+// into skips, since excludeMounts drops their adjustments.
+func (r *mountResults) exclude(cfg *Config) {
+	if r == nil {
+		return
+	}
+	for i, res := range r.results {
+		if res.Action == mountSkipped {
+			continue
+		}
+		if pattern, ok := cfg.excludedMount(res.Destination); ok {
+			r.results[i] = mountResult{
+				Destination: res.Destination,
+				Action:      mountSkipped,
+				Reason:      fmt.Sprintf("excluded by excludeMounts (%s)", pattern),
+			}
+		}
+	}
+}
+
+// newDryRunEvent describes how a systemd container would be adjusted,
+// with the results per mount destination.
+func newDryRunEvent(s *containerState, reason string, adjust *api.ContainerAdjustment, results *mountResults) *event {
+	e := newAdjustedEvent(s, reason, adjust)
+	e.Event = eventDryRun
+	e.MountResults = results.results
+	return e
+}
@@ -0,0 +1,124 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/containerd/nri/pkg/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDryRun(t *testing.T) {
+	var out bytes.Buffer
+	p := newCgroupV1TestPlugin(configWith(func(c *Config) {
+		c.ExcludeMounts = []string{"/var/log/journal"}
+		c.StateDir = t.TempDir()
+		c.AllowedUnits = []string{"sshd.service"}
+	}))
+	p.dryRun = newEventWriter(&out)
+	p.events = newEventWriter(&out)
+
+	container := newProfileTestContainer(map[string]string{enableUnitsAnnotation: "sshd.service"},
+		&api.Mount{Destination: "/tmp", Type: "bind", Source: "/data/tmp", Options: []string{"rbind", "rw"}},
+		&api.Mount{Destination: "/run/lock", Type: "tmpfs", Source: "tmpfs", Options: []string{"ro"}},
+	)
+	adjust, updates, err := p.CreateContainer(context.Background(), nil, container)
+	require.NoError(t, err)
+	assert.Nil(t, adjust)
+	assert.Nil(t, updates)
+
+	// nothing rendered, recorded or emitted
+	assert.NoDirExists(t, p.config().StateDir+"/units")
+	assert.Empty(t, p.state.list())
+
+	var e event
+	require.NoError(t, json.Unmarshal(out.Bytes(), &e))
+	assert.Equal(t, "dry-run", e.Event)
+	assert.Equal(t, []mountResult{
+		{"/sys/fs/cgroup", "skip", "left read-only; only the name=systemd hierarchy needs to be writable on cgroup v1"},
+		{"/sys/fs/cgroup/systemd", "add", "name=systemd hierarchy needed on cgroup v1 hosts"},
+		{"/run", "add", "tmpfs needed by systemd"},
+		{"/run/lock", "skip", "mounted read-only by the container, replaceReadOnlyMounts is off"},
+		{"/tmp", "skip", "already mounted by the container"},
+		{"/var/log/journal", "skip", "excluded by excludeMounts (/var/log/journal)"},
+	}, e.MountResults)
+	assert.Contains(t, e.Mounts, "/run/systemd/system")
+}
+
+func TestDryRunMountResults(t *testing.T) {
+	tests := []struct {
+		name      string
+		newPlugin func(*Config) *plugin
+		config    func(*Config)
+		container *api.Container
+		expected  []mountResult
+	}{
+		{
+			name:      "cgroup already writable",
+			newPlugin: newTestPlugin,
+			container: &api.Container{
+				Args: []string{"/sbin/init"},
+				Mounts: []*api.Mount{
+					{Destination: "/sys/fs/cgroup", Type: "cgroup2", Source: "cgroup", Options: []string{"rw"}},
+				},
+			},
+			config: func(c *Config) { c.RuntimeTmpfs = true },
+			expected: []mountResult{
+				{"/sys/fs/cgroup", "skip", "already writable"},
+				{"/run", "skip", "left to the runtime (runtimeTmpfs)"},
+				{"/run/lock", "skip", "left to the runtime (runtimeTmpfs)"},
+				{"/tmp", "skip", "left to the runtime (runtimeTmpfs)"},
+				{"/var/log/journal", "skip", "left to the runtime (runtimeTmpfs)"},
+			},
+		},
+		{
+			name:      "cgroup kept by profile, read-only mount replaced",
+			newPlugin: newTestPlugin,
+			container: newProfileTestContainer(map[string]string{profileAnnotation: profileRootless},
+				&api.Mount{Destination: "/run", Type: "tmpfs", Source: "tmpfs", Options: []string{"ro"}},
+			),
+			config: func(c *Config) { c.ReplaceReadOnlyMounts = true },
+			expected: []mountResult{
+				{"/sys/fs/cgroup", "skip", "profile rootless keeps the cgroup mount of the runtime"},
+				{"/run", "modify", "read-only mount replaced with a tmpfs"},
+				{"/run/lock", "add", "tmpfs needed by systemd"},
+				{"/tmp", "add", "tmpfs needed by systemd"},
+				{"/var/log/journal", "add", "tmpfs needed by systemd"},
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var out bytes.Buffer
+			p := tc.newPlugin(configWith(tc.config))
+			p.dryRun = newEventWriter(&out)
+
+			_, _, err := p.CreateContainer(context.Background(), nil, tc.container)
+			require.NoError(t, err)
+
+			var e event
+			require.NoError(t, json.Unmarshal(out.Bytes(), &e))
+			assert.ElementsMatch(t, tc.expected, e.MountResults)
+		})
+	}
+}
@@ -0,0 +1,131 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/containerd/nri/pkg/api"
+)
+
+const (
+	eventAdjusted = "adjusted"
+	eventDryRun   = "dry-run"
+)
+
+// event describes something the plugin did to a container. Events are
+// written to the audit log and to stdout, one JSON object per line. The
+// fields are a stable interface for log collectors: fields may be added,
+// but are never renamed or removed.
+type event struct {
+	Event         string    `json:"event"`
+	Time          time.Time `json:"time"`
+	ContainerID   string    `json:"containerId"`
+	Container     string    `json:"container"`
+	Namespace     string    `json:"namespace,omitempty"`
+	Profile       string    `json:"profile,omitempty"`
+	Reason        string    `json:"reason,omitempty"`
+	Mounts        []string  `json:"mounts,omitempty"`
+	RemovedMounts []string  `json:"removedMounts,omitempty"`
+	Env           []string  `json:"env,omitempty"`
+	Devices       []string  `json:"devices,omitempty"`
+
+	// Node and the runtime identify where the container was adjusted.
+	Node           string `json:"node,omitempty"`
+	Runtime        string `json:"runtime,omitempty"`
+	RuntimeVersion string `json:"runtimeVersion,omitempty"`
+
+	// MountResults are only reported in dry-run mode.
+	MountResults []mountResult `json:"mountResults,omitempty"`
+}
+
+// newAdjustedEvent summarizes the adjustment of a systemd container,
+// detected as such for the given reason.
+func newAdjustedEvent(s *containerState, reason string, adjust *api.ContainerAdjustment) *event {
+	e := &event{
+		Event:       eventAdjusted,
+		Time:        time.Now().UTC(),
+		ContainerID: s.id,
+		Container:   s.name,
+		Namespace:   s.namespace,
+		Profile:     s.profile,
+		Reason:      reason,
+	}
+	for _, m := range adjust.Mounts {
+		if dest, removed := api.IsMarkedForRemoval(m.Destination); removed {
+			e.RemovedMounts = append(e.RemovedMounts, dest)
+		} else {
+			e.Mounts = append(e.Mounts, dest)
+		}
+	}
+	for _, env := range adjust.Env {
+		e.Env = append(e.Env, env.Key)
+	}
+	if adjust.Linux != nil {
+		for _, d := range adjust.Linux.Devices {
+			e.Devices = append(e.Devices, d.Path)
+		}
+	}
+	return e
+}
+
+func (e *event) marshal() ([]byte, error) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// eventWriter writes events to a stream, e.g. stdout.
+type eventWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func newEventWriter(w io.Writer) *eventWriter {
+	return &eventWriter{w: w}
+}
+
+func (ew *eventWriter) write(e *event) error {
+	data, err := e.marshal()
+	if err != nil {
+		return err
+	}
+
+	ew.mu.Lock()
+	defer ew.mu.Unlock()
+	_, err = ew.w.Write(data)
+	return err
+}
+
+// emit writes the event to the enabled event streams.
+func (p *plugin) emit(e *event) {
+	if p.audit != nil {
+		if err := p.audit.write(e); err != nil {
+			p.log.Warnf("%s: failed to write audit log: %v", e.Container, err)
+		}
+	}
+	if p.events != nil {
+		if err := p.events.write(e); err != nil {
+			p.log.Warnf("%s: failed to write event: %v", e.Container, err)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/containerd/nri/pkg/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEvents(t *testing.T) {
+	var out bytes.Buffer
+	p := newTestPlugin(configWith(func(c *Config) { c.Profile = profileNestedRuntime }))
+	p.events = newEventWriter(&out)
+
+	pod := &api.PodSandbox{Name: "pod", Namespace: "default"}
+	container := newProfileTestContainer(nil)
+	container.Id = "c1"
+	_, _, err := p.CreateContainer(context.Background(), pod, container)
+	require.NoError(t, err)
+
+	// not a systemd container
+	_, _, err = p.CreateContainer(context.Background(), pod, &api.Container{Id: "c2", Args: []string{"/bin/sh"}})
+	require.NoError(t, err)
+
+	lines := bytes.Split(bytes.TrimSuffix(out.Bytes(), []byte("\n")), []byte("\n"))
+	require.Len(t, lines, 1)
+
+	var e map[string]any
+	require.NoError(t, json.Unmarshal(lines[0], &e))
+	assert.NotEmpty(t, e["time"])
+	delete(e, "time")
+
+	assert.Equal(t, map[string]any{
+		"event":         "adjusted",
+		"containerId":   "c1",
+		"container":     containerName(pod, container),
+		"namespace":     "default",
+		"profile":       "nested-runtime",
+		"reason":        "entrypoint",
+		"mounts":        []any{"/sys/fs/cgroup", "/run", "/run/lock", "/tmp", "/var/log/journal", "/var/lib/docker", "/var/lib/containers"},
+		"removedMounts": []any{"/sys/fs/cgroup"},
+		"env":           []any{"container", "container_uuid"},
+		"devices":       []any{"/dev/fuse", "/dev/net/tun"},
+	}, e)
+}
@@ -0,0 +1,167 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"time"
+
+	"sigs.k8s.io/yaml"
+)
+
+// fakeHostNone is the cgroup layout of a fake host without /sys/fs/cgroup.
+const fakeHostNone cgroupLayout = "none"
+
+// fakeHost describes a synthetic host, for running the plugin where the
+// host probes would hit Linux-only paths, like on a developer machine.
+type fakeHost struct {
+	// CgroupLayout is the arrangement of the cgroup hierarchies: v2, v1,
+	// hybrid, unknown, or none for a host without /sys/fs/cgroup.
+	CgroupLayout cgroupLayout `json:"cgroupLayout"`
+
+	// KernelRelease is the release of the running kernel, like uname -r.
+	KernelRelease string `json:"kernelRelease,omitempty"`
+
+	// Paths are further paths existing on the host, e.g. the kernel
+	// modules at /lib/modules/<release>.
+	Paths []string `json:"paths,omitempty"`
+
+	// Symlinks map paths on the host to their resolved targets.
+	Symlinks map[string]string `json:"symlinks,omitempty"`
+
+	// CgroupFS and SysctlFS are directories standing in for /sys/fs/cgroup
+	// and /proc/sys. Cgroup controllers are not checked without CgroupFS,
+	// host sysctls are not checked without SysctlFS.
+	CgroupFS string `json:"cgroupFS,omitempty"`
+	SysctlFS string `json:"sysctlFS,omitempty"`
+}
+
+// loadFakeHost reads a fake host description from a YAML file.
+func loadFakeHost(file string) (*fakeHost, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read fake host: %w", err)
+	}
+	h := &fakeHost{}
+	if err := yaml.UnmarshalStrict(data, h); err != nil {
+		return nil, fmt.Errorf("failed to parse fake host %s: %w", file, err)
+	}
+	if err := h.validate(); err != nil {
+		return nil, fmt.Errorf("invalid fake host %s: %w", file, err)
+	}
+	return h, nil
+}
+
+func (h *fakeHost) validate() error {
+	switch h.CgroupLayout {
+	case cgroupLayoutV2, cgroupLayoutV1, cgroupLayoutHybrid, cgroupLayoutUnknown, fakeHostNone:
+	default:
+		return fmt.Errorf("invalid cgroupLayout %q, must be %q, %q, %q, %q or %q", h.CgroupLayout,
+			cgroupLayoutV2, cgroupLayoutV1, cgroupLayoutHybrid, cgroupLayoutUnknown, fakeHostNone)
+	}
+	for _, p := range h.Paths {
+		if !path.IsAbs(p) {
+			return fmt.Errorf("invalid path %q, must be absolute", p)
+		}
+	}
+	for p, target := range h.Symlinks {
+		if !path.IsAbs(p) || !path.IsAbs(target) {
+			return fmt.Errorf("invalid symlink %s -> %s, both must be absolute", p, target)
+		}
+	}
+	return nil
+}
+
+// paths returns the paths existing on the host, including those probed to
+// detect the cgroup layout.
+func (h *fakeHost) paths() map[string]bool {
+	paths := map[string]bool{}
+	switch h.CgroupLayout {
+	case cgroupLayoutV2:
+		paths[cgroupRoot+"/cgroup.controllers"] = true
+	case cgroupLayoutV1:
+		for _, hierarchy := range v1Hierarchies {
+			paths[cgroupRoot+"/"+hierarchy] = true
+		}
+	case cgroupLayoutHybrid:
+		paths[cgroupRoot+"/unified/cgroup.controllers"] = true
+		paths[systemdCgroupDir] = true
+	}
+	if h.CgroupLayout != fakeHostNone {
+		paths[cgroupRoot] = true
+	}
+	for _, p := range h.Paths {
+		paths[path.Clean(p)] = true
+	}
+	return paths
+}
+
+// useFakeHost makes the plugin probe the described host instead of the one
+// it runs on.
+func (p *plugin) useFakeHost(h *fakeHost) {
+	p.prober = &fakeHostProber{paths: h.paths(), symlinks: h.Symlinks}
+	p.cgroupFS = h.CgroupFS
+	p.sysctlFS = h.SysctlFS
+	release := h.KernelRelease
+	p.kernelRelease = func() (string, error) {
+		if release == "" {
+			return "", fmt.Errorf("the fake host has no kernelRelease")
+		}
+		return release, nil
+	}
+	p.hostInfo.Store(nil)
+}
+
+// fakeHostProber answers host probes from a fake host description.
+type fakeHostProber struct {
+	paths    map[string]bool
+	symlinks map[string]string
+}
+
+func (f *fakeHostProber) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if !f.paths[path.Clean(name)] {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return fakeFileInfo(path.Base(name)), nil
+}
+
+func (f *fakeHostProber) EvalSymlinks(ctx context.Context, name string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	if target, ok := f.symlinks[path.Clean(name)]; ok {
+		return target, nil
+	}
+	return name, nil
+}
+
+// fakeFileInfo is a directory of a fake host.
+type fakeFileInfo string
+
+func (fi fakeFileInfo) Name() string    { return string(fi) }
+func (fakeFileInfo) Size() int64        { return 0 }
+func (fakeFileInfo) Mode() fs.FileMode  { return fs.ModeDir | 0o755 }
+func (fakeFileInfo) ModTime() time.Time { return time.Time{} }
+func (fakeFileInfo) IsDir() bool        { return true }
+func (fakeFileInfo) Sys() any           { return nil }
@@ -0,0 +1,98 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/nri/pkg/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeFakeHost writes a fake host description and returns its path.
+func writeFakeHost(t *testing.T, data string) string {
+	file := filepath.Join(t.TempDir(), "host.yaml")
+	require.NoError(t, os.WriteFile(file, []byte(data), 0o644))
+	return file
+}
+
+func TestLoadFakeHost(t *testing.T) {
+	h, err := loadFakeHost(writeFakeHost(t, "cgroupLayout: v1\nkernelRelease: 5.15.0\npaths: [/lib/modules/5.15.0]\n"))
+	require.NoError(t, err)
+	assert.Equal(t, &fakeHost{CgroupLayout: cgroupLayoutV1, KernelRelease: "5.15.0", Paths: []string{"/lib/modules/5.15.0"}}, h)
+
+	for name, data := range map[string]string{
+		"unknown layout":   "cgroupLayout: v3\n",
+		"missing layout":   "kernelRelease: 5.15.0\n",
+		"relative path":    "cgroupLayout: v2\npaths: [lib/modules]\n",
+		"relative symlink": "cgroupLayout: v2\nsymlinks: {/sys/fs/cgroup: cgroup-unified}\n",
+		"unknown field":    "cgroupLayout: v2\nselinux: enforcing\n",
+	} {
+		_, err := loadFakeHost(writeFakeHost(t, data))
+		assert.Error(t, err, name)
+	}
+
+	_, err = loadFakeHost(filepath.Join(t.TempDir(), "missing.yaml"))
+	assert.Error(t, err)
+}
+
+func TestFakeHostProbes(t *testing.T) {
+	for _, layout := range []cgroupLayout{cgroupLayoutV2, cgroupLayoutV1, cgroupLayoutHybrid, cgroupLayoutUnknown} {
+		p := newTestPlugin(nil)
+		p.useFakeHost(&fakeHost{CgroupLayout: layout})
+
+		info, err := p.host(context.Background())
+		require.NoError(t, err)
+		assert.True(t, info.CgroupRoot, layout)
+		assert.Equal(t, layout, info.CgroupLayout)
+	}
+
+	p := newTestPlugin(nil)
+	p.useFakeHost(&fakeHost{CgroupLayout: fakeHostNone})
+	info, err := p.host(context.Background())
+	require.NoError(t, err)
+	assert.False(t, info.CgroupRoot)
+}
+
+func TestFakeHostAdjustment(t *testing.T) {
+	adjust := func(t *testing.T, host string) *api.ContainerAdjustment {
+		h, err := loadFakeHost(writeFakeHost(t, host))
+		require.NoError(t, err)
+		p := newTestPlugin(configWith(func(c *Config) { c.AllowHostModules = true }))
+		p.useFakeHost(h)
+
+		container := newProfileTestContainer(map[string]string{hostModulesAnnotation: "true"})
+		adjust, _, err := p.CreateContainer(context.Background(), nil, container)
+		require.NoError(t, err)
+		require.NotNil(t, adjust)
+		return adjust
+	}
+
+	v2 := adjust(t, "cgroupLayout: v2\nkernelRelease: 6.8.0\npaths: [/lib/modules/6.8.0]\n")
+	v1 := adjust(t, "cgroupLayout: v1\nkernelRelease: 5.4.0\npaths: [/lib/modules/5.4.0]\n")
+
+	assert.Nil(t, findMount(v2.Mounts, systemdCgroupDir))
+	assert.NotNil(t, findMount(v1.Mounts, systemdCgroupDir))
+
+	assert.NotNil(t, findMount(v2.Mounts, "/lib/modules/6.8.0"))
+	assert.NotNil(t, findMount(v1.Mounts, "/lib/modules/5.4.0"))
+	assert.Nil(t, findMount(v1.Mounts, "/lib/modules/6.8.0"))
+}
@@ -0,0 +1,249 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/containerd/nri/pkg/api"
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// Outputs of -hook.
+const (
+	// hookOutputPatch writes the adjustment as a partial OCI runtime spec
+	// to stdout, like an OCI plan, for a wrapper merging it.
+	hookOutputPatch = "patch"
+	// hookOutputBundle applies the adjustment to config.json in the bundle.
+	hookOutputBundle = "bundle"
+)
+
+// Annotations of the CRI implementations of containerd and CRI-O naming the
+// pod and container in the OCI spec of a container.
+var (
+	podNameAnnotations       = []string{"io.kubernetes.cri.sandbox-name", "io.kubernetes.pod.name"}
+	podNamespaceAnnotations  = []string{"io.kubernetes.cri.sandbox-namespace", "io.kubernetes.pod.namespace"}
+	podIDAnnotations         = []string{"io.kubernetes.cri.sandbox-id", "io.kubernetes.cri-o.SandboxID"}
+	containerNameAnnotations = []string{"io.kubernetes.cri.container-name", "io.kubernetes.container.name"}
+)
+
+func firstAnnotation(annotations map[string]string, keys []string) string {
+	for _, key := range keys {
+		if value, ok := annotations[key]; ok {
+			return value
+		}
+	}
+	return ""
+}
+
+// containerFromSpec returns the pod and container of an OCI spec, as far as
+// the spec tells. The pod has no annotations, which are not part of the
+// spec, and is nil if the spec does not name it.
+func containerFromSpec(id string, spec *rspec.Spec) (*api.PodSandbox, *api.Container) {
+	container := &api.Container{
+		Id:           id,
+		PodSandboxId: firstAnnotation(spec.Annotations, podIDAnnotations),
+		Name:         firstAnnotation(spec.Annotations, containerNameAnnotations),
+		State:        api.ContainerState_CONTAINER_CREATED,
+		Mounts:       api.FromOCIMounts(spec.Mounts),
+	}
+	if container.Name == "" {
+		container.Name = id
+	}
+	if len(spec.Annotations) > 0 {
+		container.Annotations = make(map[string]string, len(spec.Annotations))
+		for key, value := range spec.Annotations {
+			container.Annotations[key] = value
+		}
+	}
+	if spec.Process != nil {
+		container.Args = slices.Clone(spec.Process.Args)
+		container.Env = slices.Clone(spec.Process.Env)
+	}
+	if spec.Linux != nil {
+		container.Linux = &api.LinuxContainer{
+			Namespaces:  api.FromOCILinuxNamespaces(spec.Linux.Namespaces),
+			Resources:   api.FromOCILinuxResources(spec.Linux.Resources, spec.Annotations),
+			CgroupsPath: spec.Linux.CgroupsPath,
+		}
+	}
+
+	name := firstAnnotation(spec.Annotations, podNameAnnotations)
+	if name == "" {
+		return nil, container
+	}
+	return &api.PodSandbox{
+		Id:        container.PodSandboxId,
+		Name:      name,
+		Namespace: firstAnnotation(spec.Annotations, podNamespaceAnnotations),
+	}, container
+}
+
+// applyToSpec applies the adjustment of a container to its OCI spec,
+// the way runtimes apply the adjustments of NRI plugins: a mount replaces
+// those at the same destination, mounts are ordered by the depth of their
+// destination, and environment variables replace those of the same name.
+func applyToSpec(spec *rspec.Spec, adjust *api.ContainerAdjustment) {
+	removeMounts := func(dest string) {
+		spec.Mounts = slices.DeleteFunc(spec.Mounts, func(m rspec.Mount) bool {
+			return path.Clean(m.Destination) == path.Clean(dest)
+		})
+	}
+	for _, m := range adjust.Mounts {
+		if dest, ok := api.IsMarkedForRemoval(m.Destination); ok {
+			removeMounts(dest)
+			continue
+		}
+		removeMounts(m.Destination)
+		spec.Mounts = append(spec.Mounts, m.ToOCI(nil))
+	}
+	if len(adjust.Mounts) > 0 {
+		depth := func(dest string) int {
+			return len(strings.Split(path.Clean(dest), "/"))
+		}
+		slices.SortStableFunc(spec.Mounts, func(a, b rspec.Mount) int {
+			return depth(a.Destination) - depth(b.Destination)
+		})
+	}
+
+	for _, e := range adjust.Env {
+		if spec.Process == nil {
+			spec.Process = &rspec.Process{}
+		}
+		key, removed := api.IsMarkedForRemoval(e.Key)
+		spec.Process.Env = slices.DeleteFunc(spec.Process.Env, func(v string) bool {
+			return v == key || strings.HasPrefix(v, key+"=")
+		})
+		if !removed {
+			spec.Process.Env = append(spec.Process.Env, e.ToOCI())
+		}
+	}
+
+	for key, value := range adjust.Annotations {
+		if spec.Annotations == nil {
+			spec.Annotations = map[string]string{}
+		}
+		if key, ok := api.IsMarkedForRemoval(key); ok {
+			delete(spec.Annotations, key)
+			continue
+		}
+		spec.Annotations[key] = value
+	}
+
+	for _, d := range adjust.GetLinux().GetDevices() {
+		if spec.Linux == nil {
+			spec.Linux = &rspec.Linux{}
+		}
+		spec.Linux.Devices = slices.DeleteFunc(spec.Linux.Devices, func(o rspec.LinuxDevice) bool {
+			return o.Path == d.Path
+		})
+		spec.Linux.Devices = append(spec.Linux.Devices, d.ToOCI())
+		if spec.Linux.Resources == nil {
+			spec.Linux.Resources = &rspec.LinuxResources{}
+		}
+		major, minor := d.Major, d.Minor
+		spec.Linux.Resources.Devices = append(spec.Linux.Resources.Devices, rspec.LinuxDeviceCgroup{
+			Allow:  true,
+			Type:   d.Type,
+			Major:  &major,
+			Minor:  &minor,
+			Access: "rwm",
+		})
+	}
+}
+
+// runHook adjusts a container as an OCI hook, with the OCI state of the
+// container read from in and its spec from config.json in the bundle. The
+// adjustment is the one of CreateContainer, written to out as a patch or
+// applied to the bundle. For a stopped container, e.g. as a poststop hook,
+// the files rendered for it are removed instead.
+func (p *plugin) runHook(ctx context.Context, in io.Reader, out io.Writer, output string) error {
+	if output != hookOutputPatch && output != hookOutputBundle {
+		return fmt.Errorf("invalid hook output %q, must be %s or %s", output, hookOutputPatch, hookOutputBundle)
+	}
+
+	var state rspec.State
+	if err := json.NewDecoder(in).Decode(&state); err != nil {
+		return fmt.Errorf("invalid OCI state: %w", err)
+	}
+	if state.ID == "" || state.Bundle == "" {
+		return fmt.Errorf("invalid OCI state: missing id or bundle")
+	}
+
+	if state.Status == rspec.StateStopped {
+		return p.RemoveContainer(ctx, nil, &api.Container{Id: state.ID, Name: state.ID})
+	}
+
+	file := filepath.Join(state.Bundle, "config.json")
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("failed to read OCI spec: %w", err)
+	}
+	var spec rspec.Spec
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return fmt.Errorf("invalid OCI spec %s: %w", file, err)
+	}
+
+	pod, container := containerFromSpec(state.ID, &spec)
+	adjust, _, err := p.CreateContainer(ctx, pod, container)
+	if err != nil {
+		return err
+	}
+
+	if output == hookOutputBundle {
+		if adjust == nil {
+			return nil
+		}
+		applyToSpec(&spec, adjust)
+		return writeSpec(file, &spec)
+	}
+
+	if adjust == nil {
+		adjust = &api.ContainerAdjustment{}
+	}
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(ociPlan(adjust))
+}
+
+// writeSpec replaces the OCI spec in file at once, keeping its mode.
+func writeSpec(file string, spec *rspec.Spec) error {
+	info, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(spec)
+	if err != nil {
+		return err
+	}
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, data, info.Mode().Perm()); err != nil {
+		return fmt.Errorf("failed to write OCI spec: %w", err)
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		return fmt.Errorf("failed to write OCI spec: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,262 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/containerd/nri/pkg/api"
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// hookTestSpec returns the OCI spec of a container in pod default/web, as
+// created by containerd.
+func hookTestSpec(args ...string) *rspec.Spec {
+	limit := int64(512 << 20)
+	return &rspec.Spec{
+		Version: rspec.Version,
+		Process: &rspec.Process{
+			Args: args,
+			Env:  []string{"PATH=/usr/sbin:/usr/bin", "container=docker"},
+		},
+		Mounts: []rspec.Mount{
+			{Destination: "/proc", Type: "proc", Source: "proc", Options: []string{"nosuid", "noexec", "nodev"}},
+			{Destination: "/dev", Type: "tmpfs", Source: "tmpfs", Options: []string{"nosuid", "strictatime", "mode=755", "size=65536k"}},
+			{Destination: "/sys", Type: "sysfs", Source: "sysfs", Options: []string{"nosuid", "noexec", "nodev", "ro"}},
+			{Destination: "/sys/fs/cgroup", Type: "cgroup", Source: "cgroup", Options: []string{"nosuid", "noexec", "nodev", "relatime", "ro"}},
+			{Destination: "/etc/hosts", Type: "bind", Source: "/var/lib/containerd/hosts", Options: []string{"rbind", "rprivate", "rw"}},
+		},
+		Annotations: map[string]string{
+			"io.kubernetes.cri.container-type":                      "container",
+			"io.kubernetes.cri.container-name":                      "systemd",
+			"io.kubernetes.cri.sandbox-id":                          "pod-id",
+			"io.kubernetes.cri.sandbox-name":                        "web",
+			"io.kubernetes.cri.sandbox-namespace":                   "default",
+			dropInAnnotationPrefix + "system.conf.d/50-custom.conf": "[Manager]\nDefaultTimeoutStopSec=10s\n",
+		},
+		Linux: &rspec.Linux{
+			Namespaces: []rspec.LinuxNamespace{
+				{Type: rspec.PIDNamespace},
+				{Type: rspec.MountNamespace},
+				{Type: rspec.CgroupNamespace},
+			},
+			Resources:   &rspec.LinuxResources{Memory: &rspec.LinuxMemory{Limit: &limit}},
+			CgroupsPath: "kubepods-besteffort.slice:cri-containerd:hook-test",
+		},
+	}
+}
+
+// writeHookBundle writes a bundle with the spec and returns the OCI state
+// of its container.
+func writeHookBundle(t *testing.T, spec *rspec.Spec, status rspec.ContainerState) (string, string) {
+	bundle := t.TempDir()
+	data, err := json.Marshal(spec)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(bundle, "config.json"), data, 0o600))
+
+	state, err := json.Marshal(rspec.State{
+		Version: rspec.Version,
+		ID:      "hook-test",
+		Status:  status,
+		Bundle:  bundle,
+	})
+	require.NoError(t, err)
+	return bundle, string(state)
+}
+
+// nriAdjustment returns the adjustment of the container of the spec on the
+// NRI path, from the pod and container the runtime passes to the plugin.
+func nriAdjustment(t *testing.T, cfg *Config, spec *rspec.Spec) *api.ContainerAdjustment {
+	pod := &api.PodSandbox{Id: "pod-id", Name: "web", Namespace: "default"}
+	container := &api.Container{
+		Id:           "hook-test",
+		PodSandboxId: "pod-id",
+		Name:         "systemd",
+		State:        api.ContainerState_CONTAINER_CREATED,
+		Args:         spec.Process.Args,
+		Env:          spec.Process.Env,
+		Mounts:       api.FromOCIMounts(spec.Mounts),
+		Annotations:  spec.Annotations,
+		Linux: &api.LinuxContainer{
+			Namespaces:  api.FromOCILinuxNamespaces(spec.Linux.Namespaces),
+			Resources:   api.FromOCILinuxResources(spec.Linux.Resources, nil),
+			CgroupsPath: spec.Linux.CgroupsPath,
+		},
+	}
+
+	adjust, _, err := newTestPlugin(cfg).CreateContainer(context.Background(), pod, container)
+	require.NoError(t, err)
+	return adjust
+}
+
+func TestHook(t *testing.T) {
+	cfg := configWith(func(c *Config) {
+		c.StateDir = t.TempDir()
+		c.TmpfsOptions.MemorySize = 25
+	})
+
+	t.Run("patch", func(t *testing.T) {
+		spec := hookTestSpec("/sbin/init")
+		bundle, state := writeHookBundle(t, spec, rspec.StateCreating)
+		before, err := os.ReadFile(filepath.Join(bundle, "config.json"))
+		require.NoError(t, err)
+
+		var out bytes.Buffer
+		require.NoError(t, newTestPlugin(cfg).runHook(context.Background(), strings.NewReader(state), &out, hookOutputPatch))
+
+		expected, err := json.MarshalIndent(ociPlan(nriAdjustment(t, cfg, spec)), "", "  ")
+		require.NoError(t, err)
+		assert.Equal(t, string(expected)+"\n", out.String())
+
+		after, err := os.ReadFile(filepath.Join(bundle, "config.json"))
+		require.NoError(t, err)
+		assert.Equal(t, before, after)
+	})
+
+	t.Run("bundle", func(t *testing.T) {
+		spec := hookTestSpec("/sbin/init")
+		bundle, state := writeHookBundle(t, spec, rspec.StateCreating)
+
+		var out bytes.Buffer
+		require.NoError(t, newTestPlugin(cfg).runHook(context.Background(), strings.NewReader(state), &out, hookOutputBundle))
+		assert.Empty(t, out.String())
+
+		data, err := os.ReadFile(filepath.Join(bundle, "config.json"))
+		require.NoError(t, err)
+		var adjusted rspec.Spec
+		require.NoError(t, json.Unmarshal(data, &adjusted))
+
+		expected := hookTestSpec("/sbin/init")
+		applyToSpec(expected, nriAdjustment(t, cfg, spec))
+		assert.Equal(t, expected, &adjusted)
+
+		var cgroup *rspec.Mount
+		for i, m := range adjusted.Mounts {
+			if m.Destination == "/sys/fs/cgroup" {
+				assert.Nil(t, cgroup, "duplicate cgroup mount")
+				cgroup = &adjusted.Mounts[i]
+			}
+		}
+		require.NotNil(t, cgroup)
+		assert.Contains(t, cgroup.Options, "rw")
+		assert.Contains(t, adjusted.Process.Env, "container=docker")
+		assert.Contains(t, adjusted.Annotations[provenanceAnnotation], "drop-ins")
+		assert.FileExists(t, filepath.Join(cfg.StateDir, "drop-ins", "hook-test", "system.conf.d", "50-custom.conf"))
+
+		info, err := os.Stat(filepath.Join(bundle, "config.json"))
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+	})
+
+	t.Run("poststop", func(t *testing.T) {
+		p := newTestPlugin(cfg)
+		_, state := writeHookBundle(t, hookTestSpec("/sbin/init"), rspec.StateCreating)
+		require.NoError(t, p.runHook(context.Background(), strings.NewReader(state), &bytes.Buffer{}, hookOutputBundle))
+		require.DirExists(t, filepath.Join(cfg.StateDir, "drop-ins", "hook-test"))
+
+		_, state = writeHookBundle(t, hookTestSpec("/sbin/init"), rspec.StateStopped)
+		require.NoError(t, p.runHook(context.Background(), strings.NewReader(state), &bytes.Buffer{}, hookOutputBundle))
+		assert.NoDirExists(t, filepath.Join(cfg.StateDir, "drop-ins", "hook-test"))
+	})
+
+	t.Run("not systemd", func(t *testing.T) {
+		bundle, state := writeHookBundle(t, hookTestSpec("/bin/sh", "-c", "sleep infinity"), rspec.StateCreating)
+		before, err := os.ReadFile(filepath.Join(bundle, "config.json"))
+		require.NoError(t, err)
+
+		p := newTestPlugin(cfg)
+		require.NoError(t, p.runHook(context.Background(), strings.NewReader(state), &bytes.Buffer{}, hookOutputBundle))
+		after, err := os.ReadFile(filepath.Join(bundle, "config.json"))
+		require.NoError(t, err)
+		assert.Equal(t, before, after)
+
+		var out bytes.Buffer
+		require.NoError(t, p.runHook(context.Background(), strings.NewReader(state), &out, hookOutputPatch))
+		assert.JSONEq(t, `{"ociVersion": "`+rspec.Version+`"}`, out.String())
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		p := newTestPlugin(cfg)
+		for _, state := range []string{"", "{", `{"id": "hook-test"}`, `{"id": "hook-test", "bundle": "/nonexistent"}`} {
+			assert.Error(t, p.runHook(context.Background(), strings.NewReader(state), &bytes.Buffer{}, hookOutputPatch), state)
+		}
+		_, state := writeHookBundle(t, hookTestSpec("/sbin/init"), rspec.StateCreating)
+		assert.Error(t, p.runHook(context.Background(), strings.NewReader(state), &bytes.Buffer{}, "merge"))
+	})
+}
+
+func TestContainerFromSpec(t *testing.T) {
+	pod, container := containerFromSpec("hook-test", hookTestSpec("/sbin/init"))
+	assert.Equal(t, &api.PodSandbox{Id: "pod-id", Name: "web", Namespace: "default"}, pod)
+	assert.Equal(t, "web/systemd", containerName(pod, container))
+	assert.Equal(t, []string{"/sbin/init"}, container.Args)
+	assert.Equal(t, int64(512<<20), container.GetLinux().GetResources().GetMemory().GetLimit().GetValue())
+	assert.NotNil(t, findMount(container.Mounts, "/sys/fs/cgroup"))
+
+	spec := hookTestSpec("/sbin/init")
+	spec.Annotations = nil
+	pod, container = containerFromSpec("hook-test", spec)
+	assert.Nil(t, pod)
+	assert.Equal(t, "hook-test", containerName(pod, container))
+}
+
+func TestApplyToSpec(t *testing.T) {
+	spec := &rspec.Spec{
+		Process: &rspec.Process{Env: []string{"PATH=/usr/bin", "container=docker", "TERM=xterm"}},
+		Mounts: []rspec.Mount{
+			{Destination: "/proc", Type: "proc"},
+			{Destination: "/run/secrets/token", Type: "bind"},
+			{Destination: "/sys/fs/cgroup", Type: "cgroup", Options: []string{"ro"}},
+			{Destination: "/tmp", Type: "bind"},
+		},
+		Annotations: map[string]string{"keep": "1", "drop": "1"},
+	}
+
+	adjust := &api.ContainerAdjustment{}
+	adjust.RemoveMount("/sys/fs/cgroup")
+	adjust.AddMount(&api.Mount{Destination: "/sys/fs/cgroup", Type: "cgroup", Options: []string{"rw"}})
+	adjust.AddMount(&api.Mount{Destination: "/run", Type: "tmpfs"})
+	adjust.AddMount(&api.Mount{Destination: "/tmp/", Type: "tmpfs"})
+	adjust.AddEnv("container", "containerd")
+	adjust.RemoveEnv("TERM")
+	adjust.AddAnnotation("added", "1")
+	adjust.RemoveAnnotation("drop")
+	adjust.AddDevice(&api.LinuxDevice{Path: "/dev/fuse", Type: "c", Major: 10, Minor: 229})
+
+	applyToSpec(spec, adjust)
+
+	var mounts []string
+	for _, m := range spec.Mounts {
+		mounts = append(mounts, m.Destination+":"+m.Type)
+	}
+	assert.Equal(t, []string{"/proc:proc", "/run:tmpfs", "/tmp/:tmpfs", "/run/secrets/token:bind", "/sys/fs/cgroup:cgroup"}, mounts)
+	assert.Equal(t, []string{"rw"}, spec.Mounts[4].Options)
+	assert.Equal(t, []string{"PATH=/usr/bin", "container=containerd"}, spec.Process.Env)
+	assert.Equal(t, map[string]string{"keep": "1", "added": "1"}, spec.Annotations)
+	require.Len(t, spec.Linux.Devices, 1)
+	assert.Equal(t, "/dev/fuse", spec.Linux.Devices[0].Path)
+	require.Len(t, spec.Linux.Resources.Devices, 1)
+	assert.Equal(t, int64(229), *spec.Linux.Resources.Devices[0].Minor)
+}
@@ -0,0 +1,72 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"os"
+	"time"
+)
+
+// hostInfo is what the plugin knows about the host. It does not change
+// while the node is up, so it is probed on first use and cached. The
+// reprobe action refreshes it, e.g. after fixing a mount on the host.
+type hostInfo struct {
+	// CgroupRoot tells whether /sys/fs/cgroup exists.
+	CgroupRoot bool       `json:"cgroupRoot"`
+	CgroupMode cgroupMode `json:"cgroupMode"`
+	// CgroupLayout tells how the cgroup hierarchies are arranged.
+	CgroupLayout cgroupLayout `json:"cgroupLayout"`
+	Probed       time.Time    `json:"probed"`
+}
+
+// host returns the cached host information, probing the host if needed.
+func (p *plugin) host(ctx context.Context) (*hostInfo, error) {
+	if info := p.hostInfo.Load(); info != nil {
+		return info, nil
+	}
+	return p.reprobe(ctx)
+}
+
+// reprobe probes the host and caches the result. Failed probes are not
+// cached, so the next event tries again.
+func (p *plugin) reprobe(ctx context.Context) (*hostInfo, error) {
+	info := &hostInfo{Probed: time.Now()}
+
+	_, err := p.prober.Stat(ctx, cgroupRoot)
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return nil, ctxErr
+	}
+	info.CgroupRoot = !os.IsNotExist(err)
+
+	info.CgroupLayout = cgroupLayoutUnknown
+	if info.CgroupRoot {
+		var how string
+		if info.CgroupMode, how, err = p.cgroupMode(ctx); err != nil {
+			return nil, err
+		}
+		p.hostLog.Debugf("detected cgroup %v: %s", info.CgroupMode, how)
+		if info.CgroupLayout, err = classifyCgroupLayout(ctx, p.prober); err != nil {
+			return nil, err
+		}
+	}
+
+	p.hostInfo.Store(info)
+	p.hostLog.Debugf("probed host: cgroup root %v, cgroup %v, layout %s", info.CgroupRoot, info.CgroupMode, info.CgroupLayout)
+
+	return info, nil
+}
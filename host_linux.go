@@ -0,0 +1,38 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"syscall"
+)
+
+// defaultFakeHost is the host probed without -fake-host. On Linux, it is
+// the real host.
+var defaultFakeHost *fakeHost
+
+// FSType returns the filesystem magic number of the filesystem mounted at
+// path.
+func (hostFS) FSType(ctx context.Context, path string) (int64, error) {
+	return withContext(ctx, func() (int64, error) {
+		var st syscall.Statfs_t
+		if err := syscall.Statfs(path, &st); err != nil {
+			return 0, err
+		}
+		return int64(st.Type), nil
+	})
+}
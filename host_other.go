@@ -0,0 +1,36 @@
+//go:build !linux
+
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+// defaultFakeHost is the host probed without -fake-host. Off Linux, the
+// host probes would fail, so it is a cgroup v2 host.
+var defaultFakeHost = &fakeHost{
+	CgroupLayout:  cgroupLayoutV2,
+	KernelRelease: "6.1.0-fake",
+}
+
+// FSType is not supported off Linux.
+func (hostFS) FSType(context.Context, string) (int64, error) {
+	return 0, errors.ErrUnsupported
+}
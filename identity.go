@@ -0,0 +1,184 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/sirupsen/logrus"
+)
+
+// Labels and log fields identifying the plugin instance, so that telemetry
+// aggregated from many nodes can be told apart.
+const (
+	identityNode           = "node"
+	identityRuntime        = "runtime"
+	identityRuntimeVersion = "runtime_version"
+)
+
+var identityLabels = []string{identityNode, identityRuntime, identityRuntimeVersion}
+
+// nodeName returns the name of the node: the given one, else the NODE_NAME
+// variable, usually set from spec.nodeName, else the host name.
+func nodeName(name string) (string, error) {
+	if name != "" {
+		return name, nil
+	}
+	if name = os.Getenv("NODE_NAME"); name != "" {
+		return name, nil
+	}
+	name, err := os.Hostname()
+	if err != nil {
+		return "", fmt.Errorf("failed to get the node name: %w", err)
+	}
+	return name, nil
+}
+
+// identity is the node the plugin runs on and the runtime it registered
+// with, empty until known.
+type identity struct {
+	node           string
+	runtime        string
+	runtimeVersion string
+}
+
+// values returns the non-empty values of the identity by label.
+func (id identity) values() map[string]string {
+	values := make(map[string]string, len(identityLabels))
+	for label, value := range map[string]string{
+		identityNode:           id.node,
+		identityRuntime:        id.runtime,
+		identityRuntimeVersion: id.runtimeVersion,
+	} {
+		if value != "" {
+			values[label] = value
+		}
+	}
+	return values
+}
+
+// identityHook adds the identity of the plugin as fields to every log
+// entry.
+type identityHook struct {
+	fields atomic.Pointer[logrus.Fields]
+}
+
+func (h *identityHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *identityHook) Fire(entry *logrus.Entry) error {
+	fields := h.fields.Load()
+	if fields == nil {
+		return nil
+	}
+	for key, value := range *fields {
+		if _, ok := entry.Data[key]; !ok {
+			entry.Data[key] = value
+		}
+	}
+	return nil
+}
+
+func (h *identityHook) set(id identity) {
+	fields := logrus.Fields{}
+	for label, value := range id.values() {
+		fields[label] = value
+	}
+	h.fields.Store(&fields)
+}
+
+// setNode records the node the plugin runs on.
+func (p *plugin) setNode(node string) {
+	p.identityMu.Lock()
+	defer p.identityMu.Unlock()
+	id := p.identity()
+	id.node = node
+	p.setIdentity(id)
+}
+
+// setRuntime records the runtime the plugin registered with.
+func (p *plugin) setRuntime(runtime, version string) {
+	p.identityMu.Lock()
+	defer p.identityMu.Unlock()
+	id := p.identity()
+	id.runtime, id.runtimeVersion = runtime, version
+	p.setIdentity(id)
+}
+
+func (p *plugin) setIdentity(id identity) {
+	p.id.Store(&id)
+	p.identityFields.set(id)
+}
+
+func (p *plugin) identity() identity {
+	if id := p.id.Load(); id != nil {
+		return *id
+	}
+	return identity{}
+}
+
+// identify adds the identity of the plugin to the event.
+func (p *plugin) identify(e *event) *event {
+	id := p.identity()
+	e.Node, e.Runtime, e.RuntimeVersion = id.node, id.runtime, id.runtimeVersion
+	return e
+}
+
+// gatherer returns the metrics of the plugin with the identity labels of
+// the configuration.
+func (p *plugin) gatherer() prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		families, err := p.metrics.registry.Gather()
+		if err != nil {
+			return families, err
+		}
+		values := p.identity().values()
+		var labels []*dto.LabelPair
+		for _, label := range p.config().IdentityMetricLabels {
+			if value, ok := values[label]; ok {
+				labels = append(labels, &dto.LabelPair{Name: &label, Value: &value})
+			}
+		}
+		if len(labels) > 0 {
+			for _, f := range families {
+				for _, m := range f.Metric {
+					m.Label = withLabels(m.Label, labels)
+				}
+			}
+		}
+		return families, nil
+	})
+}
+
+// withLabels adds the labels not set already, keeping the labels sorted by
+// name as expected by the exposition formats.
+func withLabels(existing, labels []*dto.LabelPair) []*dto.LabelPair {
+	for _, l := range labels {
+		if !slices.ContainsFunc(existing, func(e *dto.LabelPair) bool { return e.GetName() == l.GetName() }) {
+			existing = append(existing, l)
+		}
+	}
+	slices.SortFunc(existing, func(a, b *dto.LabelPair) int { return strings.Compare(a.GetName(), b.GetName()) })
+	return existing
+}
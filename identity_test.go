@@ -0,0 +1,114 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/containerd/nri/pkg/api"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNodeName(t *testing.T) {
+	t.Setenv("NODE_NAME", "env-node")
+	name, err := nodeName("flag-node")
+	require.NoError(t, err)
+	assert.Equal(t, "flag-node", name)
+
+	name, err = nodeName("")
+	require.NoError(t, err)
+	assert.Equal(t, "env-node", name)
+
+	t.Setenv("NODE_NAME", "")
+	name, err = nodeName("")
+	require.NoError(t, err)
+	assert.NotEmpty(t, name)
+}
+
+func TestIdentityLogFields(t *testing.T) {
+	p := newTestPlugin(nil)
+	hook := logtest.NewLocal(p.logs.base)
+
+	p.setNode("node-1")
+	p.stateLog.Infof("before registration")
+	require.NotNil(t, hook.LastEntry())
+	assert.Equal(t, "node-1", hook.LastEntry().Data["node"])
+	assert.NotContains(t, hook.LastEntry().Data, "runtime")
+
+	_, err := p.Configure(context.Background(), "", "containerd", "v1.7.20")
+	require.NoError(t, err)
+	p.stateLog.Infof("after registration")
+	entry := hook.LastEntry()
+	assert.Equal(t, "node-1", entry.Data["node"])
+	assert.Equal(t, "containerd", entry.Data["runtime"])
+	assert.Equal(t, "v1.7.20", entry.Data["runtime_version"])
+	assert.Equal(t, logState, entry.Data["module"])
+}
+
+func TestIdentityEvents(t *testing.T) {
+	var out bytes.Buffer
+	p := newTestPlugin(nil)
+	p.events = newEventWriter(&out)
+	p.setNode("node-1")
+	p.setRuntime("cri-o", "1.30.0")
+
+	_, _, err := p.CreateContainer(context.Background(), &api.PodSandbox{Name: "pod"}, newProfileTestContainer(nil))
+	require.NoError(t, err)
+
+	var e map[string]any
+	require.NoError(t, json.Unmarshal(out.Bytes(), &e))
+	assert.Equal(t, "node-1", e["node"])
+	assert.Equal(t, "cri-o", e["runtime"])
+	assert.Equal(t, "1.30.0", e["runtimeVersion"])
+}
+
+func TestIdentityMetricLabels(t *testing.T) {
+	const expected = `
+# HELP nri_systemd_repairs_total Number of files rendered again for systemd containers by autoRepair.
+# TYPE nri_systemd_repairs_total counter
+nri_systemd_repairs_total{node="node-1",runtime="containerd",runtime_version="v1.7.20"} 0
+`
+	p := newTestPlugin(nil)
+	p.setNode("node-1")
+	p.setRuntime("containerd", "v1.7.20")
+	assert.NoError(t, testutil.GatherAndCompare(p.gatherer(), strings.NewReader(expected), "nri_systemd_repairs_total"))
+
+	// labels the scraper adds itself are left out
+	p = newTestPlugin(configWith(func(c *Config) { c.IdentityMetricLabels = []string{"runtime"} }))
+	p.setNode("node-1")
+	p.setRuntime("containerd", "v1.7.20")
+	assert.NoError(t, testutil.GatherAndCompare(p.gatherer(), strings.NewReader(`
+# HELP nri_systemd_repairs_total Number of files rendered again for systemd containers by autoRepair.
+# TYPE nri_systemd_repairs_total counter
+nri_systemd_repairs_total{runtime="containerd"} 0
+`), "nri_systemd_repairs_total"))
+
+	// labels of metrics are kept, and sorted with the identity labels
+	p.metrics.existingTmpfs.WithLabelValues("/run").Inc()
+	assert.NoError(t, testutil.GatherAndCompare(p.gatherer(), strings.NewReader(`
+# HELP nri_systemd_tmpfs_already_mounted_total Number of tmpfs mounts not added to systemd containers because they mount the destination themselves.
+# TYPE nri_systemd_tmpfs_already_mounted_total counter
+nri_systemd_tmpfs_already_mounted_total{destination="/run",runtime="containerd"} 1
+`), "nri_systemd_tmpfs_already_mounted_total"))
+}
@@ -0,0 +1,191 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"syscall"
+	"time"
+)
+
+const (
+	// instanceLockFile is the lock taken below stateDir by the running
+	// instance of the plugin, so that a second instance on the node does
+	// not adjust the same containers again.
+	instanceLockFile = "instance.lock"
+
+	// instanceLockRetry is how often an instance in standby tries to take
+	// over the lock.
+	instanceLockRetry = 5 * time.Second
+)
+
+// instanceMarker identifies the instance holding the lock. It is written
+// to the lock file, and cleared again on clean shutdown.
+type instanceMarker struct {
+	PID     int       `json:"pid"`
+	Version string    `json:"version"`
+	Index   string    `json:"index,omitempty"`
+	Started time.Time `json:"started"`
+}
+
+func (m *instanceMarker) String() string {
+	s := fmt.Sprintf("pid %d, version %s", m.PID, m.Version)
+	if m.Index != "" {
+		s += ", index " + m.Index
+	}
+	return s + ", started " + m.Started.Format(time.RFC3339)
+}
+
+// newInstanceMarker describes the running process.
+func newInstanceMarker(index string) *instanceMarker {
+	version := "unknown"
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		version = info.Main.Version
+	}
+	return &instanceMarker{PID: os.Getpid(), Version: version, Index: index, Started: time.Now().UTC()}
+}
+
+// instanceLockedError is returned while another instance holds the lock.
+type instanceLockedError struct {
+	path string
+	// holder is the marker of the other instance, nil if it has not been
+	// written yet.
+	holder *instanceMarker
+}
+
+func (e *instanceLockedError) Error() string {
+	if e.holder == nil {
+		return fmt.Sprintf("another instance of the plugin holds %s", e.path)
+	}
+	return fmt.Sprintf("another instance of the plugin holds %s (%v)", e.path, e.holder)
+}
+
+// instanceLock is an advisory lock on a file, held until released or
+// until the process exits, e.g. crashing. The kernel releases it then, so
+// a crashed instance never leaves the lock behind, only its marker.
+type instanceLock struct {
+	file *os.File
+}
+
+// acquireInstanceLock takes the instance lock below dir without waiting.
+// stale is the marker of a previous instance which did not shut down
+// cleanly, if any.
+func acquireInstanceLock(dir string, marker *instanceMarker) (lock *instanceLock, stale *instanceMarker, err error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, nil, fmt.Errorf("failed to create %s: %w", dir, err)
+	}
+	path := filepath.Join(dir, instanceLockFile)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open instance lock: %w", err)
+	}
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		holder := readInstanceMarker(f)
+		f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, nil, &instanceLockedError{path: path, holder: holder}
+		}
+		return nil, nil, fmt.Errorf("failed to lock %s: %w", path, err)
+	}
+
+	stale = readInstanceMarker(f)
+	data, err := json.Marshal(marker)
+	if err == nil {
+		err = writeInstanceMarker(f, data)
+	}
+	if err != nil {
+		f.Close()
+		return nil, nil, fmt.Errorf("failed to write instance marker: %w", err)
+	}
+	return &instanceLock{file: f}, stale, nil
+}
+
+// readInstanceMarker reads the marker of the lock file, returning nil if
+// there is none or it cannot be parsed.
+func readInstanceMarker(f *os.File) *instanceMarker {
+	data, err := io.ReadAll(io.NewSectionReader(f, 0, 1<<16))
+	if err != nil || len(data) == 0 {
+		return nil
+	}
+	m := &instanceMarker{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil
+	}
+	return m
+}
+
+func writeInstanceMarker(f *os.File, data []byte) error {
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	_, err := f.WriteAt(data, 0)
+	return err
+}
+
+// release clears the marker and releases the lock. The lock file is kept,
+// since removing it would race with an instance locking it.
+func (l *instanceLock) release() error {
+	err := l.file.Truncate(0)
+	if unlockErr := syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN); err == nil {
+		err = unlockErr
+	}
+	if closeErr := l.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// lockInstance takes the instance lock below dir according to the
+// duplicate policy: with exit it fails while another instance holds the
+// lock, with standby it waits for the other instance to release it,
+// trying again every retry.
+func (p *plugin) lockInstance(ctx context.Context, dir string, policy DuplicatePolicy, marker *instanceMarker, retry time.Duration) (*instanceLock, error) {
+	standby := false
+	for {
+		lock, stale, err := acquireInstanceLock(dir, marker)
+		var locked *instanceLockedError
+		switch {
+		case err == nil:
+			if stale != nil {
+				p.log.Warnf("previous instance (%v) did not shut down cleanly, taking over", stale)
+			}
+			if standby {
+				p.log.Infof("took over the instance lock, leaving standby")
+			}
+			return lock, nil
+		case !errors.As(err, &locked) || policy != DuplicateStandby:
+			return nil, err
+		case !standby:
+			p.log.Warnf("%v, waiting in standby until it exits", err)
+			standby = true
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(retry):
+		}
+	}
+}
@@ -0,0 +1,172 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInstanceLock(t *testing.T) {
+	first := &instanceMarker{PID: 100, Version: "v1.2.0", Index: "10", Started: time.Date(2026, 10, 1, 8, 0, 0, 0, time.UTC)}
+	second := &instanceMarker{PID: 200, Version: "v1.3.0", Index: "20", Started: time.Date(2026, 10, 2, 8, 0, 0, 0, time.UTC)}
+
+	t.Run("second instance exits", func(t *testing.T) {
+		dir := t.TempDir()
+		p := newTestPlugin(nil)
+
+		lock, err := p.lockInstance(context.Background(), dir, DuplicateExit, first, time.Millisecond)
+		require.NoError(t, err)
+		defer lock.release()
+
+		_, err = p.lockInstance(context.Background(), dir, DuplicateExit, second, time.Millisecond)
+		var locked *instanceLockedError
+		require.ErrorAs(t, err, &locked)
+		assert.Equal(t, first, locked.holder)
+		assert.Contains(t, err.Error(), "pid 100, version v1.2.0, index 10")
+
+		// the default policy is exit
+		_, err = p.lockInstance(context.Background(), dir, "", second, time.Millisecond)
+		assert.ErrorAs(t, err, &locked)
+	})
+
+	t.Run("second instance takes over from standby", func(t *testing.T) {
+		dir := t.TempDir()
+		p := newTestPlugin(nil)
+		logs := logtest.NewLocal(p.logs.base)
+
+		lock, err := p.lockInstance(context.Background(), dir, DuplicateExit, first, time.Millisecond)
+		require.NoError(t, err)
+
+		acquired := make(chan *instanceLock)
+		go func() {
+			standby, err := p.lockInstance(context.Background(), dir, DuplicateStandby, second, time.Millisecond)
+			assert.NoError(t, err)
+			acquired <- standby
+		}()
+
+		select {
+		case <-acquired:
+			t.Fatal("took over while the first instance holds the lock")
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		require.NoError(t, lock.release())
+		var standby *instanceLock
+		select {
+		case standby = <-acquired:
+		case <-time.After(5 * time.Second):
+			t.Fatal("did not take over after the first instance released the lock")
+		}
+		defer standby.release()
+
+		data, err := os.ReadFile(filepath.Join(dir, instanceLockFile))
+		require.NoError(t, err)
+		var marker instanceMarker
+		require.NoError(t, json.Unmarshal(data, &marker))
+		assert.Equal(t, *second, marker)
+
+		var messages []string
+		for _, e := range logs.AllEntries() {
+			messages = append(messages, e.Message)
+		}
+		assert.Contains(t, messages, "took over the instance lock, leaving standby")
+		for _, e := range logs.AllEntries() {
+			assert.NotContains(t, e.Message, "did not shut down cleanly")
+		}
+	})
+
+	t.Run("standby gives up with the context", func(t *testing.T) {
+		dir := t.TempDir()
+		p := newTestPlugin(nil)
+
+		lock, err := p.lockInstance(context.Background(), dir, DuplicateExit, first, time.Millisecond)
+		require.NoError(t, err)
+		defer lock.release()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		_, err = p.lockInstance(ctx, dir, DuplicateStandby, second, time.Millisecond)
+		assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	})
+
+	t.Run("clean shutdown clears the marker", func(t *testing.T) {
+		dir := t.TempDir()
+
+		lock, stale, err := acquireInstanceLock(dir, first)
+		require.NoError(t, err)
+		assert.Nil(t, stale)
+		require.NoError(t, lock.release())
+
+		data, err := os.ReadFile(filepath.Join(dir, instanceLockFile))
+		require.NoError(t, err)
+		assert.Empty(t, data)
+
+		lock, stale, err = acquireInstanceLock(dir, second)
+		require.NoError(t, err)
+		assert.Nil(t, stale)
+		require.NoError(t, lock.release())
+	})
+
+	t.Run("crashed instance", func(t *testing.T) {
+		// the kernel released the lock of the crashed instance, but its
+		// marker is left behind
+		dir := t.TempDir()
+		data, err := json.Marshal(first)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(dir, instanceLockFile), data, 0o644))
+
+		p := newTestPlugin(nil)
+		logs := logtest.NewLocal(p.logs.base)
+		lock, err := p.lockInstance(context.Background(), dir, DuplicateExit, second, time.Millisecond)
+		require.NoError(t, err)
+		defer lock.release()
+
+		if assert.NotNil(t, logs.LastEntry()) {
+			assert.Equal(t, logrus.WarnLevel, logs.LastEntry().Level)
+			assert.Contains(t, logs.LastEntry().Message, "pid 100")
+			assert.Contains(t, logs.LastEntry().Message, "did not shut down cleanly")
+		}
+	})
+
+	t.Run("garbage marker", func(t *testing.T) {
+		dir := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(dir, instanceLockFile), []byte("not json"), 0o644))
+
+		lock, stale, err := acquireInstanceLock(dir, second)
+		require.NoError(t, err)
+		assert.Nil(t, stale)
+		require.NoError(t, lock.release())
+	})
+
+	t.Run("state dir created", func(t *testing.T) {
+		dir := filepath.Join(t.TempDir(), "state")
+		lock, _, err := acquireInstanceLock(dir, first)
+		require.NoError(t, err)
+		require.NoError(t, lock.release())
+	})
+}
@@ -0,0 +1,158 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+var envVarName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// interpolateConfig expands environment variables in all string values of
+// the YAML configuration, see interpolate. Keys are left alone.
+func interpolateConfig(data []byte, lookup func(string) (string, bool)) ([]byte, error) {
+	data, err := yaml.YAMLToJSON(data)
+	if err != nil {
+		return nil, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+
+	if v, err = interpolateValue(v, "", lookup); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(v)
+}
+
+func interpolateValue(v interface{}, field string, lookup func(string) (string, bool)) (interface{}, error) {
+	switch v := v.(type) {
+	case string:
+		s, err := interpolate(v, lookup)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", field, err)
+		}
+		return s, nil
+	case map[string]interface{}:
+		for key, value := range v {
+			name := key
+			if field != "" {
+				name = field + "." + key
+			}
+			expanded, err := interpolateValue(value, name, lookup)
+			if err != nil {
+				return nil, err
+			}
+			v[key] = expanded
+		}
+	case []interface{}:
+		for i, value := range v {
+			expanded, err := interpolateValue(value, field+"["+strconv.Itoa(i)+"]", lookup)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = expanded
+		}
+	}
+	return v, nil
+}
+
+// interpolate expands ${VAR} with the value of the environment variable
+// VAR, failing if it is not set. ${VAR:-default} expands to default if VAR
+// is unset or empty, and default may contain references itself. $$ is a
+// literal $, other $ are kept as they are.
+func interpolate(s string, lookup func(string) (string, bool)) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+
+		switch s[i+1] {
+		case '$':
+			b.WriteByte('$')
+			i++
+		case '{':
+			end, err := referenceEnd(s, i+2)
+			if err != nil {
+				return "", err
+			}
+			value, err := expandReference(s[i+2:end], lookup)
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(value)
+			i = end
+		default:
+			b.WriteByte('$')
+		}
+	}
+	return b.String(), nil
+}
+
+// referenceEnd returns the index of the brace closing the reference which
+// starts at s[start], skipping nested references.
+func referenceEnd(s string, start int) (int, error) {
+	depth := 0
+	for i := start; i < len(s); i++ {
+		switch {
+		case s[i] == '$' && i+1 < len(s) && s[i+1] == '$':
+			i++
+		case s[i] == '$' && i+1 < len(s) && s[i+1] == '{':
+			depth++
+			i++
+		case s[i] == '}':
+			if depth == 0 {
+				return i, nil
+			}
+			depth--
+		}
+	}
+	return 0, fmt.Errorf("unterminated variable reference in %q", s)
+}
+
+func expandReference(ref string, lookup func(string) (string, bool)) (string, error) {
+	name, def, hasDefault := strings.Cut(ref, ":-")
+	if !envVarName.MatchString(name) {
+		return "", fmt.Errorf("invalid variable reference ${%s}", ref)
+	}
+
+	value, ok := lookup(name)
+	if hasDefault {
+		if ok && value != "" {
+			return value, nil
+		}
+		return interpolate(def, lookup)
+	}
+	if !ok {
+		return "", fmt.Errorf("variable %s is not set", name)
+	}
+	return value, nil
+}
@@ -0,0 +1,265 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/containerd/nri/pkg/api"
+)
+
+const (
+	// journalDir is where systemd keeps its persistent journal.
+	journalDir = "/var/log/journal"
+
+	// journalCaptureDir is the directory below stateDir the captured
+	// journals are written to, one file per container.
+	journalCaptureDir = "journals"
+)
+
+// machineIDPattern matches the per-machine subdirectories of a journal
+// directory.
+var machineIDPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// journalQuery selects entries of the journal files in a host directory:
+// the last lines, or those between since and until.
+type journalQuery struct {
+	dir   string
+	lines int
+	since time.Time
+	until time.Time
+}
+
+func (q journalQuery) args() []string {
+	args := []string{"--directory=" + q.dir, "--no-pager", "--output=short-iso-precise"}
+	if q.lines > 0 {
+		args = append(args, "--lines="+strconv.Itoa(q.lines))
+	}
+	if !q.since.IsZero() {
+		args = append(args, "--since=@"+strconv.FormatInt(q.since.Unix(), 10))
+	}
+	if !q.until.IsZero() {
+		args = append(args, "--until=@"+strconv.FormatInt(q.until.Unix(), 10))
+	}
+	return args
+}
+
+// journalctl reads the entries of the query with journalctl of the plugin.
+func journalctl(ctx context.Context, q journalQuery) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "journalctl", q.args()...)
+	cmd.SysProcAttr = readerProcAttr()
+	out, err := cmd.Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return nil, fmt.Errorf("%w: %s", err, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return nil, err
+	}
+	return out, nil
+}
+
+// persistentJournalDir returns the host directory bind-mounted at
+// /var/log/journal of the container, empty if its journal is not
+// persistent, like with the default tmpfs.
+func persistentJournalDir(container *api.Container) string {
+	var dir string
+	for _, m := range container.GetMounts() {
+		if path.Clean(m.Destination) == journalDir && m.Type == "bind" {
+			dir = m.Source
+		}
+	}
+	return dir
+}
+
+// machineJournalDir returns the subdirectory of a persistent journal
+// directory systemd writes to, named after the machine ID of the
+// container. A directory shared by several containers, or reused with a
+// new machine ID, has several, of which the most recently written one is
+// the container's. Without any, the journal files are expected in the
+// directory itself.
+func machineJournalDir(dir string) (string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+
+	newest, newestTime := dir, time.Time{}
+	for _, e := range entries {
+		if !e.IsDir() || !machineIDPattern.MatchString(e.Name()) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		if info.ModTime().After(newestTime) {
+			newest, newestTime = filepath.Join(dir, e.Name()), info.ModTime()
+		}
+	}
+	return newest, nil
+}
+
+// oomKills returns the number of processes of the container the kernel
+// killed when it ran out of memory, from memory.events of its cgroup on
+// cgroup v2 hosts. NRI passes no exit status of stopped containers, so
+// this is the only stop reason the plugin can tell. Zero if the runtime
+// removed the cgroup already.
+func (p *plugin) oomKills(ctx context.Context, s *containerState) int {
+	if s.host == nil || s.host.CgroupMode != cgroupV2 {
+		return 0
+	}
+	dir, err := containerCgroupDir(s.container.GetLinux().GetCgroupsPath())
+	if err != nil {
+		return 0
+	}
+	data, err := withContext(ctx, func() ([]byte, error) {
+		return os.ReadFile(filepath.Join(p.cgroupFS, dir, "memory.events"))
+	})
+	if err != nil {
+		return 0
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		if name, value, ok := strings.Cut(scanner.Text(), " "); ok && name == "oom_kill" {
+			n, _ := strconv.Atoi(value)
+			return n
+		}
+	}
+	return 0
+}
+
+// captureJournal saves the recent journal of a systemd container which
+// died abnormally, if its journal is persistent, and logs where.
+func (p *plugin) captureJournal(ctx context.Context, cfg *Config, s *containerState, reason string) {
+	if !cfg.JournalCapture.Enabled || persistentJournalDir(s.container) == "" {
+		return
+	}
+	file, err := p.writeJournalCapture(ctx, cfg, s, reason, time.Now())
+	if err != nil {
+		p.log.Warnf("%s: %s, failed to capture its journal: %v", s.name, reason, err)
+		return
+	}
+	p.log.Warnf("%s: %s, captured the journal of the last %v at %s", s.name, reason, cfg.JournalCapture.Window.Duration(), file)
+}
+
+// writeJournalCapture extracts the journal entries of the capture window
+// before now from the persistent journal of the container into a gzip
+// file below stateDir/journals, noting the reason in a header and in the
+// gzip comment. Without the gzip header, zcat shows the same. Captures
+// beyond journalCapture.maxSize keep the newest entries. Captures older
+// than the retention are removed first.
+func (p *plugin) writeJournalCapture(ctx context.Context, cfg *Config, s *containerState, reason string, now time.Time) (string, error) {
+	opts := cfg.JournalCapture
+	if err := pruneJournalCaptures(cfg, now); err != nil {
+		p.stateLog.Warnf("failed to remove old journal captures: %v", err)
+	}
+
+	dir, err := machineJournalDir(persistentJournalDir(s.container))
+	if err != nil {
+		return "", err
+	}
+	q := journalQuery{dir: dir, since: now.Add(-opts.Window.Duration()), until: now}
+	entries, err := p.readJournal(ctx, q)
+	if err != nil {
+		return "", err
+	}
+
+	truncated := false
+	if len(entries) > opts.MaxSize {
+		entries = entries[len(entries)-opts.MaxSize:]
+		if i := bytes.IndexByte(entries, '\n'); i >= 0 {
+			entries = entries[i+1:]
+		}
+		truncated = true
+	}
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Name = s.id + ".log"
+	zw.Comment = reason
+	zw.ModTime = now
+	fmt.Fprintf(zw, "# container: %s (%s)\n", s.name, s.id)
+	fmt.Fprintf(zw, "# reason: %s\n", reason)
+	fmt.Fprintf(zw, "# journal: %s, %s to %s\n", dir, q.since.UTC().Format(time.RFC3339), q.until.UTC().Format(time.RFC3339))
+	if truncated {
+		fmt.Fprintf(zw, "# older entries dropped, the capture is limited to %d bytes\n", opts.MaxSize)
+	}
+	if _, err := zw.Write(entries); err != nil {
+		return "", err
+	}
+	if err := zw.Close(); err != nil {
+		return "", err
+	}
+
+	base, err := renderedDir(cfg, journalCaptureDir, s.id)
+	if err != nil {
+		return "", err
+	}
+	file := base + ".log.gz"
+	if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(file+".tmp", buf.Bytes(), 0o644); err != nil {
+		return "", err
+	}
+	return file, os.Rename(file+".tmp", file)
+}
+
+// pruneJournalCaptures removes the captures older than the retention.
+func pruneJournalCaptures(cfg *Config, now time.Time) error {
+	return pruneOlder(filepath.Join(cfg.StateDir, journalCaptureDir), now.Add(-cfg.JournalCapture.Retention.Duration()))
+}
+
+// capturePastStops captures the journals of the tracked systemd containers
+// which stopped or disappeared while the plugin was not connected to the
+// runtime, when synchronizing with it.
+func (p *plugin) capturePastStops(ctx context.Context, cfg *Config, containers []*api.Container) {
+	if !cfg.JournalCapture.Enabled {
+		return
+	}
+	current := make(map[string]*api.Container, len(containers))
+	for _, c := range containers {
+		current[c.Id] = c
+	}
+	for _, s := range p.state.list() {
+		if s.stopped {
+			continue
+		}
+		c, ok := current[s.id]
+		switch {
+		case !ok:
+			p.captureJournal(ctx, cfg, s, "removed while the plugin was disconnected")
+		case c.State == api.ContainerState_CONTAINER_STOPPED:
+			p.captureJournal(ctx, cfg, s, "stopped while the plugin was disconnected")
+		}
+	}
+}
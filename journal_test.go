@@ -0,0 +1,263 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/containerd/nri/pkg/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testMachineID    = "0123456789abcdef0123456789abcdef"
+	oldTestMachineID = "fedcba9876543210fedcba9876543210"
+)
+
+func TestJournalQueryArgs(t *testing.T) {
+	assert.Equal(t, []string{"--directory=/var/lib/journals/web-0", "--no-pager", "--output=short-iso-precise", "--lines=100"},
+		journalQuery{dir: "/var/lib/journals/web-0", lines: 100}.args())
+
+	until := time.Unix(1760608800, 0)
+	assert.Equal(t, []string{"--directory=/j", "--no-pager", "--output=short-iso-precise", "--since=@1760608200", "--until=@1760608800"},
+		journalQuery{dir: "/j", since: until.Add(-10 * time.Minute), until: until}.args())
+}
+
+func TestMachineJournalDir(t *testing.T) {
+	dir := t.TempDir()
+	got, err := machineJournalDir(dir)
+	require.NoError(t, err)
+	assert.Equal(t, dir, got)
+
+	for _, name := range []string{oldTestMachineID, testMachineID, "lost+found"} {
+		require.NoError(t, os.Mkdir(filepath.Join(dir, name), 0o755))
+	}
+	now := time.Now()
+	require.NoError(t, os.Chtimes(filepath.Join(dir, oldTestMachineID), now.Add(-time.Hour), now.Add(-time.Hour)))
+	require.NoError(t, os.Chtimes(filepath.Join(dir, "lost+found"), now.Add(time.Hour), now.Add(time.Hour)))
+
+	got, err = machineJournalDir(dir)
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, testMachineID), got)
+
+	_, err = machineJournalDir(filepath.Join(dir, "missing"))
+	assert.Error(t, err)
+}
+
+func TestJournalCapture(t *testing.T) {
+	const scope = "kubepods.slice/kubepods-pod1.slice/cri-containerd-test-container-id-12345.scope"
+
+	// captureTestPlugin returns a plugin capturing journals, tracking a
+	// systemd container with its journal in a fixture directory, and the
+	// queries of the journal.
+	captureTestPlugin := func(t *testing.T, fn func(*Config)) (*plugin, *api.Container, *[]journalQuery) {
+		p := newTestPlugin(configWith(func(c *Config) {
+			c.StateDir = t.TempDir()
+			c.JournalCapture.Enabled = true
+			if fn != nil {
+				fn(c)
+			}
+		}))
+		p.cgroupFS = t.TempDir()
+		require.NoError(t, os.MkdirAll(filepath.Join(p.cgroupFS, scope), 0o755))
+
+		journals := t.TempDir()
+		require.NoError(t, os.Mkdir(filepath.Join(journals, testMachineID), 0o755))
+
+		var queries []journalQuery
+		p.readJournal = func(_ context.Context, q journalQuery) ([]byte, error) {
+			queries = append(queries, q)
+			return []byte("2026-10-16T10:00:00.000000+00:00 web kernel: Out of memory\n" +
+				"2026-10-16T10:00:01.000000+00:00 web systemd[1]: app.service: Failed with result 'oom-kill'.\n"), nil
+		}
+
+		container := newProfileTestContainer(nil, &api.Mount{Destination: "/var/log/journal", Type: "bind", Source: journals})
+		container.Linux.CgroupsPath = "kubepods-pod1.slice:cri-containerd:test-container-id-12345"
+		_, _, err := p.CreateContainer(context.Background(), &api.PodSandbox{}, container)
+		require.NoError(t, err)
+		return p, container, &queries
+	}
+	oomKilled := func(t *testing.T, p *plugin) {
+		require.NoError(t, os.WriteFile(filepath.Join(p.cgroupFS, scope, "memory.events"),
+			[]byte("low 0\nhigh 0\nmax 12\noom 1\noom_kill 2\n"), 0o644))
+	}
+	captureFile := func(p *plugin) string {
+		return filepath.Join(p.config().StateDir, "journals", "test-container-id-12345.log.gz")
+	}
+	readCapture := func(t *testing.T, file string) (*gzip.Reader, string) {
+		f, err := os.Open(file)
+		require.NoError(t, err)
+		t.Cleanup(func() { f.Close() })
+		zr, err := gzip.NewReader(f)
+		require.NoError(t, err)
+		data, err := io.ReadAll(zr)
+		require.NoError(t, err)
+		return zr, string(data)
+	}
+
+	t.Run("event mask", func(t *testing.T) {
+		events := eventMask(configWith(func(c *Config) { c.JournalCapture.Enabled = true }))
+		assert.True(t, events.IsSet(api.Event_STOP_CONTAINER))
+		assert.False(t, events.IsSet(api.Event_POST_START_CONTAINER))
+	})
+
+	t.Run("OOM-killed", func(t *testing.T) {
+		p, container, queries := captureTestPlugin(t, nil)
+		oomKilled(t, p)
+
+		before := time.Now()
+		_, err := p.StopContainer(context.Background(), &api.PodSandbox{}, container)
+		require.NoError(t, err)
+
+		require.Len(t, *queries, 1)
+		q := (*queries)[0]
+		assert.Equal(t, filepath.Join(persistentJournalDir(container), testMachineID), q.dir)
+		assert.Zero(t, q.lines)
+		assert.False(t, q.until.Before(before))
+		assert.Equal(t, 10*time.Minute, q.until.Sub(q.since))
+
+		zr, content := readCapture(t, captureFile(p))
+		assert.Equal(t, "OOM-killed, 2 processes killed by the kernel", zr.Comment)
+		assert.Equal(t, "test-container-id-12345.log", zr.Name)
+		assert.Equal(t, fmt.Sprintf("# container: /test-container-systemd (test-container-id-12345)\n"+
+			"# reason: OOM-killed, 2 processes killed by the kernel\n"+
+			"# journal: %s, %s to %s\n"+
+			"2026-10-16T10:00:00.000000+00:00 web kernel: Out of memory\n"+
+			"2026-10-16T10:00:01.000000+00:00 web systemd[1]: app.service: Failed with result 'oom-kill'.\n",
+			q.dir, q.since.UTC().Format(time.RFC3339), q.until.UTC().Format(time.RFC3339)), content)
+		assert.True(t, p.state.get(container.Id).stopped)
+	})
+
+	t.Run("window", func(t *testing.T) {
+		p, container, queries := captureTestPlugin(t, func(c *Config) { c.JournalCapture.Window = Duration(2 * time.Minute) })
+		oomKilled(t, p)
+
+		_, err := p.StopContainer(context.Background(), &api.PodSandbox{}, container)
+		require.NoError(t, err)
+		require.Len(t, *queries, 1)
+		assert.Equal(t, 2*time.Minute, (*queries)[0].until.Sub((*queries)[0].since))
+	})
+
+	t.Run("stopped normally", func(t *testing.T) {
+		p, container, queries := captureTestPlugin(t, nil)
+		require.NoError(t, os.WriteFile(filepath.Join(p.cgroupFS, scope, "memory.events"), []byte("oom 0\noom_kill 0\n"), 0o644))
+
+		_, err := p.StopContainer(context.Background(), &api.PodSandbox{}, container)
+		require.NoError(t, err)
+		assert.Empty(t, *queries)
+		assert.NoFileExists(t, captureFile(p))
+	})
+
+	t.Run("journal not persistent", func(t *testing.T) {
+		p, _, queries := captureTestPlugin(t, nil)
+		oomKilled(t, p)
+		container := newProfileTestContainer(nil)
+		container.Linux.CgroupsPath = "kubepods-pod1.slice:cri-containerd:test-container-id-12345"
+		_, _, err := p.CreateContainer(context.Background(), &api.PodSandbox{}, container)
+		require.NoError(t, err)
+
+		_, err = p.StopContainer(context.Background(), &api.PodSandbox{}, container)
+		require.NoError(t, err)
+		assert.Empty(t, *queries)
+		assert.NoFileExists(t, captureFile(p))
+	})
+
+	t.Run("failed boot", func(t *testing.T) {
+		p, container, _ := captureTestPlugin(t, func(c *Config) { c.BootCheckWindow = Duration(time.Minute) })
+		container.State = api.ContainerState_CONTAINER_STOPPED
+
+		require.NoError(t, p.PostStartContainer(context.Background(), &api.PodSandbox{}, container))
+		zr, _ := readCapture(t, captureFile(p))
+		assert.Equal(t, "exited right after starting, systemd likely failed to boot", zr.Comment)
+	})
+
+	t.Run("capped in size", func(t *testing.T) {
+		p, container, _ := captureTestPlugin(t, func(c *Config) { c.JournalCapture.MaxSize = 100 })
+		oomKilled(t, p)
+		var lines []string
+		for i := range 10 {
+			lines = append(lines, fmt.Sprintf("2026-10-16T10:00:%02d web app[7]: line %d", i, i))
+		}
+		p.readJournal = func(context.Context, journalQuery) ([]byte, error) {
+			return []byte(strings.Join(lines, "\n") + "\n"), nil
+		}
+
+		_, err := p.StopContainer(context.Background(), &api.PodSandbox{}, container)
+		require.NoError(t, err)
+		_, content := readCapture(t, captureFile(p))
+		assert.Contains(t, content, "# older entries dropped, the capture is limited to 100 bytes\n")
+		assert.True(t, strings.HasSuffix(content, "\n"+strings.Join(lines[8:], "\n")+"\n"))
+		assert.NotContains(t, content, "line 7")
+	})
+
+	t.Run("retention", func(t *testing.T) {
+		p, container, _ := captureTestPlugin(t, func(c *Config) { c.JournalCapture.Retention = Duration(24 * time.Hour) })
+		oomKilled(t, p)
+		dir := filepath.Join(p.config().StateDir, "journals")
+		require.NoError(t, os.MkdirAll(dir, 0o755))
+		old := filepath.Join(dir, "old.log.gz")
+		require.NoError(t, os.WriteFile(old, nil, 0o644))
+		require.NoError(t, os.Chtimes(old, time.Now().Add(-48*time.Hour), time.Now().Add(-48*time.Hour)))
+
+		_, err := p.StopContainer(context.Background(), &api.PodSandbox{}, container)
+		require.NoError(t, err)
+		assert.NoFileExists(t, old)
+		assert.FileExists(t, captureFile(p))
+
+		require.NoError(t, pruneJournalCaptures(p.config(), time.Now().Add(25*time.Hour)))
+		assert.NoFileExists(t, captureFile(p))
+	})
+
+	t.Run("stopped while disconnected", func(t *testing.T) {
+		p, container, _ := captureTestPlugin(t, nil)
+		container.State = api.ContainerState_CONTAINER_STOPPED
+
+		_, err := p.Synchronize(context.Background(), nil, []*api.Container{container})
+		require.NoError(t, err)
+		zr, _ := readCapture(t, captureFile(p))
+		assert.Equal(t, "stopped while the plugin was disconnected", zr.Comment)
+	})
+
+	t.Run("removed while disconnected", func(t *testing.T) {
+		p, _, _ := captureTestPlugin(t, nil)
+
+		_, err := p.Synchronize(context.Background(), nil, nil)
+		require.NoError(t, err)
+		zr, _ := readCapture(t, captureFile(p))
+		assert.Equal(t, "removed while the plugin was disconnected", zr.Comment)
+	})
+
+	t.Run("stop already handled", func(t *testing.T) {
+		p, container, queries := captureTestPlugin(t, nil)
+		_, err := p.StopContainer(context.Background(), &api.PodSandbox{}, container)
+		require.NoError(t, err)
+		container.State = api.ContainerState_CONTAINER_STOPPED
+
+		_, err = p.Synchronize(context.Background(), nil, []*api.Container{container})
+		require.NoError(t, err)
+		assert.Empty(t, *queries)
+	})
+}
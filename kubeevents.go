@@ -0,0 +1,246 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/containerd/nri/pkg/api"
+)
+
+const (
+	// serviceAccountDir is where Kubernetes mounts the credentials of the
+	// service account of the pod.
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+	kubeEventComponent = "nri-plugin-systemd"
+	kubeEventNormal    = "Normal"
+	kubeEventWarning   = "Warning"
+
+	kubeReasonAdjusted = "SystemdAdjusted"
+	kubeReasonFailed   = "SystemdAdjustmentFailed"
+
+	// maxKubeEventMessage is the size messages are truncated to, the limit
+	// of the API server for events.k8s.io events.
+	maxKubeEventMessage = 1024
+
+	// kubeEventQueueSize bounds the events waiting to be posted. Events are
+	// dropped while the queue is full, so a slow or unavailable API server
+	// never delays creating containers.
+	kubeEventQueueSize = 128
+	kubeEventTimeout   = 10 * time.Second
+)
+
+// kubeEvent is a core/v1 Event on the pod of a container, shown by kubectl
+// describe pod. Only the fields set by the plugin are declared.
+type kubeEvent struct {
+	APIVersion         string          `json:"apiVersion"`
+	Kind               string          `json:"kind"`
+	Metadata           kubeObjectMeta  `json:"metadata"`
+	InvolvedObject     kubeObjectRef   `json:"involvedObject"`
+	Reason             string          `json:"reason"`
+	Message            string          `json:"message"`
+	Type               string          `json:"type"`
+	Source             kubeEventSource `json:"source"`
+	FirstTimestamp     time.Time       `json:"firstTimestamp"`
+	LastTimestamp      time.Time       `json:"lastTimestamp"`
+	Count              int             `json:"count"`
+	ReportingComponent string          `json:"reportingComponent"`
+	ReportingInstance  string          `json:"reportingInstance"`
+}
+
+type kubeObjectMeta struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+}
+
+type kubeObjectRef struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Namespace  string `json:"namespace"`
+	Name       string `json:"name"`
+	UID        string `json:"uid,omitempty"`
+	FieldPath  string `json:"fieldPath,omitempty"`
+}
+
+type kubeEventSource struct {
+	Component string `json:"component"`
+	Host      string `json:"host,omitempty"`
+}
+
+// newKubeEvent returns an event of the given type and reason on the pod of
+// the container, reported from the node. Like kubelet, it is named after
+// the pod and the time in nanoseconds, which keeps names unique.
+func newKubeEvent(pod *api.PodSandbox, container *api.Container, eventType, reason, message, node string, now time.Time) *kubeEvent {
+	name := fmt.Sprintf("%s.%x", pod.Name, now.UnixNano())
+	now = now.UTC().Truncate(time.Second)
+	if len(message) > maxKubeEventMessage {
+		message = message[:maxKubeEventMessage-3] + "..."
+	}
+
+	e := &kubeEvent{
+		APIVersion: "v1",
+		Kind:       "Event",
+		Metadata: kubeObjectMeta{
+			Name:      name,
+			Namespace: pod.Namespace,
+		},
+		InvolvedObject: kubeObjectRef{
+			APIVersion: "v1",
+			Kind:       "Pod",
+			Namespace:  pod.Namespace,
+			Name:       pod.Name,
+			UID:        pod.Uid,
+		},
+		Reason:             reason,
+		Message:            message,
+		Type:               eventType,
+		Source:             kubeEventSource{Component: kubeEventComponent, Host: node},
+		FirstTimestamp:     now,
+		LastTimestamp:      now,
+		Count:              1,
+		ReportingComponent: kubeEventComponent,
+		ReportingInstance:  kubeEventComponent + "-" + node,
+	}
+	if container != nil && container.Name != "" {
+		e.InvolvedObject.FieldPath = fmt.Sprintf("spec.containers{%s}", container.Name)
+	}
+	return e
+}
+
+// kubeEventRecorder posts events to the Kubernetes API server in the
+// background, with the credentials of a service account.
+type kubeEventRecorder struct {
+	server    string
+	tokenFile string
+	node      string
+	client    *http.Client
+	queue     chan *kubeEvent
+	log       *logger
+}
+
+// newKubeEventRecorder returns a recorder using the in-cluster
+// configuration: the API server from the KUBERNETES_SERVICE_HOST and
+// KUBERNETES_SERVICE_PORT variables, and the token and CA of the service
+// account in dir. Events are reported from the given node.
+func newKubeEventRecorder(dir, node string, log *logger) (*kubeEventRecorder, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT must be set for Kubernetes events")
+	}
+
+	pem, err := os.ReadFile(filepath.Join(dir, "ca.crt"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the CA of the service account: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", filepath.Join(dir, "ca.crt"))
+	}
+
+	client := &http.Client{
+		Timeout:   kubeEventTimeout,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+	}
+	return &kubeEventRecorder{
+		server:    "https://" + net.JoinHostPort(host, port),
+		tokenFile: filepath.Join(dir, "token"),
+		node:      node,
+		client:    client,
+		queue:     make(chan *kubeEvent, kubeEventQueueSize),
+		log:       log,
+	}, nil
+}
+
+// record queues an event on the pod of the container, dropping it if the
+// queue is full.
+func (r *kubeEventRecorder) record(pod *api.PodSandbox, container *api.Container, eventType, reason, message string) {
+	e := newKubeEvent(pod, container, eventType, reason, message, r.node, time.Now())
+	select {
+	case r.queue <- e:
+	default:
+		r.log.Warnf("dropped Kubernetes event %s on pod %s/%s, too many events pending",
+			reason, pod.Namespace, pod.Name)
+	}
+}
+
+// run posts the queued events until the context is done.
+func (r *kubeEventRecorder) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-r.queue:
+			if err := r.post(ctx, e); err != nil {
+				r.log.Warnf("failed to post Kubernetes event %s on pod %s/%s: %v",
+					e.Reason, e.Metadata.Namespace, e.InvolvedObject.Name, err)
+			}
+		}
+	}
+}
+
+func (r *kubeEventRecorder) post(ctx context.Context, e *kubeEvent) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	// projected service account tokens are rotated, so read it every time
+	token, err := os.ReadFile(r.tokenFile)
+	if err != nil {
+		return fmt.Errorf("failed to read the service account token: %w", err)
+	}
+
+	url := fmt.Sprintf("%s/api/v1/namespaces/%s/events", r.server, e.Metadata.Namespace)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("API server returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// kubeEvent records an event on the pod of the container, if Kubernetes
+// events are enabled and the container belongs to a pod.
+func (p *plugin) kubeEvent(pod *api.PodSandbox, container *api.Container, eventType, reason, message string) {
+	if p.kubeEvents == nil || pod == nil || pod.Name == "" || pod.Namespace == "" {
+		return
+	}
+	p.kubeEvents.record(pod, container, eventType, reason, message)
+}
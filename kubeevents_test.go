@@ -0,0 +1,195 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/containerd/nri/pkg/api"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var kubeEventPod = &api.PodSandbox{Name: "web-0", Namespace: "apps", Uid: "0d3e9c1a"}
+
+func TestNewKubeEvent(t *testing.T) {
+	now := time.Date(2026, 10, 16, 12, 30, 5, 123456789, time.UTC)
+	container := &api.Container{Name: "systemd"}
+
+	e := newKubeEvent(kubeEventPod, container, kubeEventNormal, kubeReasonAdjusted, "Adjusted for systemd", "node-1", now)
+
+	data, err := json.Marshal(e)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{
+		"apiVersion": "v1",
+		"kind": "Event",
+		"metadata": {"name": "web-0.18df0263f93f8f15", "namespace": "apps"},
+		"involvedObject": {
+			"apiVersion": "v1",
+			"kind": "Pod",
+			"namespace": "apps",
+			"name": "web-0",
+			"uid": "0d3e9c1a",
+			"fieldPath": "spec.containers{systemd}"
+		},
+		"reason": "SystemdAdjusted",
+		"message": "Adjusted for systemd",
+		"type": "Normal",
+		"source": {"component": "nri-plugin-systemd", "host": "node-1"},
+		"firstTimestamp": "2026-10-16T12:30:05Z",
+		"lastTimestamp": "2026-10-16T12:30:05Z",
+		"count": 1,
+		"reportingComponent": "nri-plugin-systemd",
+		"reportingInstance": "nri-plugin-systemd-node-1"
+	}`, string(data))
+
+	t.Run("long message truncated", func(t *testing.T) {
+		e := newKubeEvent(kubeEventPod, nil, kubeEventWarning, kubeReasonFailed, strings.Repeat("x", 2000), "node-1", now)
+		assert.Len(t, e.Message, maxKubeEventMessage)
+		assert.True(t, strings.HasSuffix(e.Message, "..."))
+		assert.Empty(t, e.InvolvedObject.FieldPath)
+	})
+}
+
+// newTestKubeEventRecorder returns a recorder posting to a TLS test server
+// handing the requests to handler.
+func newTestKubeEventRecorder(t *testing.T, handler http.HandlerFunc) *kubeEventRecorder {
+	server := httptest.NewTLSServer(handler)
+	t.Cleanup(server.Close)
+
+	dir := t.TempDir()
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "ca.crt"), ca, 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "token"), []byte("secret-token\n"), 0o600))
+
+	host, port, ok := strings.Cut(strings.TrimPrefix(server.URL, "https://"), ":")
+	require.True(t, ok)
+	t.Setenv("KUBERNETES_SERVICE_HOST", host)
+	t.Setenv("KUBERNETES_SERVICE_PORT", port)
+
+	base := logrus.New()
+	base.SetOutput(io.Discard)
+	r, err := newKubeEventRecorder(dir, "node-1", newLoggers(base).get(logDefault))
+	require.NoError(t, err)
+	return r
+}
+
+func TestKubeEventRecorder(t *testing.T) {
+	t.Run("post", func(t *testing.T) {
+		var (
+			path, auth string
+			posted     kubeEvent
+		)
+		r := newTestKubeEventRecorder(t, func(w http.ResponseWriter, req *http.Request) {
+			path, auth = req.URL.Path, req.Header.Get("Authorization")
+			assert.NoError(t, json.NewDecoder(req.Body).Decode(&posted))
+			w.WriteHeader(http.StatusCreated)
+		})
+
+		e := newKubeEvent(kubeEventPod, nil, kubeEventWarning, kubeReasonFailed, "cgroup mount required", r.node, time.Now())
+		require.NoError(t, r.post(context.Background(), e))
+		assert.Equal(t, "/api/v1/namespaces/apps/events", path)
+		assert.Equal(t, "Bearer secret-token", auth)
+		assert.Equal(t, "web-0", posted.InvolvedObject.Name)
+		assert.Equal(t, "node-1", posted.Source.Host)
+	})
+
+	t.Run("rejected", func(t *testing.T) {
+		r := newTestKubeEventRecorder(t, func(w http.ResponseWriter, _ *http.Request) {
+			http.Error(w, `events is forbidden`, http.StatusForbidden)
+		})
+
+		e := newKubeEvent(kubeEventPod, nil, kubeEventNormal, kubeReasonAdjusted, "adjusted", r.node, time.Now())
+		err := r.post(context.Background(), e)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "403")
+		assert.Contains(t, err.Error(), "events is forbidden")
+	})
+
+	t.Run("queue full", func(t *testing.T) {
+		r := newTestKubeEventRecorder(t, func(http.ResponseWriter, *http.Request) {})
+		for range kubeEventQueueSize + 10 {
+			r.record(kubeEventPod, nil, kubeEventNormal, kubeReasonAdjusted, "adjusted")
+		}
+		assert.Len(t, r.queue, kubeEventQueueSize)
+	})
+}
+
+func TestPluginKubeEvents(t *testing.T) {
+	newPlugin := func(t *testing.T, cfg *Config) *plugin {
+		p := newTestPlugin(cfg)
+		p.kubeEvents = newTestKubeEventRecorder(t, func(http.ResponseWriter, *http.Request) {})
+		return p
+	}
+	next := func(t *testing.T, p *plugin) *kubeEvent {
+		select {
+		case e := <-p.kubeEvents.queue:
+			return e
+		default:
+			t.Fatal("no Kubernetes event recorded")
+			return nil
+		}
+	}
+
+	t.Run("adjusted", func(t *testing.T) {
+		p := newPlugin(t, nil)
+		_, _, err := p.CreateContainer(context.Background(), kubeEventPod, newProfileTestContainer(nil))
+		require.NoError(t, err)
+
+		e := next(t, p)
+		assert.Equal(t, kubeEventNormal, e.Type)
+		assert.Equal(t, kubeReasonAdjusted, e.Reason)
+		assert.Equal(t, "apps", e.Metadata.Namespace)
+		assert.Contains(t, e.Message, "cgroup")
+	})
+
+	t.Run("missing cgroup mount", func(t *testing.T) {
+		p := newPlugin(t, configWith(func(c *Config) { c.AddMissingCgroupMount = false }))
+		container := newProfileTestContainer(nil)
+		container.Mounts = []*api.Mount{{Destination: "/data", Type: "bind", Source: "/srv/data", Options: []string{"rbind"}}}
+
+		_, _, err := p.CreateContainer(context.Background(), kubeEventPod, container)
+		require.Error(t, err)
+
+		e := next(t, p)
+		assert.Equal(t, kubeEventWarning, e.Type)
+		assert.Equal(t, kubeReasonFailed, e.Reason)
+		assert.Contains(t, e.Message, "cgroup mount required")
+		assert.Contains(t, e.Message, "container creation failed")
+	})
+
+	t.Run("not a systemd container", func(t *testing.T) {
+		p := newPlugin(t, nil)
+		container := newProfileTestContainer(nil)
+		container.Args = []string{"/usr/bin/nginx"}
+
+		_, _, err := p.CreateContainer(context.Background(), kubeEventPod, container)
+		require.NoError(t, err)
+		assert.Empty(t, p.kubeEvents.queue)
+	})
+}
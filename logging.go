@@ -0,0 +1,243 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Modules of the plugin with their own log level.
+const (
+	// logDefault covers everything not in another module.
+	logDefault = "default"
+	// logDetect covers detecting and skipping systemd containers.
+	logDetect = "detect"
+	// logMounts covers the mounts and files of the adjustment steps.
+	logMounts = "mounts"
+	// logHost covers probing the host: cgroups, controllers and sysctls.
+	logHost = "host"
+	// logState covers tracking containers, drift checks and rendered files.
+	logState = "state"
+	// logMetrics covers serving and pushing metrics.
+	logMetrics = "metrics"
+)
+
+var logModules = []string{logDefault, logDetect, logMounts, logHost, logState, logMetrics}
+
+// parseLogLevels parses comma-separated module=level pairs, like
+// "mounts=debug,default=info". A level without a module is the one of the
+// default module.
+func parseLogLevels(s string) (map[string]logrus.Level, error) {
+	levels := map[string]logrus.Level{}
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		module, value, ok := strings.Cut(entry, "=")
+		if !ok {
+			module, value = logDefault, entry
+		}
+		module = strings.TrimSpace(module)
+		if !slices.Contains(logModules, module) {
+			return nil, fmt.Errorf("unknown log module %q, must be one of %s", module, strings.Join(logModules, ", "))
+		}
+		level, err := logrus.ParseLevel(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("invalid log level for %s: %w", module, err)
+		}
+		levels[module] = level
+	}
+	return levels, nil
+}
+
+// resolveLogLevels returns the level of every module: the one given for the
+// module, else the one given for the default module, else its current one.
+func resolveLogLevels(levels map[string]logrus.Level, current func(module string) logrus.Level) map[string]logrus.Level {
+	resolved := make(map[string]logrus.Level, len(logModules))
+	for _, module := range logModules {
+		if level, ok := levels[module]; ok {
+			resolved[module] = level
+		} else if level, ok := levels[logDefault]; ok {
+			resolved[module] = level
+		} else {
+			resolved[module] = current(module)
+		}
+	}
+	return resolved
+}
+
+// logger logs the messages of a module at the level of the module, through
+// the logger of the plugin. Messages of modules other than the default one
+// carry the module in a field.
+type logger struct {
+	base   *logrus.Logger
+	module string
+	level  *atomic.Uint32
+	fields logrus.Fields
+}
+
+func (l *logger) enabled(level logrus.Level) bool {
+	return level <= logrus.Level(l.level.Load())
+}
+
+func (l *logger) logf(level logrus.Level, format string, args ...any) {
+	if !l.enabled(level) {
+		return
+	}
+	entry := logrus.NewEntry(l.base)
+	if l.module != logDefault {
+		entry = entry.WithField("module", l.module)
+	}
+	if len(l.fields) > 0 {
+		entry = entry.WithFields(l.fields)
+	}
+	entry.Logf(level, format, args...)
+}
+
+func (l *logger) Debugf(format string, args ...any) { l.logf(logrus.DebugLevel, format, args...) }
+func (l *logger) Infof(format string, args ...any)  { l.logf(logrus.InfoLevel, format, args...) }
+func (l *logger) Warnf(format string, args ...any)  { l.logf(logrus.WarnLevel, format, args...) }
+func (l *logger) Errorf(format string, args ...any) { l.logf(logrus.ErrorLevel, format, args...) }
+
+// WithFields returns a logger of the same module adding the fields to its
+// messages.
+func (l *logger) WithFields(fields logrus.Fields) *logger {
+	derived := *l
+	derived.fields = maps.Clone(l.fields)
+	if derived.fields == nil {
+		derived.fields = logrus.Fields{}
+	}
+	maps.Copy(derived.fields, fields)
+	return &derived
+}
+
+// loggers are the loggers of all modules, sharing one logrus logger which
+// lets everything through and leaves filtering to them.
+type loggers struct {
+	base   *logrus.Logger
+	levels map[string]*atomic.Uint32
+
+	mu sync.Mutex
+	// configured are the levels of the configuration, restored when
+	// debug logging is toggled off.
+	configured map[string]logrus.Level
+	toggled    bool
+}
+
+func newLoggers(base *logrus.Logger) *loggers {
+	base.SetLevel(logrus.TraceLevel)
+	l := &loggers{
+		base:   base,
+		levels: make(map[string]*atomic.Uint32, len(logModules)),
+	}
+	for _, module := range logModules {
+		l.levels[module] = &atomic.Uint32{}
+		l.levels[module].Store(uint32(logrus.InfoLevel))
+	}
+	return l
+}
+
+func (l *loggers) get(module string) *logger {
+	return &logger{base: l.base, module: module, level: l.levels[module]}
+}
+
+func (l *loggers) current(module string) logrus.Level {
+	return logrus.Level(l.levels[module].Load())
+}
+
+// configure sets the levels of the configuration, with modules without
+// a level of their own at debug if verbose and at info otherwise. It ends
+// debug logging toggled on and drops levels changed at runtime.
+func (l *loggers) configure(levels map[string]logrus.Level, verbose bool) {
+	fallback := logrus.InfoLevel
+	if verbose {
+		fallback = logrus.DebugLevel
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.configured = resolveLogLevels(levels, func(string) logrus.Level { return fallback })
+	l.toggled = false
+	l.store(l.configured)
+}
+
+// set changes the levels of the given modules at runtime, until the
+// configuration is loaded again. A level for the default module also
+// applies to the modules without their own.
+func (l *loggers) set(levels map[string]logrus.Level) map[string]logrus.Level {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	resolved := resolveLogLevels(levels, l.current)
+	l.store(resolved)
+	return resolved
+}
+
+// toggleDebug switches all modules to at least debug, or back to the levels
+// of the configuration. It returns whether debug logging is on.
+func (l *loggers) toggleDebug() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.toggled = !l.toggled
+	if !l.toggled {
+		l.store(l.configured)
+		return false
+	}
+	debug := make(map[string]logrus.Level, len(logModules))
+	for _, module := range logModules {
+		debug[module] = max(l.current(module), logrus.DebugLevel)
+	}
+	l.store(debug)
+	return true
+}
+
+func (l *loggers) store(levels map[string]logrus.Level) {
+	for module, level := range levels {
+		l.levels[module].Store(uint32(level))
+	}
+}
+
+// list returns the current level of every module.
+func (l *loggers) list() map[string]string {
+	levels := make(map[string]string, len(logModules))
+	for _, module := range logModules {
+		levels[module] = l.current(module).String()
+	}
+	return levels
+}
+
+// toggleDebugOnSignal toggles debug logging of all modules on SIGUSR1.
+func (p *plugin) toggleDebugOnSignal() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR1)
+	for range ch {
+		if p.logs.toggleDebug() {
+			p.log.Infof("debug logging of all modules on by SIGUSR1")
+		} else {
+			p.log.Infof("debug logging off by SIGUSR1, back to the configured log levels")
+		}
+	}
+}
@@ -0,0 +1,160 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/containerd/nri/pkg/api"
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLogLevels(t *testing.T) {
+	levels, err := parseLogLevels("detect=debug, mounts=trace,default=warn")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]logrus.Level{
+		logDetect:  logrus.DebugLevel,
+		logMounts:  logrus.TraceLevel,
+		logDefault: logrus.WarnLevel,
+	}, levels)
+
+	levels, err = parseLogLevels("debug")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]logrus.Level{logDefault: logrus.DebugLevel}, levels)
+
+	levels, err = parseLogLevels("")
+	require.NoError(t, err)
+	assert.Empty(t, levels)
+
+	for _, s := range []string{"mount=debug", "detect=loud", "=debug", "detect=", "detect=debug,cgroups=info"} {
+		_, err := parseLogLevels(s)
+		assert.Error(t, err, s)
+	}
+}
+
+// debugModules returns the modules of the debug lines logged.
+func debugModules(hook *logtest.Hook) []string {
+	var modules []string
+	for _, e := range hook.AllEntries() {
+		if e.Level != logrus.DebugLevel {
+			continue
+		}
+		module, _ := e.Data["module"].(string)
+		if module == "" {
+			module = logDefault
+		}
+		if !slices.Contains(modules, module) {
+			modules = append(modules, module)
+		}
+	}
+	return modules
+}
+
+func TestModuleLogLevels(t *testing.T) {
+	adjustContainers := func(p *plugin) {
+		_, _, err := p.CreateContainer(context.Background(), nil, newProfileTestContainer(nil))
+		require.NoError(t, err)
+		other := &api.Container{Id: "other", Name: "other", Args: []string{"/bin/sh"}}
+		_, _, err = p.CreateContainer(context.Background(), nil, other)
+		require.NoError(t, err)
+	}
+
+	t.Run("only the targeted module", func(t *testing.T) {
+		p := newTestPlugin(configWith(func(c *Config) { c.LogLevel = "mounts=debug,default=info" }))
+		hook := logtest.NewLocal(p.logs.base)
+
+		adjustContainers(p)
+		assert.Equal(t, []string{logMounts}, debugModules(hook))
+	})
+
+	t.Run("verbose", func(t *testing.T) {
+		p := newTestPlugin(configWith(func(c *Config) {
+			c.Verbose = true
+			c.LogLevel = "mounts=info"
+		}))
+		hook := logtest.NewLocal(p.logs.base)
+
+		adjustContainers(p)
+		modules := debugModules(hook)
+		assert.Contains(t, modules, logDetect)
+		assert.NotContains(t, modules, logMounts)
+	})
+
+	t.Run("toggled", func(t *testing.T) {
+		p := newTestPlugin(configWith(func(c *Config) { c.LogLevel = "mounts=trace" }))
+		hook := logtest.NewLocal(p.logs.base)
+
+		require.True(t, p.logs.toggleDebug())
+		assert.Equal(t, "trace", p.logs.list()[logMounts])
+		adjustContainers(p)
+		assert.Contains(t, debugModules(hook), logDetect)
+
+		hook.Reset()
+		require.False(t, p.logs.toggleDebug())
+		assert.Equal(t, map[string]string{
+			logDefault: "info", logDetect: "info", logMounts: "trace",
+			logHost: "info", logState: "info", logMetrics: "info",
+		}, p.logs.list())
+		adjustContainers(p)
+		assert.Equal(t, []string{logMounts}, debugModules(hook))
+	})
+
+	t.Run("debug API", func(t *testing.T) {
+		p := newTestPlugin(nil)
+		hook := logtest.NewLocal(p.logs.base)
+
+		setLevels := func(body string, uid uint32) (int, map[string]string) {
+			req := httptest.NewRequest(http.MethodPut, "/log-level", strings.NewReader(body))
+			req = req.WithContext(context.WithValue(req.Context(), peerUIDKey{}, uid))
+			rec := httptest.NewRecorder()
+			p.debugHandler().ServeHTTP(rec, req)
+			var levels map[string]string
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &levels))
+			return rec.Code, levels
+		}
+
+		code, levels := setLevels("detect=debug", 0)
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, "debug", levels[logDetect])
+		assert.Equal(t, "info", levels[logMounts])
+		adjustContainers(p)
+		assert.Equal(t, []string{logDetect}, debugModules(hook))
+
+		code, _ = setLevels("detect=debug,bogus=debug", 0)
+		assert.Equal(t, http.StatusBadRequest, code)
+		code, _ = setLevels("debug", 65534)
+		assert.Equal(t, http.StatusForbidden, code)
+
+		var current map[string]string
+		assert.Equal(t, http.StatusOK, debugRequest(t, p, http.MethodGet, "/log-level", 65534, &current))
+		assert.Equal(t, "debug", current[logDetect])
+		assert.Equal(t, "info", current[logHost])
+
+		// the configuration replaces levels changed at runtime
+		require.NoError(t, p.setConfig(p.config()))
+		assert.Equal(t, "info", p.logs.list()[logDetect])
+	})
+}
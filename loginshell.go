@@ -0,0 +1,278 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"debug/elf"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+
+	"github.com/containerd/nri/pkg/api"
+)
+
+const (
+	// loginShellName is the name of the login-shell helper. The plugin
+	// binary acts as the helper when run under this name.
+	loginShellName = "login-shell"
+
+	// loginShellPath is where the helper is mounted in systemd containers.
+	loginShellPath = "/run/nri-systemd/bin/" + loginShellName
+
+	// loginShellEnv points users of kubectl exec at the helper.
+	loginShellEnv = "NRI_SYSTEMD_LOGIN_SHELL"
+
+	// loginShellDir is the directory below stateDir the helper is
+	// installed in, as the source of its mounts.
+	loginShellDir = "bin"
+)
+
+// errHelperUnavailable means there is no login-shell helper which could
+// run on the node.
+var errHelperUnavailable = errors.New("login-shell helper unavailable")
+
+// elfMachines are the ELF machines of the architectures the helper is
+// built for.
+var elfMachines = map[string]elf.Machine{
+	"386":     elf.EM_386,
+	"amd64":   elf.EM_X86_64,
+	"arm":     elf.EM_ARM,
+	"arm64":   elf.EM_AARCH64,
+	"ppc64le": elf.EM_PPC64,
+	"riscv64": elf.EM_RISCV,
+	"s390x":   elf.EM_S390,
+}
+
+// checkHelperArch checks that file is a Linux executable for arch.
+func checkHelperArch(file, arch string) error {
+	f, err := elf.Open(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%w: %s does not exist", errHelperUnavailable, file)
+	}
+	var formatErr *elf.FormatError
+	if errors.As(err, &formatErr) {
+		return fmt.Errorf("%w: %s is not a Linux executable", errHelperUnavailable, file)
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if machine, ok := elfMachines[arch]; !ok || f.Machine != machine {
+		return fmt.Errorf("%w: %s is built for %v, not %s", errHelperUnavailable, file, f.Machine, arch)
+	}
+	return nil
+}
+
+// installLoginShell copies the helper below stateDir, unless it is there
+// already, and returns the installed copy. The helper must not be mounted
+// from its original location, which is usually inside the container of the
+// plugin. In a dry run, the helper is only checked.
+func (p *plugin) installLoginShell(cfg *Config) (string, error) {
+	src := cfg.LoginShell.Helper
+	if src == "" {
+		exe, err := os.Executable()
+		if err != nil {
+			return "", fmt.Errorf("%w: %v", errHelperUnavailable, err)
+		}
+		src = exe
+	}
+	if err := checkHelperArch(src, runtime.GOARCH); err != nil {
+		return "", err
+	}
+
+	dest := filepath.Join(cfg.StateDir, loginShellDir, loginShellName)
+	if p.dryRun != nil {
+		return dest, nil
+	}
+
+	p.loginShellMu.Lock()
+	defer p.loginShellMu.Unlock()
+
+	srcInfo, err := os.Stat(src)
+	if err != nil {
+		return "", err
+	}
+	if info, err := os.Stat(dest); err == nil && info.Size() == srcInfo.Size() && !info.ModTime().Before(srcInfo.ModTime()) {
+		return dest, nil
+	}
+
+	if err := copyExecutable(src, dest); err != nil {
+		return "", fmt.Errorf("failed to install the login-shell helper: %w", err)
+	}
+	p.mountLog.Infof("installed the login-shell helper %s at %s", src, dest)
+	return dest, nil
+}
+
+// copyExecutable replaces dest with an executable copy of src, owned by
+// root.
+func copyExecutable(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+		return err
+	}
+	tmp := dest + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o755)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if err := chownToRoot(tmp); err != nil {
+		return err
+	}
+	return os.Rename(tmp, dest)
+}
+
+// addLoginShellMount bind-mounts the login-shell helper read-only into the
+// container, and points users at it with an environment variable. Without a
+// helper for the node, the mount is skipped with a warning.
+func (p *plugin) addLoginShellMount(cfg *Config, adjust *api.ContainerAdjustment, container *api.Container, ctrName string, results *mountResults) error {
+	if hasMount(container, loginShellPath) {
+		p.mountLog.Debugf("%s: %s already mounted, skipping", ctrName, loginShellPath)
+		results.add(loginShellPath, mountSkipped, "already mounted by the container")
+		return nil
+	}
+
+	source, err := p.installLoginShell(cfg)
+	if errors.Is(err, errHelperUnavailable) {
+		p.mountLog.Warnf("%s: not mounting the login-shell helper, %v", ctrName, err)
+		results.add(loginShellPath, mountSkipped, "%v", err)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	adjust.AddMount(&api.Mount{
+		Destination: loginShellPath,
+		Type:        "bind",
+		Source:      source,
+		Options:     []string{"bind", "ro", "nosuid", "nodev"},
+	})
+	if !hasEnv(container, loginShellEnv) {
+		adjust.AddEnv(loginShellEnv, loginShellPath)
+	}
+	p.mountLog.Debugf("%s: mounted the login-shell helper at %s", ctrName, loginShellPath)
+	results.add(loginShellPath, mountAdded, "login-shell helper for kubectl exec")
+
+	return nil
+}
+
+// loginShellRequest is what the login-shell helper was asked to run.
+type loginShellRequest struct {
+	user string
+	// tty tells whether stdin is a terminal, as with kubectl exec -t.
+	tty  bool
+	term string
+	// command runs instead of the login shell of the user, if set.
+	command []string
+}
+
+// loginShellArgs returns the systemd-run command line running the shell,
+// or the command, of the request in a login session of the systemd of the
+// container, like machinectl shell does. Unlike a process started by the
+// runtime, it gets the environment, PAM session and cgroup of a login,
+// so e.g. systemctl --user works. shellOf returns the login shell of a
+// user.
+func loginShellArgs(req loginShellRequest, shellOf func(user string) string) []string {
+	args := []string{"systemd-run", "--quiet", "--wait", "--collect", "--same-dir",
+		"--service-type=exec", "--property=PAMName=login", "--uid=" + req.user}
+	if req.tty {
+		args = append(args, "--pty")
+	} else {
+		args = append(args, "--pipe")
+	}
+	if req.term != "" {
+		args = append(args, "--setenv=TERM="+req.term)
+	}
+
+	args = append(args, "--")
+	if len(req.command) > 0 {
+		return append(args, req.command...)
+	}
+	return append(args, shellOf(req.user), "-l")
+}
+
+// userShell returns the login shell of user in an /etc/passwd file,
+// /bin/sh if it has none.
+func userShell(passwd io.Reader, user string) string {
+	scanner := bufio.NewScanner(passwd)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ":")
+		if len(fields) == 7 && fields[0] == user && fields[6] != "" {
+			return fields[6]
+		}
+	}
+	return "/bin/sh"
+}
+
+// runLoginShell is the login-shell helper, run inside the container by
+// kubectl exec, e.g. kubectl exec -it pod -- /run/nri-systemd/bin/login-shell.
+// It replaces itself with systemd-run and returns only on failure.
+func runLoginShell(args []string) int {
+	flags := flag.NewFlagSet(loginShellName, flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s [-u user] [command [args...]]\n", loginShellName)
+		flags.PrintDefaults()
+	}
+	user := flags.String("u", "root", "user to log in as")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	req := loginShellRequest{user: *user, term: os.Getenv("TERM"), command: flags.Args()}
+	if info, err := os.Stdin.Stat(); err == nil {
+		req.tty = info.Mode()&os.ModeCharDevice != 0
+	}
+
+	argv := loginShellArgs(req, func(user string) string {
+		f, err := os.Open("/etc/passwd")
+		if err != nil {
+			return "/bin/sh"
+		}
+		defer f.Close()
+		return userShell(f, user)
+	})
+
+	systemdRun, err := exec.LookPath(argv[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v, the container needs systemd 240 or later\n", loginShellName, err)
+		return 127
+	}
+	err = syscall.Exec(systemdRun, argv, os.Environ())
+	fmt.Fprintf(os.Stderr, "%s: failed to run %s: %v\n", loginShellName, systemdRun, err)
+	return 126
+}
@@ -0,0 +1,166 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/containerd/nri/pkg/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoginShellMount(t *testing.T) {
+	exe, err := os.Executable()
+	require.NoError(t, err)
+	if checkHelperArch(exe, runtime.GOARCH) != nil {
+		t.Skip("the test binary is no Linux executable")
+	}
+
+	newLoginShellTestPlugin := func(t *testing.T, helper string) *plugin {
+		return newTestPlugin(configWith(func(c *Config) {
+			c.StateDir = t.TempDir()
+			c.LoginShell = LoginShellOptions{Enabled: true, Helper: helper}
+		}))
+	}
+
+	t.Run("mounted", func(t *testing.T) {
+		p := newLoginShellTestPlugin(t, "")
+
+		adjust, _, err := p.CreateContainer(context.Background(), &api.PodSandbox{}, newProfileTestContainer(nil))
+		require.NoError(t, err)
+		installed := filepath.Join(p.config().StateDir, "bin", "login-shell")
+		assert.Equal(t, &api.Mount{
+			Destination: "/run/nri-systemd/bin/login-shell",
+			Type:        "bind",
+			Source:      installed,
+			Options:     []string{"bind", "ro", "nosuid", "nodev"},
+		}, findMount(adjust.Mounts, loginShellPath))
+		assert.Contains(t, adjust.Env, &api.KeyValue{Key: "NRI_SYSTEMD_LOGIN_SHELL", Value: loginShellPath})
+		assert.Contains(t, adjust.Annotations[provenanceAnnotation], "login-shell")
+
+		info, err := os.Stat(installed)
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0o755), info.Mode().Perm())
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		p := newTestPlugin(configWith(func(c *Config) { c.StateDir = t.TempDir() }))
+
+		adjust, _, err := p.CreateContainer(context.Background(), &api.PodSandbox{}, newProfileTestContainer(nil))
+		require.NoError(t, err)
+		assert.Nil(t, findMount(adjust.Mounts, loginShellPath))
+		assert.NotContains(t, adjust.Annotations[provenanceAnnotation], "login-shell")
+	})
+
+	t.Run("helper unavailable", func(t *testing.T) {
+		script := filepath.Join(t.TempDir(), "login-shell.sh")
+		require.NoError(t, os.WriteFile(script, []byte("#!/bin/sh\n"), 0o755))
+
+		for _, helper := range []string{"/nonexistent/login-shell", script} {
+			p := newLoginShellTestPlugin(t, helper)
+
+			adjust, _, err := p.CreateContainer(context.Background(), &api.PodSandbox{}, newProfileTestContainer(nil))
+			require.NoError(t, err)
+			assert.Nil(t, findMount(adjust.Mounts, loginShellPath))
+			for _, env := range adjust.Env {
+				assert.NotEqual(t, loginShellEnv, env.Key)
+			}
+		}
+	})
+
+	t.Run("already mounted", func(t *testing.T) {
+		p := newLoginShellTestPlugin(t, "")
+		container := newProfileTestContainer(nil, &api.Mount{Destination: loginShellPath, Type: "bind", Source: "/opt/login-shell"})
+
+		adjust, _, err := p.CreateContainer(context.Background(), &api.PodSandbox{}, container)
+		require.NoError(t, err)
+		assert.Nil(t, findMount(adjust.Mounts, loginShellPath))
+	})
+}
+
+func TestCheckHelperArch(t *testing.T) {
+	exe, err := os.Executable()
+	require.NoError(t, err)
+	if runtime.GOOS != "linux" {
+		t.Skip("the test binary is no Linux executable")
+	}
+
+	assert.NoError(t, checkHelperArch(exe, runtime.GOARCH))
+
+	other := "riscv64"
+	if runtime.GOARCH == other {
+		other = "amd64"
+	}
+	err = checkHelperArch(exe, other)
+	assert.ErrorIs(t, err, errHelperUnavailable)
+	assert.ErrorContains(t, err, "not "+other)
+
+	assert.ErrorIs(t, checkHelperArch(exe, "mips"), errHelperUnavailable)
+}
+
+func TestLoginShellArgs(t *testing.T) {
+	shellOf := func(user string) string {
+		return map[string]string{"root": "/bin/bash", "dev": "/usr/bin/zsh"}[user]
+	}
+	common := []string{"systemd-run", "--quiet", "--wait", "--collect", "--same-dir",
+		"--service-type=exec", "--property=PAMName=login"}
+
+	tests := []struct {
+		name     string
+		req      loginShellRequest
+		expected []string
+	}{
+		{
+			name:     "interactive shell",
+			req:      loginShellRequest{user: "root", tty: true, term: "xterm"},
+			expected: append(common, "--uid=root", "--pty", "--setenv=TERM=xterm", "--", "/bin/bash", "-l"),
+		},
+		{
+			name:     "shell of another user",
+			req:      loginShellRequest{user: "dev", tty: true},
+			expected: append(common, "--uid=dev", "--pty", "--", "/usr/bin/zsh", "-l"),
+		},
+		{
+			name:     "command without a terminal",
+			req:      loginShellRequest{user: "dev", command: []string{"systemctl", "--user", "status"}},
+			expected: append(common, "--uid=dev", "--pipe", "--", "systemctl", "--user", "status"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, loginShellArgs(tt.req, shellOf))
+		})
+	}
+}
+
+func TestUserShell(t *testing.T) {
+	passwd := "root:x:0:0:root:/root:/bin/bash\n" +
+		"daemon:x:1:1:daemon:/usr/sbin:\n" +
+		"dev:x:1000:1000::/home/dev:/usr/bin/zsh\n"
+
+	assert.Equal(t, "/bin/bash", userShell(strings.NewReader(passwd), "root"))
+	assert.Equal(t, "/usr/bin/zsh", userShell(strings.NewReader(passwd), "dev"))
+	assert.Equal(t, "/bin/sh", userShell(strings.NewReader(passwd), "daemon"))
+	assert.Equal(t, "/bin/sh", userShell(strings.NewReader(passwd), "nobody"))
+}
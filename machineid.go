@@ -0,0 +1,80 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/containerd/nri/pkg/api"
+)
+
+const machineIDFile = "/etc/machine-id"
+
+// machineIDContent is what /etc/machine-id contains in the given mode.
+func machineIDContent(mode MachineID) string {
+	if mode == MachineIDFirstBoot {
+		return "uninitialized\n"
+	}
+	return ""
+}
+
+// addMachineIDMount mounts the rendered /etc/machine-id of the container,
+// unless the container mounts its own. It is writable, so that systemd can
+// commit the generated ID, which only ends up in the file of the container.
+func (p *plugin) addMachineIDMount(cfg *Config, adjust *api.ContainerAdjustment, container *api.Container, ctrName string) error {
+	if hasMount(container, machineIDFile) {
+		p.mountLog.Debugf("%s: %s already mounted, skipping", ctrName, machineIDFile)
+		return nil
+	}
+	dir, err := renderedDir(cfg, renderedMachineID, container.Id)
+	if err != nil {
+		return err
+	}
+
+	adjust.AddMount(&api.Mount{
+		Destination: machineIDFile,
+		Type:        "bind",
+		Source:      filepath.Join(dir, "machine-id"),
+		Options:     []string{"bind", "rw", "nosuid", "nodev", "noexec"},
+	})
+	p.mountLog.Debugf("%s: mounting a %s %s", ctrName, cfg.MachineID, machineIDFile)
+
+	return nil
+}
+
+// renderMachineID renders the /etc/machine-id of the container, replacing
+// an earlier rendering.
+func renderMachineID(ctx context.Context, cfg *Config, _ *api.PodSandbox, container *api.Container) error {
+	dir, err := renderedDir(cfg, renderedMachineID, container.Id)
+	if err != nil {
+		return err
+	}
+
+	return renderDir(ctx, dir, func(tmp string) error {
+		file := filepath.Join(tmp, "machine-id")
+		if err := os.WriteFile(file, []byte(machineIDContent(cfg.MachineID)), 0o644); err != nil {
+			return fmt.Errorf("failed to render %s: %w", machineIDFile, err)
+		}
+		if err := chownToRoot(file); err != nil {
+			return fmt.Errorf("failed to render %s: %w", machineIDFile, err)
+		}
+		return nil
+	})
+}
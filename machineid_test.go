@@ -0,0 +1,94 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/nri/pkg/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMachineID(t *testing.T) {
+	pod := &api.PodSandbox{
+		Name:        "test-pod",
+		Annotations: map[string]string{"io.kubernetes.pod.uid": "d1b2c3a4-0000-4000-8000-000000000001"},
+	}
+
+	for mode, content := range map[MachineID]string{
+		MachineIDEmpty:     "",
+		MachineIDFirstBoot: "uninitialized\n",
+	} {
+		t.Run(string(mode), func(t *testing.T) {
+			p := newTestPlugin(configWith(func(c *Config) {
+				c.StateDir = t.TempDir()
+				c.MachineID = mode
+			}))
+			container := newProfileTestContainer(map[string]string{uuidAnnotation: "6f1c2a9b-e3d0-4c1a-9b2e-7d3f4a5b6c7d"})
+
+			adjust, _, err := p.CreateContainer(context.Background(), pod, container)
+			require.NoError(t, err)
+
+			source := filepath.Join(p.config().StateDir, "machine-id", container.Id, "machine-id")
+			assert.Equal(t, &api.Mount{
+				Destination: "/etc/machine-id",
+				Type:        "bind",
+				Source:      source,
+				Options:     []string{"bind", "rw", "nosuid", "nodev", "noexec"},
+			}, findMount(adjust.Mounts, "/etc/machine-id"))
+			data, err := os.ReadFile(source)
+			require.NoError(t, err)
+			assert.Equal(t, content, string(data))
+			assert.Contains(t, adjust.Annotations[provenanceAnnotation], "machine-id="+string(mode))
+
+			// no stable ID for systemd to initialize the machine ID with
+			for _, env := range adjust.Env {
+				assert.NotEqual(t, "container_uuid", env.Key)
+			}
+
+			require.NoError(t, p.RemoveContainer(context.Background(), pod, container))
+			assert.NoDirExists(t, filepath.Dir(source))
+		})
+	}
+
+	t.Run("stable", func(t *testing.T) {
+		p := newTestPlugin(configWith(func(c *Config) { c.StateDir = t.TempDir() }))
+
+		adjust, _, err := p.CreateContainer(context.Background(), pod, newProfileTestContainer(nil))
+		require.NoError(t, err)
+		assert.Nil(t, findMount(adjust.Mounts, "/etc/machine-id"))
+		value, ok := adjustedEnv(adjust, &api.Container{}, "container_uuid")
+		assert.True(t, ok)
+		assert.Equal(t, "d1b2c3a4-0000-4000-8000-000000000001", value)
+	})
+
+	t.Run("own machine-id", func(t *testing.T) {
+		p := newTestPlugin(configWith(func(c *Config) {
+			c.StateDir = t.TempDir()
+			c.MachineID = MachineIDFirstBoot
+		}))
+		container := newProfileTestContainer(nil, &api.Mount{Destination: "/etc/machine-id", Type: "bind", Source: "/srv/machine-id"})
+
+		adjust, _, err := p.CreateContainer(context.Background(), pod, container)
+		require.NoError(t, err)
+		assert.Nil(t, findMount(adjust.Mounts, "/etc/machine-id"))
+	})
+}
@@ -0,0 +1,228 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "nri_systemd"
+
+var latencyBuckets = []float64{.0005, .001, .005, .01, .05, .1, .25, .5, 1, 2.5}
+
+// metrics holds the instruments of a plugin. Each plugin has its own
+// registry, so tests never observe each other's measurements.
+type metrics struct {
+	registry         *prometheus.Registry
+	stepDuration     *prometheus.HistogramVec
+	deadlineExceeded *prometheus.CounterVec
+	stepFailures     *prometheus.CounterVec
+	hookDuration     *prometheus.HistogramVec
+	queueDepth       prometheus.Gauge
+	queueWait        prometheus.Histogram
+	processing       prometheus.Histogram
+	connected        prometheus.Gauge
+	reconnects       prometheus.Counter
+	lastEvent        prometheus.Gauge
+	lastSynchronize  prometheus.Gauge
+	drifted          prometheus.Gauge
+	repairs          prometheus.Counter
+	reclaimedBytes   prometheus.Counter
+	existingTmpfs    *prometheus.CounterVec
+	skipped          *prometheus.CounterVec
+	remountIgnored   prometheus.Counter
+	sysctlShortfall  *prometheus.GaugeVec
+	sysctlRaised     prometheus.Counter
+	failedBoots      prometheus.Counter
+}
+
+func newMetrics() *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		stepDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "step_duration_seconds",
+			Help:      "Time spent in each step of adjusting a systemd container.",
+			Buckets:   latencyBuckets,
+		}, []string{"step"}),
+		deadlineExceeded: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "hook_deadline_exceeded_total",
+			Help:      "Number of expired hook deadlines by the step running at the time.",
+		}, []string{"step"}),
+		stepFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "step_failures_total",
+			Help:      "Number of failed steps of adjusting a systemd container, by step and class of the error.",
+		}, []string{"step", "class"}),
+		hookDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "hook_duration_seconds",
+			Help:      "Time spent handling each hook of the runtime, including waiting in the queue.",
+			Buckets:   latencyBuckets,
+		}, []string{"hook"}),
+		queueDepth: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "queue_depth",
+			Help:      "Number of events waiting for their container's turn or a free worker.",
+		}),
+		queueWait: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "queue_wait_seconds",
+			Help:      "Time events spent waiting in the queue.",
+			Buckets:   latencyBuckets,
+		}),
+		processing: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "processing_seconds",
+			Help:      "Time spent processing events after leaving the queue.",
+			Buckets:   latencyBuckets,
+		}),
+		connected: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "connected",
+			Help:      "Whether the plugin is connected to the runtime (1) or not (0).",
+		}),
+		reconnects: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "reconnects_total",
+			Help:      "Number of attempts to reconnect to the runtime.",
+		}),
+		lastEvent: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "last_event_timestamp_seconds",
+			Help:      "Unix time of the last successfully handled event.",
+		}),
+		lastSynchronize: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "last_synchronize_timestamp_seconds",
+			Help:      "Unix time of the last synchronization with the runtime.",
+		}),
+		drifted: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "drifted_containers",
+			Help:      "Number of systemd containers which drifted, as found by the last drift check.",
+		}),
+		repairs: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "repairs_total",
+			Help:      "Number of files rendered again for systemd containers by autoRepair.",
+		}),
+		reclaimedBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "reclaimed_bytes_total",
+			Help:      "Size of the removed rendered files of containers unknown to the runtime.",
+		}),
+		existingTmpfs: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "tmpfs_already_mounted_total",
+			Help:      "Number of tmpfs mounts not added to systemd containers because they mount the destination themselves.",
+		}, []string{"destination"}),
+		skipped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "skipped_total",
+			Help:      "Number of likely systemd containers not adjusted, by the configuration key of the rule keeping the plugin from it.",
+		}, []string{"reason"}),
+		remountIgnored: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "cgroup_remount_ignored_total",
+			Help:      "Number of systemd containers created with a read-only cgroup mount the plugin made writable.",
+		}),
+		sysctlShortfall: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "host_sysctl_shortfall",
+			Help:      "How far a host sysctl is below the value required for the tracked systemd containers, as found by the last check.",
+		}, []string{"sysctl"}),
+		sysctlRaised: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "host_sysctl_raised_total",
+			Help:      "Number of times the plugin raised a host sysctl, with manageHostSysctls.",
+		}),
+		failedBoots: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "failed_boots_total",
+			Help:      "Number of systemd containers which exited right after starting or within bootCheckWindow.",
+		}),
+	}
+
+	m.registry.MustRegister(
+		m.stepDuration,
+		m.deadlineExceeded,
+		m.stepFailures,
+		m.hookDuration,
+		m.queueDepth,
+		m.queueWait,
+		m.processing,
+		m.connected,
+		m.reconnects,
+		m.lastEvent,
+		m.lastSynchronize,
+		m.drifted,
+		m.repairs,
+		m.reclaimedBytes,
+		m.existingTmpfs,
+		m.skipped,
+		m.remountIgnored,
+		m.sysctlShortfall,
+		m.sysctlRaised,
+		m.failedBoots,
+	)
+
+	return m
+}
+
+// serveMetrics exposes the metrics of the plugin at /metrics on addr, and
+// the connection status at /readyz. The address is bound right away, so
+// privileged ports keep working after dropping privileges.
+func (p *plugin) serveMetrics(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(p.gatherer(), promhttp.HandlerOpts{}))
+	mux.HandleFunc("/readyz", p.serveReadyz)
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to serve metrics: %w", err)
+	}
+
+	go func() {
+		if err := http.Serve(l, mux); err != nil {
+			p.metricsLog.Errorf("metrics server on %s failed: %v", addr, err)
+		}
+	}()
+
+	return nil
+}
+
+// serveReadyz reports the connection status, failing while the plugin is
+// disconnected from the runtime.
+func (p *plugin) serveReadyz(w http.ResponseWriter, _ *http.Request) {
+	status := p.conn.status()
+
+	w.Header().Set("Content-Type", "application/json")
+	if !status.Connected {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		p.metricsLog.Errorf("failed to write readiness status: %v", err)
+	}
+}
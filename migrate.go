@@ -0,0 +1,114 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// configAPIVersion is the schema of the configuration file read by
+	// parseConfig, and written by -print-effective-config.
+	configAPIVersion = "v2"
+
+	// configAPIVersionV1 is the schema of configuration files without an
+	// apiVersion, with the detection options at the top level.
+	configAPIVersionV1 = "v1"
+)
+
+// configMigration moves a field of an older schema to its path in the
+// current one.
+type configMigration struct {
+	from string
+	to   []string
+}
+
+// configMigrationsV1 migrate v1 configuration files to the current schema.
+var configMigrationsV1 = []configMigration{
+	{from: "detectShellExec", to: []string{"detection", "shellExec"}},
+	{from: "detectionOrder", to: []string{"detection", "order"}},
+}
+
+// migrateConfig migrates a configuration file of an older schema to the
+// current one, returning a deprecation warning for each migrated field.
+// Files of the current schema are returned as they are.
+func migrateConfig(data []byte) ([]byte, []string, error) {
+	data, err := yaml.YAMLToJSON(data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var raw map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&raw); err != nil || raw == nil {
+		// empty or not an object, left to parseConfig to complain about
+		return data, nil, nil
+	}
+
+	version, ok := raw["apiVersion"].(string)
+	if !ok && raw["apiVersion"] != nil {
+		return nil, nil, fmt.Errorf("invalid apiVersion %v, must be a string", raw["apiVersion"])
+	}
+	switch version {
+	case configAPIVersion:
+		return data, nil, nil
+	case "", configAPIVersionV1:
+	default:
+		return nil, nil, fmt.Errorf("unsupported apiVersion %q, must be %s or %s", version, configAPIVersionV1, configAPIVersion)
+	}
+
+	var warnings []string
+	for _, m := range configMigrationsV1 {
+		value, ok := raw[m.from]
+		if !ok {
+			continue
+		}
+		to := strings.Join(m.to, ".")
+
+		parent := raw
+		for _, key := range m.to[:len(m.to)-1] {
+			if parent[key] == nil {
+				parent[key] = map[string]interface{}{}
+			}
+			child, ok := parent[key].(map[string]interface{})
+			if !ok {
+				return nil, nil, fmt.Errorf("cannot migrate %s to %s, %s is not an object", m.from, to, key)
+			}
+			parent = child
+		}
+		last := m.to[len(m.to)-1]
+		if _, ok := parent[last]; ok {
+			return nil, nil, fmt.Errorf("both %s and its replacement %s are set", m.from, to)
+		}
+
+		parent[last] = value
+		delete(raw, m.from)
+		warnings = append(warnings, fmt.Sprintf("config field %s is deprecated, migrated to %s", m.from, to))
+	}
+
+	raw["apiVersion"] = configAPIVersion
+	if data, err = json.Marshal(raw); err != nil {
+		return nil, nil, err
+	}
+	return data, warnings, nil
+}
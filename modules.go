@@ -0,0 +1,102 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/nri/pkg/api"
+)
+
+const (
+	// hostModulesAnnotation, set to "true", bind-mounts the kernel modules
+	// of the host read-only, for systemd-modules-load and units calling
+	// modprobe. It needs allowHostModules. Set on the pod it applies to all
+	// containers of the pod without their own annotation.
+	hostModulesAnnotation = "io.systemd.container/host-modules"
+
+	hostModulesDir = "/lib/modules"
+)
+
+// hostKernelRelease returns the release of the running kernel, like
+// uname -r.
+func hostKernelRelease() (string, error) {
+	data, err := os.ReadFile(procSysDir + "/kernel/osrelease")
+	if err != nil {
+		return "", fmt.Errorf("failed to read the kernel release: %w", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// wantsHostModules tells whether the container asks for the kernel modules
+// of the host.
+func wantsHostModules(pod *api.PodSandbox, container *api.Container) (bool, error) {
+	value, ok := lookupAnnotation(pod, container, hostModulesAnnotation)
+	if !ok {
+		return false, nil
+	}
+	want, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s annotation %q: %w", hostModulesAnnotation, value, err)
+	}
+	return want, nil
+}
+
+// addHostModulesMount bind-mounts /lib/modules/<release> of the host
+// read-only at the same path. Only the directory of the running kernel is
+// mounted, which is all modprobe looks at. Being a mount, it also works
+// with a read-only root filesystem.
+func (p *plugin) addHostModulesMount(ctx context.Context, cfg *Config, adjust *api.ContainerAdjustment, container *api.Container, ctrName string) error {
+	if !cfg.AllowHostModules {
+		return fmt.Errorf("%s annotation is not allowed, allowHostModules is off", hostModulesAnnotation)
+	}
+
+	release, err := p.kernelRelease()
+	if err != nil {
+		return err
+	}
+	dir := path.Join(hostModulesDir, release)
+
+	if hasMount(container, hostModulesDir) || hasMount(container, dir) {
+		p.mountLog.Debugf("%s: %s already mounted, skipping", ctrName, dir)
+		return nil
+	}
+
+	_, err = p.prober.Stat(ctx, dir)
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	if err != nil {
+		p.mountLog.Warnf("%s: not mounting the kernel modules, %s does not exist on the host", ctrName, dir)
+		return nil
+	}
+
+	adjust.AddMount(&api.Mount{
+		Destination: dir,
+		Type:        "bind",
+		Source:      dir,
+		Options:     []string{"rbind", "ro", "nosuid", "nodev"},
+	})
+	p.mountLog.Debugf("%s: mounted the kernel modules of the host at %s", ctrName, dir)
+
+	return nil
+}
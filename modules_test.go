@@ -0,0 +1,111 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/containerd/nri/pkg/api"
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHostModules(t *testing.T) {
+	const modules = "/lib/modules/6.8.0-45-generic"
+
+	newModulesTestPlugin := func(allow bool) *plugin {
+		p := newTestPlugin(configWith(func(c *Config) { c.AllowHostModules = allow }))
+		p.prober.(*fakeProber).paths[modules] = true
+		p.kernelRelease = func() (string, error) { return "6.8.0-45-generic", nil }
+		return p
+	}
+	annotated := func(value string) *api.Container {
+		return newProfileTestContainer(map[string]string{hostModulesAnnotation: value})
+	}
+
+	t.Run("host present", func(t *testing.T) {
+		p := newModulesTestPlugin(true)
+
+		adjust, _, err := p.CreateContainer(context.Background(), &api.PodSandbox{}, annotated("true"))
+		require.NoError(t, err)
+		assert.Equal(t, &api.Mount{
+			Destination: modules,
+			Type:        "bind",
+			Source:      modules,
+			Options:     []string{"rbind", "ro", "nosuid", "nodev"},
+		}, findMount(adjust.Mounts, modules))
+		assert.Contains(t, adjust.Annotations[provenanceAnnotation], "host-modules")
+	})
+
+	t.Run("host missing", func(t *testing.T) {
+		p := newModulesTestPlugin(true)
+		delete(p.prober.(*fakeProber).paths, modules)
+		logs := logtest.NewLocal(p.logs.base)
+
+		adjust, _, err := p.CreateContainer(context.Background(), &api.PodSandbox{}, annotated("true"))
+		require.NoError(t, err)
+		assert.Nil(t, findMount(adjust.Mounts, modules))
+
+		warned := false
+		for _, e := range logs.AllEntries() {
+			if e.Level == logrus.WarnLevel && strings.HasSuffix(e.Message, ": not mounting the kernel modules, "+modules+" does not exist on the host") {
+				warned = true
+			}
+		}
+		assert.True(t, warned)
+	})
+
+	t.Run("not allowed", func(t *testing.T) {
+		p := newModulesTestPlugin(false)
+
+		adjust, _, err := p.CreateContainer(context.Background(), &api.PodSandbox{}, annotated("true"))
+		assert.ErrorContains(t, err, "io.systemd.container/host-modules annotation is not allowed, allowHostModules is off")
+		assert.Nil(t, adjust)
+	})
+
+	t.Run("not requested", func(t *testing.T) {
+		for _, container := range []*api.Container{newProfileTestContainer(nil), annotated("false")} {
+			p := newModulesTestPlugin(true)
+
+			adjust, _, err := p.CreateContainer(context.Background(), &api.PodSandbox{}, container)
+			require.NoError(t, err)
+			assert.Nil(t, findMount(adjust.Mounts, modules))
+			assert.NotContains(t, adjust.Annotations[provenanceAnnotation], "host-modules")
+		}
+	})
+
+	t.Run("invalid value", func(t *testing.T) {
+		p := newModulesTestPlugin(true)
+
+		_, _, err := p.CreateContainer(context.Background(), &api.PodSandbox{}, annotated("yes please"))
+		assert.ErrorContains(t, err, `invalid io.systemd.container/host-modules annotation "yes please"`)
+	})
+
+	t.Run("already mounted", func(t *testing.T) {
+		p := newModulesTestPlugin(true)
+		container := annotated("true")
+		container.Mounts = append(container.Mounts, &api.Mount{Destination: "/lib/modules", Type: "bind", Source: "/lib/modules"})
+
+		adjust, _, err := p.CreateContainer(context.Background(), &api.PodSandbox{}, container)
+		require.NoError(t, err)
+		assert.Nil(t, findMount(adjust.Mounts, modules))
+	})
+}
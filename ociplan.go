@@ -0,0 +1,118 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containerd/nri/pkg/api"
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// removedMountsAnnotation lists the destinations of the mounts removed
+// from the spec in an OCI plan, which has no field for removals.
+const removedMountsAnnotation = "io.systemd.container/removed-mounts"
+
+// ociPlan maps the adjustment of a container to a partial OCI runtime
+// spec, holding only the fields the plugin adjusts. Mounts replaced by
+// the adjustment are listed in an annotation, followed by their
+// replacement in mounts.
+func ociPlan(adjust *api.ContainerAdjustment) *rspec.Spec {
+	spec := &rspec.Spec{Version: rspec.Version}
+
+	var removed []string
+	for _, m := range adjust.Mounts {
+		if dest, ok := api.IsMarkedForRemoval(m.Destination); ok {
+			removed = append(removed, dest)
+			continue
+		}
+		spec.Mounts = append(spec.Mounts, m.ToOCI(nil))
+	}
+
+	if len(adjust.Env) > 0 {
+		spec.Process = &rspec.Process{}
+		for _, e := range adjust.Env {
+			spec.Process.Env = append(spec.Process.Env, e.ToOCI())
+		}
+	}
+
+	if devices := adjust.GetLinux().GetDevices(); len(devices) > 0 {
+		spec.Linux = &rspec.Linux{}
+		for _, d := range devices {
+			spec.Linux.Devices = append(spec.Linux.Devices, d.ToOCI())
+		}
+	}
+
+	if len(adjust.Annotations) > 0 || len(removed) > 0 {
+		spec.Annotations = map[string]string{}
+		for key, value := range adjust.Annotations {
+			spec.Annotations[key] = value
+		}
+		if len(removed) > 0 {
+			spec.Annotations[removedMountsAnnotation] = strings.Join(removed, ",")
+		}
+	}
+
+	return spec
+}
+
+// ociPlanFile returns the file with the OCI plan of the container.
+func ociPlanFile(dir, id string) (string, error) {
+	if id == "" || id == "." || id == ".." || strings.ContainsRune(id, '/') {
+		return "", fmt.Errorf("invalid container ID %q", id)
+	}
+	return filepath.Join(dir, id+".json"), nil
+}
+
+// writeOCIPlan writes the OCI plan of the container, replacing a previous
+// one at once.
+func writeOCIPlan(dir, id string, adjust *api.ContainerAdjustment) error {
+	file, err := ociPlanFile(dir, id)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(ociPlan(adjust), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// removeOCIPlan removes the OCI plan of the container, if any.
+func removeOCIPlan(dir, id string) error {
+	file, err := ociPlanFile(dir, id)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(file); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
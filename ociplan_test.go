@@ -0,0 +1,79 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/nri/pkg/api"
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOCIPlan(t *testing.T) {
+	adjust := &api.ContainerAdjustment{}
+	adjust.RemoveMount("/sys/fs/cgroup")
+	adjust.AddMount(&api.Mount{Destination: "/sys/fs/cgroup", Type: "cgroup2", Source: "cgroup", Options: []string{"rw", "nosuid"}})
+	adjust.AddMount(&api.Mount{Destination: "/run", Type: "tmpfs", Source: "tmpfs", Options: []string{"rw", "mode=0755"}})
+	adjust.AddEnv("container", "other")
+	adjust.AddDevice(&api.LinuxDevice{Path: "/dev/fuse", Type: "c", Major: 10, Minor: 229, FileMode: api.FileMode(os.FileMode(0o666))})
+	adjust.AddAnnotation(provenanceAnnotation, "cgroup,tmpfs,env")
+
+	mode := os.FileMode(0o666)
+	assert.Equal(t, &rspec.Spec{
+		Version: rspec.Version,
+		Mounts: []rspec.Mount{
+			{Destination: "/sys/fs/cgroup", Type: "cgroup2", Source: "cgroup", Options: []string{"rw", "nosuid"}},
+			{Destination: "/run", Type: "tmpfs", Source: "tmpfs", Options: []string{"rw", "mode=0755"}},
+		},
+		Process: &rspec.Process{Env: []string{"container=other"}},
+		Linux: &rspec.Linux{
+			Devices: []rspec.LinuxDevice{{Path: "/dev/fuse", Type: "c", Major: 10, Minor: 229, FileMode: &mode}},
+		},
+		Annotations: map[string]string{
+			provenanceAnnotation:    "cgroup,tmpfs,env",
+			removedMountsAnnotation: "/sys/fs/cgroup",
+		},
+	}, ociPlan(adjust))
+
+	assert.Equal(t, &rspec.Spec{Version: rspec.Version}, ociPlan(&api.ContainerAdjustment{}))
+}
+
+func TestOCIPlanFile(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "plans")
+	p := newTestPlugin(configWith(func(c *Config) { c.OCIPlanDir = dir }))
+	container := newProfileTestContainer(nil)
+
+	_, _, err := p.CreateContainer(context.Background(), nil, container)
+	require.NoError(t, err)
+
+	data, err := os.ReadFile(filepath.Join(dir, container.Id+".json"))
+	require.NoError(t, err)
+	var spec rspec.Spec
+	require.NoError(t, json.Unmarshal(data, &spec))
+	assert.Equal(t, rspec.Version, spec.Version)
+	assert.Contains(t, spec.Process.Env, "container=other")
+	assert.Equal(t, "cgroup,tmpfs,env", spec.Annotations[provenanceAnnotation])
+
+	require.NoError(t, p.RemoveContainer(context.Background(), nil, container))
+	assert.NoFileExists(t, filepath.Join(dir, container.Id+".json"))
+}
@@ -0,0 +1,123 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/containerd/nri/pkg/api"
+	"github.com/containerd/nri/pkg/stub"
+)
+
+// onceTimeout bounds connecting and synchronizing with the runtime in
+// -once mode.
+const onceTimeout = 30 * time.Second
+
+// Exit codes of -once mode.
+const (
+	onceNoDrift = 0
+	onceDrift   = 1
+	onceFailed  = 2
+)
+
+// oncePlugin is the plugin as registered with the runtime in -once mode.
+// It does not handle CreateContainer, so it never adjusts containers
+// created while it is connected.
+type oncePlugin struct {
+	p      *plugin
+	synced chan struct{}
+	once   sync.Once
+}
+
+// Configure applies the defaults of the runtime, so drift is checked
+// against the same policy the plugin applies when running. It subscribes
+// to the events the oncePlugin handles, not those of the plugin.
+func (o *oncePlugin) Configure(ctx context.Context, config, runtime, version string) (api.EventMask, error) {
+	_, err := o.p.Configure(ctx, config, runtime, version)
+	return 0, err
+}
+
+func (o *oncePlugin) Synchronize(ctx context.Context, pods []*api.PodSandbox, containers []*api.Container) ([]*api.ContainerUpdate, error) {
+	updates, err := o.p.Synchronize(ctx, pods, containers)
+	o.once.Do(func() { close(o.synced) })
+	return updates, err
+}
+
+// RemoveContainer does nothing. The stub refuses plugins which do not
+// subscribe to any event.
+func (o *oncePlugin) RemoveContainer(context.Context, *api.PodSandbox, *api.Container) error {
+	return nil
+}
+
+// onceStubFactory creates the stub connecting the -once plugin to the
+// runtime.
+type onceStubFactory func(plugin interface{}, onClose func()) (stub.Stub, error)
+
+// runOnce connects to the runtime, writes a reconciliation report of the
+// systemd containers to w and disconnects again. It returns the exit code
+// of -once mode.
+func (p *plugin) runOnce(ctx context.Context, newStub onceStubFactory, output string, w io.Writer) int {
+	report, err := p.reconcileOnce(ctx, newStub)
+	if err != nil {
+		p.log.Errorf("%v", err)
+		return onceFailed
+	}
+
+	if err := report.write(w, output); err != nil {
+		p.log.Errorf("failed to write report: %v", err)
+		return onceFailed
+	}
+
+	if report.Drifted > 0 || report.sysctlViolations() > 0 {
+		return onceDrift
+	}
+	return onceNoDrift
+}
+
+func (p *plugin) reconcileOnce(ctx context.Context, newStub onceStubFactory) (*reconcileReport, error) {
+	ctx, cancel := context.WithTimeout(ctx, onceTimeout)
+	defer cancel()
+
+	op := &oncePlugin{p: p, synced: make(chan struct{})}
+	closed := make(chan struct{})
+	var closeOnce sync.Once
+
+	s, err := newStub(op, func() { closeOnce.Do(func() { close(closed) }) })
+	if err != nil {
+		return nil, fmt.Errorf("failed to create plugin stub: %w", err)
+	}
+	if err := s.Start(ctx); err != nil {
+		return nil, fmt.Errorf("failed to connect to the runtime: %w", err)
+	}
+	// closing the connection unregisters the plugin
+	defer s.Stop()
+
+	select {
+	case <-op.synced:
+	case <-closed:
+		return nil, errors.New("the runtime closed the connection before synchronizing")
+	case <-ctx.Done():
+		return nil, fmt.Errorf("waiting for synchronization: %w", ctx.Err())
+	}
+
+	return p.reconcile(ctx)
+}
@@ -0,0 +1,150 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/containerd/nri/pkg/api"
+	"github.com/containerd/nri/pkg/stub"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// applyAdjustment updates the container to what the runtime creates with
+// the adjustment.
+func applyAdjustment(c *api.Container, adjust *api.ContainerAdjustment) {
+	removed := map[string]bool{}
+	for _, m := range adjust.Mounts {
+		if dest, ok := api.IsMarkedForRemoval(m.Destination); ok {
+			removed[dest] = true
+		}
+	}
+
+	var mounts []*api.Mount
+	for _, m := range c.Mounts {
+		if !removed[m.Destination] {
+			mounts = append(mounts, m)
+		}
+	}
+	for _, m := range adjust.Mounts {
+		if _, ok := api.IsMarkedForRemoval(m.Destination); !ok {
+			mounts = append(mounts, m)
+		}
+	}
+	c.Mounts = mounts
+
+	for _, e := range adjust.Env {
+		c.Env = append(c.Env, e.Key+"="+e.Value)
+	}
+}
+
+// onceRuntime returns a stub factory for a fake runtime reporting the
+// given containers when synchronizing.
+func onceRuntime(t *testing.T, pods []*api.PodSandbox, containers []*api.Container) onceStubFactory {
+	return func(plugin interface{}, _ func()) (stub.Stub, error) {
+		s := &fakeStub{}
+		s.onStart = func() {
+			_, err := plugin.(stub.SynchronizeInterface).Synchronize(context.Background(), pods, containers)
+			assert.NoError(t, err)
+		}
+		_, adjusts := plugin.(stub.CreateContainerInterface)
+		assert.False(t, adjusts, "-once plugin handles CreateContainer")
+		return s, nil
+	}
+}
+
+func TestRunOnce(t *testing.T) {
+	pod := &api.PodSandbox{Id: "pod", Name: "web", Namespace: "default"}
+
+	newContainer := func(id string) *api.Container {
+		c := newProfileTestContainer(nil)
+		c.Id = id
+		c.Name = id
+		c.PodSandboxId = pod.Id
+		c.State = api.ContainerState_CONTAINER_RUNNING
+		return c
+	}
+
+	// a container adjusted by the plugin
+	adjusted := newContainer("adjusted")
+	adjust, _, err := newTestPlugin(nil).CreateContainer(context.Background(), pod, adjusted)
+	require.NoError(t, err)
+	applyAdjustment(adjusted, adjust)
+
+	// a container created while the plugin was not running
+	missed := newContainer("missed")
+
+	other := &api.Container{Id: "nginx", PodSandboxId: pod.Id, Args: []string{"nginx"}}
+
+	t.Run("no drift", func(t *testing.T) {
+		p := newTestPlugin(nil)
+		var out bytes.Buffer
+
+		code := p.runOnce(context.Background(), onceRuntime(t, []*api.PodSandbox{pod}, []*api.Container{adjusted, other}), outputJSON, &out)
+		assert.Equal(t, onceNoDrift, code)
+
+		var report reconcileReport
+		require.NoError(t, json.Unmarshal(out.Bytes(), &report))
+		assert.Equal(t, reconcileReport{
+			Containers: []reconciledContainer{{ID: "adjusted", Name: "web/adjusted", Namespace: "default"}},
+		}, report)
+	})
+
+	t.Run("drift", func(t *testing.T) {
+		p := newTestPlugin(nil)
+		var out bytes.Buffer
+
+		code := p.runOnce(context.Background(), onceRuntime(t, []*api.PodSandbox{pod}, []*api.Container{adjusted, missed, other}), outputTable, &out)
+		assert.Equal(t, onceDrift, code)
+
+		assert.Equal(t, `CONTAINER     ID        PROFILE  DRIFT
+web/adjusted  adjusted  -        -
+web/missed    missed    -        mount /sys/fs/cgroup differs; mount /run is missing; mount /run/lock is missing; mount /tmp is missing; mount /var/log/journal is missing; environment variable container is missing; environment variable container_uuid is missing
+`, out.String())
+	})
+
+	t.Run("connection failure", func(t *testing.T) {
+		p := newTestPlugin(nil)
+		newStub := func(interface{}, func()) (stub.Stub, error) {
+			return &fakeStub{startErr: errors.New("no runtime")}, nil
+		}
+
+		code := p.runOnce(context.Background(), newStub, outputJSON, &bytes.Buffer{})
+		assert.Equal(t, onceFailed, code)
+	})
+
+	t.Run("interrupted", func(t *testing.T) {
+		p := newTestPlugin(nil)
+		// the runtime never synchronizes
+		newStub := func(interface{}, func()) (stub.Stub, error) {
+			return &fakeStub{}, nil
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(50*time.Millisecond, cancel)
+
+		start := time.Now()
+		code := p.runOnce(ctx, newStub, outputJSON, &bytes.Buffer{})
+		assert.Equal(t, onceFailed, code)
+		assert.Less(t, time.Since(start), onceTimeout)
+	})
+}
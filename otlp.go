@@ -0,0 +1,107 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	otelprom "go.opentelemetry.io/contrib/bridges/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+)
+
+const defaultOTLPInterval = 30 * time.Second
+
+// otlpOptions configure pushing metrics to an OTLP collector.
+type otlpOptions struct {
+	// endpoint is the URL of the collector, e.g. https://collector:4318.
+	// Metrics are sent to /v1/metrics unless the URL has a path.
+	endpoint string
+	caFile   string
+	headers  map[string]string
+	interval time.Duration
+}
+
+// parseHeader adds a key=value header given on the command line.
+func (o *otlpOptions) parseHeader(s string) error {
+	key, value, ok := strings.Cut(s, "=")
+	if !ok || key == "" {
+		return fmt.Errorf("invalid header %q, must be key=value", s)
+	}
+	if o.headers == nil {
+		o.headers = map[string]string{}
+	}
+	o.headers[key] = value
+	return nil
+}
+
+// pushMetrics periodically pushes the metrics of the plugin to an OTLP
+// collector over HTTP. Pushing happens in the background: failed exports
+// are retried with backoff until the next one is due and never delay
+// event processing. The returned function flushes and stops pushing.
+func (p *plugin) pushMetrics(ctx context.Context, o otlpOptions) (func(context.Context) error, error) {
+	if o.interval <= 0 {
+		o.interval = defaultOTLPInterval
+	}
+
+	opts := []otlpmetrichttp.Option{
+		otlpmetrichttp.WithEndpointURL(o.endpoint),
+		otlpmetrichttp.WithHeaders(o.headers),
+		otlpmetrichttp.WithRetry(otlpmetrichttp.RetryConfig{
+			Enabled:         true,
+			InitialInterval: o.interval / 10,
+			MaxInterval:     o.interval / 2,
+			MaxElapsedTime:  o.interval,
+		}),
+	}
+
+	if o.caFile != "" {
+		pem, err := os.ReadFile(o.caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read OTLP CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in OTLP CA file %s", o.caFile)
+		}
+		opts = append(opts, otlpmetrichttp.WithTLSClientConfig(&tls.Config{RootCAs: pool}))
+	}
+
+	exporter, err := otlpmetrichttp.New(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP exporter: %w", err)
+	}
+
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		p.metricsLog.Warnf("failed to push metrics: %v", err)
+	}))
+
+	reader := sdkmetric.NewPeriodicReader(exporter,
+		sdkmetric.WithInterval(o.interval),
+		sdkmetric.WithProducer(otelprom.NewMetricProducer(otelprom.WithGatherer(p.gatherer()))),
+	)
+	provider := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+
+	return provider.Shutdown, nil
+}
@@ -0,0 +1,125 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/containerd/nri/pkg/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	collectorpb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// otlpCollector is an in-process OTLP/HTTP metrics collector.
+type otlpCollector struct {
+	// failures is the number of requests to reject before accepting any
+	failures int
+
+	mu      sync.Mutex
+	headers http.Header
+	points  map[string]float64
+}
+
+func (c *otlpCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.failures > 0 {
+		c.failures--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var req collectorpb.ExportMetricsServiceRequest
+	if err := proto.Unmarshal(body, &req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	c.headers = r.Header.Clone()
+	for _, rm := range req.ResourceMetrics {
+		for _, sm := range rm.ScopeMetrics {
+			for _, m := range sm.Metrics {
+				if g := m.GetGauge(); g != nil && len(g.DataPoints) > 0 {
+					c.points[m.Name] = g.DataPoints[0].GetAsDouble()
+				}
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	out, _ := proto.Marshal(&collectorpb.ExportMetricsServiceResponse{})
+	_, _ = w.Write(out)
+}
+
+func (c *otlpCollector) point(name string) (float64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v, ok := c.points[name]
+	return v, ok
+}
+
+func TestPushMetrics(t *testing.T) {
+	collector := &otlpCollector{failures: 2, points: map[string]float64{}}
+	srv := httptest.NewServer(collector)
+	defer srv.Close()
+
+	p := newTestPlugin(nil)
+	ctr := newStateTestContainer("ctr", "pod", nil)
+	_, _, err := p.CreateContainer(context.Background(), &api.PodSandbox{Id: "pod", Namespace: "default"}, ctr)
+	require.NoError(t, err)
+
+	o := otlpOptions{endpoint: srv.URL, interval: 50 * time.Millisecond}
+	require.NoError(t, o.parseHeader("authorization=Bearer secret"))
+	shutdown, err := p.pushMetrics(context.Background(), o)
+	require.NoError(t, err)
+	defer func() {
+		_ = shutdown(context.Background())
+	}()
+
+	// the first exports fail and are retried
+	assert.Eventually(t, func() bool {
+		v, ok := collector.point("nri_systemd_containers")
+		return ok && v == 1
+	}, 10*time.Second, 10*time.Millisecond)
+
+	collector.mu.Lock()
+	assert.Zero(t, collector.failures)
+	assert.Equal(t, "Bearer secret", collector.headers.Get("Authorization"))
+	collector.mu.Unlock()
+}
+
+func TestParseOTLPHeader(t *testing.T) {
+	var o otlpOptions
+	assert.NoError(t, o.parseHeader("x-scope-orgid=edge=1"))
+	assert.Equal(t, map[string]string{"x-scope-orgid": "edge=1"}, o.headers)
+	assert.Error(t, o.parseHeader("no-value"))
+	assert.Error(t, o.parseHeader("=value"))
+}
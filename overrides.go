@@ -0,0 +1,120 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/containerd/nri/pkg/api"
+	"google.golang.org/protobuf/proto"
+	"sigs.k8s.io/yaml"
+)
+
+// configAnnotation overrides several settings for a container at once,
+// with a YAML or JSON ContainerOverrides snippet. Set on the pod it applies
+// to all containers of the pod without their own annotation.
+const configAnnotation = "io.systemd.container/config"
+
+// ContainerOverrides are the settings a container can override. Settings
+// also available as a specific annotation take the same values as the
+// annotation, which takes precedence when set on the container or pod.
+type ContainerOverrides struct {
+	Profile         *string  `json:"profile,omitempty"`
+	EnableUnits     []string `json:"enableUnits,omitempty"`
+	DisableUnits    []string `json:"disableUnits,omitempty"`
+	DefaultTarget   string   `json:"defaultTarget,omitempty"`
+	RuntimeWatchdog string   `json:"runtimeWatchdog,omitempty"`
+	Tmpfs           []string `json:"tmpfs,omitempty"`
+	Skip            []string `json:"skip,omitempty"`
+
+	// TmpfsOptions and TmpfsMountOptions override those of the
+	// configuration, per field.
+	TmpfsOptions      TmpfsOptions            `json:"tmpfsOptions"`
+	TmpfsMountOptions map[string]TmpfsOptions `json:"tmpfsMountOptions,omitempty"`
+}
+
+// annotations returns the overrides available as specific annotations.
+func (o *ContainerOverrides) annotations() map[string]string {
+	annotations := map[string]string{}
+	set := func(key, value string) {
+		if value != "" {
+			annotations[key] = value
+		}
+	}
+	if o.Profile != nil {
+		annotations[profileAnnotation] = *o.Profile
+	}
+	set(enableUnitsAnnotation, strings.Join(o.EnableUnits, ","))
+	set(disableUnitsAnnotation, strings.Join(o.DisableUnits, ","))
+	set(defaultTargetAnnotation, o.DefaultTarget)
+	set(runtimeWatchdogAnnotation, o.RuntimeWatchdog)
+	set(optionalTmpfsAnnotation, strings.Join(o.Tmpfs, ","))
+	set(skipAnnotation, strings.Join(o.Skip, ","))
+	return annotations
+}
+
+// config returns the configuration with the overrides applied.
+func (o *ContainerOverrides) config(cfg *Config) *Config {
+	return cfg.withTmpfsOptions(o.TmpfsOptions, o.TmpfsMountOptions)
+}
+
+// applyConfigAnnotation returns the configuration and container with the
+// tmpfs options of the namespace, the overrides of the config annotation
+// and the tmpfs-mounts annotation applied, in this order. The container is
+// copied with the overrides added as specific annotations, unless the
+// container or pod sets them already. Without the config annotation, the
+// container is returned unchanged.
+func applyConfigAnnotation(cfg *Config, pod *api.PodSandbox, container *api.Container) (*Config, *api.Container, error) {
+	cfg = namespaceConfig(cfg, pod)
+
+	value, ok := lookupAnnotation(pod, container, configAnnotation)
+	if !ok {
+		annotated, err := applyTmpfsMountsAnnotation(cfg, pod, container)
+		return annotated, container, err
+	}
+	if len(value) > cfg.MaxConfigAnnotationSize {
+		return nil, nil, fmt.Errorf("%s annotation has %d bytes, more than maxConfigAnnotationSize (%d)",
+			configAnnotation, len(value), cfg.MaxConfigAnnotationSize)
+	}
+
+	var o ContainerOverrides
+	if err := yaml.UnmarshalStrict([]byte(value), &o); err != nil {
+		return nil, nil, fmt.Errorf("invalid %s annotation: %w", configAnnotation, err)
+	}
+	overridden := o.config(cfg)
+	if err := overridden.validate(); err != nil {
+		return nil, nil, fmt.Errorf("invalid %s annotation: %w", configAnnotation, err)
+	}
+
+	container = proto.Clone(container).(*api.Container)
+	for key, value := range o.annotations() {
+		if _, ok := lookupAnnotation(pod, container, key); ok {
+			continue
+		}
+		if container.Annotations == nil {
+			container.Annotations = map[string]string{}
+		}
+		container.Annotations[key] = value
+	}
+
+	overridden, err := applyTmpfsMountsAnnotation(overridden, pod, container)
+	if err != nil {
+		return nil, nil, err
+	}
+	return overridden, container, nil
+}
@@ -0,0 +1,175 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/containerd/nri/pkg/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigAnnotation(t *testing.T) {
+	snippet := `
+profile: nested-runtime
+tmpfs: [/var/tmp]
+tmpfsOptions:
+  uid: 1000
+tmpfsMountOptions:
+  /var/tmp:
+    size: 1g
+`
+
+	t.Run("multiple settings", func(t *testing.T) {
+		container := newProfileTestContainer(map[string]string{configAnnotation: snippet})
+		adjust, _, err := newTestPlugin(nil).CreateContainer(context.Background(), nil, container)
+		require.NoError(t, err)
+
+		assert.Contains(t, adjust.Annotations[provenanceAnnotation], "profile=nested-runtime")
+		assert.Equal(t, []string{"rw", "rprivate", "nosuid", "nodev", "mode=1777", "uid=1000", "size=1g"},
+			findMount(adjust.Mounts, "/var/tmp").Options)
+		assert.Equal(t, []string{"rw", "rprivate", "nosuid", "nodev", "mode=0755", "uid=1000", "size=64m"},
+			findMount(adjust.Mounts, "/run").Options)
+
+		// the container of the runtime is left alone
+		assert.NotContains(t, container.Annotations, profileAnnotation)
+	})
+
+	t.Run("specific annotations take precedence", func(t *testing.T) {
+		container := newProfileTestContainer(map[string]string{
+			configAnnotation:        snippet,
+			optionalTmpfsAnnotation: "/var/cache",
+		})
+		pod := &api.PodSandbox{Name: "test-pod", Annotations: map[string]string{profileAnnotation: ""}}
+		adjust, _, err := newTestPlugin(nil).CreateContainer(context.Background(), pod, container)
+		require.NoError(t, err)
+
+		assert.NotContains(t, adjust.Annotations[provenanceAnnotation], "profile=")
+		assert.Nil(t, findMount(adjust.Mounts, "/var/tmp"))
+		assert.NotNil(t, findMount(adjust.Mounts, "/var/cache"))
+	})
+
+	t.Run("pod annotation", func(t *testing.T) {
+		pod := &api.PodSandbox{Name: "test-pod", Annotations: map[string]string{configAnnotation: `{"tmpfs": ["/var/cache"]}`}}
+		adjust, _, err := newTestPlugin(nil).CreateContainer(context.Background(), pod, newProfileTestContainer(nil))
+		require.NoError(t, err)
+		assert.NotNil(t, findMount(adjust.Mounts, "/var/cache"))
+	})
+
+	for name, value := range map[string]string{
+		"unknown setting":    "allowedUnits: ['*']\n",
+		"invalid tmpfs mode": "tmpfsOptions:\n  mode: rwx\n",
+		"unknown tmpfs":      "tmpfsMountOptions:\n  /srv:\n    size: 1g\n",
+		"oversized":          "tmpfs: [/var/tmp]\n" + strings.Repeat("# padding\n", 500),
+	} {
+		t.Run(name, func(t *testing.T) {
+			container := newProfileTestContainer(map[string]string{configAnnotation: value})
+			_, _, err := newTestPlugin(nil).CreateContainer(context.Background(), nil, container)
+			assert.ErrorContains(t, err, configAnnotation)
+		})
+	}
+
+	t.Run("size limit", func(t *testing.T) {
+		p := newTestPlugin(configWith(func(c *Config) { c.MaxConfigAnnotationSize = 16 }))
+		container := newProfileTestContainer(map[string]string{configAnnotation: "tmpfs: [/var/tmp]"})
+		_, _, err := p.CreateContainer(context.Background(), nil, container)
+		assert.ErrorContains(t, err, "maxConfigAnnotationSize")
+	})
+}
+
+// TestAnnotatedConcurrently derives and validates the configurations of
+// annotated containers concurrently, which must leave the shared
+// configuration alone. Run with -race.
+func TestAnnotatedConcurrently(t *testing.T) {
+	cfg, err := parseConfig([]byte("excludeMounts: [/var/run/secrets/, /opt/*/data]\n"))
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for i := range 16 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var err error
+			if i%2 == 0 {
+				container := newProfileTestContainer(map[string]string{configAnnotation: "tmpfs: [/var/tmp]\n"})
+				_, _, err = applyConfigAnnotation(cfg, nil, container)
+			} else {
+				container := newProfileTestContainer(map[string]string{tmpfsMountsAnnotation: "/tmp:size=1G"})
+				_, err = applyTmpfsMountsAnnotation(cfg, nil, container)
+			}
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, []string{"/var/run/secrets", "/opt/*/data"}, cfg.ExcludeMounts)
+
+	// the same through the hooks
+	p := newTestPlugin(cfg)
+	for i := range 16 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			container := newProfileTestContainer(map[string]string{configAnnotation: "tmpfs: [/var/tmp]\n"})
+			container.Id = fmt.Sprintf("ctr-%d", i)
+			_, _, err := p.CreateContainer(context.Background(), nil, container)
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+}
+
+func TestNamespaceTmpfs(t *testing.T) {
+	uid := OwnerID(1000)
+	p := newTestPlugin(configWith(func(c *Config) {
+		c.TmpfsOptions = TmpfsOptions{Size: "size=64m", UID: &uid}
+		c.NamespaceTmpfs = map[string]NamespaceTmpfs{
+			"batch": {
+				TmpfsOptions:      TmpfsOptions{Size: "size=512m"},
+				TmpfsMountOptions: map[string]TmpfsOptions{"/tmp": {Size: "size=4g"}},
+			},
+		}
+	}))
+	tmpfsOptions := func(namespace string, annotations map[string]string, dest string) []string {
+		t.Helper()
+		pod := &api.PodSandbox{Name: "test-pod", Namespace: namespace}
+		adjust, _, err := p.CreateContainer(context.Background(), pod, newProfileTestContainer(annotations))
+		require.NoError(t, err)
+		return findMount(adjust.Mounts, dest).Options
+	}
+
+	// global default
+	assert.Equal(t, []string{"rw", "rprivate", "nosuid", "nodev", "mode=1777", "uid=1000", "size=64m"},
+		tmpfsOptions("system", nil, "/tmp"))
+
+	// namespace default, for all mounts and per destination
+	assert.Equal(t, []string{"rw", "rprivate", "nosuid", "nodev", "mode=0755", "uid=1000", "size=512m"},
+		tmpfsOptions("batch", nil, "/run"))
+	assert.Equal(t, []string{"rw", "rprivate", "nosuid", "nodev", "mode=1777", "uid=1000", "size=4g"},
+		tmpfsOptions("batch", nil, "/tmp"))
+
+	// container annotation
+	override := map[string]string{configAnnotation: "tmpfsMountOptions:\n  /tmp:\n    size: 1g\n"}
+	assert.Equal(t, []string{"rw", "rprivate", "nosuid", "nodev", "mode=1777", "uid=1000", "size=1g"},
+		tmpfsOptions("batch", override, "/tmp"))
+	assert.Equal(t, []string{"rw", "rprivate", "nosuid", "nodev", "mode=0755", "uid=1000", "size=512m"},
+		tmpfsOptions("batch", override, "/run"))
+}
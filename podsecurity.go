@@ -0,0 +1,177 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/containerd/nri/pkg/api"
+	"github.com/sirupsen/logrus"
+)
+
+// PodSecurityLevel is a level of the Kubernetes Pod Security Standards.
+type PodSecurityLevel string
+
+const (
+	PodSecurityPrivileged PodSecurityLevel = "privileged"
+	PodSecurityBaseline   PodSecurityLevel = "baseline"
+	PodSecurityRestricted PodSecurityLevel = "restricted"
+)
+
+// podSecurityAnnotation carries the enforced level of the pod's namespace.
+// NRI does not pass namespace labels to plugins, so the plugin relies on
+// the label being copied to the pod, e.g. by a mutating webhook.
+const podSecurityAnnotation = "pod-security.kubernetes.io/enforce"
+
+// rank orders the levels from the least to the most restrictive.
+func (l PodSecurityLevel) rank() int {
+	switch l {
+	case PodSecurityBaseline:
+		return 1
+	case PodSecurityRestricted:
+		return 2
+	}
+	return 0
+}
+
+func (l PodSecurityLevel) validate() error {
+	switch l {
+	case "", PodSecurityPrivileged, PodSecurityBaseline, PodSecurityRestricted:
+		return nil
+	}
+	return fmt.Errorf("invalid podSecurityLevel %q, must be %q, %q or %q", l,
+		PodSecurityPrivileged, PodSecurityBaseline, PodSecurityRestricted)
+}
+
+// podSecurityConflict is a Pod Security Standards control an adjustment
+// step bypasses, starting at the given level.
+type podSecurityConflict struct {
+	control string
+	level   PodSecurityLevel
+	reason  string
+}
+
+// podSecurityConflicts maps adjustment steps, as listed in the provenance
+// annotation, to the control they conflict with. The plugin changes the
+// spec after admission, so these adjustments would go unnoticed by the
+// Pod Security admission controller.
+var podSecurityConflicts = map[string]podSecurityConflict{
+	"profile=nested-runtime": {
+		control: "HostPath Volumes",
+		level:   PodSecurityBaseline,
+		reason:  "adds the host devices /dev/fuse and /dev/net/tun",
+	},
+	"profile=nested-containers": {
+		control: "HostPath Volumes",
+		level:   PodSecurityBaseline,
+		reason:  "adds the host device /dev/fuse",
+	},
+	"profile=container-engine": {
+		control: "Privileged Containers",
+		level:   PodSecurityBaseline,
+		reason:  "runs a container engine, which needs privileges",
+	},
+	"host-modules": {
+		control: "HostPath Volumes",
+		level:   PodSecurityBaseline,
+		reason:  "bind-mounts the kernel modules of the host",
+	},
+	"host-dbus": {
+		control: "HostPath Volumes",
+		level:   PodSecurityBaseline,
+		reason:  "bind-mounts the system D-Bus socket of the host",
+	},
+	"units": {
+		control: "Volume Types",
+		level:   PodSecurityRestricted,
+		reason:  "bind-mounts rendered units from the host",
+	},
+	"machine-id=empty": {
+		control: "Volume Types",
+		level:   PodSecurityRestricted,
+		reason:  "bind-mounts a rendered /etc/machine-id from the host",
+	},
+	"machine-id=first-boot": {
+		control: "Volume Types",
+		level:   PodSecurityRestricted,
+		reason:  "bind-mounts a rendered /etc/machine-id from the host",
+	},
+	"shared-run": {
+		control: "Volume Types",
+		level:   PodSecurityRestricted,
+		reason:  "bind-mounts a directory of the host as /run, shared with the pod",
+	},
+	"login-shell": {
+		control: "Volume Types",
+		level:   PodSecurityRestricted,
+		reason:  "bind-mounts the login-shell helper from the host",
+	},
+	"drop-ins": {
+		control: "Volume Types",
+		level:   PodSecurityRestricted,
+		reason:  "bind-mounts rendered systemd drop-ins from the host",
+	},
+}
+
+// podSecurityLevel returns the enforced level of the pod, taken from the
+// pod annotation or else the configuration.
+func podSecurityLevel(cfg *Config, pod *api.PodSandbox) PodSecurityLevel {
+	if pod != nil {
+		if value, ok := pod.Annotations[podSecurityAnnotation]; ok {
+			if level := PodSecurityLevel(value); level.validate() == nil && level != "" {
+				return level
+			}
+		}
+	}
+	if cfg.PodSecurityLevel == "" {
+		return PodSecurityPrivileged
+	}
+	return cfg.PodSecurityLevel
+}
+
+// checkPodSecurity warns about the steps conflicting with the enforced Pod
+// Security level of the pod, and leaves them out unless
+// overridePSSWarnings is set.
+func (p *plugin) checkPodSecurity(cfg *Config, pod *api.PodSandbox, ctrName string, steps []adjustmentStep) []adjustmentStep {
+	level := podSecurityLevel(cfg, pod)
+	if level == PodSecurityPrivileged {
+		return steps
+	}
+
+	var allowed []adjustmentStep
+	for _, s := range steps {
+		c, ok := podSecurityConflicts[s.String()]
+		if !ok || level.rank() < c.level.rank() {
+			allowed = append(allowed, s)
+			continue
+		}
+
+		log := p.log.WithFields(logrus.Fields{
+			"container": ctrName,
+			"step":      s.String(),
+			"level":     level,
+			"control":   c.control,
+		})
+		if cfg.OverridePSSWarnings {
+			log.Warnf("%s: %s conflicts with the %s Pod Security level (%s), applying it anyway", ctrName, s, level, c.reason)
+			allowed = append(allowed, s)
+			continue
+		}
+		log.Warnf("%s: skipping %s, it conflicts with the %s Pod Security level (%s)", ctrName, s, level, c.reason)
+	}
+	return allowed
+}
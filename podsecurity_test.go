@@ -0,0 +1,118 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/containerd/nri/pkg/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPodSecurity(t *testing.T) {
+	tests := []struct {
+		name        string
+		configLevel PodSecurityLevel
+		podLevel    string
+		override    bool
+		annotations map[string]string
+		step        string
+		applied     bool
+	}{
+		{
+			name:        "privileged by default",
+			annotations: map[string]string{profileAnnotation: "nested-runtime"},
+			step:        "profile=nested-runtime",
+			applied:     true,
+		},
+		{
+			name:        "host devices on baseline pod",
+			podLevel:    "baseline",
+			annotations: map[string]string{profileAnnotation: "nested-runtime"},
+			step:        "profile=nested-runtime",
+		},
+		{
+			name:        "host devices on restricted default",
+			configLevel: PodSecurityRestricted,
+			annotations: map[string]string{profileAnnotation: "nested-runtime"},
+			step:        "profile=nested-runtime",
+		},
+		{
+			name:        "pod annotation overrides default",
+			configLevel: PodSecurityRestricted,
+			podLevel:    "privileged",
+			annotations: map[string]string{profileAnnotation: "nested-runtime"},
+			step:        "profile=nested-runtime",
+			applied:     true,
+		},
+		{
+			name:        "overridden warning",
+			podLevel:    "restricted",
+			override:    true,
+			annotations: map[string]string{profileAnnotation: "nested-runtime"},
+			step:        "profile=nested-runtime",
+			applied:     true,
+		},
+		{
+			name:        "rendered units on baseline pod",
+			podLevel:    "baseline",
+			annotations: map[string]string{enableUnitsAnnotation: "sshd.service"},
+			step:        "units",
+			applied:     true,
+		},
+		{
+			name:        "rendered units on restricted pod",
+			podLevel:    "restricted",
+			annotations: map[string]string{enableUnitsAnnotation: "sshd.service"},
+			step:        "units",
+		},
+		{
+			name:     "systemd adjustments on restricted pod",
+			podLevel: "restricted",
+			step:     "cgroup",
+			applied:  true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			p := newTestPlugin(configWith(func(c *Config) {
+				c.StateDir = t.TempDir()
+				c.AllowedUnits = []string{"*"}
+				c.PodSecurityLevel = tc.configLevel
+				c.OverridePSSWarnings = tc.override
+			}))
+			pod := &api.PodSandbox{Name: "test-pod"}
+			if tc.podLevel != "" {
+				pod.Annotations = map[string]string{podSecurityAnnotation: tc.podLevel}
+			}
+
+			adjust, _, err := p.CreateContainer(context.Background(), pod, newProfileTestContainer(tc.annotations))
+			require.NoError(t, err)
+
+			applied := strings.Split(adjust.Annotations[provenanceAnnotation], ",")
+			if tc.applied {
+				assert.Contains(t, applied, tc.step)
+			} else {
+				assert.NotContains(t, applied, tc.step)
+			}
+		})
+	}
+}
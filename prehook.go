@@ -0,0 +1,71 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// runPreHook runs the pre-hook command, if any, logging its output. A
+// failing command fails the start of the plugin unless ignoreFailure is
+// set.
+func (p *plugin) runPreHook(ctx context.Context, hook PreHook) error {
+	if len(hook.Command) == 0 {
+		return nil
+	}
+
+	timeout := hook.Timeout
+	if timeout == 0 {
+		timeout = defaultPreHookTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout.Duration())
+	defer cancel()
+
+	var output bytes.Buffer
+	cmd := exec.CommandContext(ctx, hook.Command[0], hook.Command[1:]...)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	// do not wait for children of a killed command holding on to the output
+	cmd.WaitDelay = time.Second
+
+	p.log.Infof("running pre-hook %s", strings.Join(hook.Command, " "))
+	err := cmd.Run()
+	if out := strings.TrimSpace(output.String()); out != "" {
+		p.log.Infof("pre-hook output: %s", out)
+	}
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		err = fmt.Errorf("timed out after %v", timeout.Duration())
+	case errors.Is(ctx.Err(), context.Canceled):
+		err = errors.New("interrupted")
+	}
+	if err == nil {
+		return nil
+	}
+
+	if hook.IgnoreFailure {
+		p.log.Warnf("pre-hook failed: %v, starting anyway", err)
+		return nil
+	}
+	return fmt.Errorf("pre-hook failed: %w", err)
+}
@@ -0,0 +1,87 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPreHook(t *testing.T) {
+	sh := func(script string) []string {
+		return []string{"/bin/sh", "-c", script}
+	}
+
+	t.Run("none", func(t *testing.T) {
+		assert.NoError(t, newTestPlugin(nil).runPreHook(context.Background(), PreHook{}))
+	})
+
+	t.Run("success", func(t *testing.T) {
+		p := newTestPlugin(nil)
+		hook := logtest.NewLocal(p.logs.base)
+		dir := t.TempDir() + "/journal"
+
+		assert.NoError(t, p.runPreHook(context.Background(), PreHook{Command: sh("mkdir " + dir + " && echo created")}))
+		assert.DirExists(t, dir)
+		assert.Equal(t, "pre-hook output: created", hook.LastEntry().Message)
+	})
+
+	t.Run("interrupted", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(50*time.Millisecond, cancel)
+
+		start := time.Now()
+		err := newTestPlugin(nil).runPreHook(ctx, PreHook{Command: sh("sleep 60")})
+		assert.EqualError(t, err, "pre-hook failed: interrupted")
+		assert.Less(t, time.Since(start), 10*time.Second)
+	})
+
+	t.Run("failure", func(t *testing.T) {
+		p := newTestPlugin(nil)
+		hook := logtest.NewLocal(p.logs.base)
+
+		err := p.runPreHook(context.Background(), PreHook{Command: sh("echo no space left >&2; exit 3")})
+		assert.ErrorContains(t, err, "exit status 3")
+		assert.Equal(t, "pre-hook output: no space left", hook.LastEntry().Message)
+	})
+
+	t.Run("ignored failure", func(t *testing.T) {
+		p := newTestPlugin(nil)
+		hook := logtest.NewLocal(p.logs.base)
+
+		assert.NoError(t, p.runPreHook(context.Background(), PreHook{Command: sh("exit 1"), IgnoreFailure: true}))
+		assert.Contains(t, hook.LastEntry().Message, "starting anyway")
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		p := newTestPlugin(nil)
+
+		start := time.Now()
+		err := p.runPreHook(context.Background(), PreHook{Command: sh("sleep 10"), Timeout: Duration(50 * time.Millisecond)})
+		assert.ErrorContains(t, err, "timed out after 50ms")
+		assert.Less(t, time.Since(start), 5*time.Second)
+	})
+
+	t.Run("missing command", func(t *testing.T) {
+		err := newTestPlugin(nil).runPreHook(context.Background(), PreHook{Command: []string{"/nonexistent/prehook"}})
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,338 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// capability is a Linux capability number, see capabilities(7).
+type capability uint
+
+const (
+	capChown         capability = 0
+	capDacOverride   capability = 1
+	capDacReadSearch capability = 2
+)
+
+var capabilityNames = map[capability]string{
+	capChown:         "CAP_CHOWN",
+	capDacOverride:   "CAP_DAC_OVERRIDE",
+	capDacReadSearch: "CAP_DAC_READ_SEARCH",
+}
+
+func (c capability) String() string {
+	if name, ok := capabilityNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("capability(%d)", uint(c))
+}
+
+// privilegedFeature is a feature which still needs capabilities after
+// privileges were dropped with -run-as, or does not work at all without
+// root if incompatible.
+type privilegedFeature struct {
+	name         string
+	caps         []capability
+	incompatible bool
+	enabled      func(cfg *Config) bool
+}
+
+// privilegedFeatures is the compatibility matrix of features and the
+// capabilities they need. Everything else works with the credentials of
+// the -run-as user, who is handed stateDir and access to the NRI socket
+// before privileges are dropped.
+var privilegedFeatures = []privilegedFeature{
+	{
+		// handed to root, who owns /run in the container, and emptied of
+		// the files left by the container
+		name:    "sharedRun",
+		caps:    []capability{capChown, capDacOverride},
+		enabled: func(cfg *Config) bool { return cfg.SharedRun.Enabled },
+	},
+	{
+		// the journal of the host is read by journalctl
+		name:    "crashReports",
+		caps:    []capability{capDacReadSearch},
+		enabled: func(cfg *Config) bool { return cfg.CrashReports.Enabled },
+	},
+	{
+		// the persistent journal of the container is read on the host by
+		// journalctl
+		name:    "journalCapture",
+		caps:    []capability{capDacReadSearch},
+		enabled: func(cfg *Config) bool { return cfg.JournalCapture.Enabled },
+	},
+	{
+		// handed to root, as it runs as root in the containers
+		name:    "loginShell",
+		caps:    []capability{capChown},
+		enabled: func(cfg *Config) bool { return cfg.LoginShell.Enabled },
+	},
+	{
+		// cgroup.subtree_control of the host's cgroups is owned by root
+		name:    "fixParentDelegation",
+		caps:    []capability{capDacOverride},
+		enabled: func(cfg *Config) bool { return cfg.FixParentDelegation },
+	},
+	{
+		// /proc/sys is only writable by root in the initial user namespace
+		name:         "manageHostSysctls",
+		incompatible: true,
+		enabled:      func(cfg *Config) bool { return cfg.ManageHostSysctls },
+	},
+	{
+		// handed to root, who commits the generated ID in the container
+		name:    "machineID",
+		caps:    []capability{capChown},
+		enabled: func(cfg *Config) bool { return cfg.MachineID.fresh() },
+	},
+}
+
+// requiredCapabilities returns the capabilities needed by the enabled
+// features.
+func requiredCapabilities(cfg *Config) []capability {
+	var caps []capability
+	for _, f := range privilegedFeatures {
+		if f.enabled(cfg) && !f.incompatible {
+			caps = append(caps, f.caps...)
+		}
+	}
+	slices.Sort(caps)
+	return slices.Compact(caps)
+}
+
+// checkCapabilities fails if an enabled feature is incompatible with
+// dropping privileges or needs a capability which is not in the available
+// set.
+func checkCapabilities(cfg *Config, available uint64) error {
+	var missing []string
+	for _, f := range privilegedFeatures {
+		if !f.enabled(cfg) {
+			continue
+		}
+		if f.incompatible {
+			missing = append(missing, f.name+" needs root")
+			continue
+		}
+		for _, c := range f.caps {
+			if available&(1<<c) == 0 {
+				missing = append(missing, fmt.Sprintf("%s needs %s", f.name, c))
+			}
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("enabled features do not work after dropping privileges: %s",
+			strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// capabilitySet returns the set of the given capabilities.
+func capabilitySet(caps []capability) uint64 {
+	var set uint64
+	for _, c := range caps {
+		set |= 1 << c
+	}
+	return set
+}
+
+// checkDroppedPrivileges fails if privileges were dropped and an enabled
+// feature of the configuration does not work with the capabilities
+// retained, e.g. for a configuration delivered by the runtime later on.
+func (p *plugin) checkDroppedPrivileges(cfg *Config) error {
+	retained := p.retainedCaps.Load()
+	if retained == nil {
+		return nil
+	}
+	return checkCapabilities(cfg, *retained)
+}
+
+// privilegeDrop validates -run-as against the enabled features and returns
+// the function dropping privileges, to be called once the NRI socket is
+// connected. The configuration is validated again when dropping, as the
+// runtime may have delivered another one meanwhile.
+func (p *plugin) privilegeDrop(runAs, socketPath string) (func() error, error) {
+	creds, err := parseRunAs(runAs)
+	if err != nil {
+		return nil, err
+	}
+
+	if syscall.Geteuid() != 0 {
+		return nil, fmt.Errorf("the plugin must be started as root")
+	}
+
+	cfg := p.config()
+	available, err := permittedCapabilities()
+	if err != nil {
+		return nil, err
+	}
+	if err := checkCapabilities(cfg, available); err != nil {
+		return nil, err
+	}
+
+	caps := requiredCapabilities(cfg)
+	if len(caps) > 0 && !canRetainCapabilities() {
+		return nil, fmt.Errorf("retaining %v needs a binary built with CGO_ENABLED=0", caps)
+	}
+
+	return func() error {
+		cfg := p.config()
+		if err := checkCapabilities(cfg, available); err != nil {
+			return err
+		}
+		if err := grantStateDir(cfg.StateDir, creds); err != nil {
+			return fmt.Errorf("failed to hand %s to uid %d: %w", cfg.StateDir, creds.uid, err)
+		}
+		if err := grantSocket(socketPath, creds.gid); errors.Is(err, fs.ErrNotExist) {
+			// connected through a socket passed by the runtime
+			p.log.Warnf("no NRI socket at %s, reconnecting needs root", socketPath)
+		} else if err != nil {
+			return fmt.Errorf("failed to grant gid %d access to the NRI socket: %w", creds.gid, err)
+		}
+		caps := requiredCapabilities(cfg)
+		if err := dropPrivileges(creds, caps); err != nil {
+			return fmt.Errorf("failed to drop privileges: %w", err)
+		}
+		retained := capabilitySet(caps)
+		p.retainedCaps.Store(&retained)
+		p.log.Infof("dropped privileges to uid %d, gid %d, retaining %v", creds.uid, creds.gid, caps)
+		return nil
+	}, nil
+}
+
+// grantStateDir hands stateDir to the -run-as user, so that files can be
+// rendered below it after dropping privileges. What was handed to root for
+// the containers stays with root: the shared /run of pods, machine IDs and
+// the login-shell helper.
+func grantStateDir(dir string, creds credentials) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		parts := strings.Split(filepath.ToSlash(rel), "/")
+		switch {
+		case len(parts) == 2 && parts[0] == sharedRunKind:
+			return filepath.SkipDir
+		case len(parts) == 3 && parts[0] == renderedMachineID && !d.IsDir():
+			return nil
+		case len(parts) == 2 && parts[0] == loginShellDir && !d.IsDir():
+			return nil
+		}
+		return os.Lchown(path, creds.uid, creds.gid)
+	})
+}
+
+// grantSocket gives the group read and write access to the NRI socket, so
+// that the plugin can reconnect after dropping privileges, as long as the
+// runtime does not recreate it.
+func grantSocket(socket string, gid int) error {
+	for _, path := range []string{filepath.Dir(socket), socket} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		perm := info.Mode().Perm() | 0o060
+		if info.IsDir() {
+			perm = info.Mode().Perm() | 0o010
+		}
+		if err := os.Chown(path, -1, gid); err != nil {
+			return err
+		}
+		if err := os.Chmod(path, perm); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// chownToRoot hands a file created after dropping privileges to root, who
+// owns it when created with privileges.
+func chownToRoot(path string) error {
+	if os.Geteuid() == 0 {
+		return nil
+	}
+	return os.Lchown(path, 0, 0)
+}
+
+// credentials identify the user to run as after dropping privileges.
+type credentials struct {
+	uid int
+	gid int
+}
+
+// parseRunAs parses user[:group], given by name or numeric ID. Without a
+// group, the primary group of the user is used, or the numeric user ID
+// for users unknown to the host.
+func parseRunAs(s string) (credentials, error) {
+	userPart, groupPart, hasGroup := strings.Cut(s, ":")
+
+	var c credentials
+	u, err := lookupUser(userPart)
+	switch {
+	case err == nil:
+		c.uid, _ = strconv.Atoi(u.Uid)
+		c.gid, _ = strconv.Atoi(u.Gid)
+	case isNumericID(userPart):
+		c.uid, _ = strconv.Atoi(userPart)
+		c.gid = c.uid
+	default:
+		return c, fmt.Errorf("unknown user %q: %w", userPart, err)
+	}
+
+	if hasGroup {
+		if isNumericID(groupPart) {
+			c.gid, _ = strconv.Atoi(groupPart)
+		} else {
+			g, err := user.LookupGroup(groupPart)
+			if err != nil {
+				return c, fmt.Errorf("unknown group %q: %w", groupPart, err)
+			}
+			c.gid, _ = strconv.Atoi(g.Gid)
+		}
+	}
+
+	return c, nil
+}
+
+func lookupUser(s string) (*user.User, error) {
+	if isNumericID(s) {
+		return user.LookupId(s)
+	}
+	return user.Lookup(s)
+}
+
+func isNumericID(s string) bool {
+	_, err := strconv.ParseUint(s, 10, 32)
+	return err == nil
+}
@@ -0,0 +1,116 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// canRetainCapabilities tells whether capabilities can be changed for all
+// threads, which is not possible in binaries using cgo.
+func canRetainCapabilities() bool {
+	_, _, errno := syscall.AllThreadsSyscall(syscall.SYS_PRCTL, syscall.PR_GET_KEEPCAPS, 0, 0)
+	return errno != syscall.ENOTSUP
+}
+
+const linuxCapabilityVersion3 = 0x20080522
+
+type capHeader struct {
+	version uint32
+	pid     int32
+}
+
+type capData struct {
+	effective   uint32
+	permitted   uint32
+	inheritable uint32
+}
+
+// permittedCapabilities returns the permitted capability set of the
+// calling thread.
+func permittedCapabilities() (uint64, error) {
+	hdr := capHeader{version: linuxCapabilityVersion3}
+	var data [2]capData
+	_, _, errno := syscall.RawSyscall(syscall.SYS_CAPGET,
+		uintptr(unsafe.Pointer(&hdr)), uintptr(unsafe.Pointer(&data[0])), 0)
+	if errno != 0 {
+		return 0, fmt.Errorf("capget: %w", errno)
+	}
+	return uint64(data[0].permitted) | uint64(data[1].permitted)<<32, nil
+}
+
+// dropPrivileges switches all threads to the given credentials, retaining
+// only the given capabilities. Capabilities are per thread, so retaining
+// them needs syscall.AllThreadsSyscall, which is not available in binaries
+// using cgo.
+func dropPrivileges(creds credentials, caps []capability) error {
+	if len(caps) > 0 {
+		_, _, errno := syscall.AllThreadsSyscall(syscall.SYS_PRCTL, syscall.PR_SET_KEEPCAPS, 1, 0)
+		if errno == syscall.ENOTSUP {
+			return fmt.Errorf("retaining %v needs a binary built with CGO_ENABLED=0", caps)
+		}
+		if errno != 0 {
+			return fmt.Errorf("failed to keep capabilities: %w", errno)
+		}
+	}
+
+	if err := syscall.Setgroups([]int{}); err != nil {
+		return fmt.Errorf("failed to drop supplementary groups: %w", err)
+	}
+	if err := syscall.Setgid(creds.gid); err != nil {
+		return fmt.Errorf("failed to set gid %d: %w", creds.gid, err)
+	}
+	if err := syscall.Setuid(creds.uid); err != nil {
+		return fmt.Errorf("failed to set uid %d: %w", creds.uid, err)
+	}
+
+	if len(caps) == 0 {
+		return nil
+	}
+
+	set := capabilitySet(caps)
+	hdr := capHeader{version: linuxCapabilityVersion3}
+	data := [2]capData{
+		{effective: uint32(set), permitted: uint32(set)},
+		{effective: uint32(set >> 32), permitted: uint32(set >> 32)},
+	}
+	_, _, errno := syscall.AllThreadsSyscall(syscall.SYS_CAPSET,
+		uintptr(unsafe.Pointer(&hdr)), uintptr(unsafe.Pointer(&data[0])), 0)
+	if errno != 0 {
+		return fmt.Errorf("failed to set capabilities: %w", errno)
+	}
+
+	return nil
+}
+
+// readerProcAttr passes CAP_DAC_READ_SEARCH on to a command reading files
+// of the host, like journalctl, if it was retained after dropping
+// privileges. Executed commands lose the capabilities of the plugin
+// otherwise.
+func readerProcAttr() *syscall.SysProcAttr {
+	if os.Geteuid() == 0 {
+		return nil
+	}
+	permitted, err := permittedCapabilities()
+	if err != nil || permitted&(1<<capDacReadSearch) == 0 {
+		return nil
+	}
+	return &syscall.SysProcAttr{AmbientCaps: []uintptr{uintptr(capDacReadSearch)}}
+}
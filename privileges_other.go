@@ -0,0 +1,42 @@
+//go:build !linux
+
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+var errPrivilegesUnsupported = errors.New("dropping privileges is only supported on Linux")
+
+func canRetainCapabilities() bool {
+	return false
+}
+
+func permittedCapabilities() (uint64, error) {
+	return 0, errPrivilegesUnsupported
+}
+
+func dropPrivileges(credentials, []capability) error {
+	return errPrivilegesUnsupported
+}
+
+func readerProcAttr() *syscall.SysProcAttr {
+	return nil
+}
@@ -0,0 +1,364 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/containerd/nri/pkg/api"
+	"github.com/containerd/nri/pkg/stub"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCapabilityMatrix(t *testing.T) {
+	all := capabilitySet([]capability{capChown, capDacOverride, capDacReadSearch})
+
+	tests := []struct {
+		name         string
+		cfg          *Config
+		expected     []capability
+		incompatible bool
+	}{
+		{
+			name: "units",
+			cfg:  configWith(func(c *Config) { c.AllowedUnits = []string{"*"} }),
+		},
+		{
+			name: "units",
+			cfg:  configWith(func(c *Config) { c.AllowedTargets = []string{"rescue.target"} }),
+		},
+		{
+			name: "reconnect",
+			cfg:  configWith(func(c *Config) { c.ExitOnDisconnect = false }),
+		},
+		{
+			name:     "sharedRun",
+			cfg:      configWith(func(c *Config) { c.SharedRun.Enabled = true }),
+			expected: []capability{capChown, capDacOverride},
+		},
+		{
+			name:     "crashReports",
+			cfg:      configWith(func(c *Config) { c.CrashReports.Enabled = true }),
+			expected: []capability{capDacReadSearch},
+		},
+		{
+			name:     "journalCapture",
+			cfg:      configWith(func(c *Config) { c.JournalCapture.Enabled = true }),
+			expected: []capability{capDacReadSearch},
+		},
+		{
+			name:     "loginShell",
+			cfg:      configWith(func(c *Config) { c.LoginShell.Enabled = true }),
+			expected: []capability{capChown},
+		},
+		{
+			name:     "fixParentDelegation",
+			cfg:      configWith(func(c *Config) { c.FixParentDelegation = true }),
+			expected: []capability{capDacOverride},
+		},
+		{
+			name:         "manageHostSysctls",
+			cfg:          configWith(func(c *Config) { c.ManageHostSysctls = true }),
+			incompatible: true,
+		},
+		{
+			name:     "machineID",
+			cfg:      configWith(func(c *Config) { c.MachineID = MachineIDEmpty }),
+			expected: []capability{capChown},
+		},
+		{
+			name:     "machineID",
+			cfg:      configWith(func(c *Config) { c.MachineID = MachineIDFirstBoot }),
+			expected: []capability{capChown},
+		},
+	}
+
+	t.Run("default", func(t *testing.T) {
+		assert.Empty(t, requiredCapabilities(defaultConfig()))
+		assert.NoError(t, checkCapabilities(defaultConfig(), 0))
+	})
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.incompatible {
+				assert.Empty(t, requiredCapabilities(tt.cfg))
+				assert.ErrorContains(t, checkCapabilities(tt.cfg, all), tt.name+" needs root")
+				return
+			}
+			assert.Equal(t, tt.expected, requiredCapabilities(tt.cfg))
+			assert.NoError(t, checkCapabilities(tt.cfg, all))
+			for _, c := range tt.expected {
+				err := checkCapabilities(tt.cfg, all&^(1<<c))
+				assert.ErrorContains(t, err, tt.name+" needs "+c.String())
+			}
+		})
+	}
+}
+
+func TestIncompatibleFeature(t *testing.T) {
+	features := privilegedFeatures
+	t.Cleanup(func() { privilegedFeatures = features })
+	privilegedFeatures = append(slices.Clone(features), privilegedFeature{
+		name:         "host writes",
+		incompatible: true,
+		enabled:      func(cfg *Config) bool { return cfg.Verbose },
+	})
+
+	cfg := configWith(func(c *Config) { c.Verbose = true })
+	assert.Empty(t, requiredCapabilities(cfg))
+	assert.EqualError(t, checkCapabilities(cfg, ^uint64(0)),
+		"enabled features do not work after dropping privileges: host writes needs root")
+	assert.NoError(t, checkCapabilities(defaultConfig(), ^uint64(0)))
+}
+
+func TestConfigAfterPrivilegeDrop(t *testing.T) {
+	p := newTestPlugin(nil)
+	sharedRun := configWith(func(c *Config) { c.SharedRun.Enabled = true })
+
+	// before dropping privileges, everything goes
+	require.NoError(t, p.setConfig(sharedRun))
+
+	retained := capabilitySet(requiredCapabilities(defaultConfig()))
+	p.retainedCaps.Store(&retained)
+	require.NoError(t, p.setConfig(defaultConfig()))
+	assert.ErrorContains(t, p.setConfig(sharedRun), "sharedRun needs CAP_CHOWN")
+	assert.ErrorContains(t, p.setConfig(configWith(func(c *Config) { c.ManageHostSysctls = true })),
+		"manageHostSysctls needs root")
+	assert.False(t, p.config().ManageHostSysctls)
+
+	// a configuration delivered by the runtime fails the registration
+	_, err := p.Configure(context.Background(), "manageHostSysctls: true\n", "containerd", "v2.0.0")
+	assert.ErrorContains(t, err, "manageHostSysctls needs root")
+	assert.False(t, p.config().ManageHostSysctls)
+	_, err = p.Configure(context.Background(), "manageHostSysctls: false\n", "containerd", "v2.0.0")
+	assert.NoError(t, err)
+}
+
+func TestGrantStateDir(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("handing files to another user needs root")
+	}
+	dir := t.TempDir()
+	for _, file := range []string{
+		"units/ctr/multi-user.target.wants/sshd.service",
+		"machine-id/ctr/machine-id",
+		"shared-run/pod-uid/dbus/system_bus_socket",
+		"bin/login-shell",
+		"journals/ctr.log.gz",
+	} {
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, filepath.Dir(file)), 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, file), nil, 0o644))
+	}
+
+	require.NoError(t, grantStateDir(dir, credentials{uid: 65534, gid: 65534}))
+
+	for file, uid := range map[string]uint32{
+		".": 65534,
+		"units/ctr/multi-user.target.wants/sshd.service": 65534,
+		"machine-id/ctr":            65534,
+		"machine-id/ctr/machine-id": 0,
+		"shared-run":                65534,
+		"shared-run/pod-uid":        0,
+		"shared-run/pod-uid/dbus":   0,
+		"bin":                       65534,
+		"bin/login-shell":           0,
+		"journals/ctr.log.gz":       65534,
+	} {
+		fi, err := os.Lstat(filepath.Join(dir, file))
+		require.NoError(t, err)
+		assert.Equal(t, uid, fi.Sys().(*syscall.Stat_t).Uid, file)
+	}
+}
+
+func TestGrantSocket(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("handing files to another group needs root")
+	}
+	dir := t.TempDir()
+	require.NoError(t, os.Chmod(dir, 0o700))
+	socket := filepath.Join(dir, "nri.sock")
+	l, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	defer l.Close()
+	require.NoError(t, os.Chmod(socket, 0o600))
+
+	require.NoError(t, grantSocket(socket, 4242))
+
+	for file, perm := range map[string]os.FileMode{dir: 0o710, socket: 0o660} {
+		fi, err := os.Stat(file)
+		require.NoError(t, err)
+		assert.Equal(t, perm, fi.Mode().Perm(), file)
+		assert.Equal(t, uint32(4242), fi.Sys().(*syscall.Stat_t).Gid, file)
+	}
+	assert.ErrorIs(t, grantSocket(filepath.Join(dir, "missing.sock"), 4242), fs.ErrNotExist)
+}
+
+func TestParseRunAs(t *testing.T) {
+	tests := []struct {
+		runAs     string
+		expected  credentials
+		expectErr bool
+	}{
+		{runAs: "root", expected: credentials{0, 0}},
+		{runAs: "0", expected: credentials{0, 0}},
+		{runAs: "root:12", expected: credentials{0, 12}},
+		{runAs: "65534:65534", expected: credentials{65534, 65534}},
+		{runAs: "4242", expected: credentials{4242, 4242}},
+		{runAs: "no-such-user", expectErr: true},
+		{runAs: "root:no-such-group", expectErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.runAs, func(t *testing.T) {
+			creds, err := parseRunAs(tt.runAs)
+			if tt.expectErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, creds)
+		})
+	}
+}
+
+// TestRunAs drops privileges in a child process, since the drop affects
+// the whole process, and checks that events are still processed.
+func TestRunAs(t *testing.T) {
+	if os.Getenv("TEST_RUN_AS_CHILD") == "1" {
+		testRunAsChild(t)
+		return
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("dropping privileges needs root")
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestRunAs$", "-test.v")
+	// the child cannot remove temporary directories in the sticky /tmp
+	// once privileges are dropped, so the parent provides them
+	cmd.Env = append(os.Environ(), "TEST_RUN_AS_CHILD=1",
+		"TEST_RUN_AS_STATE_DIR="+t.TempDir(), "TEST_RUN_AS_SOCKET_DIR="+t.TempDir())
+	out, err := cmd.CombinedOutput()
+	assert.NoError(t, err, "%s", out)
+}
+
+func testRunAsChild(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.StateDir = os.Getenv("TEST_RUN_AS_STATE_DIR")
+	if !canRetainCapabilities() {
+		t.Skip("retaining capabilities needs a binary built with CGO_ENABLED=0")
+	}
+	// rendered below stateDir and handed to root
+	cfg.MachineID = MachineIDEmpty
+	cfg.LoginShell.Enabled = true
+	cfg.SharedRun.Enabled = true
+	// rendered below stateDir
+	cfg.AllowedUnits = []string{"sshd.service"}
+	// journalctl reads the journal of the host
+	cfg.JournalCapture.Enabled = true
+
+	p := newPlugin(cfg)
+	p.logs.base.SetOutput(io.Discard)
+
+	socket := filepath.Join(os.Getenv("TEST_RUN_AS_SOCKET_DIR"), "nri.sock")
+	l, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	defer l.Close()
+	require.NoError(t, os.Chmod(socket, 0o600))
+
+	drop, err := p.privilegeDrop("65534:65534", socket)
+	require.NoError(t, err)
+	dropped := make(chan error, 1)
+	p.afterConnect = func() error {
+		err := drop()
+		dropped <- err
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = p.run(ctx, func(onClose func()) (stub.Stub, error) {
+			return &fakeStub{onClose: onClose}, nil
+		})
+	}()
+
+	select {
+	case err := <-dropped:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("privileges not dropped")
+	}
+
+	assert.Equal(t, 65534, os.Getuid())
+	assert.Equal(t, 65534, os.Getgid())
+
+	permitted, err := permittedCapabilities()
+	require.NoError(t, err)
+	var expected uint64
+	for _, c := range requiredCapabilities(cfg) {
+		expected |= 1 << c
+	}
+	assert.Equal(t, expected, permitted)
+
+	// the socket is still accessible for reconnecting
+	conn, err := net.Dial("unix", socket)
+	require.NoError(t, err)
+	conn.Close()
+
+	ctr := newProfileTestContainer(map[string]string{enableUnitsAnnotation: "sshd.service"})
+	ctr.Id = "ctr"
+	pod := &api.PodSandbox{Name: "pod", Uid: "pod-uid", Annotations: map[string]string{shareRunAnnotation: "true"}}
+	adjust, _, err := p.CreateContainer(context.Background(), pod, ctr)
+	require.NoError(t, err)
+	assert.NotEmpty(t, adjust.Mounts)
+
+	for _, file := range []string{
+		filepath.Join(cfg.StateDir, renderedMachineID, ctr.Id, "machine-id"),
+		filepath.Join(cfg.StateDir, sharedRunKind, pod.Uid),
+		filepath.Join(cfg.StateDir, sharedRunKind, pod.Uid, "dbus"),
+		filepath.Join(cfg.StateDir, loginShellDir, loginShellName),
+	} {
+		fi, err := os.Stat(file)
+		require.NoError(t, err)
+		assert.Equal(t, uint32(0), fi.Sys().(*syscall.Stat_t).Uid, file)
+	}
+	assert.DirExists(t, filepath.Join(cfg.StateDir, renderedUnits, ctr.Id))
+
+	// journalctl reads the journal of the host with the retained
+	// CAP_DAC_READ_SEARCH
+	secret := filepath.Join(cfg.StateDir, "secret")
+	require.NoError(t, os.WriteFile(secret, []byte("journal"), 0o600))
+	require.NoError(t, chownToRoot(secret))
+	_, err = exec.Command("cat", secret).Output()
+	assert.Error(t, err)
+	cmd := exec.Command("cat", secret)
+	cmd.SysProcAttr = readerProcAttr()
+	out, err := cmd.Output()
+	require.NoError(t, err)
+	assert.Equal(t, "journal", string(out))
+}
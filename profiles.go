@@ -0,0 +1,357 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/containerd/nri/pkg/api"
+)
+
+const (
+	// profileAnnotation selects a profile for a container. Set on the pod
+	// it applies to all containers of the pod without their own selection.
+	profileAnnotation = "io.systemd.container/profile"
+
+	profileNestedRuntime    = "nested-runtime"
+	profileNestedContainers = "nested-containers"
+	profileContainerEngine  = "container-engine"
+	profileRootless         = "rootless"
+)
+
+// profile bundles the adjustments needed for a common use case on top of
+// the basic systemd support.
+type profile struct {
+	name  string
+	apply func(cfg *Config, adjust *api.ContainerAdjustment, container *api.Container)
+
+	// keepCgroupMount leaves the cgroup mount as set up by the runtime,
+	// instead of making it writable.
+	keepCgroupMount bool
+
+	// gated profiles grant containers more than systemd support, so they
+	// can only be selected if listed in allowedProfiles.
+	gated bool
+
+	// check, if set, fails the profile if the configuration blocks an
+	// adjustment the profile cannot do without.
+	check func(cfg *Config, container *api.Container) error
+
+	// gaps, if set, lists what the container still lacks for the use case
+	// of the profile, which the plugin cannot provide. They are logged as
+	// warnings.
+	gaps func(container *api.Container) []string
+}
+
+var profiles = map[string]*profile{
+	profileNestedRuntime: {
+		name:  profileNestedRuntime,
+		apply: applyNestedRuntimeProfile,
+	},
+	profileNestedContainers: {
+		name:  profileNestedContainers,
+		apply: applyNestedContainersProfile,
+		gated: true,
+		check: checkNestedContainersProfile,
+	},
+	profileContainerEngine: {
+		name:  profileContainerEngine,
+		apply: applyContainerEngineProfile,
+		gated: true,
+		check: checkContainerEngineProfile,
+		gaps:  containerEngineGaps,
+	},
+	profileRootless: {
+		name:            profileRootless,
+		keepCgroupMount: true,
+	},
+}
+
+// selectProfile returns the profile for the container. The container
+// annotation takes precedence over the pod annotation. Without either,
+// the configured default applies, or, if there is none, the rootless
+// profile for rootless containers.
+func selectProfile(cfg *Config, pod *api.PodSandbox, container *api.Container) (*profile, error) {
+	name, ok := lookupAnnotation(pod, container, profileAnnotation)
+	if !ok {
+		name = cfg.Profile
+		if name == "" && isRootlessContainer(container) {
+			name = profileRootless
+		}
+	}
+
+	if name == "" {
+		return nil, nil
+	}
+
+	p, ok := profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown systemd container profile %q", name)
+	}
+	if p.gated && !slices.Contains(cfg.AllowedProfiles, name) {
+		return nil, fmt.Errorf("systemd container profile %s is not in allowedProfiles", name)
+	}
+
+	return p, nil
+}
+
+// applyProfile applies the selected profile, if any.
+func (p *plugin) applyProfile(cfg *Config, prof *profile, adjust *api.ContainerAdjustment, container *api.Container, ctrName string) error {
+	if prof == nil {
+		return nil
+	}
+
+	if prof.check != nil {
+		if err := prof.check(cfg, container); err != nil {
+			p.mountLog.Errorf("%s: profile %s: %v", ctrName, prof.name, err)
+			return fmt.Errorf("profile %s: %w", prof.name, err)
+		}
+	}
+	if prof.apply != nil {
+		prof.apply(cfg, adjust, container)
+	}
+	if prof.gaps != nil {
+		for _, gap := range prof.gaps(container) {
+			p.mountLog.Warnf("%s: profile %s: %s", ctrName, prof.name, gap)
+		}
+	}
+	p.mountLog.Debugf("%s: applied profile %s", ctrName, prof.name)
+
+	return nil
+}
+
+func profileName(prof *profile) string {
+	if prof == nil {
+		return ""
+	}
+	return prof.name
+}
+
+// isRootlessContainer tells whether the container runs in its own user
+// namespace, i.e. with uid mappings. Its root user cannot write the cgroup
+// files owned by the host, so making the cgroup mount writable does not
+// help and only hides the runtime's own handling.
+func isRootlessContainer(container *api.Container) bool {
+	if container.Linux == nil {
+		return false
+	}
+	for _, ns := range container.Linux.Namespaces {
+		if ns.Type == "user" {
+			return true
+		}
+	}
+	return false
+}
+
+// applyNestedRuntimeProfile prepares a systemd container for running a
+// container runtime (docker, podman, containerd) inside of it:
+//
+//   - the inner runtime creates and delegates its own cgroups below the
+//     writable cgroup mount every systemd container gets
+//   - /var/lib/docker and /var/lib/containers get a tmpfs, because overlayfs
+//     cannot use the container's own overlay rootfs as its upper layer;
+//     a volume mounted there by the pod spec is left untouched
+//   - /dev/fuse is added for fuse-overlayfs
+//   - /dev/net/tun is added for slirp4netns/pasta networking
+//
+// Capabilities cannot be adjusted through NRI. The inner runtime still needs
+// CAP_SYS_ADMIN (and usually CAP_NET_ADMIN) granted by the pod securityContext.
+func applyNestedRuntimeProfile(_ *Config, adjust *api.ContainerAdjustment, container *api.Container) {
+	storageMounts := []struct {
+		dest string
+		mode TmpfsMode
+	}{
+		{"/var/lib/docker", "mode=0711"},
+		{"/var/lib/containers", "mode=0755"},
+	}
+
+	for _, m := range storageMounts {
+		if hasMount(container, m.dest) {
+			continue
+		}
+		adjust.AddMount(&api.Mount{
+			Destination: m.dest,
+			Type:        "tmpfs",
+			Source:      "tmpfs",
+			Options:     []string{"rw", "rprivate", string(m.mode)},
+		})
+	}
+
+	adjust.AddDevice(charDevice("/dev/fuse", 10, 229))
+	adjust.AddDevice(charDevice("/dev/net/tun", 10, 200))
+}
+
+// machinesDir is where systemd-nspawn and machinectl keep container images.
+const machinesDir = "/var/lib/machines"
+
+// applyNestedContainersProfile prepares a systemd container for running
+// systemd-nspawn (or other systemd-based containers) inside of it:
+//
+//   - the nested containers get cgroups delegated below the writable cgroup
+//     mount every systemd container gets
+//   - /var/lib/machines gets a tmpfs, because overlayfs cannot use the
+//     container's own overlay rootfs as its upper layer; a volume mounted
+//     there by the pod spec is left untouched
+//   - /dev/fuse is added for fuse-overlayfs and FUSE-backed images
+//
+// Capabilities and the sysctls allowing unprivileged user namespaces cannot
+// be adjusted through NRI. systemd-nspawn still needs CAP_SYS_ADMIN granted
+// by the pod securityContext.
+func applyNestedContainersProfile(_ *Config, adjust *api.ContainerAdjustment, container *api.Container) {
+	if !hasMount(container, machinesDir) {
+		adjust.AddMount(&api.Mount{
+			Destination: machinesDir,
+			Type:        "tmpfs",
+			Source:      "tmpfs",
+			Options:     []string{"rw", "rprivate", "mode=0700"},
+		})
+	}
+
+	adjust.AddDevice(charDevice("/dev/fuse", 10, 229))
+}
+
+// checkNestedContainersProfile fails if excludeMounts keeps the plugin from
+// making the cgroup mount writable or mounting /var/lib/machines. Nested
+// containers cannot run without cgroup delegation, and a silently missing
+// tmpfs leaves systemd-nspawn failing with obscure overlayfs errors.
+func checkNestedContainersProfile(cfg *Config, container *api.Container) error {
+	if pattern, ok := cfg.excludedMount(cgroupRoot); ok {
+		return fmt.Errorf("the cgroup mount is excluded by excludeMounts (%s), nested containers need it writable", pattern)
+	}
+	if pattern, ok := cfg.excludedMount(machinesDir); ok && !hasMount(container, machinesDir) {
+		return fmt.Errorf("%s is excluded by excludeMounts (%s), nested containers need it", machinesDir, pattern)
+	}
+	return nil
+}
+
+// applyContainerEngineProfile prepares a systemd container for running a
+// container engine (docker, podman) inside of it, like nested-runtime, and
+// additionally:
+//
+//   - sizes the /run tmpfs for the state and sockets of the inner engine,
+//     including a /run tmpfs mounted by the runtime itself
+//   - adds the configured environment, e.g. iptables hints for dind images
+//
+// What still requires privileges is listed by containerEngineGaps.
+func applyContainerEngineProfile(cfg *Config, adjust *api.ContainerAdjustment, container *api.Container) {
+	applyNestedRuntimeProfile(cfg, adjust, container)
+
+	size := string(cfg.ContainerEngine.RunSize)
+	if m := findAdjustedMount(adjust, "/run"); m != nil {
+		m.Options = withTmpfsSize(m.Options, size)
+	} else if m := findContainerMount(container, "/run"); m != nil && m.Type == "tmpfs" {
+		adjust.RemoveMount(m.Destination)
+		adjust.AddMount(&api.Mount{
+			Destination: m.Destination,
+			Type:        m.Type,
+			Source:      m.Source,
+			Options:     withTmpfsSize(m.Options, size),
+		})
+	}
+
+	keys := make([]string, 0, len(cfg.ContainerEngine.Env))
+	for key := range cfg.ContainerEngine.Env {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		if !hasEnv(container, key) {
+			adjust.AddEnv(key, cfg.ContainerEngine.Env[key])
+		}
+	}
+}
+
+// checkContainerEngineProfile fails if excludeMounts keeps the plugin from
+// making the cgroup mount writable, which the inner engine cannot do
+// without.
+func checkContainerEngineProfile(cfg *Config, _ *api.Container) error {
+	if pattern, ok := cfg.excludedMount(cgroupRoot); ok {
+		return fmt.Errorf("the cgroup mount is excluded by excludeMounts (%s), container engines need it writable", pattern)
+	}
+	return nil
+}
+
+// containerEngineGaps lists what an inner container engine still needs from
+// the pod spec, since NRI cannot adjust capabilities, security profiles or
+// the read-only /proc/sys and /sys of unprivileged containers:
+//
+//   - CAP_SYS_ADMIN to mount overlay filesystems and create namespaces
+//   - CAP_NET_ADMIN to create bridges and program iptables for the
+//     containers' networks
+//   - an unconfined seccomp and AppArmor profile, since the default ones
+//     block mount, unshare and pivot_root
+//   - a writable /proc/sys, e.g. for net.ipv4.ip_forward
+//
+// Privileged containers have all of them. Others are detected by their
+// read-only /sys mount, and the gaps are logged, since the plugin cannot
+// tell which of them the pod spec already covers.
+func containerEngineGaps(container *api.Container) []string {
+	sys := findContainerMount(container, "/sys")
+	if sys == nil || !isReadOnlyMount(sys) {
+		return nil
+	}
+	return []string{
+		"not privileged, the container engine still needs CAP_SYS_ADMIN and CAP_NET_ADMIN from the pod securityContext",
+		"not privileged, the container engine still needs unconfined seccomp and AppArmor profiles",
+		"not privileged, /proc/sys and /sys are read-only, the container engine cannot enable IP forwarding itself",
+	}
+}
+
+// withTmpfsSize returns the tmpfs mount options with the size replaced.
+func withTmpfsSize(options []string, size string) []string {
+	options = slices.DeleteFunc(slices.Clone(options), func(opt string) bool {
+		return strings.HasPrefix(opt, "size=")
+	})
+	return append(options, size)
+}
+
+// findAdjustedMount returns the mount added by the adjustment at the
+// destination, if any.
+func findAdjustedMount(adjust *api.ContainerAdjustment, destination string) *api.Mount {
+	for _, m := range adjust.Mounts {
+		if m.Destination == destination {
+			return m
+		}
+	}
+	return nil
+}
+
+func findContainerMount(container *api.Container, destination string) *api.Mount {
+	for _, mount := range container.Mounts {
+		if mount.Destination == destination {
+			return mount
+		}
+	}
+	return nil
+}
+
+func charDevice(path string, major, minor int64) *api.LinuxDevice {
+	return &api.LinuxDevice{
+		Path:     path,
+		Type:     "c",
+		Major:    major,
+		Minor:    minor,
+		FileMode: api.FileMode(os.FileMode(0o666)),
+	}
+}
+
+func hasMount(container *api.Container, destination string) bool {
+	return findContainerMount(container, destination) != nil
+}
@@ -0,0 +1,421 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/containerd/nri/pkg/api"
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newProfileTestContainer(annotations map[string]string, mounts ...*api.Mount) *api.Container {
+	return &api.Container{
+		Name:        "test-container-systemd",
+		Annotations: annotations,
+		Args:        []string{"/sbin/init"},
+		Linux:       &api.LinuxContainer{},
+		Mounts: append([]*api.Mount{
+			{
+				Destination: "/sys/fs/cgroup",
+				Type:        "cgroup",
+				Source:      "cgroup",
+				Options:     []string{"nosuid", "noexec", "nodev", "relatime", "ro"},
+			},
+		}, mounts...),
+		Id: "test-container-id-12345",
+	}
+}
+
+func TestNestedRuntimeProfile(t *testing.T) {
+	p := newTestPlugin(nil)
+	pod := &api.PodSandbox{
+		Name: "test-pod-ci",
+		Annotations: map[string]string{
+			profileAnnotation: profileNestedRuntime,
+		},
+	}
+	container := newProfileTestContainer(map[string]string{})
+
+	adjust, _, err := p.CreateContainer(context.Background(), pod, container)
+	require.NoError(t, err)
+	require.NotNil(t, adjust)
+
+	mounts := map[string]*api.Mount{}
+	for _, m := range adjust.Mounts {
+		mounts[m.Destination] = m
+	}
+
+	// basic systemd support is still in place
+	assert.Contains(t, mounts, "/run")
+	assert.Contains(t, mounts, "/sys/fs/cgroup")
+	assert.Contains(t, mounts["/sys/fs/cgroup"].Options, "rw")
+
+	// storage for the inner runtime
+	if assert.Contains(t, mounts, "/var/lib/docker") {
+		assert.Equal(t, "tmpfs", mounts["/var/lib/docker"].Type)
+		assert.Contains(t, mounts["/var/lib/docker"].Options, "mode=0711")
+	}
+	assert.Contains(t, mounts, "/var/lib/containers")
+
+	devices := map[string]*api.LinuxDevice{}
+	for _, d := range adjust.GetLinux().GetDevices() {
+		devices[d.Path] = d
+	}
+	if assert.Contains(t, devices, "/dev/fuse") {
+		assert.Equal(t, "c", devices["/dev/fuse"].Type)
+		assert.Equal(t, int64(10), devices["/dev/fuse"].Major)
+		assert.Equal(t, int64(229), devices["/dev/fuse"].Minor)
+		assert.Equal(t, "rw", devices["/dev/fuse"].AccessString())
+	}
+	if assert.Contains(t, devices, "/dev/net/tun") {
+		assert.Equal(t, int64(200), devices["/dev/net/tun"].Minor)
+	}
+}
+
+func TestNestedRuntimeProfileKeepsExistingVolume(t *testing.T) {
+	p := newTestPlugin(nil)
+	container := newProfileTestContainer(
+		map[string]string{profileAnnotation: profileNestedRuntime},
+		&api.Mount{
+			Destination: "/var/lib/docker",
+			Type:        "bind",
+			Source:      "/var/lib/kubelet/pods/uid/volumes/kubernetes.io~empty-dir/docker",
+			Options:     []string{"rbind", "rw"},
+		},
+	)
+
+	adjust, _, err := p.CreateContainer(context.Background(), nil, container)
+	require.NoError(t, err)
+
+	for _, m := range adjust.Mounts {
+		assert.NotEqual(t, "/var/lib/docker", m.Destination)
+	}
+}
+
+func TestNestedContainersProfile(t *testing.T) {
+	allowed := func(c *Config) { c.AllowedProfiles = []string{profileNestedContainers} }
+	annotations := map[string]string{profileAnnotation: profileNestedContainers}
+
+	t.Run("applied", func(t *testing.T) {
+		p := newTestPlugin(configWith(allowed))
+
+		adjust, _, err := p.CreateContainer(context.Background(), nil, newProfileTestContainer(annotations))
+		require.NoError(t, err)
+
+		// basic systemd support, including cgroup delegation
+		for _, dest := range []string{"/run", "/run/lock", "/tmp", "/var/log/journal"} {
+			assert.NotNil(t, findMount(adjust.Mounts, dest), dest)
+		}
+		cgroup := findMount(adjust.Mounts, "/sys/fs/cgroup")
+		require.NotNil(t, cgroup)
+		assert.Contains(t, cgroup.Options, "rw")
+
+		assert.Equal(t, &api.Mount{
+			Destination: "/var/lib/machines",
+			Type:        "tmpfs",
+			Source:      "tmpfs",
+			Options:     []string{"rw", "rprivate", "mode=0700"},
+		}, findMount(adjust.Mounts, "/var/lib/machines"))
+
+		devices := adjust.GetLinux().GetDevices()
+		require.Len(t, devices, 1)
+		assert.Equal(t, "/dev/fuse", devices[0].Path)
+
+		assert.Equal(t, "cgroup,tmpfs,env,profile=nested-containers", adjust.Annotations[provenanceAnnotation])
+	})
+
+	t.Run("not allowed", func(t *testing.T) {
+		p := newTestPlugin(nil)
+
+		adjust, _, err := p.CreateContainer(context.Background(), nil, newProfileTestContainer(annotations))
+		assert.ErrorContains(t, err, "not in allowedProfiles")
+		assert.Nil(t, adjust)
+	})
+
+	for name, exclude := range map[string]string{
+		"cgroup mount excluded":    "/sys/fs",
+		"machines mount excluded":  "/var/lib/machines",
+		"machines parent excluded": "/var/lib",
+	} {
+		t.Run(name, func(t *testing.T) {
+			p := newTestPlugin(configWith(func(c *Config) {
+				allowed(c)
+				c.ExcludeMounts = []string{exclude}
+			}))
+
+			adjust, _, err := p.CreateContainer(context.Background(), nil, newProfileTestContainer(annotations))
+			assert.ErrorContains(t, err, "excludeMounts")
+			assert.Nil(t, adjust)
+		})
+	}
+
+	t.Run("machines excluded with volume", func(t *testing.T) {
+		p := newTestPlugin(configWith(func(c *Config) {
+			allowed(c)
+			c.ExcludeMounts = []string{"/var/lib/machines"}
+		}))
+		container := newProfileTestContainer(annotations, &api.Mount{
+			Destination: "/var/lib/machines",
+			Type:        "bind",
+			Source:      "/var/lib/kubelet/pods/uid/volumes/kubernetes.io~empty-dir/machines",
+			Options:     []string{"rbind", "rw"},
+		})
+
+		adjust, _, err := p.CreateContainer(context.Background(), nil, container)
+		require.NoError(t, err)
+		assert.Nil(t, findMount(adjust.Mounts, "/var/lib/machines"))
+	})
+
+	t.Run("denial fails open by policy", func(t *testing.T) {
+		p := newTestPlugin(configWith(func(c *Config) {
+			allowed(c)
+			c.ExcludeMounts = []string{"/sys/fs/cgroup"}
+			c.FailurePolicy = FailOpen
+		}))
+
+		adjust, _, err := p.CreateContainer(context.Background(), nil, newProfileTestContainer(annotations))
+		assert.NoError(t, err)
+		assert.Nil(t, adjust)
+	})
+}
+
+func TestContainerEngineProfile(t *testing.T) {
+	newPlugin := func() *plugin {
+		return newTestPlugin(configWith(func(c *Config) {
+			c.AllowedProfiles = []string{profileContainerEngine}
+			c.ContainerEngine.Env = map[string]string{"DOCKER_IPTABLES_LEGACY": "1", "DOCKER_TLS_CERTDIR": ""}
+		}))
+	}
+	newContainer := func(mounts ...*api.Mount) *api.Container {
+		container := newProfileTestContainer(map[string]string{profileAnnotation: profileContainerEngine}, mounts...)
+		container.Env = []string{"DOCKER_TLS_CERTDIR=/certs"}
+		return container
+	}
+	roSys := &api.Mount{Destination: "/sys", Type: "sysfs", Source: "sysfs", Options: []string{"nosuid", "noexec", "nodev", "ro"}}
+	gapWarnings := func(hook *logtest.Hook) int {
+		n := 0
+		for _, e := range hook.AllEntries() {
+			if e.Level == logrus.WarnLevel && strings.Contains(e.Message, "not privileged") {
+				n++
+			}
+		}
+		return n
+	}
+
+	t.Run("bundle", func(t *testing.T) {
+		p := newPlugin()
+		hook := logtest.NewLocal(p.logs.base)
+
+		adjust, _, err := p.CreateContainer(context.Background(), nil, newContainer(roSys))
+		require.NoError(t, err)
+
+		// cgroup delegation
+		cgroup := findMount(adjust.Mounts, "/sys/fs/cgroup")
+		require.NotNil(t, cgroup)
+		assert.Contains(t, cgroup.Options, "rw")
+
+		// storage and devices of nested-runtime
+		assert.NotNil(t, findMount(adjust.Mounts, "/var/lib/docker"))
+		assert.NotNil(t, findMount(adjust.Mounts, "/var/lib/containers"))
+		var devices []string
+		for _, d := range adjust.GetLinux().GetDevices() {
+			devices = append(devices, d.Path)
+		}
+		assert.ElementsMatch(t, []string{"/dev/fuse", "/dev/net/tun"}, devices)
+
+		run := findMount(adjust.Mounts, "/run")
+		require.NotNil(t, run)
+		assert.Equal(t, []string{"rw", "rprivate", "nosuid", "nodev", "mode=0755", "size=512m"}, run.Options)
+
+		// the container's own DOCKER_TLS_CERTDIR is kept
+		env := map[string]string{}
+		for _, e := range adjust.Env {
+			env[e.Key] = e.Value
+		}
+		assert.Equal(t, "1", env["DOCKER_IPTABLES_LEGACY"])
+		assert.NotContains(t, env, "DOCKER_TLS_CERTDIR")
+
+		assert.Equal(t, 3, gapWarnings(hook))
+	})
+
+	t.Run("runtime /run resized", func(t *testing.T) {
+		p := newPlugin()
+
+		adjust, _, err := p.CreateContainer(context.Background(), nil, newContainer(&api.Mount{
+			Destination: "/run", Type: "tmpfs", Source: "tmpfs", Options: []string{"rw", "nosuid", "size=65536k"},
+		}))
+		require.NoError(t, err)
+
+		assert.NotNil(t, findMount(adjust.Mounts, "-/run"))
+		assert.Equal(t, &api.Mount{
+			Destination: "/run", Type: "tmpfs", Source: "tmpfs", Options: []string{"rw", "nosuid", "size=512m"},
+		}, findMount(adjust.Mounts, "/run"))
+	})
+
+	t.Run("privileged", func(t *testing.T) {
+		p := newPlugin()
+		hook := logtest.NewLocal(p.logs.base)
+
+		_, _, err := p.CreateContainer(context.Background(), nil, newContainer(&api.Mount{
+			Destination: "/sys", Type: "sysfs", Source: "sysfs", Options: []string{"nosuid", "noexec", "nodev", "rw"},
+		}))
+		require.NoError(t, err)
+		assert.Zero(t, gapWarnings(hook))
+	})
+
+	t.Run("not allowed", func(t *testing.T) {
+		p := newTestPlugin(nil)
+
+		_, _, err := p.CreateContainer(context.Background(), nil, newContainer())
+		assert.ErrorContains(t, err, "not in allowedProfiles")
+	})
+
+	t.Run("cgroup mount excluded", func(t *testing.T) {
+		p := newTestPlugin(configWith(func(c *Config) {
+			c.AllowedProfiles = []string{profileContainerEngine}
+			c.ExcludeMounts = []string{"/sys/fs/cgroup"}
+		}))
+
+		_, _, err := p.CreateContainer(context.Background(), nil, newContainer())
+		assert.ErrorContains(t, err, "excludeMounts")
+	})
+}
+
+func TestSelectProfile(t *testing.T) {
+	tests := []struct {
+		name        string
+		defaultName string
+		podAnn      map[string]string
+		ctrAnn      map[string]string
+		userns      bool
+		expected    string
+		expectErr   bool
+	}{
+		{
+			name:     "no profile",
+			expected: "",
+		},
+		{
+			name:        "configured default",
+			defaultName: profileNestedRuntime,
+			expected:    profileNestedRuntime,
+		},
+		{
+			name:     "pod annotation",
+			podAnn:   map[string]string{profileAnnotation: profileNestedRuntime},
+			expected: profileNestedRuntime,
+		},
+		{
+			name:        "empty container annotation overrides default",
+			defaultName: profileNestedRuntime,
+			ctrAnn:      map[string]string{profileAnnotation: ""},
+			expected:    "",
+		},
+		{
+			name:     "user namespace",
+			userns:   true,
+			expected: profileRootless,
+		},
+		{
+			name:        "configured default overrides user namespace",
+			defaultName: profileNestedRuntime,
+			userns:      true,
+			expected:    profileNestedRuntime,
+		},
+		{
+			name:        "empty annotation disables user namespace",
+			defaultName: profileNestedRuntime,
+			ctrAnn:      map[string]string{profileAnnotation: ""},
+			userns:      true,
+			expected:    "",
+		},
+		{
+			name:     "annotation overrides user namespace",
+			podAnn:   map[string]string{profileAnnotation: profileNestedRuntime},
+			userns:   true,
+			expected: profileNestedRuntime,
+		},
+		{
+			name:      "unknown profile",
+			ctrAnn:    map[string]string{profileAnnotation: "no-such-profile"},
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{Profile: tt.defaultName}
+			pod := &api.PodSandbox{Annotations: tt.podAnn}
+			container := &api.Container{Annotations: tt.ctrAnn, Linux: &api.LinuxContainer{}}
+			if tt.userns {
+				container.Linux.Namespaces = []*api.LinuxNamespace{{Type: "user"}}
+			}
+
+			p, err := selectProfile(cfg, pod, container)
+			if tt.expectErr {
+				assert.Error(t, err)
+				return
+			}
+
+			assert.NoError(t, err)
+			if tt.expected == "" {
+				assert.Nil(t, p)
+			} else if assert.NotNil(t, p) {
+				assert.Equal(t, tt.expected, p.name)
+			}
+		})
+	}
+}
+
+func TestRootlessProfile(t *testing.T) {
+	pod := &api.PodSandbox{Name: "test-pod-rootless"}
+
+	t.Run("user namespace", func(t *testing.T) {
+		p := newCgroupV1TestPlugin(nil)
+		container := newProfileTestContainer(map[string]string{})
+		container.Linux.Namespaces = []*api.LinuxNamespace{{Type: "user"}}
+
+		adjust, _, err := p.CreateContainer(context.Background(), pod, container)
+		require.NoError(t, err)
+		require.NotNil(t, adjust)
+
+		// the cgroup mount is left to the runtime
+		assert.Nil(t, findMount(adjust.Mounts, "/sys/fs/cgroup"))
+		assert.Nil(t, findMount(adjust.Mounts, "-/sys/fs/cgroup"))
+		assert.Nil(t, findMount(adjust.Mounts, "/sys/fs/cgroup/systemd"))
+
+		// everything else is still set up
+		assert.NotNil(t, findMount(adjust.Mounts, "/run"))
+		assert.Contains(t, adjust.Env, &api.KeyValue{Key: "container", Value: "other"})
+	})
+
+	t.Run("selected by annotation", func(t *testing.T) {
+		p := newTestPlugin(nil)
+		container := newProfileTestContainer(map[string]string{profileAnnotation: profileRootless})
+
+		adjust, _, err := p.CreateContainer(context.Background(), pod, container)
+		require.NoError(t, err)
+		require.NotNil(t, adjust)
+		assert.Nil(t, findMount(adjust.Mounts, "/sys/fs/cgroup"))
+	})
+}
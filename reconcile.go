@@ -0,0 +1,193 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/containerd/nri/pkg/api"
+)
+
+const (
+	outputTable = "table"
+	outputJSON  = "json"
+)
+
+// reconcileReport lists the tracked systemd containers and where they
+// drifted from the current policy, and the checked host sysctls.
+type reconcileReport struct {
+	Containers  []reconciledContainer `json:"containers"`
+	Drifted     int                   `json:"drifted"`
+	HostSysctls []sysctlCheck         `json:"hostSysctls,omitempty"`
+}
+
+// sysctlViolations returns the number of violated host sysctls.
+func (r *reconcileReport) sysctlViolations() int {
+	n := 0
+	for _, c := range r.HostSysctls {
+		if c.violated() {
+			n++
+		}
+	}
+	return n
+}
+
+type reconciledContainer struct {
+	ID        string   `json:"id"`
+	Name      string   `json:"name"`
+	Namespace string   `json:"namespace,omitempty"`
+	Profile   string   `json:"profile,omitempty"`
+	Drift     []string `json:"drift,omitempty"`
+}
+
+// reconcile checks the tracked containers against the current policy:
+// the spec drift found when synchronizing with the runtime, and changes
+// of the host since a container was adjusted. Containers keep their
+// adjustments until they are recreated.
+func (p *plugin) reconcile(ctx context.Context) (*reconcileReport, error) {
+	host, err := p.host(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	states := p.state.list()
+	slices.SortFunc(states, func(a, b *containerState) int {
+		return strings.Compare(a.name, b.name)
+	})
+
+	report := &reconcileReport{Containers: []reconciledContainer{}}
+	for _, s := range states {
+		c := reconciledContainer{
+			ID:        s.id,
+			Name:      s.name,
+			Namespace: s.namespace,
+			Profile:   s.profile,
+			Drift:     slices.Concat(s.drift, s.artifactDrift),
+		}
+
+		if s.host != nil {
+			if s.host.CgroupRoot != host.CgroupRoot {
+				c.Drift = append(c.Drift, fmt.Sprintf("adjusted with cgroup root %v, host now has %v",
+					s.host.CgroupRoot, host.CgroupRoot))
+			} else if s.host.CgroupMode != host.CgroupMode {
+				c.Drift = append(c.Drift, fmt.Sprintf("adjusted for cgroup %v, host now has cgroup %v",
+					s.host.CgroupMode, host.CgroupMode))
+			}
+		}
+
+		if len(c.Drift) > 0 {
+			report.Drifted++
+		}
+		report.Containers = append(report.Containers, c)
+	}
+	report.HostSysctls = p.checkSysctls(ctx, p.config(), false)
+
+	return report, nil
+}
+
+// specDrift returns what adjusting the container spec would still change
+// under the current policy. Adjusted containers report nothing, since the
+// plugin leaves mounts and environment variables alone which are already
+// in place. Devices are not compared.
+func (p *plugin) specDrift(ctx context.Context, cfg *Config, pod *api.PodSandbox, container *api.Container, ctrName string) []string {
+	cfg, container, err := applyConfigAnnotation(cfg, pod, container)
+	if err != nil {
+		return []string{err.Error()}
+	}
+
+	prof, err := selectProfile(cfg, pod, container)
+	if err != nil {
+		return []string{err.Error()}
+	}
+
+	adjust := &api.ContainerAdjustment{}
+	for _, s := range p.adjustmentSteps(cfg, pod, container, ctrName, prof, adjust, nil) {
+		if err := s.fn(ctx); err != nil {
+			return []string{fmt.Sprintf("%s: %v", s.name, err)}
+		}
+	}
+	p.excludeMounts(cfg, adjust, ctrName)
+
+	removed := map[string]bool{}
+	for _, m := range adjust.Mounts {
+		if dest, ok := api.IsMarkedForRemoval(m.Destination); ok {
+			removed[dest] = true
+		}
+	}
+
+	var drift []string
+	for _, m := range adjust.Mounts {
+		if _, ok := api.IsMarkedForRemoval(m.Destination); ok {
+			continue
+		}
+		if removed[m.Destination] {
+			drift = append(drift, fmt.Sprintf("mount %s differs", m.Destination))
+		} else {
+			drift = append(drift, fmt.Sprintf("mount %s is missing", m.Destination))
+		}
+	}
+	var keys []string
+	for _, e := range adjust.Env {
+		if !slices.Contains(keys, e.Key) {
+			keys = append(keys, e.Key)
+			drift = append(drift, fmt.Sprintf("environment variable %s is missing", e.Key))
+		}
+	}
+
+	return drift
+}
+
+// write writes the report in the given output format.
+func (r *reconcileReport) write(w io.Writer, output string) error {
+	switch output {
+	case outputJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(r)
+	case outputTable:
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "CONTAINER\tID\tPROFILE\tDRIFT")
+		for _, c := range r.Containers {
+			drift := "-"
+			if len(c.Drift) > 0 {
+				drift = strings.Join(c.Drift, "; ")
+			}
+			profile := c.Profile
+			if profile == "" {
+				profile = "-"
+			}
+			fmt.Fprintf(tw, "%s\t%.12s\t%s\t%s\n", c.Name, c.ID, profile, drift)
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+		for _, c := range r.HostSysctls {
+			if c.violated() {
+				fmt.Fprintf(w, "host: %s\n", c)
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown output format %q", output)
+	}
+}
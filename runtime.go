@@ -0,0 +1,152 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/nri/pkg/api"
+)
+
+// runtimeInfo identifies the runtime the plugin is connected to.
+type runtimeInfo struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	// Defaults is the name of the runtime defaults layer in effect, if any.
+	Defaults string `json:"defaults,omitempty"`
+	// Config is set if the runtime delivered a configuration.
+	Config bool `json:"config,omitempty"`
+}
+
+// runtimeDefaults adjusts the built-in defaults for a runtime. The
+// configuration file is applied on top, so every default can still be
+// overridden.
+type runtimeDefaults struct {
+	name       string
+	runtime    string
+	minVersion string
+	apply      func(cfg *Config)
+}
+
+var runtimeDefaultLayers = []runtimeDefaults{
+	{
+		// CRI-O mounts tmpfs at /run, /run/lock, /tmp and /var/log/journal
+		// for containers running systemd on its own. It supports NRI
+		// since 1.26.
+		name:       "cri-o",
+		runtime:    "cri-o",
+		minVersion: "1.26.0",
+		apply: func(cfg *Config) {
+			cfg.RuntimeTmpfs = true
+		},
+	},
+}
+
+// selectRuntimeDefaults returns the defaults layer of the runtime, nil if
+// the built-in defaults apply as they are.
+func selectRuntimeDefaults(runtime, version string) *runtimeDefaults {
+	for i, l := range runtimeDefaultLayers {
+		if l.runtime == runtime && compareVersions(version, l.minVersion) >= 0 {
+			return &runtimeDefaultLayers[i]
+		}
+	}
+	return nil
+}
+
+// compareVersions compares the numeric components of two versions like
+// "v1.28.2-dev". Unparsable components count as 0.
+func compareVersions(a, b string) int {
+	pa, pb := versionComponents(a), versionComponents(b)
+	for i := 0; i < max(len(pa), len(pb)); i++ {
+		var x, y int
+		if i < len(pa) {
+			x = pa[i]
+		}
+		if i < len(pb) {
+			y = pb[i]
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+func versionComponents(v string) []int {
+	v = strings.TrimPrefix(v, "v")
+	if i := strings.IndexAny(v, "-+ "); i >= 0 {
+		v = v[:i]
+	}
+	var components []int
+	for _, s := range strings.Split(v, ".") {
+		n, _ := strconv.Atoi(s)
+		components = append(components, n)
+	}
+	return components
+}
+
+// Configure records the runtime the plugin registered with and applies
+// its defaults and the configuration it delivers, if any, beneath the
+// configuration file and flags. It subscribes to the events needed by the
+// resulting configuration. An invalid configuration of the runtime fails
+// the registration, so that the runtime reports it.
+func (p *plugin) Configure(_ context.Context, config, runtime, version string) (api.EventMask, error) {
+	info := &runtimeInfo{Name: runtime, Version: version}
+	defaults := defaultConfig()
+	if l := selectRuntimeDefaults(runtime, version); l != nil {
+		info.Defaults = l.name
+		l.apply(defaults)
+	}
+	if strings.TrimSpace(config) != "" {
+		var err error
+		if defaults, err = parseConfigOver(defaults, []byte(config)); err != nil {
+			p.log.Errorf("invalid configuration of %s: %v", runtime, err)
+			return 0, fmt.Errorf("invalid configuration of %s: %w", runtime, err)
+		}
+		info.Config = true
+	}
+	p.runtime.Store(info)
+	p.setRuntime(runtime, version)
+
+	cfg := defaults
+	if p.parseConfig != nil {
+		var err error
+		if cfg, err = p.parseConfig(defaults); err != nil {
+			return 0, err
+		}
+	}
+	if p.parseConfig != nil || info.Config {
+		if err := p.setConfig(cfg); err != nil {
+			p.log.Errorf("configuration of %s rejected: %v", runtime, err)
+			return 0, fmt.Errorf("configuration of %s rejected: %w", runtime, err)
+		}
+	}
+
+	if info.Defaults != "" {
+		p.log.Infof("connected to %s %s, using its defaults", runtime, version)
+	} else {
+		p.log.Infof("connected to %s %s", runtime, version)
+	}
+
+	return eventMask(p.config()), nil
+}
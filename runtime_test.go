@@ -0,0 +1,168 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/containerd/nri/pkg/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// configureTestPlugin returns a test plugin with the given configuration
+// file, registered with the runtime.
+func configureTestPlugin(t *testing.T, data, runtime, version string) *plugin {
+	t.Helper()
+
+	p := newTestPlugin(nil)
+	p.parseConfig = func(defaults *Config) (*Config, error) {
+		return parseConfigOver(defaults, []byte(data))
+	}
+	_, err := p.Configure(context.Background(), "", runtime, version)
+	require.NoError(t, err)
+	return p
+}
+
+func TestRuntimeDefaults(t *testing.T) {
+	containerd := configureTestPlugin(t, "", "containerd", "v2.0.4")
+	crio := configureTestPlugin(t, "", "cri-o", "1.31.2")
+	oldCrio := configureTestPlugin(t, "", "cri-o", "1.25.0")
+
+	assert.Equal(t, defaultConfig(), containerd.config())
+	assert.Equal(t, configWith(func(c *Config) { c.RuntimeTmpfs = true }), crio.config())
+	assert.Equal(t, defaultConfig(), oldCrio.config())
+
+	assert.Equal(t, &runtimeInfo{Name: "containerd", Version: "v2.0.4"}, containerd.runtime.Load())
+	assert.Equal(t, &runtimeInfo{Name: "cri-o", Version: "1.31.2", Defaults: "cri-o"}, crio.runtime.Load())
+
+	// the configuration file overrides the runtime defaults
+	p := configureTestPlugin(t, "runtimeTmpfs: false\nprofile: nested-runtime\n", "cri-o", "1.31.2")
+	assert.Equal(t, configWith(func(c *Config) { c.Profile = profileNestedRuntime }), p.config())
+
+	// the defaults layer is part of the effective configuration
+	var effective struct {
+		Runtime runtimeInfo    `json:"runtime"`
+		Config  map[string]any `json:"config"`
+	}
+	assert.Equal(t, http.StatusOK, debugRequest(t, crio, http.MethodGet, "/config", 0, &effective))
+	assert.Equal(t, "cri-o", effective.Runtime.Defaults)
+	assert.Equal(t, true, effective.Config["runtimeTmpfs"])
+}
+
+func TestRuntimeConfig(t *testing.T) {
+	runtimeConfig := `
+verbose: true
+containerEnv: docker
+bootCheckWindow: 30s
+tmpfsMounts:
+- destination: /run
+detection:
+  initPaths: [/sbin/init]
+`
+
+	t.Run("runtime only", func(t *testing.T) {
+		p := newTestPlugin(nil)
+		events, err := p.Configure(context.Background(), runtimeConfig, "containerd", "v2.0.4")
+		require.NoError(t, err)
+
+		cfg := p.config()
+		assert.True(t, cfg.Verbose)
+		assert.Equal(t, "docker", cfg.ContainerEnv)
+		assert.Equal(t, []TmpfsMountSpec{{Destination: "/run"}}, cfg.TmpfsMounts)
+		assert.Equal(t, []string{"/sbin/init"}, cfg.Detection.InitPaths)
+		assert.Equal(t, eventMask(cfg), events)
+		assert.True(t, events.IsSet(api.Event_POST_START_CONTAINER))
+		assert.True(t, p.runtime.Load().Config)
+
+		adjust, _, err := p.CreateContainer(context.Background(), nil, newProfileTestContainer(nil))
+		require.NoError(t, err)
+		assert.Contains(t, adjust.Env, &api.KeyValue{Key: "container", Value: "docker"})
+		assert.Nil(t, findMount(adjust.Mounts, "/tmp"))
+	})
+
+	t.Run("file and flags take precedence", func(t *testing.T) {
+		p := newTestPlugin(nil)
+		p.parseConfig = func(defaults *Config) (*Config, error) {
+			cfg, err := parseConfigOver(defaults, []byte("containerEnv: podman\n"))
+			if err != nil {
+				return nil, err
+			}
+			// like -init-paths
+			err = cfg.addInitPaths("/usr/lib/systemd/systemd")
+			return cfg, err
+		}
+		_, err := p.Configure(context.Background(), runtimeConfig, "containerd", "v2.0.4")
+		require.NoError(t, err)
+
+		cfg := p.config()
+		assert.Equal(t, "podman", cfg.ContainerEnv)
+		assert.True(t, cfg.Verbose)
+		assert.Equal(t, []string{"/sbin/init", "/usr/lib/systemd/systemd"}, cfg.Detection.InitPaths)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		for name, data := range map[string]string{
+			"malformed":     "tmpfsMounts: [\n",
+			"unknown field": "tmpfsMount: []\n",
+			"invalid value": "tmpfsMounts:\n- destination: run\n",
+		} {
+			p := newTestPlugin(nil)
+			_, err := p.Configure(context.Background(), data, "containerd", "v2.0.4")
+			assert.ErrorContains(t, err, "invalid configuration of containerd", name)
+			assert.Equal(t, defaultConfig(), p.config(), name)
+		}
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		p := newTestPlugin(nil)
+		_, err := p.Configure(context.Background(), "\n", "containerd", "v2.0.4")
+		require.NoError(t, err)
+		assert.False(t, p.runtime.Load().Config)
+		assert.Equal(t, defaultConfig(), p.config())
+	})
+}
+
+func TestRuntimeTmpfs(t *testing.T) {
+	p := newTestPlugin(configWith(func(c *Config) { c.RuntimeTmpfs = true }))
+
+	adjust, _, err := p.CreateContainer(context.Background(), nil, newProfileTestContainer(nil))
+	require.NoError(t, err)
+	for _, dest := range []string{"/run", "/run/lock", "/tmp", "/var/log/journal"} {
+		assert.Nil(t, findMount(adjust.Mounts, dest), dest)
+	}
+	assert.NotNil(t, findMount(adjust.Mounts, "/sys/fs/cgroup"))
+}
+
+func TestCompareVersions(t *testing.T) {
+	for _, tt := range []struct {
+		a, b     string
+		expected int
+	}{
+		{"1.26.0", "1.26.0", 0},
+		{"v1.26", "1.26.0", 0},
+		{"1.31.2", "1.26.0", 1},
+		{"1.9.0", "1.26.0", -1},
+		{"1.26.0-dev", "1.26.0", 0},
+		{"2.0", "1.99.99", 1},
+		{"", "1.26.0", -1},
+	} {
+		assert.Equal(t, tt.expected, compareVersions(tt.a, tt.b), "%s <=> %s", tt.a, tt.b)
+	}
+}
@@ -0,0 +1,263 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/containerd/nri/pkg/api"
+)
+
+const (
+	// shareRunAnnotation makes the systemd container of a pod share its
+	// /run with the other containers of the pod, e.g. sidecars talking to
+	// systemd over D-Bus or systemctl. Only read from the pod.
+	shareRunAnnotation = "io.systemd.container/share-run"
+
+	// sharedRunKind is the directory below stateDir with the shared /run
+	// of every pod, one directory per pod UID.
+	sharedRunKind = "shared-run"
+
+	runDir = "/run"
+)
+
+// defaultSharedRunPaths are shared with the other containers of a pod by
+// default: the D-Bus system bus and the private socket of systemctl.
+var defaultSharedRunPaths = []string{"/run/dbus", "/run/systemd"}
+
+// sharesRun tells whether the pod shares the /run of its systemd container.
+func sharesRun(cfg *Config, pod *api.PodSandbox) (bool, error) {
+	if pod == nil {
+		return false, nil
+	}
+	value, ok := pod.Annotations[shareRunAnnotation]
+	if !ok {
+		return false, nil
+	}
+	share, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s annotation %q", shareRunAnnotation, value)
+	}
+	if share && !cfg.SharedRun.Enabled {
+		return false, fmt.Errorf("%s annotation not allowed without sharedRun.enabled", shareRunAnnotation)
+	}
+	return share, nil
+}
+
+// sharedRunDir returns the host directory backing the shared /run of the
+// pod.
+func sharedRunDir(cfg *Config, pod *api.PodSandbox) (string, error) {
+	uid := pod.Uid
+	if uid == "" || uid == "." || uid == ".." || strings.ContainsRune(uid, '/') {
+		return "", fmt.Errorf("invalid pod UID %q", uid)
+	}
+	return filepath.Join(cfg.StateDir, sharedRunKind, uid), nil
+}
+
+// prepareSharedRun creates the shared /run of the pod, including the
+// shared paths, so that they can be bind-mounted before systemd creates
+// them. It is called for every container of the pod, which may be created
+// in any order. The directories are owned by root, who owns the /run of
+// the container, also in a user namespace through the idmapped mount.
+func prepareSharedRun(cfg *Config, pod *api.PodSandbox) (string, error) {
+	dir, err := sharedRunDir(cfg, pod)
+	if err != nil {
+		return "", err
+	}
+	for _, p := range cfg.SharedRun.paths() {
+		shared := filepath.Join(dir, strings.TrimPrefix(p, runDir))
+		if err := os.MkdirAll(shared, 0o755); err != nil {
+			return "", fmt.Errorf("failed to create shared /run: %w", err)
+		}
+		for d := shared; d != filepath.Dir(dir); d = filepath.Dir(d) {
+			if err := chownToRoot(d); err != nil {
+				return "", fmt.Errorf("failed to create shared /run: %w", err)
+			}
+		}
+	}
+	return dir, nil
+}
+
+// clearSharedRun empties the shared /run left by a previous instance of
+// the systemd container of the pod, as systemd expects an empty /run like
+// the tmpfs it gets otherwise. The shared paths are kept, only emptied,
+// since the sidecars of the pod bind-mount them.
+func clearSharedRun(cfg *Config, dir string) error {
+	return clearSharedDir(dir, runDir, cfg.SharedRun.paths())
+}
+
+// clearSharedDir empties dir, the directory backing path in the
+// container, keeping the directories of the shared paths and their
+// parents.
+func clearSharedDir(dir, path string, shared []string) error {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		entry := path + "/" + e.Name()
+		keep := slices.ContainsFunc(shared, func(s string) bool {
+			return s == entry || strings.HasPrefix(s, entry+"/")
+		})
+		if keep && e.IsDir() {
+			err = clearSharedDir(filepath.Join(dir, e.Name()), entry, shared)
+		} else {
+			err = os.RemoveAll(filepath.Join(dir, e.Name()))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sharedRunOptions returns the options of a bind mount of the shared /run.
+// In a user namespace the mount is idmapped, so that the root user of the
+// container owns it.
+func sharedRunOptions(container *api.Container, readOnly bool) []string {
+	opts := []string{"rbind", "rw", "nosuid", "nodev"}
+	if readOnly {
+		opts[1] = "ro"
+	}
+	if isRootlessContainer(container) {
+		opts = append(opts, "idmap")
+	}
+	return opts
+}
+
+// addSharedRun backs /run of the systemd container with the shared /run of
+// its pod, instead of a tmpfs.
+func (p *plugin) addSharedRun(cfg *Config, pod *api.PodSandbox, container *api.Container, ctrName string, adjust *api.ContainerAdjustment, results *mountResults) error {
+	dir, err := sharedRunDir(cfg, pod)
+	if err != nil {
+		return err
+	}
+	if p.dryRun == nil {
+		if err := clearSharedRun(cfg, dir); err != nil {
+			return fmt.Errorf("failed to clear shared /run: %w", err)
+		}
+		if dir, err = prepareSharedRun(cfg, pod); err != nil {
+			return err
+		}
+	}
+
+	mount := &api.Mount{
+		Destination: runDir,
+		Type:        "bind",
+		Source:      dir,
+		Options:     sharedRunOptions(container, false),
+	}
+
+	// replace the tmpfs of the tmpfs step, if any
+	if i := slices.IndexFunc(adjust.Mounts, func(m *api.Mount) bool { return m.Destination == runDir }); i >= 0 {
+		adjust.Mounts[i] = mount
+	} else if hasMount(container, runDir) {
+		if err := p.tolerate(cfg, ctrName, fmt.Errorf("not sharing /run with the pod, the container mounts /run itself")); err != nil {
+			return err
+		}
+		results.add(runDir, mountSkipped, "mounted by the container, not shared with the pod")
+		return nil
+	} else {
+		adjust.AddMount(mount)
+	}
+	p.mountLog.Debugf("%s: sharing /run with the pod from %s", ctrName, dir)
+	results.add(runDir, mountModified, "shared with the other containers of the pod (%s)", shareRunAnnotation)
+	return nil
+}
+
+// adjustSidecar adjusts a container of a pod sharing /run which is not a
+// systemd container. err is the error of parsing the share-run annotation.
+func (p *plugin) adjustSidecar(cfg *Config, pod *api.PodSandbox, container *api.Container, ctrName string, err error) (*api.ContainerAdjustment, []*api.ContainerUpdate, error) {
+	var adjust *api.ContainerAdjustment
+	if err == nil {
+		adjust, err = p.shareRunWithSidecar(cfg, pod, container, ctrName)
+	}
+	if err != nil {
+		p.log.Errorf("%s: %v", ctrName, err)
+		return nil, nil, p.fail(cfg, pod, container, ctrName, err)
+	}
+	if p.dryRun != nil {
+		p.decide(ctrName, decisionDryRun, "sidecar of a pod sharing /run", "shared-run")
+		return nil, nil, nil
+	}
+	p.decide(ctrName, decisionAdjusted, "sidecar of a pod sharing /run", "shared-run")
+	return adjust, nil, nil
+}
+
+// shareRunWithSidecar bind-mounts the shared paths of the shared /run of
+// the pod into a container which is not a systemd container. Paths the
+// container mounts itself are left alone.
+func (p *plugin) shareRunWithSidecar(cfg *Config, pod *api.PodSandbox, container *api.Container, ctrName string) (*api.ContainerAdjustment, error) {
+	dir, err := sharedRunDir(cfg, pod)
+	if err != nil {
+		return nil, err
+	}
+	if p.dryRun == nil {
+		if dir, err = prepareSharedRun(cfg, pod); err != nil {
+			return nil, err
+		}
+	}
+
+	adjust := &api.ContainerAdjustment{}
+	var shared []string
+	for _, dest := range cfg.SharedRun.paths() {
+		if hasMount(container, dest) {
+			p.mountLog.Debugf("%s: %s already mounted, not sharing it", ctrName, dest)
+			continue
+		}
+		adjust.AddMount(&api.Mount{
+			Destination: dest,
+			Type:        "bind",
+			Source:      filepath.Join(dir, strings.TrimPrefix(dest, runDir)),
+			Options:     sharedRunOptions(container, !cfg.SharedRun.ReadWrite),
+		})
+		shared = append(shared, dest)
+	}
+	if len(shared) == 0 {
+		return nil, nil
+	}
+	p.mountLog.Infof("%s: sharing %s of the systemd container of the pod", ctrName, strings.Join(shared, ", "))
+	return adjust, nil
+}
+
+// removeSharedRun removes the shared /run of the pod, if any.
+func removeSharedRun(cfg *Config, pod *api.PodSandbox) error {
+	dir, err := sharedRunDir(cfg, pod)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+// RemovePodSandbox removes the shared /run of a removed pod.
+func (p *plugin) RemovePodSandbox(_ context.Context, pod *api.PodSandbox) error {
+	defer p.observeHook("RemovePodSandbox", time.Now())
+	defer p.conn.eventHandled()
+	if err := removeSharedRun(p.config(), pod); err != nil {
+		p.stateLog.Warnf("%s/%s: failed to remove shared /run: %v", pod.Namespace, pod.Name, err)
+	}
+	return nil
+}
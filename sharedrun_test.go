@@ -0,0 +1,219 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/nri/pkg/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSharedRun(t *testing.T) {
+	newPod := func(share string) *api.PodSandbox {
+		pod := &api.PodSandbox{Id: "pod-sandbox-id", Uid: "pod-uid", Name: "web-0", Namespace: "apps"}
+		if share != "" {
+			pod.Annotations = map[string]string{shareRunAnnotation: share}
+		}
+		return pod
+	}
+	newSidecar := func(mounts ...*api.Mount) *api.Container {
+		return &api.Container{Id: "sidecar-id", Name: "exporter", Args: []string{"/bin/exporter"}, Mounts: mounts}
+	}
+	newPlugin := func(t *testing.T, fn func(*Config)) *plugin {
+		return newTestPlugin(configWith(func(c *Config) {
+			c.StateDir = t.TempDir()
+			c.SharedRun.Enabled = true
+			if fn != nil {
+				fn(c)
+			}
+		}))
+	}
+
+	t.Run("systemd container and sidecar share the host directory", func(t *testing.T) {
+		p := newPlugin(t, nil)
+		pod := newPod("true")
+
+		systemd, _, err := p.CreateContainer(context.Background(), pod, newProfileTestContainer(nil))
+		require.NoError(t, err)
+		sidecar, _, err := p.CreateContainer(context.Background(), pod, newSidecar())
+		require.NoError(t, err)
+
+		dir := filepath.Join(p.config().StateDir, sharedRunKind, pod.Uid)
+		run := findMount(systemd.Mounts, "/run")
+		require.NotNil(t, run)
+		assert.Equal(t, &api.Mount{Destination: "/run", Type: "bind", Source: dir, Options: []string{"rbind", "rw", "nosuid", "nodev"}}, run)
+		assert.NotNil(t, findMount(systemd.Mounts, "/run/lock"))
+		assert.Contains(t, systemd.Annotations[provenanceAnnotation], "shared-run")
+
+		require.Len(t, sidecar.Mounts, 2)
+		assert.Equal(t, &api.Mount{Destination: "/run/dbus", Type: "bind", Source: dir + "/dbus", Options: []string{"rbind", "ro", "nosuid", "nodev"}}, sidecar.Mounts[0])
+		assert.Equal(t, &api.Mount{Destination: "/run/systemd", Type: "bind", Source: dir + "/systemd", Options: []string{"rbind", "ro", "nosuid", "nodev"}}, sidecar.Mounts[1])
+		assert.DirExists(t, dir+"/dbus")
+		assert.DirExists(t, dir+"/systemd")
+
+		require.NoError(t, p.RemovePodSandbox(context.Background(), pod))
+		assert.NoDirExists(t, dir)
+	})
+
+	t.Run("sidecar created first", func(t *testing.T) {
+		p := newPlugin(t, func(c *Config) {
+			c.SharedRun = SharedRunOptions{Enabled: true, Paths: []string{"/run"}, ReadWrite: true}
+		})
+		pod := newPod("true")
+
+		sidecar, _, err := p.CreateContainer(context.Background(), pod, newSidecar())
+		require.NoError(t, err)
+		systemd, _, err := p.CreateContainer(context.Background(), pod, newProfileTestContainer(nil))
+		require.NoError(t, err)
+
+		require.Len(t, sidecar.Mounts, 1)
+		assert.Equal(t, findMount(systemd.Mounts, "/run").Source, sidecar.Mounts[0].Source)
+		assert.Equal(t, []string{"rbind", "rw", "nosuid", "nodev"}, sidecar.Mounts[0].Options)
+	})
+
+	t.Run("systemd container restarted", func(t *testing.T) {
+		p := newPlugin(t, nil)
+		pod := newPod("true")
+		_, _, err := p.CreateContainer(context.Background(), pod, newProfileTestContainer(nil))
+		require.NoError(t, err)
+		_, _, err = p.CreateContainer(context.Background(), pod, newSidecar())
+		require.NoError(t, err)
+
+		// left by the previous instance
+		dir := filepath.Join(p.config().StateDir, sharedRunKind, pod.Uid)
+		require.NoError(t, os.MkdirAll(dir+"/systemd/units", 0o755))
+		require.NoError(t, os.WriteFile(dir+"/systemd/private", nil, 0o600))
+		require.NoError(t, os.WriteFile(dir+"/dbus/system_bus_socket", nil, 0o600))
+		require.NoError(t, os.WriteFile(dir+"/nologin", nil, 0o644))
+		require.NoError(t, os.Mkdir(dir+"/user", 0o755))
+		dbus, err := os.Stat(dir + "/dbus")
+		require.NoError(t, err)
+
+		// a restarted sidecar keeps the state of the running systemd
+		_, _, err = p.CreateContainer(context.Background(), pod, newSidecar())
+		require.NoError(t, err)
+		assert.FileExists(t, dir+"/nologin")
+
+		restarted := newProfileTestContainer(nil)
+		restarted.Id = "restarted-id"
+		_, _, err = p.CreateContainer(context.Background(), pod, restarted)
+		require.NoError(t, err)
+		entries, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		require.Len(t, entries, 2)
+		assert.Equal(t, "dbus", entries[0].Name())
+		assert.Equal(t, "systemd", entries[1].Name())
+		assert.NoDirExists(t, dir+"/systemd/units")
+		assert.NoFileExists(t, dir+"/systemd/private")
+		assert.NoFileExists(t, dir+"/dbus/system_bus_socket")
+
+		// the sidecars still see the shared paths they mounted
+		fi, err := os.Stat(dir + "/dbus")
+		require.NoError(t, err)
+		assert.True(t, os.SameFile(dbus, fi))
+	})
+
+	t.Run("without the annotation", func(t *testing.T) {
+		for _, share := range []string{"", "false"} {
+			p := newPlugin(t, nil)
+			pod := newPod(share)
+
+			systemd, _, err := p.CreateContainer(context.Background(), pod, newProfileTestContainer(nil))
+			require.NoError(t, err)
+			assert.Equal(t, "tmpfs", findMount(systemd.Mounts, "/run").Type)
+
+			sidecar, _, err := p.CreateContainer(context.Background(), pod, newSidecar())
+			require.NoError(t, err)
+			assert.Nil(t, sidecar)
+		}
+	})
+
+	t.Run("invalid annotation", func(t *testing.T) {
+		p := newPlugin(t, nil)
+
+		_, _, err := p.CreateContainer(context.Background(), newPod("yes please"), newSidecar())
+		assert.ErrorContains(t, err, shareRunAnnotation)
+		_, _, err = p.CreateContainer(context.Background(), newPod("yes please"), newProfileTestContainer(nil))
+		assert.ErrorContains(t, err, shareRunAnnotation)
+	})
+
+	t.Run("not enabled", func(t *testing.T) {
+		p := newPlugin(t, func(c *Config) { c.SharedRun.Enabled = false })
+
+		_, _, err := p.CreateContainer(context.Background(), newPod("true"), newSidecar())
+		assert.ErrorContains(t, err, "sharedRun.enabled")
+		_, _, err = p.CreateContainer(context.Background(), newPod("true"), newProfileTestContainer(nil))
+		assert.ErrorContains(t, err, "sharedRun.enabled")
+		assert.NoDirExists(t, filepath.Join(p.config().StateDir, sharedRunKind))
+
+		// false needs no setting
+		adjust, _, err := p.CreateContainer(context.Background(), newPod("false"), newProfileTestContainer(nil))
+		require.NoError(t, err)
+		assert.Equal(t, "tmpfs", findMount(adjust.Mounts, "/run").Type)
+	})
+
+	t.Run("user namespace", func(t *testing.T) {
+		p := newPlugin(t, nil)
+		pod := newPod("true")
+		sidecar := newSidecar()
+		sidecar.Linux = &api.LinuxContainer{Namespaces: []*api.LinuxNamespace{{Type: "user"}}}
+
+		adjust, _, err := p.CreateContainer(context.Background(), pod, sidecar)
+		require.NoError(t, err)
+		assert.Contains(t, adjust.Mounts[0].Options, "idmap")
+	})
+
+	t.Run("paths mounted by the sidecar kept", func(t *testing.T) {
+		p := newPlugin(t, nil)
+		sidecar := newSidecar(&api.Mount{Destination: "/run/dbus", Type: "tmpfs", Source: "tmpfs"})
+
+		adjust, _, err := p.CreateContainer(context.Background(), newPod("true"), sidecar)
+		require.NoError(t, err)
+		require.Len(t, adjust.Mounts, 1)
+		assert.Equal(t, "/run/systemd", adjust.Mounts[0].Destination)
+	})
+
+	t.Run("/run mounted by the systemd container", func(t *testing.T) {
+		p := newPlugin(t, func(c *Config) { c.FailurePolicy = FailClosed })
+		container := newProfileTestContainer(nil, &api.Mount{Destination: "/run", Type: "tmpfs", Source: "tmpfs", Options: []string{"rw"}})
+
+		_, _, err := p.CreateContainer(context.Background(), newPod("true"), container)
+		assert.ErrorContains(t, err, "the container mounts /run itself")
+	})
+
+	t.Run("pruned when synchronizing", func(t *testing.T) {
+		p := newPlugin(t, func(c *Config) { c.OrphanGC.MinAge = 0 })
+		pod := newPod("true")
+		_, _, err := p.CreateContainer(context.Background(), pod, newSidecar())
+		require.NoError(t, err)
+		dir := filepath.Join(p.config().StateDir, sharedRunKind, pod.Uid)
+
+		_, err = p.Synchronize(context.Background(), []*api.PodSandbox{pod}, nil)
+		require.NoError(t, err)
+		assert.DirExists(t, dir)
+
+		_, err = p.Synchronize(context.Background(), nil, nil)
+		require.NoError(t, err)
+		_, err = os.Stat(dir)
+		assert.True(t, os.IsNotExist(err))
+	})
+}
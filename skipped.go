@@ -0,0 +1,130 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/containerd/nri/pkg/api"
+)
+
+// skipRule is a policy which kept the plugin from adjusting a likely
+// systemd container.
+type skipRule struct {
+	// Key is the configuration key controlling the rule, also the reason
+	// label of nri_systemd_skipped_total.
+	Key string `json:"key"`
+	// Reason describes how the rule applied to the container.
+	Reason string `json:"reason"`
+
+	// warn is set for rules which are likely unintended for the container,
+	// unlike opting out.
+	warn bool
+}
+
+// skippedContainer is a likely systemd container the plugin did not
+// adjust, with the rule which kept it from doing so.
+type skippedContainer struct {
+	ID        string   `json:"id"`
+	Name      string   `json:"name"`
+	Namespace string   `json:"namespace,omitempty"`
+	Rule      skipRule `json:"rule"`
+}
+
+// likelySystemd tells whether the container looks like a systemd
+// container, whether or not the configuration lets the plugin adjust it.
+func likelySystemd(cfg *Config, pod *api.PodSandbox, container *api.Container) bool {
+	if systemd, _ := annotatedSystemdContainer(pod, container); systemd {
+		return true
+	}
+	args := container.Args
+	return len(args) > 0 && (isInitPath(cfg, args[0]) || isShellExecSystemd(cfg, args))
+}
+
+// blockingRule returns the rule keeping the plugin from adjusting a likely
+// systemd container. Containers which do not look like systemd containers
+// have none.
+func blockingRule(cfg *Config, pod *api.PodSandbox, container *api.Container) (skipRule, bool) {
+	if !likelySystemd(cfg, pod, container) {
+		return skipRule{}, false
+	}
+
+	if key, ok := disabledByPod(cfg, pod); ok {
+		return skipRule{
+			Key:    "disableAnnotations",
+			Reason: fmt.Sprintf("pod annotation %s is listed in disableAnnotations", key),
+		}, true
+	}
+
+	if key, ok := ephemeralMarker(cfg, container); ok && cfg.EphemeralContainers == EphemeralSkip {
+		return skipRule{
+			Key:    "ephemeralContainers",
+			Reason: fmt.Sprintf("ephemeral container by annotation %s, ephemeralContainers is %s", key, EphemeralSkip),
+		}, true
+	}
+
+	switch reason, systemd := systemdDetection(cfg, pod, container); {
+	case systemd:
+	case reason == detectedAnnotation:
+		return skipRule{
+			Key:    "detection.order",
+			Reason: fmt.Sprintf("%s annotation is false, which detection.order ranks above the entrypoint", systemdAnnotation),
+		}, true
+	default:
+		// only a shell running systemd is left undetected
+		return skipRule{
+			Key:    "detection.shellExec",
+			Reason: "entrypoint is a shell running systemd with exec, detection.shellExec is off",
+			warn:   true,
+		}, true
+	}
+
+	if pid1, err := runsAsPID1(pod, container); cfg.SkipNonPID1 && err == nil && !pid1 {
+		return skipRule{
+			Key:    "skipNonPid1",
+			Reason: "systemd does not run as PID 1, skipNonPid1 is on",
+			warn:   true,
+		}, true
+	}
+
+	return skipRule{}, false
+}
+
+// skip records that the plugin does not adjust a likely systemd container
+// because of the given rule.
+func (p *plugin) skip(pod *api.PodSandbox, container *api.Container, ctrName string, rule skipRule) {
+	if rule.warn {
+		p.detectLog.Warnf("%s: likely a systemd container, not adjusted: %s", ctrName, rule.Reason)
+	} else {
+		p.detectLog.Infof("%s: likely a systemd container, not adjusted: %s", ctrName, rule.Reason)
+	}
+	p.state.addSkipped(newSkippedContainer(pod, container, ctrName, rule))
+	p.metrics.skipped.WithLabelValues(rule.Key).Inc()
+	p.decide(ctrName, decisionSkipped, rule.Reason, "")
+}
+
+func newSkippedContainer(pod *api.PodSandbox, container *api.Container, ctrName string, rule skipRule) *skippedContainer {
+	s := &skippedContainer{
+		ID:   container.Id,
+		Name: ctrName,
+		Rule: rule,
+	}
+	if pod != nil {
+		s.Namespace = pod.Namespace
+	}
+	return s
+}
@@ -0,0 +1,182 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/containerd/nri/pkg/api"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestSkippedContainers(t *testing.T) {
+	disabledPod := &api.PodSandbox{
+		Name:        "test-pod",
+		Namespace:   "default",
+		Annotations: map[string]string{"example.com/managed-by": "other"},
+	}
+	nonPID1 := func() *api.Container {
+		container := newProfileTestContainer(nil)
+		container.Linux.Namespaces = []*api.LinuxNamespace{{Type: "pid", Path: "/proc/4242/ns/pid"}}
+		return container
+	}
+	shellExec := func() *api.Container {
+		container := newProfileTestContainer(nil)
+		container.Args = []string{"/bin/sh", "-c", "setup && exec /sbin/init"}
+		return container
+	}
+
+	tests := []struct {
+		name      string
+		cfg       func(c *Config)
+		pod       *api.PodSandbox
+		container *api.Container
+		key       string
+		reason    string
+	}{
+		{
+			name:      "disable annotation",
+			cfg:       func(c *Config) { c.DisableAnnotations = []string{"example.com/managed-by"} },
+			pod:       disabledPod,
+			container: newProfileTestContainer(nil),
+			key:       "disableAnnotations",
+			reason:    "pod annotation example.com/managed-by is listed in disableAnnotations",
+		},
+		{
+			name:      "opt-out annotation",
+			cfg:       func(c *Config) {},
+			container: newProfileTestContainer(map[string]string{systemdAnnotation: "false"}),
+			key:       "detection.order",
+			reason:    "io.systemd.container annotation is false, which detection.order ranks above the entrypoint",
+		},
+		{
+			name:      "shell exec detection off",
+			cfg:       func(c *Config) {},
+			container: shellExec(),
+			key:       "detection.shellExec",
+			reason:    "entrypoint is a shell running systemd with exec, detection.shellExec is off",
+		},
+		{
+			name:      "not PID 1",
+			cfg:       func(c *Config) { c.SkipNonPID1 = true },
+			container: nonPID1(),
+			key:       "skipNonPid1",
+			reason:    "systemd does not run as PID 1, skipNonPid1 is on",
+		},
+		{
+			name:      "ephemeral container",
+			cfg:       func(c *Config) { c.EphemeralContainers = EphemeralSkip },
+			container: newProfileTestContainer(map[string]string{ephemeralAnnotation: "true"}),
+			key:       "ephemeralContainers",
+			reason:    "ephemeral container by annotation io.systemd.container/ephemeral, ephemeralContainers is skip",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestPlugin(configWith(tt.cfg))
+			pod := tt.pod
+			if pod == nil {
+				pod = &api.PodSandbox{Name: "test-pod", Namespace: "default"}
+			}
+
+			adjust, _, err := p.CreateContainer(context.Background(), pod, tt.container)
+			require.NoError(t, err)
+			assert.Nil(t, adjust)
+
+			expected := []*skippedContainer{{
+				ID:        tt.container.Id,
+				Name:      "test-pod/test-container-systemd",
+				Namespace: "default",
+				Rule:      skipRule{Key: tt.key, Reason: tt.reason},
+			}}
+			var skipped []*skippedContainer
+			assert.Equal(t, http.StatusOK, debugRequest(t, p, http.MethodGet, "/skipped", 0, &skipped))
+			assert.Equal(t, expected, skipped)
+			assert.Equal(t, 1.0, testutil.ToFloat64(p.metrics.skipped.WithLabelValues(tt.key)))
+			assert.Equal(t, tt.reason, p.recent.list()[0].Reason)
+
+			// rebuilt when synchronizing
+			running := proto.Clone(tt.container).(*api.Container)
+			running.State = api.ContainerState_CONTAINER_RUNNING
+			running.PodSandboxId = "pod"
+			syncPod := proto.Clone(pod).(*api.PodSandbox)
+			syncPod.Id = "pod"
+			_, err = p.Synchronize(context.Background(), []*api.PodSandbox{syncPod}, []*api.Container{running})
+			require.NoError(t, err)
+			assert.Empty(t, p.state.list())
+			skipped = nil
+			assert.Equal(t, http.StatusOK, debugRequest(t, p, http.MethodGet, "/skipped", 0, &skipped))
+			assert.Equal(t, expected, skipped)
+
+			require.NoError(t, p.RemoveContainer(context.Background(), pod, tt.container))
+			assert.Empty(t, p.state.listSkipped())
+		})
+	}
+
+	t.Run("not likely systemd", func(t *testing.T) {
+		p := newTestPlugin(configWith(func(c *Config) { c.DisableAnnotations = []string{"example.com/managed-by"} }))
+		container := newProfileTestContainer(nil)
+		container.Args = []string{"sleep", "infinity"}
+
+		for _, pod := range []*api.PodSandbox{disabledPod, {}} {
+			adjust, _, err := p.CreateContainer(context.Background(), pod, container)
+			require.NoError(t, err)
+			assert.Nil(t, adjust)
+		}
+		assert.Empty(t, p.state.listSkipped())
+	})
+
+	t.Run("adjusted later", func(t *testing.T) {
+		p := newTestPlugin(nil)
+		container := shellExec()
+
+		_, _, err := p.CreateContainer(context.Background(), &api.PodSandbox{}, container)
+		require.NoError(t, err)
+		require.Len(t, p.state.listSkipped(), 1)
+
+		require.NoError(t, p.setConfig(configWith(func(c *Config) { c.Detection.ShellExec = true })))
+		adjust, _, err := p.CreateContainer(context.Background(), &api.PodSandbox{}, container)
+		require.NoError(t, err)
+		assert.NotNil(t, adjust)
+		assert.Empty(t, p.state.listSkipped())
+		assert.Len(t, p.state.list(), 1)
+	})
+	t.Run("ephemeral containers adjusted", func(t *testing.T) {
+		ephemeral := newProfileTestContainer(map[string]string{"example.com/debug": "true"})
+		for _, cfg := range []*Config{
+			// not marked by the configured annotations
+			configWith(func(c *Config) { c.EphemeralContainers = EphemeralSkip }),
+			configWith(func(c *Config) { c.EphemeralAnnotations = []string{"example.com/debug"} }),
+			configWith(func(c *Config) {
+				c.EphemeralContainers = EphemeralAdjust
+				c.EphemeralAnnotations = []string{"example.com/debug"}
+			}),
+		} {
+			p := newTestPlugin(cfg)
+			adjust, _, err := p.CreateContainer(context.Background(), &api.PodSandbox{}, ephemeral)
+			require.NoError(t, err)
+			assert.NotNil(t, adjust)
+			assert.Empty(t, p.state.listSkipped())
+		}
+	})
+}
@@ -0,0 +1,328 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/containerd/nri/pkg/api"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// containerState is what the plugin remembers about an adjusted container.
+type containerState struct {
+	id        string
+	name      string
+	namespace string
+	profile   string
+
+	// host is the host information the container was adjusted with, nil
+	// if the host was not probed yet.
+	host *hostInfo
+
+	// drift lists what the plugin would still change in the spec of the
+	// container, as found when synchronizing with the runtime.
+	drift []string
+
+	// pod and container are those the container was adjusted for, used to
+	// render its files again.
+	pod       *api.PodSandbox
+	container *api.Container
+
+	// rendered lists the kinds of files rendered for the container, and
+	// artifactDrift what is wrong with them, as found by the last drift
+	// check.
+	rendered      []string
+	artifactDrift []string
+
+	// cgroupRemounted tells whether the plugin made the cgroup mount of the
+	// container writable.
+	cgroupRemounted bool
+
+	// writableMounts are the destinations of the tmpfs mounts the plugin
+	// added to the container, which must stay mounted and writable.
+	writableMounts []string
+
+	// missingControllers are the expected cgroup controllers missing in
+	// the cgroup of the container, as found when it was started or by the
+	// last drift check.
+	missingControllers []string
+
+	// started is when the container was found running after starting, with
+	// bootCheckWindow.
+	started time.Time
+
+	// adjusted records how the plugin adjusted the container, nil if it was
+	// adjusted before the plugin started.
+	adjusted *event
+
+	// stopped tells whether the plugin handled the stop of the container.
+	stopped bool
+}
+
+// stateCache tracks the systemd containers adjusted by the plugin.
+type stateCache struct {
+	mu         sync.Mutex
+	containers map[string]*containerState
+	// skipped are the likely systemd containers which were not adjusted.
+	skipped map[string]*skippedContainer
+}
+
+func newStateCache() *stateCache {
+	return &stateCache{
+		containers: make(map[string]*containerState),
+		skipped:    make(map[string]*skippedContainer),
+	}
+}
+
+func (c *stateCache) add(s *containerState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.containers[s.id] = s
+	delete(c.skipped, s.id)
+}
+
+func (c *stateCache) addSkipped(s *skippedContainer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.skipped[s.ID] = s
+	delete(c.containers, s.ID)
+}
+
+func (c *stateCache) get(id string) *containerState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.containers[id]
+}
+
+// update replaces the state of a tracked container with a copy changed by
+// fn, so that states returned by list are never changed.
+func (c *stateCache) update(id string, fn func(s *containerState)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if s, ok := c.containers[id]; ok {
+		updated := *s
+		fn(&updated)
+		c.containers[id] = &updated
+	}
+}
+
+func (c *stateCache) remove(id string) *containerState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.containers[id]
+	delete(c.containers, id)
+	delete(c.skipped, id)
+	return s
+}
+
+// reset replaces the cache content, e.g. with the containers reported by
+// the runtime after (re)connecting.
+func (c *stateCache) reset(states []*containerState, skipped []*skippedContainer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.containers = make(map[string]*containerState, len(states))
+	for _, s := range states {
+		c.containers[s.id] = s
+	}
+	c.skipped = make(map[string]*skippedContainer, len(skipped))
+	for _, s := range skipped {
+		c.skipped[s.ID] = s
+	}
+}
+
+func (c *stateCache) list() []*containerState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	states := make([]*containerState, 0, len(c.containers))
+	for _, s := range c.containers {
+		states = append(states, s)
+	}
+	return states
+}
+
+func (c *stateCache) listSkipped() []*skippedContainer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	skipped := make([]*skippedContainer, 0, len(c.skipped))
+	for _, s := range c.skipped {
+		skipped = append(skipped, s)
+	}
+	return skipped
+}
+
+func newContainerState(pod *api.PodSandbox, container *api.Container, ctrName, profile string, host *hostInfo) *containerState {
+	s := &containerState{
+		id:        container.Id,
+		name:      ctrName,
+		profile:   profile,
+		host:      host,
+		pod:       pod,
+		container: container,
+	}
+	if pod != nil {
+		s.namespace = pod.Namespace
+	}
+	return s
+}
+
+// Synchronize rebuilds the state cache from the containers known to the
+// runtime, covering any events missed while the plugin was disconnected.
+func (p *plugin) Synchronize(ctx context.Context, pods []*api.PodSandbox, containers []*api.Container) ([]*api.ContainerUpdate, error) {
+	defer p.observeHook("Synchronize", time.Now())
+	cfg := p.config()
+
+	ctx, cancel := context.WithTimeout(ctx, cfg.HookTimeout.Duration())
+	defer cancel()
+
+	podByID := make(map[string]*api.PodSandbox, len(pods))
+	for _, pod := range pods {
+		podByID[pod.Id] = pod
+	}
+
+	var (
+		states  []*containerState
+		skipped []*skippedContainer
+	)
+	for _, container := range containers {
+		if container.State == api.ContainerState_CONTAINER_STOPPED {
+			continue
+		}
+
+		pod := podByID[container.PodSandboxId]
+		ctrName := containerName(pod, container)
+
+		if rule, ok := blockingRule(cfg, pod, container); ok {
+			skipped = append(skipped, newSkippedContainer(pod, container, ctrName, rule))
+			continue
+		}
+		if !isSystemdContainer(cfg, pod, container) {
+			continue
+		}
+
+		prof, _ := selectProfile(cfg, pod, container)
+		drift := p.specDrift(ctx, cfg, pod, container, ctrName)
+		s := newContainerState(pod, container, ctrName, profileName(prof), p.hostInfo.Load())
+		s.drift = drift
+		s.rendered = existingRendered(cfg, container.Id)
+		states = append(states, s)
+	}
+
+	p.capturePastStops(ctx, cfg, containers)
+	p.state.reset(states, skipped)
+	summary, err := pruneRendered(cfg, pods, containers, time.Now())
+	if err != nil {
+		p.stateLog.Warnf("failed to prune rendered files: %v", err)
+	}
+	if summary.removed > 0 || summary.quarantined > 0 || summary.kept > 0 {
+		p.stateLog.Infof("state of unknown containers and pods: %d removed (%d bytes), %d quarantined, %d kept until older than %v",
+			summary.removed, summary.reclaimed, summary.quarantined, summary.kept, cfg.OrphanGC.MinAge.Duration())
+	}
+	p.metrics.reclaimedBytes.Add(float64(summary.reclaimed))
+	if cfg.CrashReports.Enabled {
+		if err := pruneCrashReports(cfg, time.Now()); err != nil {
+			p.stateLog.Warnf("failed to remove old crash reports: %v", err)
+		}
+	}
+	if cfg.JournalCapture.Enabled {
+		if err := pruneJournalCaptures(cfg, time.Now()); err != nil {
+			p.stateLog.Warnf("failed to remove old journal captures: %v", err)
+		}
+	}
+	p.conn.synchronized()
+	p.conn.eventHandled()
+	p.stateLog.Infof("synchronized state: %d systemd containers", len(states))
+
+	return nil, nil
+}
+
+// RemoveContainer forgets about a removed container.
+func (p *plugin) RemoveContainer(_ context.Context, pod *api.PodSandbox, container *api.Container) error {
+	defer p.observeHook("RemoveContainer", time.Now())
+	ctrName := containerName(pod, container)
+	if s := p.state.remove(container.Id); s != nil {
+		p.stateLog.Debugf("%s: removed systemd container", ctrName)
+	}
+	if err := removeRendered(p.config(), container.Id); err != nil {
+		p.stateLog.Warnf("%s: failed to remove rendered files: %v", ctrName, err)
+	}
+	if dir := p.config().OCIPlanDir; dir != "" {
+		if err := removeOCIPlan(dir, container.Id); err != nil {
+			p.stateLog.Warnf("%s: failed to remove OCI plan: %v", ctrName, err)
+		}
+	}
+	p.conn.eventHandled()
+	return nil
+}
+
+// containerCollector reports the number of adjusted systemd containers.
+// The gauge is computed from the state cache at scrape time, so it is
+// always consistent with the cache, no matter which events were missed.
+type containerCollector struct {
+	p    *plugin
+	desc *prometheus.Desc
+}
+
+func newContainerCollector(p *plugin) *containerCollector {
+	return &containerCollector{
+		p: p,
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "", "containers"),
+			"Number of systemd containers currently adjusted by the plugin.",
+			[]string{"namespace", "profile"}, nil,
+		),
+	}
+}
+
+func (c *containerCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *containerCollector) Collect(ch chan<- prometheus.Metric) {
+	type key struct {
+		namespace string
+		profile   string
+	}
+
+	withNamespace, withProfile := false, false
+	for _, label := range c.p.config().ContainerMetricLabels {
+		switch label {
+		case "namespace":
+			withNamespace = true
+		case "profile":
+			withProfile = true
+		}
+	}
+
+	counts := map[key]int{}
+	for _, s := range c.p.state.list() {
+		k := key{}
+		if withNamespace {
+			k.namespace = s.namespace
+		}
+		if withProfile {
+			k.profile = s.profile
+		}
+		counts[k]++
+	}
+
+	for k, n := range counts {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(n), k.namespace, k.profile)
+	}
+}
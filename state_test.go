@@ -0,0 +1,158 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/containerd/nri/pkg/api"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newStateTestContainer(id, podID string, annotations map[string]string) *api.Container {
+	ctr := newProfileTestContainer(annotations)
+	ctr.Id = id
+	ctr.Name = id
+	ctr.PodSandboxId = podID
+	ctr.State = api.ContainerState_CONTAINER_RUNNING
+	return ctr
+}
+
+// assertContainerGauge compares the nri_systemd_containers gauge with the
+// expected samples, given in the text exposition format.
+func assertContainerGauge(t *testing.T, p *plugin, samples ...string) {
+	t.Helper()
+
+	expected := "# HELP nri_systemd_containers Number of systemd containers currently adjusted by the plugin.\n" +
+		"# TYPE nri_systemd_containers gauge\n"
+	for _, s := range samples {
+		expected += s + "\n"
+	}
+	if len(samples) == 0 {
+		expected = ""
+	}
+
+	assert.NoError(t, testutil.GatherAndCompare(p.metrics.registry, strings.NewReader(expected), "nri_systemd_containers"))
+}
+
+func TestContainerGauge(t *testing.T) {
+	p := newTestPlugin(nil)
+
+	podA := &api.PodSandbox{Id: "pod-a", Name: "pod-a", Namespace: "team-a"}
+	podB := &api.PodSandbox{Id: "pod-b", Name: "pod-b", Namespace: "team-b"}
+	ctrA := newStateTestContainer("ctr-a", "pod-a", nil)
+	ctrB := newStateTestContainer("ctr-b", "pod-b", map[string]string{profileAnnotation: profileNestedRuntime})
+
+	// adjust
+	_, _, err := p.CreateContainer(context.Background(), podA, ctrA)
+	require.NoError(t, err)
+	assertContainerGauge(t, p, `nri_systemd_containers{namespace="team-a",profile=""} 1`)
+
+	// while disconnected, ctr-a is removed and ctr-b is created
+	_, err = p.Synchronize(context.Background(), []*api.PodSandbox{podA, podB}, []*api.Container{ctrB})
+	require.NoError(t, err)
+	assertContainerGauge(t, p, `nri_systemd_containers{namespace="team-b",profile="nested-runtime"} 1`)
+
+	// events for unknown containers are harmless
+	require.NoError(t, p.RemoveContainer(context.Background(), podA, ctrA))
+	assertContainerGauge(t, p, `nri_systemd_containers{namespace="team-b",profile="nested-runtime"} 1`)
+
+	require.NoError(t, p.RemoveContainer(context.Background(), podB, ctrB))
+	assertContainerGauge(t, p)
+}
+
+func TestContainerGaugeSynchronizeSkipsContainers(t *testing.T) {
+	p := newTestPlugin(nil)
+
+	pod := &api.PodSandbox{Id: "pod", Name: "pod", Namespace: "default"}
+	stopped := newStateTestContainer("stopped", "pod", nil)
+	stopped.State = api.ContainerState_CONTAINER_STOPPED
+	plain := newStateTestContainer("plain", "pod", nil)
+	plain.Args = []string{"/bin/sh"}
+	running := newStateTestContainer("running", "pod", nil)
+
+	_, err := p.Synchronize(context.Background(), []*api.PodSandbox{pod}, []*api.Container{stopped, plain, running})
+	require.NoError(t, err)
+	assertContainerGauge(t, p, `nri_systemd_containers{namespace="default",profile=""} 1`)
+}
+
+func TestContainerGaugeLabels(t *testing.T) {
+	tests := []struct {
+		name     string
+		labels   []string
+		expected []string
+	}{
+		{
+			name:   "all labels",
+			labels: []string{"namespace", "profile"},
+			expected: []string{
+				`nri_systemd_containers{namespace="team-a",profile=""} 1`,
+				`nri_systemd_containers{namespace="team-a",profile="nested-runtime"} 1`,
+				`nri_systemd_containers{namespace="team-b",profile="nested-runtime"} 1`,
+			},
+		},
+		{
+			name:   "namespace only",
+			labels: []string{"namespace"},
+			expected: []string{
+				`nri_systemd_containers{namespace="team-a",profile=""} 2`,
+				`nri_systemd_containers{namespace="team-b",profile=""} 1`,
+			},
+		},
+		{
+			name:   "profile only",
+			labels: []string{"profile"},
+			expected: []string{
+				`nri_systemd_containers{namespace="",profile=""} 1`,
+				`nri_systemd_containers{namespace="",profile="nested-runtime"} 2`,
+			},
+		},
+		{
+			name:     "no labels",
+			labels:   []string{},
+			expected: []string{`nri_systemd_containers{namespace="",profile=""} 3`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestPlugin(configWith(func(c *Config) { c.ContainerMetricLabels = tt.labels }))
+
+			nested := map[string]string{profileAnnotation: profileNestedRuntime}
+			podA := &api.PodSandbox{Id: "pod-a", Name: "pod-a", Namespace: "team-a"}
+			podB := &api.PodSandbox{Id: "pod-b", Name: "pod-b", Namespace: "team-b"}
+
+			for _, c := range []struct {
+				pod *api.PodSandbox
+				ctr *api.Container
+			}{
+				{podA, newStateTestContainer("ctr-1", "pod-a", nil)},
+				{podA, newStateTestContainer("ctr-2", "pod-a", nested)},
+				{podB, newStateTestContainer("ctr-3", "pod-b", nested)},
+			} {
+				_, _, err := p.CreateContainer(context.Background(), c.pod, c.ctr)
+				require.NoError(t, err)
+			}
+
+			assertContainerGauge(t, p, tt.expected...)
+		})
+	}
+}
@@ -0,0 +1,277 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/containerd/nri/pkg/api"
+)
+
+// Kinds of files rendered below stateDir for containers, one directory per
+// container in each.
+const (
+	renderedUnits     = "units"
+	renderedDropIns   = "drop-ins"
+	renderedMachineID = "machine-id"
+)
+
+var renderedKinds = []string{renderedUnits, renderedDropIns, renderedMachineID}
+
+// podKinds are the kinds of files kept below stateDir for pods, one
+// directory per pod UID in each.
+var podKinds = []string{sharedRunKind}
+
+// renderedDir returns the host directory with the rendered files of the
+// given kind for the container.
+func renderedDir(cfg *Config, kind, id string) (string, error) {
+	if id == "" || id == "." || id == ".." || strings.ContainsRune(id, '/') {
+		return "", fmt.Errorf("invalid container ID %q", id)
+	}
+	return filepath.Join(cfg.StateDir, kind, id), nil
+}
+
+// renderer renders the files of an adjustment step for a container.
+type renderer struct {
+	kind   string
+	render func(context.Context, *Config, *api.PodSandbox, *api.Container) error
+}
+
+// renderers are keyed by the name of the adjustment step they belong to.
+var renderers = map[string]renderer{
+	"units":      {kind: renderedUnits, render: renderUnits},
+	"drop-ins":   {kind: renderedDropIns, render: renderDropIns},
+	"machine-id": {kind: renderedMachineID, render: renderMachineID},
+}
+
+func rendererOf(kind string) (renderer, bool) {
+	for _, r := range renderers {
+		if r.kind == kind {
+			return r, true
+		}
+	}
+	return renderer{}, false
+}
+
+// existingRendered returns the kinds of files rendered for the container,
+// as found below stateDir.
+func existingRendered(cfg *Config, id string) []string {
+	var kinds []string
+	for _, kind := range renderedKinds {
+		dir, err := renderedDir(cfg, kind, id)
+		if err != nil {
+			continue
+		}
+		if _, err := os.Stat(dir); err == nil {
+			kinds = append(kinds, kind)
+		}
+	}
+	return kinds
+}
+
+// renderDir replaces dir with the files created by fill, which renders
+// them into an empty directory next to it first. It returns when the
+// context is done, leaving an operation on a hung filesystem running in
+// the background, which stops before the next one and leaves dir alone.
+func renderDir(ctx context.Context, dir string, fill func(tmp string) error) error {
+	_, err := withContext(ctx, func() (struct{}, error) {
+		tmp := dir + ".tmp"
+		for _, op := range []func() error{
+			func() error { return os.RemoveAll(tmp) },
+			func() error { return os.MkdirAll(tmp, 0o755) },
+			func() error { return fill(tmp) },
+			func() error { return os.RemoveAll(dir) },
+			func() error { return os.Rename(tmp, dir) },
+		} {
+			if err := ctx.Err(); err != nil {
+				return struct{}{}, err
+			}
+			if err := op(); err != nil {
+				return struct{}{}, err
+			}
+		}
+		return struct{}{}, nil
+	})
+	return err
+}
+
+// removeRendered removes the rendered files of the container, if any.
+func removeRendered(cfg *Config, id string) error {
+	for _, kind := range renderedKinds {
+		dir, err := renderedDir(cfg, kind, id)
+		if err != nil {
+			return err
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// orphanSummary counts the rendered files of unknown containers found by
+// pruneRendered.
+type orphanSummary struct {
+	removed     int
+	quarantined int
+	kept        int
+	// reclaimed is the size of the removed files in bytes.
+	reclaimed int64
+}
+
+// pruneRendered removes the rendered files of containers, and the files
+// of pods, unknown to the runtime, e.g. removed while the plugin was not
+// running. Container directories are matched against container IDs, pod
+// directories against pod UIDs. Only files older than orphanGC.minAge are
+// removed, or moved below stateDir/quarantine with orphanGC.quarantine.
+func pruneRendered(cfg *Config, pods []*api.PodSandbox, containers []*api.Container, now time.Time) (orphanSummary, error) {
+	var summary orphanSummary
+
+	knownContainers := make(map[string]bool, len(containers))
+	for _, c := range containers {
+		knownContainers[c.Id] = true
+	}
+	knownPods := make(map[string]bool, len(pods))
+	for _, pod := range pods {
+		knownPods[pod.Uid] = true
+	}
+
+	for _, kind := range append(slices.Clone(renderedKinds), podKinds...) {
+		known := knownContainers
+		if slices.Contains(podKinds, kind) {
+			known = knownPods
+		}
+		parent := filepath.Join(cfg.StateDir, kind)
+		entries, err := os.ReadDir(parent)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return summary, err
+		}
+
+		for _, e := range entries {
+			if known[strings.TrimSuffix(e.Name(), ".tmp")] {
+				continue
+			}
+			orphan := filepath.Join(parent, e.Name())
+			if !insideDir(cfg.StateDir, orphan) {
+				return summary, fmt.Errorf("refusing to remove %s outside of %s", orphan, cfg.StateDir)
+			}
+
+			info, err := e.Info()
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				return summary, err
+			}
+			if now.Sub(info.ModTime()) < cfg.OrphanGC.MinAge.Duration() {
+				summary.kept++
+				continue
+			}
+
+			if cfg.OrphanGC.Quarantine {
+				dest := filepath.Join(cfg.StateDir, quarantineDir, kind, e.Name())
+				if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+					return summary, err
+				}
+				if err := os.RemoveAll(dest); err != nil {
+					return summary, err
+				}
+				if err := os.Rename(orphan, dest); err != nil {
+					return summary, err
+				}
+				summary.quarantined++
+				continue
+			}
+
+			size := diskUsage(orphan)
+			if err := os.RemoveAll(orphan); err != nil {
+				return summary, err
+			}
+			summary.removed++
+			summary.reclaimed += size
+		}
+	}
+	return summary, nil
+}
+
+// quarantineDir is where pruneRendered moves rendered files of unknown
+// containers with orphanGC.quarantine, relative to stateDir.
+const quarantineDir = "quarantine"
+
+// insideDir tells whether path is below dir, after cleaning both.
+func insideDir(dir, path string) bool {
+	rel, err := filepath.Rel(filepath.Clean(dir), filepath.Clean(path))
+	return err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, "../") && !filepath.IsAbs(rel)
+}
+
+// diskUsage returns the size of the regular files below path, not
+// following symlinks.
+func diskUsage(path string) int64 {
+	var size int64
+	_ = filepath.WalkDir(path, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.Type().IsRegular() {
+			if info, err := d.Info(); err == nil {
+				size += info.Size()
+			}
+		}
+		return nil
+	})
+	return size
+}
+
+// pruneOlder removes the files in dir last modified before the given time,
+// e.g. reports past their retention.
+func pruneOlder(dir string, before time.Time) error {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		info, err := e.Info()
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !info.ModTime().Before(before) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, e.Name())); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"sync"
+	"time"
+)
+
+// stepTimingWindow is the number of recent adjustments the slowest step is
+// looked for in.
+const stepTimingWindow = 100
+
+// Classes of step failures, bounded for the labels of the failure metric.
+const (
+	errorClassDeadline   = "deadline"
+	errorClassCanceled   = "canceled"
+	errorClassPermission = "permission"
+	errorClassNotFound   = "not-found"
+	errorClassOther      = "other"
+)
+
+// errorClass classifies the error of a failed step.
+func errorClass(err error) string {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return errorClassDeadline
+	case errors.Is(err, context.Canceled):
+		return errorClassCanceled
+	case errors.Is(err, fs.ErrPermission):
+		return errorClassPermission
+	case errors.Is(err, fs.ErrNotExist):
+		return errorClassNotFound
+	}
+	return errorClassOther
+}
+
+// stepTiming is the slowest step of adjusting a container.
+type stepTiming struct {
+	Time      time.Time `json:"time"`
+	Container string    `json:"container"`
+	Step      string    `json:"step"`
+	Duration  Duration  `json:"duration"`
+	Failed    bool      `json:"failed,omitempty"`
+}
+
+// stepTimings keeps the slowest step of the recent adjustments.
+type stepTimings struct {
+	mu      sync.Mutex
+	entries [stepTimingWindow]stepTiming
+	// count is the number of adjustments recorded so far, the next one
+	// goes to entries[count%stepTimingWindow].
+	count int
+}
+
+func (t *stepTimings) add(timing stepTiming) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.entries[t.count%stepTimingWindow] = timing
+	t.count++
+}
+
+// slowest returns the slowest step of the recent adjustments, and their
+// number.
+func (t *stepTimings) slowest() (stepTiming, int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := min(t.count, stepTimingWindow)
+	var slowest stepTiming
+	for _, timing := range t.entries[:n] {
+		if timing.Duration > slowest.Duration {
+			slowest = timing
+		}
+	}
+	return slowest, n
+}
+
+// runSteps runs the steps of adjusting a container in order, stopping at
+// the first failing one. It returns the steps applied, as listed in the
+// provenance annotation, and records the slowest step.
+func (p *plugin) runSteps(ctx context.Context, ctrName string, steps []adjustmentStep) ([]string, error) {
+	var (
+		applied []string
+		slowest stepTiming
+		err     error
+	)
+	for _, s := range steps {
+		start := time.Now()
+		err = p.runStep(ctx, ctrName, s.name, s.fn)
+		if elapsed := Duration(time.Since(start)); elapsed >= slowest.Duration {
+			slowest = stepTiming{Step: s.name, Duration: elapsed, Failed: err != nil}
+		}
+		if err != nil {
+			break
+		}
+		applied = append(applied, s.String())
+	}
+	if slowest.Step != "" {
+		slowest.Time = time.Now().UTC()
+		slowest.Container = ctrName
+		p.stepTimings.add(slowest)
+	}
+	return applied, err
+}
+
+// observeHook records the latency of a hook, started at start.
+func (p *plugin) observeHook(hook string, start time.Time) {
+	p.metrics.hookDuration.WithLabelValues(hook).Observe(time.Since(start).Seconds())
+}
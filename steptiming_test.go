@@ -0,0 +1,149 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/containerd/nri/pkg/api"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestErrorClass(t *testing.T) {
+	for err, class := range map[error]string{
+		context.DeadlineExceeded:                         errorClassDeadline,
+		fmt.Errorf("step: %w", context.Canceled):         errorClassCanceled,
+		&fs.PathError{Op: "open", Err: fs.ErrPermission}: errorClassPermission,
+		fmt.Errorf("wrapped: %w", fs.ErrNotExist):        errorClassNotFound,
+		errors.New("invalid drop-in"):                    errorClassOther,
+	} {
+		assert.Equal(t, class, errorClass(err), err.Error())
+	}
+}
+
+// histogram returns the number and the sum of the observations of a
+// histogram.
+func histogram(t *testing.T, o prometheus.Observer) (uint64, float64) {
+	t.Helper()
+	var m dto.Metric
+	require.NoError(t, o.(prometheus.Metric).Write(&m))
+	return m.GetHistogram().GetSampleCount(), m.GetHistogram().GetSampleSum()
+}
+
+func TestStepTimings(t *testing.T) {
+	p := newTestPlugin(nil)
+	fast := adjustmentStep{name: "fast", fn: func(context.Context) error { return nil }}
+	slow := adjustmentStep{name: "slow", fn: func(context.Context) error {
+		time.Sleep(20 * time.Millisecond)
+		return nil
+	}}
+
+	applied, err := p.runSteps(context.Background(), "pod/app", []adjustmentStep{fast, slow, fast})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"fast", "slow", "fast"}, applied)
+
+	count, sum := histogram(t, p.metrics.stepDuration.WithLabelValues("slow"))
+	assert.Equal(t, uint64(1), count)
+	assert.GreaterOrEqual(t, sum, 0.02)
+	count, _ = histogram(t, p.metrics.stepDuration.WithLabelValues("fast"))
+	assert.Equal(t, uint64(2), count)
+
+	var resp struct {
+		Adjustments int `json:"adjustments"`
+		Slowest     struct {
+			Container string `json:"container"`
+			Step      string `json:"step"`
+			Duration  string `json:"duration"`
+			Failed    bool   `json:"failed"`
+		} `json:"slowest"`
+	}
+	require.Equal(t, http.StatusOK, debugRequest(t, p, http.MethodGet, "/slowest-step", 0, &resp))
+	assert.Equal(t, 1, resp.Adjustments)
+	assert.Equal(t, "pod/app", resp.Slowest.Container)
+	assert.Equal(t, "slow", resp.Slowest.Step)
+	assert.False(t, resp.Slowest.Failed)
+	d, err := time.ParseDuration(resp.Slowest.Duration)
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, d, 20*time.Millisecond)
+}
+
+func TestStepFailures(t *testing.T) {
+	p := newTestPlugin(nil)
+	failing := adjustmentStep{name: "units", fn: func(context.Context) error {
+		return fmt.Errorf("failed to render units: %w", fs.ErrPermission)
+	}}
+	skipped := adjustmentStep{name: "env", fn: func(context.Context) error {
+		t.Error("step after a failed one ran")
+		return nil
+	}}
+
+	applied, err := p.runSteps(context.Background(), "pod/app", []adjustmentStep{failing, skipped})
+	assert.ErrorIs(t, err, fs.ErrPermission)
+	assert.Empty(t, applied)
+	assert.Equal(t, 1.0, testutil.ToFloat64(p.metrics.stepFailures.WithLabelValues("units", errorClassPermission)))
+
+	slowest, n := p.stepTimings.slowest()
+	assert.Equal(t, 1, n)
+	assert.Equal(t, "units", slowest.Step)
+	assert.True(t, slowest.Failed)
+
+	// a step running into the hook deadline
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	hung := adjustmentStep{name: "cgroup", fn: func(ctx context.Context) error {
+		<-ctx.Done()
+		return nil
+	}}
+	_, err = p.runSteps(ctx, "pod/app", []adjustmentStep{hung})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, 1.0, testutil.ToFloat64(p.metrics.stepFailures.WithLabelValues("cgroup", errorClassDeadline)))
+}
+
+func TestStepTimingWindow(t *testing.T) {
+	var timings stepTimings
+	timings.add(stepTiming{Step: "units", Duration: Duration(time.Second)})
+	for i := 0; i < stepTimingWindow; i++ {
+		timings.add(stepTiming{Step: "env", Duration: Duration(time.Millisecond)})
+	}
+
+	// the slow adjustment is no longer among the recent ones
+	slowest, n := timings.slowest()
+	assert.Equal(t, stepTimingWindow, n)
+	assert.Equal(t, "env", slowest.Step)
+}
+
+func TestHookDuration(t *testing.T) {
+	p := newTestPlugin(nil)
+	_, _, err := p.CreateContainer(context.Background(), &api.PodSandbox{}, newProfileTestContainer(nil))
+	require.NoError(t, err)
+	require.NoError(t, p.RemoveContainer(context.Background(), &api.PodSandbox{}, newProfileTestContainer(nil)))
+
+	count, _ := histogram(t, p.metrics.hookDuration.WithLabelValues("CreateContainer"))
+	assert.Equal(t, uint64(1), count)
+	count, _ = histogram(t, p.metrics.hookDuration.WithLabelValues("RemoveContainer"))
+	assert.Equal(t, uint64(1), count)
+}
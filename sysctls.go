@@ -0,0 +1,269 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	procSysDir = "/proc/sys"
+
+	// sysctlRecordFile, below stateDir, keeps the values of the sysctls
+	// before the plugin raised them.
+	sysctlRecordFile = "sysctls.json"
+)
+
+// SysctlRequirement is the minimum of a host sysctl systemd containers
+// depend on. The required value grows with the number of tracked systemd
+// containers: Min + PerContainer * containers.
+type SysctlRequirement struct {
+	// Name is the sysctl in dotted form, e.g. fs.inotify.max_user_instances.
+	Name         string `json:"name"`
+	Min          int64  `json:"min,omitempty"`
+	PerContainer int64  `json:"perContainer,omitempty"`
+}
+
+// defaultHostSysctls are the sysctls every systemd container uses up. systemd,
+// journald and the other services each take inotify instances and watches
+// of the same host user, and every container runs a few dozen processes.
+var defaultHostSysctls = []SysctlRequirement{
+	{Name: "fs.inotify.max_user_instances", Min: 128, PerContainer: 8},
+	{Name: "fs.inotify.max_user_watches", Min: 8192, PerContainer: 4096},
+	{Name: "kernel.pid_max", Min: 32768, PerContainer: 1024},
+}
+
+func (r SysctlRequirement) validate() error {
+	if r.Name == "" || strings.ContainsAny(r.Name, "/ \t\n") || slices.Contains(strings.Split(r.Name, "."), "") {
+		return fmt.Errorf("invalid hostSysctls name %q", r.Name)
+	}
+	if r.Min < 0 || r.PerContainer < 0 {
+		return fmt.Errorf("invalid hostSysctls entry %s, min and perContainer must not be negative", r.Name)
+	}
+	return nil
+}
+
+// required returns the value required with the given number of containers.
+func (r SysctlRequirement) required(containers int) int64 {
+	return r.Min + r.PerContainer*int64(containers)
+}
+
+// sysctlCheck is the result of checking a host sysctl.
+type sysctlCheck struct {
+	Name     string `json:"name"`
+	Value    int64  `json:"value"`
+	Required int64  `json:"required"`
+	// Raised tells whether the plugin raised the sysctl to the required
+	// value, with manageHostSysctls.
+	Raised bool   `json:"raised,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+func (c sysctlCheck) violated() bool {
+	return c.Error != "" || c.Value < c.Required
+}
+
+func (c sysctlCheck) String() string {
+	if c.Error != "" {
+		return fmt.Sprintf("sysctl %s: %s", c.Name, c.Error)
+	}
+	return fmt.Sprintf("sysctl %s is %d, below the required %d", c.Name, c.Value, c.Required)
+}
+
+// checkSysctls checks the host sysctls against the requirements scaled by
+// the number of tracked systemd containers. With manage, sysctls below
+// their requirement are raised, recording their previous value first so
+// that restoreSysctls can undo it. Sysctls the host does not have are
+// left out.
+func (p *plugin) checkSysctls(ctx context.Context, cfg *Config, manage bool) []sysctlCheck {
+	if p.sysctlFS == "" {
+		return nil
+	}
+
+	containers := len(p.state.list())
+	var checks []sysctlCheck
+	for _, r := range cfg.HostSysctls {
+		c := sysctlCheck{Name: r.Name, Required: r.required(containers)}
+		value, err := p.readSysctl(ctx, r.Name)
+		if errors.Is(err, os.ErrNotExist) {
+			p.hostLog.Debugf("sysctl %s not available on the host, skipping", r.Name)
+			continue
+		}
+		if err != nil {
+			c.Error = err.Error()
+		}
+		c.Value = value
+
+		if err == nil && manage && c.Value < c.Required {
+			if err := p.raiseSysctl(ctx, cfg, r.Name, c.Value, c.Required); err != nil {
+				c.Error = err.Error()
+			} else {
+				p.hostLog.Infof("raised sysctl %s from %d to %d for %d systemd containers", r.Name, c.Value, c.Required, containers)
+				p.metrics.sysctlRaised.Inc()
+				c.Value, c.Raised = c.Required, true
+			}
+		}
+
+		p.metrics.sysctlShortfall.WithLabelValues(r.Name).Set(float64(max(c.Required-c.Value, 0)))
+		checks = append(checks, c)
+	}
+	return checks
+}
+
+// reportSysctls logs the violated host sysctls, if they changed since the
+// last check, so that a node problem is not reported once per container.
+func (p *plugin) reportSysctls(checks []sysctlCheck) {
+	var violations []string
+	for _, c := range checks {
+		if c.violated() {
+			violations = append(violations, c.String())
+		}
+	}
+
+	p.sysctlMu.Lock()
+	defer p.sysctlMu.Unlock()
+	if slices.Equal(violations, p.sysctlViolations) {
+		return
+	}
+	p.sysctlViolations = violations
+	for _, v := range violations {
+		p.hostLog.Warnf("%s, units in systemd containers may fail, e.g. with ENOSPC from inotify_init; "+
+			"raise it on the host or set manageHostSysctls", v)
+	}
+}
+
+func (p *plugin) sysctlPath(name string) string {
+	return filepath.Join(p.sysctlFS, strings.ReplaceAll(name, ".", "/"))
+}
+
+func (p *plugin) readSysctl(ctx context.Context, name string) (int64, error) {
+	data, err := withContext(ctx, func() ([]byte, error) {
+		return os.ReadFile(p.sysctlPath(name))
+	})
+	if err != nil {
+		return 0, err
+	}
+	// e.g. kernel.pid_max holds a single number, only the first one counts
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("sysctl %s is empty", name)
+	}
+	value, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value of sysctl %s: %w", name, err)
+	}
+	return value, nil
+}
+
+func (p *plugin) writeSysctl(ctx context.Context, name string, value int64) error {
+	_, err := withContext(ctx, func() (struct{}, error) {
+		return struct{}{}, os.WriteFile(p.sysctlPath(name), []byte(strconv.FormatInt(value, 10)), 0o644)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write sysctl %s: %w", name, err)
+	}
+	return nil
+}
+
+// raiseSysctl writes the sysctl, after recording its value before the
+// first time the plugin raised it.
+func (p *plugin) raiseSysctl(ctx context.Context, cfg *Config, name string, from, to int64) error {
+	p.sysctlMu.Lock()
+	defer p.sysctlMu.Unlock()
+
+	record, err := readSysctlRecord(cfg)
+	if err != nil {
+		return err
+	}
+	if _, ok := record[name]; !ok {
+		record[name] = from
+		if err := writeSysctlRecord(cfg, record); err != nil {
+			return err
+		}
+	}
+	return p.writeSysctl(ctx, name, to)
+}
+
+// restoreSysctls writes back the values the sysctls had before the plugin
+// raised them, and forgets about them. It returns the restored values.
+func (p *plugin) restoreSysctls(ctx context.Context, cfg *Config) (map[string]int64, error) {
+	p.sysctlMu.Lock()
+	defer p.sysctlMu.Unlock()
+
+	record, err := readSysctlRecord(cfg)
+	if err != nil {
+		return nil, err
+	}
+	restored := map[string]int64{}
+	for name, value := range record {
+		if err := p.writeSysctl(ctx, name, value); err != nil {
+			return restored, err
+		}
+		p.hostLog.Infof("restored sysctl %s to %d", name, value)
+		restored[name] = value
+		delete(record, name)
+		if err := writeSysctlRecord(cfg, record); err != nil {
+			return restored, err
+		}
+	}
+	return restored, nil
+}
+
+func readSysctlRecord(cfg *Config) (map[string]int64, error) {
+	record := map[string]int64{}
+	data, err := os.ReadFile(filepath.Join(cfg.StateDir, sysctlRecordFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return record, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, fmt.Errorf("invalid sysctl record: %w", err)
+	}
+	return record, nil
+}
+
+func writeSysctlRecord(cfg *Config, record map[string]int64) error {
+	file := filepath.Join(cfg.StateDir, sysctlRecordFile)
+	if len(record) == 0 {
+		if err := os.Remove(file); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(cfg.StateDir, 0o755); err != nil {
+		return err
+	}
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
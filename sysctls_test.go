@@ -0,0 +1,138 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/containerd/nri/pkg/api"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSysctlTree creates a /proc/sys tree with the given sysctls.
+func fakeSysctlTree(t *testing.T, dir string, sysctls map[string]string) {
+	t.Helper()
+	for name, value := range sysctls {
+		file := filepath.Join(dir, strings.ReplaceAll(name, ".", "/"))
+		require.NoError(t, os.MkdirAll(filepath.Dir(file), 0o755))
+		require.NoError(t, os.WriteFile(file, []byte(value+"\n"), 0o644))
+	}
+}
+
+func readFakeSysctl(t *testing.T, dir, name string) string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(dir, strings.ReplaceAll(name, ".", "/")))
+	require.NoError(t, err)
+	return strings.TrimSpace(string(data))
+}
+
+func newSysctlTestPlugin(t *testing.T, manage bool) *plugin {
+	t.Helper()
+	p := newTestPlugin(configWith(func(c *Config) {
+		c.StateDir = t.TempDir()
+		c.ManageHostSysctls = manage
+		c.HostSysctls = []SysctlRequirement{
+			{Name: "fs.inotify.max_user_instances", Min: 128, PerContainer: 8},
+			{Name: "kernel.pid_max", Min: 32768},
+			{Name: "fs.missing", Min: 1},
+		}
+	}))
+	p.sysctlFS = t.TempDir()
+	fakeSysctlTree(t, p.sysctlFS, map[string]string{
+		"fs.inotify.max_user_instances": "128",
+		"kernel.pid_max":                "4194304",
+	})
+	return p
+}
+
+func TestCheckSysctls(t *testing.T) {
+	t.Run("scaled by containers", func(t *testing.T) {
+		p := newSysctlTestPlugin(t, false)
+
+		checks := p.checkSysctls(context.Background(), p.config(), false)
+		assert.Equal(t, []sysctlCheck{
+			{Name: "fs.inotify.max_user_instances", Value: 128, Required: 128},
+			{Name: "kernel.pid_max", Value: 4194304, Required: 32768},
+		}, checks)
+
+		for _, id := range []string{"a", "b"} {
+			p.state.add(&containerState{id: id})
+		}
+		checks = p.checkSysctls(context.Background(), p.config(), false)
+		assert.Equal(t, sysctlCheck{Name: "fs.inotify.max_user_instances", Value: 128, Required: 144}, checks[0])
+		assert.True(t, checks[0].violated())
+		assert.Equal(t, 16.0, testutil.ToFloat64(p.metrics.sysctlShortfall.WithLabelValues("fs.inotify.max_user_instances")))
+		assert.Equal(t, 0.0, testutil.ToFloat64(p.metrics.sysctlShortfall.WithLabelValues("kernel.pid_max")))
+		assert.Equal(t, "128", readFakeSysctl(t, p.sysctlFS, "fs.inotify.max_user_instances"))
+	})
+
+	t.Run("invalid value", func(t *testing.T) {
+		p := newSysctlTestPlugin(t, false)
+		fakeSysctlTree(t, p.sysctlFS, map[string]string{"kernel.pid_max": "many"})
+
+		checks := p.checkSysctls(context.Background(), p.config(), false)
+		assert.True(t, checks[1].violated())
+		assert.Contains(t, checks[1].Error, "invalid value of sysctl kernel.pid_max")
+	})
+
+	t.Run("violations logged once", func(t *testing.T) {
+		p := newSysctlTestPlugin(t, false)
+		logs := logtest.NewLocal(p.logs.base)
+		p.state.add(&containerState{id: "a"})
+
+		p.reportSysctls(p.checkSysctls(context.Background(), p.config(), false))
+		p.reportSysctls(p.checkSysctls(context.Background(), p.config(), false))
+		require.Len(t, logs.AllEntries(), 1)
+		assert.Equal(t, logrus.WarnLevel, logs.LastEntry().Level)
+		assert.Contains(t, logs.LastEntry().Message, "sysctl fs.inotify.max_user_instances is 128, below the required 136")
+	})
+}
+
+func TestManageSysctls(t *testing.T) {
+	p := newSysctlTestPlugin(t, true)
+	cfg := p.config()
+
+	p.state.add(&containerState{id: "a"})
+	checks := p.checkSysctls(context.Background(), cfg, true)
+	assert.Equal(t, sysctlCheck{Name: "fs.inotify.max_user_instances", Value: 136, Required: 136, Raised: true}, checks[0])
+	assert.False(t, checks[0].violated())
+	assert.Equal(t, "136", readFakeSysctl(t, p.sysctlFS, "fs.inotify.max_user_instances"))
+	assert.Equal(t, "4194304", readFakeSysctl(t, p.sysctlFS, "kernel.pid_max"))
+
+	// the value before the first raise is kept
+	_, _, err := p.CreateContainer(context.Background(), &api.PodSandbox{}, newProfileTestContainer(nil))
+	require.NoError(t, err)
+	assert.Equal(t, "144", readFakeSysctl(t, p.sysctlFS, "fs.inotify.max_user_instances"))
+	assert.Equal(t, 2.0, testutil.ToFloat64(p.metrics.sysctlRaised))
+	record, err := readSysctlRecord(cfg)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int64{"fs.inotify.max_user_instances": 128}, record)
+
+	restored, err := p.restoreSysctls(context.Background(), cfg)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int64{"fs.inotify.max_user_instances": 128}, restored)
+	assert.Equal(t, "128", readFakeSysctl(t, p.sysctlFS, "fs.inotify.max_user_instances"))
+	assert.NoFileExists(t, filepath.Join(cfg.StateDir, sysctlRecordFile))
+}
@@ -0,0 +1,97 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/containerd/nri/pkg/api"
+)
+
+// runtimeWatchdogAnnotation sets RuntimeWatchdogSec and ShutdownWatchdogSec
+// of systemd, as a systemd time span like "2min". Set on the pod it applies
+// to all containers of the pod without their own annotation.
+const runtimeWatchdogAnnotation = "io.systemd.container/runtime-watchdog"
+
+// runtimeWatchdogDropIn returns the system.conf drop-in selected by the
+// runtime watchdog annotation of the container, nil if there is none.
+func runtimeWatchdogDropIn(pod *api.PodSandbox, container *api.Container) (*dropIn, error) {
+	value, ok := lookupAnnotation(pod, container, runtimeWatchdogAnnotation)
+	if !ok {
+		return nil, nil
+	}
+
+	d, err := parseTimespan(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s annotation %q: %w", runtimeWatchdogAnnotation, value, err)
+	}
+	if d < time.Second || d%time.Second != 0 {
+		return nil, fmt.Errorf("invalid %s annotation %q: must be whole seconds, at least 1s", runtimeWatchdogAnnotation, value)
+	}
+	sec := strconv.FormatInt(int64(d/time.Second), 10) + "s"
+	return &dropIn{
+		dir:     "system.conf.d",
+		name:    "50-runtime-watchdog.conf",
+		content: "[Manager]\nRuntimeWatchdogSec=" + sec + "\nShutdownWatchdogSec=" + sec + "\n",
+		source:  runtimeWatchdogAnnotation,
+	}, nil
+}
+
+var timespanUnits = map[string]time.Duration{
+	"us": time.Microsecond, "usec": time.Microsecond,
+	"ms": time.Millisecond, "msec": time.Millisecond,
+	"": time.Second, "s": time.Second, "sec": time.Second, "second": time.Second, "seconds": time.Second,
+	"m": time.Minute, "min": time.Minute, "minute": time.Minute, "minutes": time.Minute,
+	"h": time.Hour, "hr": time.Hour, "hour": time.Hour, "hours": time.Hour,
+	"d": 24 * time.Hour, "day": 24 * time.Hour, "days": 24 * time.Hour,
+}
+
+var timespanComponent = regexp.MustCompile(`^\s*([0-9]+)\s*([a-z]*)`)
+
+// parseTimespan parses a systemd time span like "2min" or "1min 30s".
+// Numbers without a unit are seconds.
+func parseTimespan(s string) (time.Duration, error) {
+	if strings.TrimSpace(s) == "" {
+		return 0, fmt.Errorf("empty time span")
+	}
+
+	var total time.Duration
+	for rest := s; strings.TrimSpace(rest) != ""; {
+		m := timespanComponent.FindStringSubmatch(rest)
+		if m == nil {
+			return 0, fmt.Errorf("invalid time span")
+		}
+		unit, ok := timespanUnits[m[2]]
+		if !ok {
+			return 0, fmt.Errorf("unknown time unit %q", m[2])
+		}
+		n, err := strconv.ParseInt(m[1], 10, 64)
+		if err != nil || n > int64(365*24*time.Hour/unit) {
+			return 0, fmt.Errorf("time span out of range")
+		}
+		total += time.Duration(n) * unit
+		if total > 365*24*time.Hour {
+			return 0, fmt.Errorf("time span out of range")
+		}
+		rest = rest[len(m[0]):]
+	}
+	return total, nil
+}
@@ -0,0 +1,105 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/containerd/nri/pkg/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTimespan(t *testing.T) {
+	for s, expected := range map[string]time.Duration{
+		"30":          30 * time.Second,
+		"30s":         30 * time.Second,
+		"2min":        2 * time.Minute,
+		"1min 30s":    90 * time.Second,
+		"1h30m":       90 * time.Minute,
+		" 5 minutes ": 5 * time.Minute,
+		"500ms":       500 * time.Millisecond,
+	} {
+		d, err := parseTimespan(s)
+		if assert.NoError(t, err, s) {
+			assert.Equal(t, expected, d, s)
+		}
+	}
+
+	for _, s := range []string{"", "  ", "2 fortnights", "-5s", "1.5s", "s", "2min;reboot", "99999999999999999999s", "400d"} {
+		_, err := parseTimespan(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestRuntimeWatchdog(t *testing.T) {
+	newPlugin := func() *plugin {
+		return newTestPlugin(configWith(func(c *Config) {
+			c.StateDir = t.TempDir()
+		}))
+	}
+
+	t.Run("rendered", func(t *testing.T) {
+		p := newPlugin()
+		pod := &api.PodSandbox{Annotations: map[string]string{runtimeWatchdogAnnotation: "2min"}}
+		container := newProfileTestContainer(nil)
+
+		adjust, _, err := p.CreateContainer(context.Background(), pod, container)
+		require.NoError(t, err)
+
+		dir := filepath.Join(p.config().StateDir, "drop-ins", container.Id)
+		assert.Equal(t, &api.Mount{
+			Destination: "/etc/systemd/system.conf.d",
+			Type:        "bind",
+			Source:      filepath.Join(dir, "system.conf.d"),
+			Options:     []string{"rbind", "ro", "nosuid", "nodev"},
+		}, findMount(adjust.Mounts, "/etc/systemd/system.conf.d"))
+		assert.Equal(t, "cgroup,tmpfs,env,drop-ins", adjust.Annotations[provenanceAnnotation])
+
+		content, err := os.ReadFile(filepath.Join(dir, "system.conf.d", "50-runtime-watchdog.conf"))
+		require.NoError(t, err)
+		assert.Equal(t, "[Manager]\nRuntimeWatchdogSec=120s\nShutdownWatchdogSec=120s\n", string(content))
+
+		require.NoError(t, p.RemoveContainer(context.Background(), pod, container))
+		assert.NoDirExists(t, dir)
+	})
+
+	t.Run("no annotation", func(t *testing.T) {
+		p := newPlugin()
+
+		adjust, _, err := p.CreateContainer(context.Background(), nil, newProfileTestContainer(nil))
+		require.NoError(t, err)
+		assert.Nil(t, findMount(adjust.Mounts, "/etc/systemd/system.conf.d"))
+		assert.NoDirExists(t, filepath.Join(p.config().StateDir, "drop-ins"))
+	})
+
+	for _, value := range []string{"soon", "500ms", "0", "1.5s"} {
+		t.Run("invalid "+value, func(t *testing.T) {
+			p := newPlugin()
+
+			adjust, _, err := p.CreateContainer(context.Background(), nil,
+				newProfileTestContainer(map[string]string{runtimeWatchdogAnnotation: value}))
+			assert.Error(t, err)
+			assert.Nil(t, adjust)
+			assert.NoDirExists(t, filepath.Join(p.config().StateDir, "drop-ins"))
+		})
+	}
+}
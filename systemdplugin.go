@@ -19,10 +19,21 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"sigs.k8s.io/yaml"
@@ -31,155 +42,1462 @@ import (
 	"github.com/containerd/nri/pkg/stub"
 )
 
+type plugin struct {
+	stub     stub.Stub
+	log      *logger
+	cfg      atomic.Pointer[Config]
+	tmpl     atomic.Pointer[adjustmentTemplate]
+	prober   hostProber
+	hostInfo atomic.Pointer[hostInfo]
+	metrics  *metrics
+	queue    *workQueue
+	state    *stateCache
+	conn     *connection
+	actions  *actionRunner
+
+	// cgroupVersion forces the cgroup version of the host, unless auto.
+	cgroupVersion cgroupVersion
+
+	// audit and events, if set, record the adjustment of every systemd
+	// container.
+	audit  *auditLog
+	events *eventWriter
+
+	// debugDump, if set, writes the objects of hooks to files.
+	debugDump *debugDumper
+
+	// kubeEvents, if set, records adjustments and failures as Kubernetes
+	// events on the pods.
+	kubeEvents *kubeEventRecorder
+
+	// dryRun, if set, receives how systemd containers would be adjusted,
+	// while they are left unchanged.
+	dryRun *eventWriter
+
+	// recent keeps the last decisions for the debug API.
+	recent *decisionRing
+
+	// stepTimings keeps the slowest steps of the recent adjustments for the
+	// debug API.
+	stepTimings stepTimings
+
+	// cgroupFS is where the cgroup hierarchy of the host is read and
+	// written, replaced by tests.
+	cgroupFS string
+
+	// sysctlFS is where the sysctls of the host are read and written,
+	// replaced by tests. Host sysctls are not checked if empty.
+	sysctlFS string
+
+	// kernelRelease returns the release of the running kernel, replaced by
+	// tests.
+	kernelRelease func() (string, error)
+	// sysctlMu serializes raising and restoring host sysctls, and guards
+	// sysctlViolations, the violations reported last.
+	sysctlMu         sync.Mutex
+	sysctlViolations []string
+
+	// loginShellMu serializes installing the login-shell helper.
+	loginShellMu sync.Mutex
+
+	// readJournal reads entries of the journal in a directory of the host,
+	// replaced by tests.
+	readJournal func(ctx context.Context, q journalQuery) ([]byte, error)
+
+	// reconnectDelay is the initial delay before reconnecting to the
+	// runtime, doubled on every failed attempt.
+	reconnectDelay time.Duration
+
+	// parseConfig, if set, parses the configuration file over the given
+	// defaults, e.g. those of the runtime the plugin is connected to.
+	parseConfig func(defaults *Config) (*Config, error)
+
+	// runtime is the runtime the plugin is connected to.
+	runtime atomic.Pointer[runtimeInfo]
+
+	// id identifies the plugin instance in logs, metrics and records,
+	// changed under identityMu. identityFields adds it to log entries.
+	id             atomic.Pointer[identity]
+	identityMu     sync.Mutex
+	identityFields *identityHook
+
+	// afterConnect, if set, runs once after the first connection to the
+	// runtime is established, e.g. to drop privileges.
+	afterConnect func() error
+
+	// retainedCaps is the set of capabilities retained once privileges
+	// were dropped with -run-as, nil before.
+	retainedCaps atomic.Pointer[uint64]
+
+	// logs holds the log levels of the modules. log is the logger of the
+	// default module, the others those of the named modules.
+	logs       *loggers
+	detectLog  *logger
+	mountLog   *logger
+	hostLog    *logger
+	stateLog   *logger
+	metricsLog *logger
+}
+
+func newPlugin(cfg *Config) *plugin {
+	p := &plugin{
+		logs:    newLoggers(newLogger()),
+		prober:  hostFS{},
+		metrics: newMetrics(),
+	}
+	p.log = p.logs.get(logDefault)
+	p.detectLog = p.logs.get(logDetect)
+	p.mountLog = p.logs.get(logMounts)
+	p.hostLog = p.logs.get(logHost)
+	p.stateLog = p.logs.get(logState)
+	p.metricsLog = p.logs.get(logMetrics)
+	p.identityFields = &identityHook{}
+	p.logs.base.AddHook(p.identityFields)
+	p.queue = newWorkQueue(cfg.MaxConcurrentAdjustments, p.metrics)
+	p.state = newStateCache()
+	p.conn = newConnection(p.metrics)
+	p.actions = p.newActionRunner()
+	p.recent = newDecisionRing(0)
+	p.cgroupFS = cgroupRoot
+	p.sysctlFS = procSysDir
+	p.kernelRelease = hostKernelRelease
+	p.readJournal = journalctl
+	p.reconnectDelay = minReconnectDelay
+	p.metrics.registry.MustRegister(newContainerCollector(p), newControllerCollector(p))
+	// privileges are not dropped yet, so the configuration is always taken
+	_ = p.setConfig(cfg)
+	return p
+}
+
+// config returns the current configuration. Hooks take a single snapshot
+// and pass it on, so a concurrent reload never changes the configuration
+// in the middle of processing an event.
+func (p *plugin) config() *Config {
+	return p.cfg.Load()
+}
+
+// setConfig makes cfg the current configuration. After dropping
+// privileges, a configuration enabling features which no longer work is
+// rejected.
+func (p *plugin) setConfig(cfg *Config) error {
+	if err := p.checkDroppedPrivileges(cfg); err != nil {
+		return err
+	}
+	levels, _ := parseLogLevels(cfg.LogLevel)
+	p.logs.configure(levels, cfg.Verbose)
+	p.recent.resize(cfg.RecentDecisions)
+	p.tmpl.Store(newAdjustmentTemplate(cfg))
+	p.cfg.Store(cfg)
+	return nil
+}
+
+// CreateContainer adjusts systemd containers. The adjustment only depends
+// on the container, its pod, the configuration and the host, so a
+// redelivered event (e.g. after reconnecting to the runtime) yields the
+// same adjustment again. Per-container state is keyed by container ID and
+// must tolerate being recorded more than once.
+func (p *plugin) CreateContainer(ctx context.Context, pod *api.PodSandbox, container *api.Container) (*api.ContainerAdjustment, []*api.ContainerUpdate, error) {
+	defer p.observeHook("CreateContainer", time.Now())
+	adjust, updates, err := p.createContainer(ctx, pod, container)
+	p.dumpHook("CreateContainer", pod, container, adjust, err)
+	if err == nil {
+		p.conn.eventHandled()
+	}
+	return adjust, updates, err
+}
+
+func (p *plugin) createContainer(ctx context.Context, pod *api.PodSandbox, container *api.Container) (*api.ContainerAdjustment, []*api.ContainerUpdate, error) {
+	cfg := p.config()
+	ctrName := containerName(pod, container)
+
+	if cfg.Verbose {
+		p.dump("CreateContainer", "pod", pod, "container", container)
+	}
+
+	if rule, ok := blockingRule(cfg, pod, container); ok {
+		p.skip(pod, container, ctrName, rule)
+		return nil, nil, nil
+	}
+
+	if key, ok := disabledByPod(cfg, pod); ok {
+		p.detectLog.Debugf("%s: pod has annotation %s, skipping", ctrName, key)
+		p.decide(ctrName, decisionSkipped, "pod has annotation "+key, "")
+		return nil, nil, nil
+	}
+
+	reason, systemd := systemdDetection(cfg, pod, container)
+	if !systemd {
+		why := "not a systemd container"
+		if reason != "" {
+			why += " by " + reason
+		}
+		if share, err := sharesRun(cfg, pod); err != nil || share {
+			return p.adjustSidecar(cfg, pod, container, ctrName, err)
+		}
+		p.detectLog.Debugf("%s: %s, skipping", ctrName, why)
+		p.decide(ctrName, decisionSkipped, why, "")
+		return nil, nil, nil
+	}
+
+	p.warnNonPID1(pod, container, ctrName)
+
+	ctx, cancel := context.WithTimeout(ctx, cfg.HookTimeout.Duration())
+	defer cancel()
+
+	release, err := p.queue.acquire(ctx, container.Id)
+	if err != nil {
+		p.log.Errorf("%s: no free worker within the hook deadline", ctrName)
+		return nil, nil, p.fail(cfg, pod, container, ctrName, fmt.Errorf("waiting for a worker: %w", err))
+	}
+	defer release()
+
+	overridden, container, err := applyConfigAnnotation(cfg, pod, container)
+	if err != nil {
+		p.log.Errorf("%s: %v", ctrName, err)
+		return nil, nil, p.fail(cfg, pod, container, ctrName, err)
+	}
+	cfg = overridden
+
+	prof, err := selectProfile(cfg, pod, container)
+	if err != nil {
+		p.log.Errorf("%s: %v", ctrName, err)
+		return nil, nil, p.fail(cfg, pod, container, ctrName, err)
+	}
+
+	if err := p.checkSystemdVersion(ctx, cfg, pod, container); err != nil {
+		p.log.Errorf("%s: %v", ctrName, err)
+		return nil, nil, p.fail(cfg, pod, container, ctrName, err)
+	}
+
+	adjust := &api.ContainerAdjustment{}
+	var results *mountResults
+	if p.dryRun != nil {
+		results = &mountResults{}
+	}
+	steps := p.checkPodSecurity(cfg, pod, ctrName, p.adjustmentSteps(cfg, pod, container, ctrName, prof, adjust, results))
+	applied, err := p.runSteps(ctx, ctrName, steps)
+	if err != nil {
+		return nil, nil, p.fail(cfg, pod, container, ctrName, err)
+	}
+
+	p.excludeMounts(cfg, adjust, ctrName)
+	results.exclude(cfg)
+	adjust.AddAnnotation(provenanceAnnotation, strings.Join(applied, ","))
+	if cfg.PublishContract {
+		for _, a := range contract(profileName(prof), p.hostInfo.Load()) {
+			adjust.AddAnnotation(a.key, a.value)
+		}
+	}
+
+	if p.dryRun != nil {
+		state := newContainerState(pod, container, ctrName, profileName(prof), p.hostInfo.Load())
+		if err := p.dryRun.write(p.identify(newDryRunEvent(state, reason, adjust, results))); err != nil {
+			p.log.Warnf("%s: failed to write dry-run result: %v", ctrName, err)
+		}
+		p.log.Infof("%s: dry run, leaving the container unchanged", ctrName)
+		p.decide(ctrName, decisionDryRun, reason, strings.Join(applied, ","))
+		return nil, nil, nil
+	}
+
+	// only render the files of steps which were applied
+	var rendered []string
+	for _, s := range steps {
+		r, ok := renderers[s.name]
+		if !ok {
+			continue
+		}
+		if err := r.render(ctx, cfg, pod, container); err != nil {
+			p.log.Errorf("%s: %v", ctrName, err)
+			return nil, nil, p.fail(cfg, pod, container, ctrName, err)
+		}
+		rendered = append(rendered, r.kind)
+	}
+
+	if cfg.OCIPlanDir != "" {
+		if err := writeOCIPlan(cfg.OCIPlanDir, container.Id, adjust); err != nil {
+			if err := p.tolerate(cfg, ctrName, fmt.Errorf("failed to write OCI plan: %w", err)); err != nil {
+				return nil, nil, p.fail(cfg, pod, container, ctrName, err)
+			}
+		}
+	}
+
+	state := newContainerState(pod, container, ctrName, profileName(prof), p.hostInfo.Load())
+	state.rendered = rendered
+	state.cgroupRemounted = remountsCgroup(adjust)
+	state.writableMounts = writableTmpfsMounts(adjust)
+	// the summary of the adjustment is only needed by its consumers
+	if p.audit != nil || p.events != nil || cfg.CrashReports.Enabled {
+		state.adjusted = p.identify(newAdjustedEvent(state, reason, adjust))
+	}
+	p.state.add(state)
+	if cfg.ManageHostSysctls {
+		p.reportSysctls(p.checkSysctls(ctx, cfg, true))
+	}
+
+	if state.adjusted != nil {
+		p.emit(state.adjusted)
+	}
+	p.decide(ctrName, decisionAdjusted, reason, strings.Join(applied, ","))
+	if p.kubeEvents != nil {
+		p.kubeEvent(pod, container, kubeEventNormal, kubeReasonAdjusted,
+			fmt.Sprintf("Adjusted for systemd (detected by %s): %s", reason, strings.Join(applied, ", ")))
+	}
+
+	if cfg.Verbose {
+		p.dump(ctrName, "ContainerAdjustment", adjust)
+	} else {
+		p.log.Infof("%s: systemd support configured", ctrName)
+	}
+
+	return adjust, nil, nil
+}
+
+// provenanceAnnotation is added to adjusted containers, listing the
+// adjustment steps applied to them, e.g. "cgroup,tmpfs,env". Steps with a
+// variant are listed as step=variant, e.g. "default-target=cmdline".
+const provenanceAnnotation = "io.systemd.container/adjusted"
+
+// adjustmentStep is a single step of adjusting a systemd container.
+type adjustmentStep struct {
+	name string
+	fn   func(ctx context.Context) error
+
+	// variant, if set, tells how the step adjusts the container.
+	variant string
+}
+
+// String returns the step as listed in the provenance annotation.
+func (s adjustmentStep) String() string {
+	if s.variant != "" {
+		return s.name + "=" + s.variant
+	}
+	return s.name
+}
+
+// adjustmentSteps returns the steps collecting the adjustments of the
+// container in adjust. Steps which do not apply to the container are left
+// out.
+func (p *plugin) adjustmentSteps(cfg *Config, pod *api.PodSandbox, container *api.Container, ctrName string, prof *profile, adjust *api.ContainerAdjustment, results *mountResults) []adjustmentStep {
+	var steps []adjustmentStep
+
+	writable, writableErr := cgroupWritable(pod, container)
+	switch {
+	case prof != nil && prof.keepCgroupMount:
+		p.mountLog.Debugf("%s: profile %s keeps the cgroup mount of the runtime", ctrName, prof.name)
+		results.add(cgroupRoot, mountSkipped, "profile %s keeps the cgroup mount of the runtime", prof.name)
+	case writableErr == nil && !writable:
+		p.mountLog.Debugf("%s: not remounting the cgroup mount, %s is false", ctrName, cgroupRWAnnotation)
+		results.add(cgroupRoot, mountSkipped, "left to the runtime by %s annotation", cgroupRWAnnotation)
+	default:
+		steps = append(steps, adjustmentStep{name: "cgroup", fn: func(ctx context.Context) error {
+			if writableErr != nil {
+				return writableErr
+			}
+			return p.configureCgroupMount(ctx, cfg, adjust, container, ctrName, results)
+		}})
+	}
+	optional := p.optionalTmpfs(cfg, pod, container, ctrName)
+	if !cfg.RuntimeTmpfs || len(optional) > 0 {
+		steps = append(steps, adjustmentStep{name: "tmpfs", fn: func(context.Context) error {
+			return p.addSystemdTmpfsMounts(cfg, adjust, container, ctrName, optional, results)
+		}})
+	} else {
+		for _, m := range cfg.systemdTmpfsMounts() {
+			if !m.optional {
+				results.add(m.dest, mountSkipped, "left to the runtime (runtimeTmpfs)")
+			}
+		}
+	}
+	if share, err := sharesRun(cfg, pod); err != nil || share {
+		steps = append(steps, adjustmentStep{name: "shared-run", fn: func(context.Context) error {
+			if err != nil {
+				return err
+			}
+			return p.addSharedRun(cfg, pod, container, ctrName, adjust, results)
+		}})
+	}
+	steps = append(steps, adjustmentStep{name: "env", fn: func(context.Context) error {
+		setSystemdEnvironment(p.template(cfg), adjust, pod, container, p.pinnedUUID(cfg, pod, container, ctrName))
+		return nil
+	}})
+	if cfg.MachineID.fresh() {
+		steps = append(steps, adjustmentStep{name: "machine-id", variant: string(cfg.MachineID), fn: func(context.Context) error {
+			return p.addMachineIDMount(cfg, adjust, container, ctrName)
+		}})
+	}
+	if prof != nil {
+		steps = append(steps, adjustmentStep{name: "profile", variant: prof.name, fn: func(context.Context) error {
+			return p.applyProfile(cfg, prof, adjust, container, ctrName)
+		}})
+	}
+
+	target, err := selectBootTarget(cfg, pod, container)
+	if hasUnitAnnotations(pod, container) || (target != nil && target.mechanism == targetSymlink) {
+		steps = append(steps, adjustmentStep{name: "units", fn: func(context.Context) error {
+			return p.addUnitsMount(cfg, adjust, pod, container, ctrName)
+		}})
+	}
+	if hasDropInAnnotations(pod, container) {
+		steps = append(steps, adjustmentStep{name: "drop-ins", fn: func(context.Context) error {
+			return p.addDropInsMount(cfg, adjust, pod, container, ctrName)
+		}})
+	}
+	if want, err := wantsHostModules(pod, container); err != nil || want {
+		steps = append(steps, adjustmentStep{name: "host-modules", fn: func(ctx context.Context) error {
+			if err != nil {
+				return err
+			}
+			return p.addHostModulesMount(ctx, cfg, adjust, container, ctrName)
+		}})
+	}
+	if want, err := wantsHostDBus(pod, container); err != nil || want {
+		steps = append(steps, adjustmentStep{name: "host-dbus", fn: func(ctx context.Context) error {
+			if err != nil {
+				return err
+			}
+			return p.addHostDBusMount(ctx, cfg, adjust, container, ctrName)
+		}})
+	}
+	if cfg.LoginShell.Enabled {
+		steps = append(steps, adjustmentStep{name: "login-shell", fn: func(context.Context) error {
+			return p.addLoginShellMount(cfg, adjust, container, ctrName, results)
+		}})
+	}
+	if err != nil || target != nil {
+		step := adjustmentStep{name: "default-target", fn: func(context.Context) error {
+			if err != nil {
+				return err
+			}
+			if target.mechanism == targetCmdline {
+				adjust.AddEnv(procCmdlineEnv, "systemd.unit="+target.name)
+			}
+			p.mountLog.Debugf("%s: booting into %s (%s)", ctrName, target.name, target.mechanism)
+			return nil
+		}}
+		if target != nil {
+			step.variant = target.mechanism
+		}
+		steps = append(steps, step)
+	}
+
+	return p.skipAnnotated(cfg, pod, container, ctrName, steps, results)
+}
+
+// skipAnnotation lists adjustment steps to leave out for a container, e.g.
+// "env,cgroup", keeping for example its own environment untouched while it
+// still gets the rest. Set on the pod it applies to all containers of the
+// pod without their own annotation.
+const skipAnnotation = "io.systemd.container/skip"
+
+// adjustmentStepNames are the names of all adjustment steps, in the order
+// they are applied.
+var adjustmentStepNames = []string{"cgroup", "tmpfs", "shared-run", "env", "machine-id", "profile", "units", "drop-ins", "host-modules", "host-dbus", "login-shell", "default-target"}
+
+// skipAnnotated leaves out the steps listed in the skip annotation of the
+// container. Unknown step names are warned about and ignored.
+func (p *plugin) skipAnnotated(cfg *Config, pod *api.PodSandbox, container *api.Container, ctrName string, steps []adjustmentStep, results *mountResults) []adjustmentStep {
+	value, ok := lookupAnnotation(pod, container, skipAnnotation)
+	if !ok {
+		return steps
+	}
+
+	skip := map[string]bool{}
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !slices.Contains(adjustmentStepNames, name) {
+			p.mountLog.Warnf("%s: ignoring unknown step %q in %s annotation, must be one of %s",
+				ctrName, name, skipAnnotation, strings.Join(adjustmentStepNames, ", "))
+			continue
+		}
+		skip[name] = true
+	}
+
+	var kept []adjustmentStep
+	for _, s := range steps {
+		if !skip[s.name] {
+			kept = append(kept, s)
+			continue
+		}
+		p.mountLog.Debugf("%s: skipping %s, listed in %s annotation", ctrName, s.name, skipAnnotation)
+		switch s.name {
+		case "cgroup":
+			results.add(cgroupRoot, mountSkipped, "skipped by %s annotation", skipAnnotation)
+		case "tmpfs":
+			for _, m := range cfg.systemdTmpfsMounts() {
+				if !m.optional {
+					results.add(m.dest, mountSkipped, "skipped by %s annotation", skipAnnotation)
+				}
+			}
+		}
+	}
+	return kept
+}
+
+// runStep runs a single adjustment step and records its duration. If the
+// hook deadline expires while the step is running, the step is named in
+// the log and in the returned error.
+func (p *plugin) runStep(ctx context.Context, ctrName, step string, fn func(context.Context) error) error {
+	start := time.Now()
+	err := fn(ctx)
+	elapsed := time.Since(start)
+
+	p.metrics.stepDuration.WithLabelValues(step).Observe(elapsed.Seconds())
+
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		p.metrics.stepFailures.WithLabelValues(step, errorClass(err)).Inc()
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		p.metrics.deadlineExceeded.WithLabelValues(step).Inc()
+		p.log.Errorf("%s: step %s exceeded the hook deadline after %v", ctrName, step,
+			elapsed.Round(time.Millisecond))
+		return fmt.Errorf("step %s: %w", step, err)
+	}
+
+	return err
+}
+
+// fail applies the failure policy to an error from processing a container.
+// Without an explicit policy, problems with the container spec fail closed
+// while an expired hook deadline (typically a hung host filesystem) fails
+// open, since the runtime would otherwise stall on every container.
+func (p *plugin) fail(cfg *Config, pod *api.PodSandbox, container *api.Container, ctrName string, err error) error {
+	policy := cfg.FailurePolicy
+	if policy == "" {
+		policy = FailClosed
+		if errors.Is(err, context.DeadlineExceeded) {
+			policy = FailOpen
+		}
+	}
+
+	if policy == FailOpen {
+		p.log.Errorf("%s: %v - creating container without systemd support", ctrName, err)
+		p.decide(ctrName, decisionFailed, err.Error(), "created without systemd support")
+		p.kubeEvent(pod, container, kubeEventWarning, kubeReasonFailed, err.Error()+", created without systemd support")
+		return nil
+	}
+
+	p.decide(ctrName, decisionFailed, err.Error(), "container creation failed")
+	p.kubeEvent(pod, container, kubeEventWarning, kubeReasonFailed, err.Error()+", container creation failed")
+	return err
+}
+
+// tolerate handles a problem which does not keep the plugin from adjusting
+// a systemd container, but likely keeps systemd from booting, like a
+// read-only tmpfs mount left in place. By default it is logged and the
+// container is adjusted anyway. With failurePolicy closed, it is returned
+// as the failure of the container.
+func (p *plugin) tolerate(cfg *Config, ctrName string, err error) error {
+	if cfg.FailurePolicy == FailClosed {
+		p.log.Errorf("%s: %v", ctrName, err)
+		return err
+	}
+	p.log.Warnf("%s: %v", ctrName, err)
+	return nil
+}
+
+// hostProber answers questions about the host the plugin runs on. It is
+// an interface so tests do not depend on the layout of the test host.
+// Probes give up once their context is done.
+type hostProber interface {
+	Stat(ctx context.Context, path string) (os.FileInfo, error)
+	EvalSymlinks(ctx context.Context, path string) (string, error)
+}
+
+type hostFS struct{}
+
+// Stat runs os.Stat with the given context.
+func (hostFS) Stat(ctx context.Context, path string) (os.FileInfo, error) {
+	return withContext(ctx, func() (os.FileInfo, error) {
+		return os.Stat(path)
+	})
+}
+
+// EvalSymlinks runs filepath.EvalSymlinks with the given context.
+func (hostFS) EvalSymlinks(ctx context.Context, path string) (string, error) {
+	return withContext(ctx, func() (string, error) {
+		return filepath.EvalSymlinks(path)
+	})
+}
+
+// withContext runs a filesystem operation with the given context. An
+// operation on a hung filesystem cannot be interrupted, so it is left
+// running in the background.
+func withContext[T any](ctx context.Context, fn func() (T, error)) (T, error) {
+	type result struct {
+		v   T
+		err error
+	}
+
+	ch := make(chan result, 1)
+	go func() {
+		v, err := fn()
+		ch <- result{v, err}
+	}()
+
+	select {
+	case r := <-ch:
+		return r.v, r.err
+	case <-ctx.Done():
+		var zero T
+		return zero, ctx.Err()
+	}
+}
+
+// systemdInitPaths are the entrypoints of systemd containers, besides the
+// initPaths of the configuration.
+var systemdInitPaths = []string{"/sbin/init", "/usr/sbin/init", "/lib/systemd/systemd", "/usr/lib/systemd/systemd"}
+
+// systemdInitNames are the base names of systemd entrypoints matched in
+// any directory with matchBasename, or given relative to the working
+// directory or PATH, like /usr/bin/systemd or init. The binary is in the
+// rootfs of the container, so symlinks like /sbin/init to systemd cannot
+// be resolved, and the name is all there is to go by.
+var systemdInitNames = []string{"init", "systemd"}
+
+// isInitPath tells whether the path is the entrypoint of a systemd
+// container: one of systemdInitPaths or the configured initPaths, or, with
+// matchBasename, any path with one of systemdInitNames or the base name of
+// a configured init path.
+func isInitPath(cfg *Config, file string) bool {
+	if slices.Contains(systemdInitPaths, file) || slices.Contains(cfg.Detection.InitPaths, file) {
+		return true
+	}
+	if !cfg.Detection.MatchBasename {
+		return false
+	}
+	base := path.Base(file)
+	if slices.Contains(systemdInitNames, base) {
+		return true
+	}
+	for _, p := range cfg.Detection.InitPaths {
+		if path.Base(p) == base {
+			return true
+		}
+	}
+	return false
+}
+
+// Reasons for detecting a systemd container, reported in events.
+const (
+	detectedAnnotation = "annotation"
+	detectedEntrypoint = "entrypoint"
+	detectedShellExec  = "shell-exec"
+)
+
+// systemdAnnotation marks a container as a systemd container ("true") or
+// not ("false"), whatever its entrypoint. Set on the pod it applies to all
+// containers of the pod without their own annotation.
+const systemdAnnotation = "io.systemd.container"
+
+// systemdAnnotationAliases are annotations other tools mark systemd
+// containers with. Only "true" counts, they never rule out systemd.
+var systemdAnnotationAliases = []string{"io.kubernetes.cri-o.systemd-cgroup", "com.microsoft.lcow.systemd"}
+
+// annotatedSystemdContainer tells whether the annotations of the container
+// or, if they do not tell, those of its pod mark a systemd container.
+func annotatedSystemdContainer(pod *api.PodSandbox, container *api.Container) (systemd, decided bool) {
+	if systemd, decided := annotatedSystemd(container.Annotations); decided || pod == nil {
+		return systemd, decided
+	}
+	return annotatedSystemd(pod.Annotations)
+}
+
+// annotatedSystemd tells whether the annotations mark a systemd container,
+// with decided false if they do not tell.
+func annotatedSystemd(annotations map[string]string) (systemd, decided bool) {
+	if value, ok := annotations[systemdAnnotation]; ok {
+		if systemd, err := strconv.ParseBool(value); err == nil {
+			return systemd, true
+		}
+	}
+	for _, key := range systemdAnnotationAliases {
+		if annotations[key] == "true" {
+			return true, true
+		}
+	}
+	return false, false
+}
+
+func isSystemdContainer(cfg *Config, pod *api.PodSandbox, container *api.Container) bool {
+	_, ok := systemdDetection(cfg, pod, container)
+	return ok
+}
+
+// systemdDetector detects systemd containers.
+type systemdDetector struct {
+	// reason is reported in events for containers detected by the
+	// detector.
+	reason  string
+	enabled func(cfg *Config) bool
+	// detect tells whether the container is a systemd container, with
+	// decided false if the detector has no say about it.
+	detect func(cfg *Config, pod *api.PodSandbox, container *api.Container) (systemd, decided bool)
+}
+
+// matchArgs detects systemd containers with a positive match of their
+// arguments. It never decides that a container is none.
+func matchArgs(match func(cfg *Config, args []string) bool) func(*Config, *api.PodSandbox, *api.Container) (bool, bool) {
+	return func(cfg *Config, _ *api.PodSandbox, container *api.Container) (bool, bool) {
+		if len(container.Args) == 0 || !match(cfg, container.Args) {
+			return false, false
+		}
+		return true, true
+	}
+}
+
+// systemdDetectors are tried in the detectionOrder of the configuration,
+// the first one to decide wins. Their order here is the default.
+var systemdDetectors = []systemdDetector{
+	{
+		reason:  detectedAnnotation,
+		enabled: func(*Config) bool { return true },
+		detect: func(_ *Config, pod *api.PodSandbox, container *api.Container) (bool, bool) {
+			return annotatedSystemdContainer(pod, container)
+		},
+	},
+	{
+		reason:  detectedEntrypoint,
+		enabled: func(*Config) bool { return true },
+		detect: matchArgs(func(cfg *Config, args []string) bool {
+			return isInitPath(cfg, args[0])
+		}),
+	},
+	{
+		reason:  detectedShellExec,
+		enabled: func(cfg *Config) bool { return cfg.Detection.ShellExec },
+		detect:  matchArgs(isShellExecSystemd),
+	},
+}
+
+// orderedDetectors returns the detectors in the detectionOrder of the
+// configuration, followed by those it does not list in their default
+// order.
+func orderedDetectors(cfg *Config) []systemdDetector {
+	if len(cfg.Detection.Order) == 0 {
+		return systemdDetectors
+	}
+	detectors := make([]systemdDetector, 0, len(systemdDetectors))
+	for _, name := range cfg.Detection.Order {
+		for _, d := range systemdDetectors {
+			if d.reason == name {
+				detectors = append(detectors, d)
+			}
+		}
+	}
+	for _, d := range systemdDetectors {
+		if !slices.Contains(cfg.Detection.Order, d.reason) {
+			detectors = append(detectors, d)
+		}
+	}
+	return detectors
+}
+
+// systemdDetection tells whether the container is a systemd container, and
+// which detector decided it, empty if none did.
+func systemdDetection(cfg *Config, pod *api.PodSandbox, container *api.Container) (string, bool) {
+	for _, d := range orderedDetectors(cfg) {
+		if !d.enabled(cfg) {
+			continue
+		}
+		if systemd, decided := d.detect(cfg, pod, container); decided {
+			return d.reason, systemd
+		}
+	}
+	return "", false
+}
+
+// disabledByPod returns the annotation disabling the plugin for the pod,
+// if it has one of the configured disableAnnotations.
+func disabledByPod(cfg *Config, pod *api.PodSandbox) (string, bool) {
+	if pod == nil {
+		return "", false
+	}
+	for _, key := range cfg.DisableAnnotations {
+		if _, ok := pod.Annotations[key]; ok {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+// ephemeralAnnotation marks an ephemeral container, when set to "true".
+// Kubernetes does not tell ephemeral containers apart in the CRI, so the
+// marker is set by whatever launches them, e.g. an admission webhook, and
+// other markers are configured with ephemeralAnnotations.
+const ephemeralAnnotation = "io.systemd.container/ephemeral"
+
+// ephemeralMarker returns the annotation marking the container as
+// ephemeral, if it has one of the configured ephemeralAnnotations set to
+// true. Pod annotations do not count, ephemeral containers join pods with
+// other containers.
+func ephemeralMarker(cfg *Config, container *api.Container) (string, bool) {
+	for _, key := range cfg.EphemeralAnnotations {
+		value, ok := container.Annotations[key]
+		if !ok {
+			continue
+		}
+		if ephemeral, err := strconv.ParseBool(value); err == nil && ephemeral {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+// lookupAnnotation returns the annotation of the container, or of its pod
+// if the container does not set it.
+func lookupAnnotation(pod *api.PodSandbox, container *api.Container, key string) (string, bool) {
+	if value, ok := container.Annotations[key]; ok {
+		return value, true
+	}
+	if pod != nil {
+		if value, ok := pod.Annotations[key]; ok {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// pid1Annotation tells whether the entrypoint of a container becomes PID 1,
+// overriding the detection from its pid namespace. Set on the pod it
+// applies to all containers of the pod without their own annotation.
+const pid1Annotation = "io.systemd.container/pid1"
+
+// runsAsPID1 tells whether the entrypoint of the container becomes PID 1
+// of its pid namespace. It does not if the container joins the pid
+// namespace of the pod (shareProcessNamespace) or the host (hostPID).
+func runsAsPID1(pod *api.PodSandbox, container *api.Container) (bool, error) {
+	if value, ok := lookupAnnotation(pod, container, pid1Annotation); ok {
+		pid1, err := strconv.ParseBool(value)
+		if err != nil {
+			return false, fmt.Errorf("invalid %s annotation %q", pid1Annotation, value)
+		}
+		return pid1, nil
+	}
+
+	// without namespace information there is nothing to go by
+	if container.Linux == nil || len(container.Linux.Namespaces) == 0 {
+		return true, nil
+	}
+	for _, ns := range container.Linux.Namespaces {
+		if ns.Type == "pid" {
+			return ns.Path == "", nil
+		}
+	}
+	return false, nil
+}
+
+// warnNonPID1 warns about systemd containers in which systemd will not run
+// as PID 1. With skipNonPid1, they are skipped by blockingRule instead.
+func (p *plugin) warnNonPID1(pod *api.PodSandbox, container *api.Container, ctrName string) {
+	pid1, err := runsAsPID1(pod, container)
+	if err != nil {
+		p.detectLog.Warnf("%s: %v, assuming systemd runs as PID 1", ctrName, err)
+		return
+	}
+	if !pid1 {
+		p.detectLog.Warnf("%s: systemd does not run as PID 1 and will likely not boot", ctrName)
+	}
+}
+
 var (
-	log     *logrus.Logger
-	verbose bool
+	shells = []string{"sh", "bash", "dash", "ash", "zsh"}
+
+	// shellExec matches a shell command replacing the shell with another
+	// program, e.g. "setup && exec /lib/systemd/systemd --unit=x".
+	shellExec = regexp.MustCompile(`(^|[\s;&|(])exec\s+([^\s;&|)]+)`)
 )
 
-type plugin struct {
-	stub stub.Stub
-}
+// isShellExecSystemd tells whether a shell runs a command ending with an
+// exec of systemd. Only exec counts, since otherwise the shell stays PID 1.
+func isShellExecSystemd(cfg *Config, args []string) bool {
+	if !slices.Contains(shells, path.Base(args[0])) {
+		return false
+	}
+	for _, m := range shellExec.FindAllStringSubmatch(strings.Join(args[1:], " "), -1) {
+		if isInitPath(cfg, m[2]) {
+			return true
+		}
+	}
+	return false
+}
+
+// sharesCgroupNamespace tells whether the container does not get a private
+// cgroup namespace, but stays in the one of the host or joins another one.
+// There, a writable cgroup mount exposes the cgroup hierarchy of the host.
+// Runtimes only create private cgroup namespaces by default on cgroup v2,
+// so a spec without one is only taken as shared there; on cgroup v1 it is
+// the default, which systemd containers have always booted with.
+func sharesCgroupNamespace(mode cgroupMode, container *api.Container) bool {
+	// without namespace information there is nothing to go by
+	if container.Linux == nil || len(container.Linux.Namespaces) == 0 {
+		return false
+	}
+	for _, ns := range container.Linux.Namespaces {
+		if ns.Type == "cgroup" {
+			return ns.Path != ""
+		}
+	}
+	return mode == cgroupV2
+}
+
+// cgroupRWAnnotation, set to "false", leaves the cgroup mount of the
+// container as the runtime made it, e.g. read-only for systemd versions
+// which boot without a writable cgroup mount in a private cgroup namespace.
+// "true" keeps the default, e.g. on a container of a pod annotated with
+// "false". Set on the pod it applies to all containers of the pod without
+// their own annotation.
+const cgroupRWAnnotation = "io.systemd.container/cgroup-rw"
+
+// cgroupWritable tells whether the cgroup mount of the container is to be
+// made writable.
+func cgroupWritable(pod *api.PodSandbox, container *api.Container) (bool, error) {
+	value, ok := lookupAnnotation(pod, container, cgroupRWAnnotation)
+	if !ok {
+		return true, nil
+	}
+	writable, err := strconv.ParseBool(value)
+	if err != nil {
+		return true, fmt.Errorf("invalid %s annotation %q: %w", cgroupRWAnnotation, value, err)
+	}
+	return writable, nil
+}
+
+func (p *plugin) configureCgroupMount(ctx context.Context, cfg *Config, adjust *api.ContainerAdjustment, container *api.Container, ctrName string, results *mountResults) error {
+	host, err := p.host(ctx)
+	if err != nil {
+		return err
+	}
+	if !host.CgroupRoot {
+		if err := p.tolerate(cfg, ctrName, errors.New("cgroup filesystem not available at /sys/fs/cgroup - skipping systemd support")); err != nil {
+			return err
+		}
+		results.add(cgroupRoot, mountSkipped, "cgroup filesystem not available on the host")
+		return nil
+	}
+
+	existingMount, err := p.findCgroupMount(ctx, cfg, container, ctrName)
+	if err != nil {
+		return err
+	}
+	if existingMount == nil && len(container.Mounts) == 0 && cfg.DeferCgroupWithoutMounts {
+		p.mountLog.Warnf("%s: no mounts in the spec, leaving the cgroup mount to the runtime", ctrName)
+		results.add(cgroupRoot, mountSkipped, "no mounts in the spec, left to the runtime (deferCgroupWithoutMounts)")
+		return nil
+	}
+	sharedNamespace := sharesCgroupNamespace(host.CgroupMode, container) && !cfg.RemountSharedCgroupNamespace
+	if existingMount == nil {
+		if !cfg.AddMissingCgroupMount {
+			p.mountLog.Errorf("%s: no existing cgroup mount found - systemd requires /sys/fs/cgroup", ctrName)
+			return fmt.Errorf("cgroup mount required for systemd container")
+		}
+		mount := missingCgroupMount(host.CgroupMode, sharedNamespace)
+		adjust.AddMount(mount)
+		p.mountLog.Warnf("%s: no cgroup mount in the spec, adding a %s mount for the cgroup %v host", ctrName, mount.Type, host.CgroupMode)
+		results.add(cgroupRoot, mountAdded, "missing from the spec, added for the cgroup %v host", host.CgroupMode)
+		return p.addSystemdHierarchy(ctx, cfg, host, adjust, container, ctrName, results, sharedNamespace)
+	}
+
+	mount := &api.Mount{
+		Destination: existingMount.Destination,
+		Type:        existingMount.Type,
+		Source:      existingMount.Source,
+		Options:     append([]string(nil), existingMount.Options...),
+	}
+	var changes, notes []string
 
-func (p *plugin) CreateContainer(_ context.Context, pod *api.PodSandbox, container *api.Container) (*api.ContainerAdjustment, []*api.ContainerUpdate, error) {
-	ctrName := containerName(pod, container)
+	if mismatch := cgroupMountMismatch(host.CgroupMode, existingMount); mismatch != "" {
+		if cfg.CorrectCgroupMountType {
+			correctCgroupMount(host.CgroupMode, mount)
+			changes = append(changes, mismatch+", corrected for the host")
+			p.mountLog.Warnf("%s: %s, correcting it for the cgroup %v host", ctrName, mismatch, host.CgroupMode)
+		} else {
+			if err := p.tolerate(cfg, ctrName, fmt.Errorf("%s, but the host has cgroup %v - systemd will likely fail to boot", mismatch, host.CgroupMode)); err != nil {
+				return err
+			}
+			notes = append(notes, mismatch+", not corrected")
+		}
+	}
 
-	if verbose {
-		dump("CreateContainer", "pod", pod, "container", container)
+	if isReadOnlyMount(mount) && sharedNamespace {
+		p.mountLog.Warnf("%s: not making the cgroup mount writable, the container shares the cgroup namespace of the host "+
+			"or another container, systemd will likely fail to boot; give it a private cgroup namespace or set remountSharedCgroupNamespace", ctrName)
+		notes = append(notes, "read-only, not made writable in a shared cgroup namespace")
+	} else if isReadOnlyMount(mount) && host.CgroupMode == cgroupV1 {
+		// the tmpfs holding the v1 hierarchies and the controller mounts
+		// below it stay read-only, systemd only writes to its named
+		// hierarchy, which is made writable below
+		p.mountLog.Debugf("%s: leaving the cgroup mount read-only on cgroup v1", ctrName)
+		notes = append(notes, "only the name=systemd hierarchy needs to be writable on cgroup v1")
+	} else if isReadOnlyMount(mount) {
+		for i, opt := range mount.Options {
+			if opt == "ro" {
+				mount.Options[i] = "rw"
+			}
+		}
+		changes = append(changes, "read-only, made writable")
+		p.mountLog.Debugf("%s: changed cgroup mount from ro to rw", ctrName)
+	} else {
+		p.mountLog.Debugf("%s: cgroup mount already has rw, skipping", ctrName)
 	}
 
-	if !isSystemdContainer(container) {
-		if verbose {
-			log.Infof("%s: not a systemd container, skipping", ctrName)
+	if len(changes) > 0 {
+		switch cfg.CgroupRemount {
+		case CgroupRemountFail:
+			p.mountLog.Errorf("%s: cgroup mount needs to be changed (%s), but cgroupRemount is %s",
+				ctrName, strings.Join(changes, "; "), CgroupRemountFail)
+			return fmt.Errorf("cgroup mount needs to be changed (%s), which the runtime does not support (cgroupRemount: %s)",
+				strings.Join(changes, "; "), CgroupRemountFail)
+		case CgroupRemountAdd:
+			changes = append(changes, "added over the runtime's mount (cgroupRemount: add)")
+		default:
+			adjust.RemoveMount(existingMount.Destination)
 		}
-		return nil, nil, nil
+		adjust.AddMount(mount)
+		results.add(mount.Destination, mountModified, "%s", strings.Join(append(changes, notes...), "; "))
+	} else {
+		reason := "already writable"
+		if isReadOnlyMount(mount) {
+			reason = "left read-only"
+		}
+		results.add(mount.Destination, mountSkipped, "%s", strings.Join(append([]string{reason}, notes...), "; "))
+	}
+	return p.addSystemdHierarchy(ctx, cfg, host, adjust, container, ctrName, results, sharedNamespace)
+}
+
+// addSystemdHierarchy adds the name=systemd hierarchy below the cgroup
+// mount on cgroup v1 hosts, unless the container shares its cgroup
+// namespace.
+func (p *plugin) addSystemdHierarchy(ctx context.Context, cfg *Config, host *hostInfo, adjust *api.ContainerAdjustment,
+	container *api.Container, ctrName string, results *mountResults, sharedNamespace bool) error {
+	if sharedNamespace {
+		if host.CgroupMode == cgroupV1 {
+			p.mountLog.Warnf("%s: not adding the %s mount in a shared cgroup namespace", ctrName, systemdCgroupDir)
+			results.add(systemdCgroupDir, mountSkipped, "shared cgroup namespace")
+		}
+		return nil
 	}
+	return p.addSystemdCgroupMount(ctx, cfg, adjust, container, ctrName, results)
+}
 
-	adjust := &api.ContainerAdjustment{}
+// v1CgroupOptions select cgroup v1 hierarchies. cgroup2 rejects them.
+var v1CgroupOptions = []string{
+	"none", "blkio", "cpu", "cpuacct", "cpuset", "devices", "freezer", "hugetlb",
+	"memory", "misc", "net_cls", "net_prio", "perf_event", "pids", "rdma",
+}
+
+func isV1CgroupOption(opt string) bool {
+	return strings.HasPrefix(opt, "name=") || slices.Contains(v1CgroupOptions, opt)
+}
 
-	if err := configureCgroupMount(adjust, container, ctrName); err != nil {
-		return nil, nil, err
+// cgroupMountMismatch describes why the cgroup mount is for the other
+// cgroup version than the host's, or returns an empty string if it is not.
+// A plain cgroup mount is not a mismatch on cgroup v2 hosts: runtimes put
+// it in every spec, and runc and crun mount cgroup2 for it there.
+func cgroupMountMismatch(mode cgroupMode, mount *api.Mount) string {
+	switch mode {
+	case cgroupV1:
+		if mount.Type == "cgroup2" {
+			return "cgroup mount has type cgroup2"
+		}
+	case cgroupV2:
+		if mount.Type == "cgroup" && slices.ContainsFunc(mount.Options, isV1CgroupOption) {
+			return "cgroup mount selects cgroup v1 hierarchies"
+		}
 	}
+	return ""
+}
 
-	addSystemdTmpfsMounts(adjust, container)
+// correctCgroupMount makes the cgroup mount match the cgroup version of
+// the host.
+func correctCgroupMount(mode cgroupMode, mount *api.Mount) {
+	switch mode {
+	case cgroupV1:
+		mount.Type = "cgroup"
+		if mount.Source == "cgroup2" {
+			mount.Source = "cgroup"
+		}
+	case cgroupV2:
+		mount.Type = "cgroup2"
+		if mount.Source == "cgroup" {
+			mount.Source = "cgroup2"
+		}
+		mount.Options = slices.DeleteFunc(mount.Options, isV1CgroupOption)
+	}
+}
 
-	setSystemdEnvironment(adjust, pod, container)
+// missingCgroupMount returns the cgroup mount added for a container without
+// one, like runc mounts it: cgroup2 on cgroup v2 hosts, and a tmpfs for the
+// v1 hierarchies on cgroup v1 hosts, below which only the name=systemd
+// hierarchy is added. The tmpfs stays writable, as the mount point of the
+// hierarchy is created in it. In a shared cgroup namespace the mount is
+// read-only.
+func missingCgroupMount(mode cgroupMode, readOnly bool) *api.Mount {
+	access := "rw"
+	if readOnly {
+		access = "ro"
+	}
+	if mode == cgroupV1 {
+		return &api.Mount{
+			Destination: cgroupRoot,
+			Type:        "tmpfs",
+			Source:      "tmpfs",
+			Options:     []string{access, "nosuid", "noexec", "nodev", "mode=755"},
+		}
+	}
+	return &api.Mount{
+		Destination: cgroupRoot,
+		Type:        "cgroup2",
+		Source:      "cgroup2",
+		Options:     []string{access, "nosuid", "noexec", "nodev"},
+	}
+}
 
-	if verbose {
-		dump(ctrName, "ContainerAdjustment", adjust)
-	} else {
-		log.Infof("%s: systemd support configured", ctrName)
+// findCgroupMount returns the cgroup mount of the container. Unless symlinks
+// are resolved, only a mount at exactly /sys/fs/cgroup counts.
+func (p *plugin) findCgroupMount(ctx context.Context, cfg *Config, container *api.Container, ctrName string) (*api.Mount, error) {
+	for _, mount := range container.Mounts {
+		if mount.Destination == cgroupRoot {
+			return mount, nil
+		}
 	}
 
-	return adjust, nil, nil
+	if !cfg.ResolveCgroupMountSymlinks {
+		return nil, nil
+	}
+
+	root, err := p.prober.EvalSymlinks(ctx, cgroupRoot)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s: %w", cgroupRoot, err)
+	}
+	for _, mount := range container.Mounts {
+		dest, err := p.prober.EvalSymlinks(ctx, mount.Destination)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			continue
+		}
+		if dest == root {
+			p.mountLog.Debugf("%s: using cgroup mount at %s, resolving to %s", ctrName, mount.Destination, root)
+			return mount, nil
+		}
+	}
+
+	return nil, nil
 }
 
-func isSystemdContainer(container *api.Container) bool {
-	if len(container.Args) == 0 {
-		return false
+// excludeMounts drops all mount adjustments at destinations excluded by
+// the configuration, whichever step produced them.
+func (p *plugin) excludeMounts(cfg *Config, adjust *api.ContainerAdjustment, ctrName string) {
+	if len(cfg.ExcludeMounts) == 0 {
+		return
 	}
 
-	cmd := container.Args[0]
-	switch cmd {
-	case "/sbin/init", "/lib/systemd/systemd", "/usr/lib/systemd/systemd":
-		return true
+	mounts := adjust.Mounts[:0]
+	for _, m := range adjust.Mounts {
+		dest, _ := api.IsMarkedForRemoval(m.Destination)
+		if pattern, ok := cfg.excludedMount(dest); ok {
+			p.mountLog.Debugf("%s: not touching excluded mount %s (%s)", ctrName, dest, pattern)
+			continue
+		}
+		mounts = append(mounts, m)
 	}
+	adjust.Mounts = mounts
+}
 
-	// TODO: Add annotation-based detection for explicit systemd container marking
-	// Example annotations to support in the future:
-	// - "io.systemd.container": "true"
-	// - "io.kubernetes.cri-o.systemd-cgroup": "true"
-	// - "com.microsoft.lcow.systemd": "true"
-	//
-	// Implementation would check container.Annotations and pod.Annotations
-	// for these keys and return true if present with value "true"
+// systemdTmpfsMount is a tmpfs mount systemd needs, with its default mode
+// and size.
+type systemdTmpfsMount struct {
+	dest string
+	mode TmpfsMode
+	size TmpfsSize
 
-	return false
+	// extra are further mount options from the configuration.
+	extra []string
+
+	// optional mounts are only added if enabled by the configuration or an
+	// annotation, since some images keep real data there.
+	optional bool
 }
 
-func configureCgroupMount(adjust *api.ContainerAdjustment, container *api.Container, ctrName string) error {
-	if _, err := os.Stat("/sys/fs/cgroup"); os.IsNotExist(err) {
-		log.Errorf("%s: cgroup filesystem not available at /sys/fs/cgroup - skipping systemd support", ctrName)
-		return nil
+// systemdTmpfsMounts lists parents before their children, so that /run is
+// added and mounted before /run/lock.
+// The sizes keep a runaway process from filling the memory of the node.
+var systemdTmpfsMounts = []systemdTmpfsMount{
+	{dest: "/run", mode: "mode=0755", size: "size=64m"},
+	{dest: "/run/lock", mode: "mode=0755", size: "size=8m"},
+	{dest: "/tmp", mode: "mode=1777", size: "size=256m"},
+	{dest: "/var/log/journal", mode: "mode=0755", size: "size=128m"},
+	{dest: "/var/tmp", mode: "mode=1777", size: "size=256m", optional: true},
+	{dest: "/var/cache", mode: "mode=0755", size: "size=256m", optional: true},
+}
+
+// systemdTmpfsMounts returns the tmpfs mounts for systemd: those of
+// TmpfsMounts if configured, the default ones otherwise, and the optional
+// ones not configured as regular mounts. Parents are listed before their
+// children.
+func (c *Config) systemdTmpfsMounts() []systemdTmpfsMount {
+	if len(c.TmpfsMounts) == 0 {
+		return systemdTmpfsMounts
+	}
+	mounts := make([]systemdTmpfsMount, 0, len(c.TmpfsMounts)+2)
+	configured := make(map[string]bool, len(c.TmpfsMounts))
+	for _, spec := range c.TmpfsMounts {
+		m := systemdTmpfsMount{dest: spec.Destination, mode: defaultTmpfsMountMode, size: defaultTmpfsMountSize}
+		if i := slices.IndexFunc(systemdTmpfsMounts, func(d systemdTmpfsMount) bool { return d.dest == spec.Destination }); i >= 0 {
+			m.mode, m.size = systemdTmpfsMounts[i].mode, systemdTmpfsMounts[i].size
+		}
+		if spec.Mode != "" {
+			m.mode = spec.Mode
+		}
+		if spec.Size != "" {
+			m.size = spec.Size
+		}
+		for _, opt := range spec.Options {
+			// the size becomes the default size of the mount, so that it
+			// is rendered once and tmpfs options still override it
+			if strings.HasPrefix(opt, "size=") {
+				m.size, _ = parseTmpfsSize(opt)
+				continue
+			}
+			m.extra = append(m.extra, opt)
+		}
+		mounts = append(mounts, m)
+		configured[spec.Destination] = true
+	}
+	for _, m := range systemdTmpfsMounts {
+		if m.optional && !configured[m.dest] {
+			mounts = append(mounts, m)
+		}
 	}
+	// a parent is a prefix of its children and sorts before them
+	slices.SortStableFunc(mounts, func(a, b systemdTmpfsMount) int {
+		return strings.Compare(a.dest, b.dest)
+	})
+	return mounts
+}
 
-	var existingMount *api.Mount
-	for _, mount := range container.Mounts {
-		if mount.Destination == "/sys/fs/cgroup" {
-			existingMount = mount
-			break
+// findSystemdTmpfsMount returns the tmpfs mount for systemd at dest in the
+// configuration, nil if there is none.
+func (c *Config) findSystemdTmpfsMount(dest string) *systemdTmpfsMount {
+	mounts := c.systemdTmpfsMounts()
+	for i := range mounts {
+		if mounts[i].dest == dest {
+			return &mounts[i]
 		}
 	}
+	return nil
+}
 
-	if existingMount == nil {
-		log.Errorf("%s: no existing cgroup mount found - systemd requires /sys/fs/cgroup", ctrName)
-		return fmt.Errorf("cgroup mount required for systemd container")
+// optionalTmpfsAnnotation enables optional tmpfs mounts for a container,
+// separated by commas, on top of those enabled by optionalTmpfs. Set on the
+// pod it applies to all containers of the pod without their own annotation.
+const optionalTmpfsAnnotation = "io.systemd.container/tmpfs"
+
+// optionalTmpfs returns the optional tmpfs mounts enabled for the
+// container. Unknown destinations in the annotation are ignored with a
+// warning.
+func (p *plugin) optionalTmpfs(cfg *Config, pod *api.PodSandbox, container *api.Container, ctrName string) map[string]bool {
+	enabled := map[string]bool{}
+	for _, dest := range cfg.OptionalTmpfs {
+		enabled[dest] = true
 	}
 
-	hasRO := false
-	for _, opt := range existingMount.Options {
-		if opt == "ro" {
-			hasRO = true
-			break
+	value, ok := lookupAnnotation(pod, container, optionalTmpfsAnnotation)
+	if !ok {
+		return enabled
+	}
+	for _, dest := range strings.Split(value, ",") {
+		dest = strings.TrimSpace(dest)
+		if dest == "" {
+			continue
+		}
+		if m := cfg.findSystemdTmpfsMount(dest); m == nil || !m.optional {
+			p.mountLog.Warnf("%s: ignoring %s in %s annotation, not an optional tmpfs mount", ctrName, dest, optionalTmpfsAnnotation)
+			continue
 		}
+		enabled[dest] = true
 	}
+	return enabled
+}
 
-	if !hasRO {
-		log.Debugf("%s: cgroup mount already has rw, skipping", ctrName)
-		return nil
+// shadowingMount returns a mount of the container which a tmpfs at dest
+// would interfere with: one at a parent directory, whose content at dest
+// would be hidden, or one below dest, which would be hidden itself.
+func shadowingMount(container *api.Container, dest string) *api.Mount {
+	for _, m := range container.Mounts {
+		if m.Destination == "/" || m.Destination == dest {
+			continue
+		}
+		if strings.HasPrefix(dest, strings.TrimSuffix(m.Destination, "/")+"/") ||
+			strings.HasPrefix(m.Destination, dest+"/") {
+			return m
+		}
 	}
+	return nil
+}
 
-	options := make([]string, 0, len(existingMount.Options))
-	for _, opt := range existingMount.Options {
-		if opt == "ro" {
-			options = append(options, "rw")
-		} else {
-			options = append(options, opt)
+// addSystemdTmpfsMounts adds the tmpfs mounts for systemd, including the
+// given optional ones. With runtimeTmpfs, only the optional ones are added.
+func (p *plugin) addSystemdTmpfsMounts(cfg *Config, adjust *api.ContainerAdjustment, container *api.Container, ctrName string, optional map[string]bool, results *mountResults) error {
+	tmpl := p.template(cfg)
+	existingMounts := make(map[string]*api.Mount)
+	// tmpfsMounts are the writable tmpfs mounts of the container, including
+	// those added here
+	tmpfsMounts := make(map[string]bool)
+	for _, mount := range container.Mounts {
+		existingMounts[mount.Destination] = mount
+		if mount.Type == "tmpfs" && !isReadOnlyMount(mount) {
+			tmpfsMounts[mount.Destination] = true
 		}
 	}
 
-	adjust.RemoveMount("/sys/fs/cgroup")
-	adjust.AddMount(&api.Mount{
-		Destination: existingMount.Destination,
-		Type:        existingMount.Type,
-		Source:      existingMount.Source,
-		Options:     options,
-	})
-	log.Debugf("%s: changed cgroup mount from ro to rw", ctrName)
+	for _, m := range tmpl.mounts {
+		if !m.optional && cfg.RuntimeTmpfs {
+			results.add(m.dest, mountSkipped, "left to the runtime (runtimeTmpfs)")
+			continue
+		}
+		if _, ok := existingMounts[m.dest]; !ok && !m.optional && cfg.SkipNestedTmpfs {
+			if parent := parentTmpfs(tmpfsMounts, m.dest); parent != "" {
+				p.mountLog.Debugf("%s: not mounting a tmpfs at %s, covered by the tmpfs at %s", ctrName, m.dest, parent)
+				results.add(m.dest, mountSkipped, "covered by the tmpfs at %s (skipNestedTmpfs)", parent)
+				continue
+			}
+		}
+		if m.optional {
+			if !optional[m.dest] {
+				continue
+			}
+			// optional mounts never replace or hide what the container
+			// mounts itself, since it may keep real data there
+			if _, ok := existingMounts[m.dest]; ok {
+				p.metrics.existingTmpfs.WithLabelValues(m.dest).Inc()
+				results.add(m.dest, mountSkipped, "already mounted by the container")
+				continue
+			}
+			if shadow := shadowingMount(container, m.dest); shadow != nil {
+				p.mountLog.Debugf("%s: not mounting a tmpfs at %s, it would interfere with the mount at %s", ctrName, m.dest, shadow.Destination)
+				results.add(m.dest, mountSkipped, "would interfere with the container's mount at %s", shadow.Destination)
+				continue
+			}
+			results.add(m.dest, mountAdded, "optional tmpfs enabled")
+		} else if existing, ok := existingMounts[m.dest]; ok {
+			if !isReadOnlyMount(existing) {
+				p.metrics.existingTmpfs.WithLabelValues(m.dest).Inc()
+				results.add(m.dest, mountSkipped, "already mounted by the container")
+				continue
+			}
+			if !cfg.ReplaceReadOnlyMounts {
+				if err := p.tolerate(cfg, ctrName, fmt.Errorf("%s is mounted read-only, systemd will fail to boot", m.dest)); err != nil {
+					return err
+				}
+				results.add(m.dest, mountSkipped, "mounted read-only by the container, replaceReadOnlyMounts is off")
+				continue
+			}
+			p.mountLog.Warnf("%s: replacing read-only %s mount with a tmpfs", ctrName, m.dest)
+			adjust.RemoveMount(m.dest)
+			results.add(m.dest, mountModified, "read-only mount replaced with a tmpfs")
+		} else {
+			results.add(m.dest, mountAdded, "tmpfs needed by systemd")
+		}
 
+		mount := tmpl.tmpfsMount(m, container)
+		p.warnSmallCopyUp(cfg, mount, ctrName)
+		adjust.AddMount(mount)
+		tmpfsMounts[m.dest] = true
+	}
 	return nil
 }
 
-func addSystemdTmpfsMounts(adjust *api.ContainerAdjustment, container *api.Container) {
-	tmpfsMounts := []struct {
-		dest string
-		mode string
-	}{
-		{"/run", "mode=755"},
-		{"/run/lock", "mode=755"},
-		{"/tmp", "mode=1777"},
-		{"/var/log/journal", "mode=755"},
+// warnSmallCopyUp warns about a tmpfs mount with tmpcopyup smaller than
+// tmpfsCopyUpMinSize, which the image content copied into it may not fit.
+func (p *plugin) warnSmallCopyUp(cfg *Config, mount *api.Mount, ctrName string) {
+	floor, ok := cfg.TmpfsCopyUpMinSize.bytes()
+	if !ok || !slices.Contains(mount.Options, "tmpcopyup") {
+		return
+	}
+	for _, opt := range mount.Options {
+		if !strings.HasPrefix(opt, "size=") {
+			continue
+		}
+		if size, ok := TmpfsSize(opt).bytes(); ok && size < floor {
+			p.mountLog.Warnf("%s: the %s tmpfs has only %s for the image content copied into it, less than tmpfsCopyUpMinSize (%s); "+
+				"the container fails to start if it does not fit", ctrName, mount.Destination,
+				strings.TrimPrefix(opt, "size="), strings.TrimPrefix(string(cfg.TmpfsCopyUpMinSize), "size="))
+		}
 	}
+}
 
-	existingMounts := make(map[string]bool)
-	for _, mount := range container.Mounts {
-		existingMounts[mount.Destination] = true
+// memoryLimit returns the memory limit of the container in bytes, 0 if it
+// has none.
+func memoryLimit(container *api.Container) int64 {
+	return container.GetLinux().GetResources().GetMemory().GetLimit().GetValue()
+}
+
+// parentTmpfs returns the closest of the given tmpfs mounts which dest is
+// below, or "" if there is none.
+func parentTmpfs(tmpfsMounts map[string]bool, dest string) string {
+	for dir := path.Dir(dest); dir != "/"; dir = path.Dir(dir) {
+		if tmpfsMounts[dir] {
+			return dir
+		}
 	}
+	return ""
+}
 
-	for _, m := range tmpfsMounts {
-		if existingMounts[m.dest] {
-			continue
+func isReadOnlyMount(mount *api.Mount) bool {
+	for _, opt := range mount.Options {
+		if opt == "ro" {
+			return true
 		}
-		adjust.AddMount(&api.Mount{
-			Destination: m.dest,
-			Type:        "tmpfs",
-			Source:      "tmpfs",
-			Options:     []string{"rw", "rprivate", "nosuid", "nodev", m.mode},
-		})
 	}
+	return false
+}
+
+// uuidAnnotation pins container_uuid, and with it the machine ID systemd
+// derives from it, e.g. across recreations of the pod. Set on the pod it
+// applies to all containers of the pod without their own annotation.
+const uuidAnnotation = "io.systemd.container/uuid"
+
+// rfc4122UUID matches UUIDs of the RFC 4122 variant, versions 1 to 5.
+var rfc4122UUID = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[1-5][0-9a-fA-F]{3}-[89abAB][0-9a-fA-F]{3}-[0-9a-fA-F]{12}$`)
+
+// pinnedUUID returns the container_uuid pinned by annotation, or "" if
+// there is none. Invalid values are ignored with a warning, as are all
+// values if the machine ID is generated fresh.
+func (p *plugin) pinnedUUID(cfg *Config, pod *api.PodSandbox, container *api.Container, ctrName string) string {
+	value, ok := lookupAnnotation(pod, container, uuidAnnotation)
+	if !ok {
+		return ""
+	}
+	if cfg.MachineID.fresh() {
+		p.log.Warnf("%s: ignoring %s annotation, machineID is %s", ctrName, uuidAnnotation, cfg.MachineID)
+		return ""
+	}
+	if !rfc4122UUID.MatchString(value) {
+		p.log.Warnf("%s: ignoring %s annotation %q, not an RFC 4122 UUID", ctrName, uuidAnnotation, value)
+		return ""
+	}
+	return value
 }
 
-func setSystemdEnvironment(adjust *api.ContainerAdjustment, pod *api.PodSandbox, container *api.Container) {
-	adjust.AddEnv("container", "other")
+// setSystemdEnvironment sets the environment variables systemd expects in
+// a container. A pinned UUID, if not empty, is used for container_uuid
+// even if the container sets it itself.
+func setSystemdEnvironment(tmpl *adjustmentTemplate, adjust *api.ContainerAdjustment, pod *api.PodSandbox, container *api.Container, pinnedUUID string) {
+	cfg := tmpl.cfg
+
+	// keep a more accurate value set by the image or runtime, e.g.
+	// container=systemd-nspawn
+	if !hasEnv(container, "container") {
+		adjust.AddEnv("container", cfg.ContainerEnv)
+	}
 
 	hasContainerUUID := false
 	for _, env := range container.Env {
@@ -189,17 +1507,67 @@ func setSystemdEnvironment(adjust *api.ContainerAdjustment, pod *api.PodSandbox,
 		}
 	}
 
-	if !hasContainerUUID && container.Id != "" {
-		adjust.AddEnv("container_uuid", container.Id)
+	switch {
+	case pinnedUUID != "":
+		adjust.AddEnv("container_uuid", pinnedUUID)
+	case hasContainerUUID, cfg.MachineID.fresh():
+		// systemd would initialize the fresh machine ID with it
+	default:
+		if container.Id != "" {
+			adjust.AddEnv("container_uuid", container.Id)
+		}
+		if pod != nil {
+			if uuid, ok := pod.Annotations["io.kubernetes.pod.uid"]; ok {
+				adjust.AddEnv("container_uuid", uuid)
+			}
+		}
 	}
 
-	if pod != nil {
-		if uuid, ok := pod.Annotations["io.kubernetes.pod.uid"]; ok {
-			if !hasContainerUUID {
-				adjust.AddEnv("container_uuid", uuid)
+	// some tools look for the uppercase variants, which get the same values
+	// as the lowercase ones unless set already
+	if cfg.EnvCasing == EnvCasingBoth {
+		for _, key := range []string{"container", "container_uuid"} {
+			upper := strings.ToUpper(key)
+			if hasEnv(container, upper) {
+				continue
+			}
+			if value, ok := adjustedEnv(adjust, container, key); ok {
+				adjust.AddEnv(upper, value)
 			}
 		}
 	}
+
+	// systemd sends watchdog keep-alives to its supervisor when started
+	// with WATCHDOG_USEC, which is specified in microseconds.
+	if tmpl.watchdogUsec != "" && !hasEnv(container, "WATCHDOG_USEC") {
+		adjust.AddEnv("WATCHDOG_USEC", tmpl.watchdogUsec)
+		adjust.AddEnv("WATCHDOG_PID", "1")
+	}
+}
+
+// adjustedEnv returns the value of an environment variable of the
+// container after the adjustment, which may override it.
+func adjustedEnv(adjust *api.ContainerAdjustment, container *api.Container, key string) (string, bool) {
+	for i := len(adjust.Env) - 1; i >= 0; i-- {
+		if adjust.Env[i].Key == key {
+			return adjust.Env[i].Value, true
+		}
+	}
+	for i := len(container.Env) - 1; i >= 0; i-- {
+		if value, ok := strings.CutPrefix(container.Env[i], key+"="); ok {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+func hasEnv(container *api.Container, key string) bool {
+	for _, env := range container.Env {
+		if strings.HasPrefix(env, key+"=") {
+			return true
+		}
+	}
+	return false
 }
 
 func containerName(pod *api.PodSandbox, container *api.Container) string {
@@ -209,7 +1577,12 @@ func containerName(pod *api.PodSandbox, container *api.Container) string {
 	return container.Name
 }
 
-func dump(args ...interface{}) {
+func (p *plugin) dump(args ...interface{}) {
+	// marshaling is by far the most expensive part of adjusting a container
+	if !p.log.enabled(logrus.InfoLevel) {
+		return
+	}
+
 	var (
 		prefix string
 		idx    int
@@ -224,42 +1597,154 @@ func dump(args ...interface{}) {
 		tag, obj := args[idx], args[idx+1]
 		msg, err := yaml.Marshal(obj)
 		if err != nil {
-			log.Infof("%s: %s: failed to dump object: %v", prefix, tag, err)
+			p.log.Infof("%s: %s: failed to dump object: %v", prefix, tag, err)
 			continue
 		}
 
 		if prefix != "" {
-			log.Infof("%s: %s:", prefix, tag)
+			p.log.Infof("%s: %s:", prefix, tag)
 			for _, line := range strings.Split(strings.TrimSpace(string(msg)), "\n") {
-				log.Infof("%s:    %s", prefix, line)
+				p.log.Infof("%s:    %s", prefix, line)
 			}
 		} else {
-			log.Infof("%s:", tag)
+			p.log.Infof("%s:", tag)
 			for _, line := range strings.Split(strings.TrimSpace(string(msg)), "\n") {
-				log.Infof("  %s", line)
+				p.log.Infof("  %s", line)
 			}
 		}
 	}
 }
 
+func newLogger() *logrus.Logger {
+	log := logrus.New()
+	log.SetFormatter(&logrus.TextFormatter{
+		PadLevelText: true,
+	})
+	return log
+}
+
 func main() {
+	if filepath.Base(os.Args[0]) == loginShellName {
+		os.Exit(runLoginShell(os.Args[1:]))
+	}
+	os.Exit(run())
+}
+
+// run runs the plugin and returns its exit code, after running deferred
+// cleanups like releasing the instance lock, which os.Exit would skip.
+func run() int {
 	var (
-		pluginIdx  string
-		socketPath string
-		opts       []stub.Option
-		err        error
+		pluginIdx   string
+		socketPath  string
+		configFile  string
+		metricsAddr string
+		debugSocket string
+		auditLog    string
+		events      bool
+		kubeEvents  bool
+		kubeCredDir string
+		node        string
+		once        bool
+		hook        bool
+		hookOutput  string
+		caps        bool
+		printConfig bool
+		dryRun      bool
+		output      string
+		runAs       string
+		hostFile    string
+		cgroupVer   cgroupVersion
+		otlp        otlpOptions
+		debugDump   = debugDumpOptions{maxFiles: defaultDebugDumpMaxFiles, maxSize: defaultDebugDumpMaxSize}
+		verbose     bool
+		logLevel    string
+		initPaths   string
+		opts        []stub.Option
+		err         error
 	)
 
-	log = logrus.StandardLogger()
-	log.SetFormatter(&logrus.TextFormatter{
-		PadLevelText: true,
-	})
+	log := newLogger()
 
 	flag.StringVar(&pluginIdx, "idx", "", "plugin index to register to NRI")
 	flag.StringVar(&socketPath, "socket-path", "", "path of the NRI socket file")
+	flag.StringVar(&configFile, "config", "", "path of the plugin configuration file")
+	flag.StringVar(&metricsAddr, "metrics-addr", "", "address to serve metrics on, disabled if empty")
+	flag.StringVar(&otlp.endpoint, "otlp-endpoint", "", "URL of an OTLP collector to push metrics to, disabled if empty")
+	flag.StringVar(&otlp.caFile, "otlp-ca-file", "", "CA certificates for verifying the OTLP collector")
+	flag.Func("otlp-header", "key=value header sent to the OTLP collector, may be repeated", otlp.parseHeader)
+	flag.DurationVar(&otlp.interval, "otlp-interval", defaultOTLPInterval, "interval of pushing metrics to the OTLP collector")
+	flag.StringVar(&debugSocket, "debug-socket", "", "path of a Unix socket to serve the debug API on, disabled if empty")
+	flag.StringVar(&debugDump.dir, "debug-dump-dir", "", "directory to write the objects of hooks to as YAML, for selected containers, disabled if empty")
+	flag.Func("debug-dump-namespace", "namespace whose containers are written to -debug-dump-dir besides annotated ones, may be repeated", debugDump.parseNamespace)
+	flag.IntVar(&debugDump.maxFiles, "debug-dump-max-files", defaultDebugDumpMaxFiles, "number of files kept in -debug-dump-dir")
+	flag.Int64Var(&debugDump.maxSize, "debug-dump-max-size", defaultDebugDumpMaxSize, "bytes kept in -debug-dump-dir")
+	flag.StringVar(&auditLog, "audit-log", "", "file to append a JSON record of every adjustment to, disabled if empty")
+	flag.BoolVar(&events, "events", false, "write a JSON event of every adjustment to stdout, one per line")
+	flag.BoolVar(&kubeEvents, "kube-events", false, "record adjustments and failures as Kubernetes events on the pods, with the in-cluster service account")
+	flag.StringVar(&kubeCredDir, "kube-credentials-dir", serviceAccountDir, "directory with the token and ca.crt of the service account for -kube-events")
+	flag.BoolVar(&dryRun, "dry-run", false, "write how systemd containers would be adjusted to stdout as JSON, one per line, without adjusting them")
+	flag.BoolVar(&once, "once", false, "report drift of the running systemd containers and exit, without adjusting containers")
+	flag.StringVar(&output, "output", outputTable, "output format of -once, table or json")
+	flag.BoolVar(&hook, "hook", false, "adjust the container of the OCI state read from stdin as an OCI hook and exit, for runtimes without NRI")
+	flag.StringVar(&hookOutput, "hook-output", hookOutputPatch, "output of -hook, patch to write a partial OCI spec to stdout or bundle to update config.json of the bundle")
+	flag.BoolVar(&caps, "capabilities", false, "print a JSON report of the hooks, detection strategies and profiles supported by the plugin and exit")
+	flag.BoolVar(&printConfig, "print-effective-config", false, "print the configuration in effect as YAML of the current schema and exit")
+	flag.Var(&cgroupVer, "cgroup-version", "cgroup version of the host, auto to detect it, v1 or v2 for hosts where detection fails")
+	flag.StringVar(&hostFile, "fake-host", "", "YAML file describing a synthetic host to probe instead of the real one, for development")
+	flag.StringVar(&node, "node-name", "", "name of the node in logs, metrics, records and Kubernetes events, defaults to NODE_NAME or the host name")
+	flag.StringVar(&runAs, "run-as", "", "user[:group] to drop privileges to once connected to the runtime")
 	flag.BoolVar(&verbose, "verbose", false, "enable (more) verbose logging")
+	flag.StringVar(&initPaths, "init-paths", "", "comma-separated entrypoints of systemd containers, added to detection.initPaths of the configuration")
+	flag.StringVar(&logLevel, "log-level", "", "log levels of modules as module=level pairs, e.g. mounts=debug,default=info, overriding the configuration")
 	flag.Parse()
 
+	if _, err := parseLogLevels(logLevel); err != nil {
+		log.Errorf("invalid -log-level: %v", err)
+		return 1
+	}
+
+	data, err := readConfig(configFile)
+	if err != nil {
+		log.Errorf("failed to load configuration: %v", err)
+		return 1
+	}
+
+	data, warnings, err := migrateConfig(data)
+	if err != nil {
+		log.Errorf("failed to load configuration: invalid config file %s: %v", configFile, err)
+		return 1
+	}
+	for _, w := range warnings {
+		log.Warnf("%s: %s", configFile, w)
+	}
+
+	// parseConfig parses the configuration file over the given defaults
+	parseConfig := func(defaults *Config) (*Config, error) {
+		cfg, err := parseConfigOver(defaults, data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config file %s: %w", configFile, err)
+		}
+		if verbose {
+			cfg.Verbose = true
+		}
+		if initPaths != "" {
+			if err := cfg.addInitPaths(initPaths); err != nil {
+				return nil, fmt.Errorf("invalid -init-paths: %w", err)
+			}
+		}
+		if logLevel != "" {
+			// later entries win, so the flag overrides the file per module
+			cfg.LogLevel = strings.Trim(cfg.LogLevel+","+logLevel, ",")
+		}
+		return cfg, nil
+	}
+
+	cfg, err := parseConfig(defaultConfig())
+	if err != nil {
+		log.Errorf("failed to load configuration: %v", err)
+		return 1
+	}
+
 	if pluginIdx != "" {
 		opts = append(opts, stub.WithPluginIdx(pluginIdx))
 	}
@@ -268,21 +1753,189 @@ func main() {
 		opts = append(opts, stub.WithSocketPath(socketPath))
 	}
 
-	if verbose {
-		logrus.SetLevel(logrus.DebugLevel)
+	p := newPlugin(cfg)
+	p.parseConfig = parseConfig
+	p.cgroupVersion = cgroupVer
+	if node, err = nodeName(node); err != nil {
+		p.log.Errorf("%v", err)
+		return 1
+	}
+	p.setNode(node)
+	if hostFile != "" {
+		h, err := loadFakeHost(hostFile)
+		if err != nil {
+			p.log.Errorf("%v", err)
+			return 1
+		}
+		p.useFakeHost(h)
+		p.hostLog.Warnf("probing the fake host of %s instead of the real one", hostFile)
+	} else if defaultFakeHost != nil {
+		p.useFakeHost(defaultFakeHost)
+		p.hostLog.Warnf("probing a fake cgroup %s host, host probes are only supported on Linux", defaultFakeHost.CgroupLayout)
+	}
+	if printConfig {
+		out, err := yaml.Marshal(cfg)
+		if err != nil {
+			p.log.Errorf("failed to write configuration: %v", err)
+			return 1
+		}
+		os.Stdout.Write(out)
+		return 0
+	}
+	if caps {
+		if err := p.capabilities().write(os.Stdout); err != nil {
+			p.log.Errorf("failed to write capabilities: %v", err)
+			return 1
+		}
+		return 0
+	}
+
+	// stop cleanly on SIGTERM and SIGINT, also in one-shot mode, releasing
+	// the instance lock and removing the debug socket
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		// a second signal terminates the plugin right away
+		stop()
+		p.log.Infof("shutting down, signal again to exit immediately")
+	}()
+
+	if once {
+		if output != outputTable && output != outputJSON {
+			p.log.Errorf("invalid -output %q, must be %s or %s", output, outputTable, outputJSON)
+			return onceFailed
+		}
+		newStub := func(plugin interface{}, onClose func()) (stub.Stub, error) {
+			return stub.New(plugin, append(opts, stub.WithOnClose(onClose))...)
+		}
+		return p.runOnce(ctx, newStub, output, os.Stdout)
+	}
+
+	if hook {
+		if err := p.runHook(context.Background(), os.Stdin, os.Stdout, hookOutput); err != nil {
+			p.log.Errorf("%v", err)
+			return 1
+		}
+		return 0
 	}
 
-	p := &plugin{}
-	if p.stub, err = stub.New(p, opts...); err != nil {
-		log.Errorf("failed to create plugin stub: %v", err)
-		os.Exit(1)
+	// a dry run does not adjust containers, so it may run next to the
+	// instance doing so
+	if !dryRun {
+		lock, err := p.lockInstance(ctx, cfg.StateDir, cfg.DuplicatePolicy, newInstanceMarker(pluginIdx), instanceLockRetry)
+		if err != nil {
+			p.log.Errorf("%v", err)
+			return 1
+		}
+		defer func() {
+			if err := lock.release(); err != nil {
+				p.log.Warnf("failed to release the instance lock: %v", err)
+			}
+		}()
 	}
 
-	ctx := context.Background()
+	if err := p.runPreHook(ctx, cfg.PreHook); err != nil {
+		p.log.Errorf("%v", err)
+		return 1
+	}
 
-	err = p.stub.Run(ctx)
+	layoutCtx, cancel := context.WithTimeout(ctx, cfg.HookTimeout.Duration())
+	err = p.checkCgroupLayout(layoutCtx, cfg.StrictCgroupLayout)
+	cancel()
 	if err != nil {
-		log.Errorf("plugin exited with error %v", err)
-		os.Exit(1)
+		p.log.Errorf("%v", err)
+		return 1
+	}
+
+	if metricsAddr != "" {
+		if err := p.serveMetrics(metricsAddr); err != nil {
+			p.log.Errorf("%v", err)
+			return 1
+		}
+	}
+
+	if otlp.endpoint != "" {
+		shutdown, err := p.pushMetrics(ctx, otlp)
+		if err != nil {
+			p.log.Errorf("%v", err)
+			return 1
+		}
+		defer func() {
+			// push the final metrics, bounded like a hook
+			flushCtx, cancel := context.WithTimeout(context.Background(), cfg.HookTimeout.Duration())
+			defer cancel()
+			if err := shutdown(flushCtx); err != nil {
+				p.metricsLog.Warnf("failed to push the final metrics: %v", err)
+			}
+		}()
+	}
+
+	if auditLog != "" {
+		if p.audit, err = openAuditLog(auditLog); err != nil {
+			p.log.Errorf("%v", err)
+			return 1
+		}
+	}
+
+	if debugDump.dir != "" {
+		if p.debugDump, err = newDebugDumper(debugDump); err != nil {
+			p.log.Errorf("%v", err)
+			return 1
+		}
+	}
+
+	if events || dryRun {
+		w := newEventWriter(os.Stdout)
+		if events {
+			p.events = w
+		}
+		if dryRun {
+			p.dryRun = w
+		}
+	}
+
+	if kubeEvents {
+		if p.kubeEvents, err = newKubeEventRecorder(kubeCredDir, node, p.log); err != nil {
+			p.log.Errorf("%v", err)
+			return 1
+		}
+		go p.kubeEvents.run(ctx)
+	}
+
+	if debugSocket != "" {
+		stopDebug, err := p.serveDebug(debugSocket)
+		if err != nil {
+			p.log.Errorf("%v", err)
+			return 1
+		}
+		defer stopDebug()
+	}
+
+	if runAs != "" {
+		if socketPath == "" {
+			socketPath = api.DefaultSocketPath
+		}
+		if p.afterConnect, err = p.privilegeDrop(runAs, socketPath); err != nil {
+			p.log.Errorf("cannot run as %s: %v", runAs, err)
+			return 1
+		}
+	}
+
+	if cfg.DriftCheckInterval > 0 {
+		go p.runDriftChecks(ctx)
+	}
+
+	go p.toggleDebugOnSignal()
+
+	newStub := func(onClose func()) (stub.Stub, error) {
+		return stub.New(p, append(opts, stub.WithOnClose(onClose))...)
+	}
+
+	if err := p.run(ctx, newStub); err != nil {
+		p.log.Errorf("plugin exited with error %v", err)
+		return 1
 	}
+	p.log.Infof("stopped")
+	return 0
 }
@@ -19,17 +19,101 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/containerd/nri/pkg/api"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
-func TestSystemdPlugin(t *testing.T) {
-	log = logrus.StandardLogger()
-	log.SetFormatter(&logrus.TextFormatter{PadLevelText: true})
+// fakeProber is a hostProber pretending that only the given paths exist,
+// with symlinks resolving as given in links.
+type fakeProber struct {
+	paths map[string]bool
+	links map[string]string
+	// fsTypes are the filesystem magic numbers by path, unknown without.
+	fsTypes map[string]int64
+}
+
+func (f *fakeProber) FSType(_ context.Context, path string) (int64, error) {
+	if typ, ok := f.fsTypes[path]; ok {
+		return typ, nil
+	}
+	return 0, errors.ErrUnsupported
+}
+
+func (f *fakeProber) Stat(_ context.Context, path string) (os.FileInfo, error) {
+	if !f.paths[path] {
+		return nil, os.ErrNotExist
+	}
+	return nil, nil
+}
+
+func (f *fakeProber) EvalSymlinks(_ context.Context, path string) (string, error) {
+	if target, ok := f.links[path]; ok {
+		return target, nil
+	}
+	return path, nil
+}
+
+// slowProber is a hostProber stuck on a hung filesystem.
+type slowProber struct{}
+
+func (slowProber) Stat(ctx context.Context, _ string) (os.FileInfo, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (slowProber) EvalSymlinks(ctx context.Context, _ string) (string, error) {
+	<-ctx.Done()
+	return "", ctx.Err()
+}
+
+// gateProber is a hostProber blocking until the gate is closed.
+type gateProber struct {
+	gate   chan struct{}
+	prober hostProber
+}
+
+func (g *gateProber) Stat(ctx context.Context, path string) (os.FileInfo, error) {
+	<-g.gate
+	return g.prober.Stat(ctx, path)
+}
+
+func (g *gateProber) EvalSymlinks(ctx context.Context, path string) (string, error) {
+	<-g.gate
+	return g.prober.EvalSymlinks(ctx, path)
+}
+
+// newTestPlugin returns a plugin with the given configuration on a fake
+// cgroup v2 host, discarding log output. Host sysctls are not checked.
+func newTestPlugin(cfg *Config) *plugin {
+	if cfg == nil {
+		cfg = defaultConfig()
+	}
+	p := newPlugin(cfg)
+	p.logs.base.SetOutput(io.Discard)
+	p.sysctlFS = ""
+	p.prober = &fakeProber{
+		paths: map[string]bool{
+			"/sys/fs/cgroup":                    true,
+			"/sys/fs/cgroup/cgroup.controllers": true,
+		},
+	}
+	return p
+}
 
+func TestSystemdPlugin(t *testing.T) {
 	t.Run("non-systemd container ignored", func(t *testing.T) {
 		testNonSystemdContainerIgnored(t)
 	})
@@ -50,7 +134,7 @@ func TestSystemdPlugin(t *testing.T) {
 func testNonSystemdContainerIgnored(t *testing.T) {
 	t.Helper()
 
-	p := &plugin{}
+	p := newTestPlugin(nil)
 	pod := &api.PodSandbox{
 		Name:        "test-pod",
 		Annotations: map[string]string{},
@@ -72,7 +156,7 @@ func testNonSystemdContainerIgnored(t *testing.T) {
 func testSystemdContainerDetectedSbinInit(t *testing.T) {
 	t.Helper()
 
-	p := &plugin{}
+	p := newTestPlugin(nil)
 	pod := &api.PodSandbox{
 		Name:        "test-pod-systemd",
 		Annotations: map[string]string{},
@@ -107,7 +191,7 @@ func testSystemdContainerDetectedSbinInit(t *testing.T) {
 func testSystemdContainerDetectedLibSystemd(t *testing.T) {
 	t.Helper()
 
-	p := &plugin{}
+	p := newTestPlugin(nil)
 	pod := &api.PodSandbox{
 		Name:        "test-pod-systemd",
 		Annotations: map[string]string{},
@@ -142,7 +226,7 @@ func testSystemdContainerDetectedLibSystemd(t *testing.T) {
 func testSystemdContainerDetectedUsrLibSystemd(t *testing.T) {
 	t.Helper()
 
-	p := &plugin{}
+	p := newTestPlugin(nil)
 	pod := &api.PodSandbox{
 		Name:        "test-pod-systemd",
 		Annotations: map[string]string{},
@@ -227,8 +311,1281 @@ func TestIsSystemdContainer(t *testing.T) {
 			container := &api.Container{
 				Args: tt.args,
 			}
-			result := isSystemdContainer(container)
+			result := isSystemdContainer(defaultConfig(), nil, container)
 			assert.Equal(t, tt.expected, result)
 		})
 	}
 }
+
+func TestShellExecDetection(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		expected bool
+	}{
+		{
+			name:     "exec after setup",
+			args:     []string{"/bin/bash", "-c", "setup && exec /lib/systemd/systemd"},
+			expected: true,
+		},
+		{
+			name:     "exec with arguments",
+			args:     []string{"sh", "-c", "exec /sbin/init --log-level=debug"},
+			expected: true,
+		},
+		{
+			name:     "exec after semicolon",
+			args:     []string{"/bin/sh", "-c", "mkdir -p /run/x;exec /usr/lib/systemd/systemd"},
+			expected: true,
+		},
+		{
+			name:     "without exec",
+			args:     []string{"/bin/bash", "-c", "setup && /lib/systemd/systemd"},
+			expected: false,
+		},
+		{
+			name:     "other path",
+			args:     []string{"/bin/bash", "-c", "exec /lib/systemd/systemd-journald"},
+			expected: false,
+		},
+		{
+			name:     "exec in a word",
+			args:     []string{"/bin/bash", "-c", "myexec /sbin/init"},
+			expected: false,
+		},
+		{
+			name:     "not a shell",
+			args:     []string{"/usr/bin/python3", "-c", "exec /sbin/init"},
+			expected: false,
+		},
+		{
+			name:     "second exec",
+			args:     []string{"/bin/sh", "-c", "test -f x || exec /bin/false;exec /sbin/init"},
+			expected: true,
+		},
+	}
+
+	enabled := configWith(func(c *Config) { c.Detection.ShellExec = true })
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			container := &api.Container{Args: tt.args}
+			assert.Equal(t, tt.expected, isSystemdContainer(enabled, nil, container))
+
+			// opt-in only
+			assert.False(t, isSystemdContainer(defaultConfig(), nil, container))
+		})
+	}
+}
+
+func TestInitPaths(t *testing.T) {
+	configured := configWith(func(c *Config) {
+		c.Detection.InitPaths = []string{"/usr/bin/systemd", "/opt/boot"}
+	})
+	basename := configWith(func(c *Config) {
+		c.Detection.InitPaths = []string{"/usr/bin/boot"}
+		c.Detection.MatchBasename = true
+	})
+
+	tests := []struct {
+		path                          string
+		builtin, configured, basename bool
+	}{
+		{path: "/sbin/init", builtin: true, configured: true, basename: true},
+		{path: "/usr/sbin/init", builtin: true, configured: true, basename: true},
+		{path: "/usr/lib/systemd/systemd", builtin: true, configured: true, basename: true},
+		{path: "/usr/bin/systemd", configured: true, basename: true},
+		{path: "/opt/myapp/init", basename: true},
+		{path: "init", basename: true},
+		{path: "systemd", basename: true},
+		{path: "./systemd", basename: true},
+		{path: "/opt/boot", configured: true, basename: true},
+		{path: "/usr/bin/boot", basename: true},
+		{path: "/usr/bin/systemd-journald"},
+		{path: "/usr/bin/tini"},
+		{path: "/sbin/initctl"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			container := &api.Container{Args: []string{tt.path}}
+			assert.Equal(t, tt.builtin, isSystemdContainer(defaultConfig(), nil, container), "builtin")
+			assert.Equal(t, tt.configured, isSystemdContainer(configured, nil, container), "configured")
+			assert.Equal(t, tt.basename, isSystemdContainer(basename, nil, container), "basename")
+		})
+	}
+
+	t.Run("shell exec", func(t *testing.T) {
+		cfg := configWith(func(c *Config) {
+			c.Detection.ShellExec = true
+			c.Detection.InitPaths = []string{"/usr/bin/systemd"}
+		})
+		assert.True(t, isSystemdContainer(cfg, nil, &api.Container{Args: []string{"sh", "-c", "setup && exec /usr/bin/systemd"}}))
+	})
+
+	t.Run("flag", func(t *testing.T) {
+		cfg, err := parseConfig([]byte("detection:\n  initPaths: [/usr/bin/systemd]\n"))
+		require.NoError(t, err)
+		require.NoError(t, cfg.addInitPaths(" /usr/sbin/init,/usr/bin/systemd,,"))
+		assert.Equal(t, []string{"/usr/bin/systemd", "/usr/sbin/init"}, cfg.Detection.InitPaths)
+		assert.Error(t, cfg.addInitPaths("bin/init"))
+	})
+}
+
+func TestDetectionPrecedence(t *testing.T) {
+	init := []string{"/sbin/init"}
+	shell := []string{"/bin/sh", "-c", "exec /sbin/init"}
+	optOut := map[string]string{systemdAnnotation: "false"}
+	optIn := map[string]string{systemdAnnotation: "true"}
+
+	tests := []struct {
+		name        string
+		order       []string
+		args        []string
+		annotations map[string]string
+		podOptOut   bool
+		expected    bool
+		reason      string
+	}{
+		{name: "opt-out wins by default", args: init, annotations: optOut, expected: false, reason: detectedAnnotation},
+		{name: "opt-out on the pod", args: init, podOptOut: true, expected: false, reason: detectedAnnotation},
+		{name: "opt-in", args: []string{"/usr/local/bin/boot"}, annotations: optIn, expected: true, reason: detectedAnnotation},
+		{name: "invalid annotation is ignored", args: init, annotations: map[string]string{systemdAnnotation: "maybe"}, expected: true, reason: detectedEntrypoint},
+		{name: "entrypoint first", order: []string{"entrypoint"}, args: init, annotations: optOut, expected: true, reason: detectedEntrypoint},
+		{name: "entrypoint first without match", order: []string{"entrypoint"}, args: []string{"sleep"}, annotations: optOut, expected: false, reason: detectedAnnotation},
+		{name: "shell-exec before annotation", order: []string{"shell-exec", "annotation"}, args: shell, annotations: optOut, expected: true, reason: detectedShellExec},
+		{name: "annotation before shell-exec", order: []string{"annotation", "shell-exec"}, args: shell, annotations: optOut, expected: false, reason: detectedAnnotation},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := configWith(func(c *Config) {
+				c.Detection.ShellExec = true
+				c.Detection.Order = tt.order
+			})
+			pod := &api.PodSandbox{}
+			if tt.podOptOut {
+				pod.Annotations = optOut
+			}
+			container := &api.Container{Args: tt.args, Annotations: tt.annotations}
+
+			reason, systemd := systemdDetection(cfg, pod, container)
+			assert.Equal(t, tt.expected, systemd)
+			assert.Equal(t, tt.reason, reason)
+		})
+	}
+
+	t.Run("skip decision", func(t *testing.T) {
+		p := newTestPlugin(nil)
+		adjust, _, err := p.CreateContainer(context.Background(), &api.PodSandbox{}, newProfileTestContainer(optOut))
+		require.NoError(t, err)
+		assert.Nil(t, adjust)
+		require.Len(t, p.recent.list(), 1)
+		assert.Equal(t, "io.systemd.container annotation is false, which detection.order ranks above the entrypoint", p.recent.list()[0].Reason)
+	})
+}
+
+func TestSystemdAnnotations(t *testing.T) {
+	wrapper := []string{"/bin/bash", "-c", "/usr/local/bin/start"}
+
+	tests := []struct {
+		name     string
+		ctr      map[string]string
+		pod      map[string]string
+		expected bool
+	}{
+		{name: "io.systemd.container", ctr: map[string]string{"io.systemd.container": "true"}, expected: true},
+		{name: "cri-o systemd cgroup", ctr: map[string]string{"io.kubernetes.cri-o.systemd-cgroup": "true"}, expected: true},
+		{name: "lcow systemd", ctr: map[string]string{"com.microsoft.lcow.systemd": "true"}, expected: true},
+		{name: "on the pod", pod: map[string]string{"io.systemd.container": "true"}, expected: true},
+		{name: "alias on the pod", pod: map[string]string{"com.microsoft.lcow.systemd": "true"}, expected: true},
+		{name: "alias other than true", ctr: map[string]string{"io.kubernetes.cri-o.systemd-cgroup": "1"}, expected: false},
+		{name: "alias false", ctr: map[string]string{"com.microsoft.lcow.systemd": "false"}, expected: false},
+		{name: "container opt-out over pod", ctr: map[string]string{"io.systemd.container": "false"}, pod: map[string]string{"io.systemd.container": "true"}, expected: false},
+		{name: "container opt-out over pod alias", ctr: map[string]string{"io.systemd.container": "false"}, pod: map[string]string{"io.kubernetes.cri-o.systemd-cgroup": "true"}, expected: false},
+		{name: "container alias over pod opt-out", ctr: map[string]string{"com.microsoft.lcow.systemd": "true"}, pod: map[string]string{"io.systemd.container": "false"}, expected: true},
+		{name: "opt-out over alias", ctr: map[string]string{"io.systemd.container": "false", "com.microsoft.lcow.systemd": "true"}, expected: false},
+		{name: "invalid value falls back to the pod", ctr: map[string]string{"io.systemd.container": "maybe"}, pod: map[string]string{"io.systemd.container": "true"}, expected: true},
+		{name: "none", expected: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := &api.PodSandbox{Annotations: tt.pod}
+			container := &api.Container{Args: wrapper, Annotations: tt.ctr}
+			assert.Equal(t, tt.expected, isSystemdContainer(defaultConfig(), pod, container))
+		})
+	}
+}
+
+func TestDisableAnnotations(t *testing.T) {
+	p := newTestPlugin(configWith(func(c *Config) {
+		c.DisableAnnotations = []string{"example.com/managed-by"}
+	}))
+
+	disabled := &api.PodSandbox{
+		Id:          "disabled-pod",
+		Annotations: map[string]string{"example.com/managed-by": ""},
+	}
+	adjust, updates, err := p.CreateContainer(context.Background(), disabled, newProfileTestContainer(nil))
+	assert.NoError(t, err)
+	assert.Nil(t, adjust)
+	assert.Nil(t, updates)
+
+	// the annotation only counts on the pod
+	container := newProfileTestContainer(map[string]string{"example.com/managed-by": "other"})
+	adjust, _, err = p.CreateContainer(context.Background(), &api.PodSandbox{}, container)
+	assert.NoError(t, err)
+	assert.NotNil(t, adjust)
+
+	// containers of disabled pods are not tracked after synchronizing
+	running := newProfileTestContainer(nil)
+	running.PodSandboxId = disabled.Id
+	_, err = p.Synchronize(context.Background(), []*api.PodSandbox{disabled}, []*api.Container{running})
+	require.NoError(t, err)
+	assert.Empty(t, p.state.list())
+}
+
+func TestExistingTmpfsMetric(t *testing.T) {
+	p := newTestPlugin(nil)
+	tmp := &api.Mount{Destination: "/tmp", Type: "tmpfs", Source: "tmpfs", Options: []string{"rw"}}
+	readOnlyRun := &api.Mount{Destination: "/run", Type: "bind", Source: "/var/lib/containers/run", Options: []string{"rbind", "ro"}}
+
+	for range 2 {
+		container := newProfileTestContainer(nil, tmp, readOnlyRun)
+		require.NoError(t, p.addSystemdTmpfsMounts(p.config(), &api.ContainerAdjustment{}, container, "test", nil, nil))
+	}
+
+	assert.Equal(t, 2.0, testutil.ToFloat64(p.metrics.existingTmpfs.WithLabelValues("/tmp")))
+	// read-only mounts are not what systemd needs
+	assert.Equal(t, 0.0, testutil.ToFloat64(p.metrics.existingTmpfs.WithLabelValues("/run")))
+	assert.Equal(t, 0.0, testutil.ToFloat64(p.metrics.existingTmpfs.WithLabelValues("/run/lock")))
+}
+
+func TestSkipAnnotation(t *testing.T) {
+	hasEnv := func(adjust *api.ContainerAdjustment, key string) bool {
+		for _, e := range adjust.Env {
+			if e.Key == key {
+				return true
+			}
+		}
+		return false
+	}
+
+	t.Run("env and cgroup with a profile", func(t *testing.T) {
+		p := newTestPlugin(nil)
+		pod := &api.PodSandbox{Annotations: map[string]string{profileAnnotation: profileNestedRuntime}}
+		container := newProfileTestContainer(map[string]string{skipAnnotation: "env, cgroup"})
+
+		adjust, _, err := p.CreateContainer(context.Background(), pod, container)
+		require.NoError(t, err)
+
+		assert.Equal(t, "tmpfs,profile=nested-runtime", adjust.Annotations[provenanceAnnotation])
+		assert.False(t, hasEnv(adjust, "container"))
+		assert.False(t, hasEnv(adjust, "container_uuid"))
+		assert.Nil(t, findMount(adjust.Mounts, "/sys/fs/cgroup"))
+		assert.NotNil(t, findMount(adjust.Mounts, "/run"))
+		assert.NotNil(t, findMount(adjust.Mounts, "/var/lib/docker"))
+	})
+
+	t.Run("profile on the pod", func(t *testing.T) {
+		p := newTestPlugin(nil)
+		pod := &api.PodSandbox{Annotations: map[string]string{
+			profileAnnotation: profileNestedRuntime,
+			skipAnnotation:    "profile,tmpfs",
+		}}
+
+		adjust, _, err := p.CreateContainer(context.Background(), pod, newProfileTestContainer(nil))
+		require.NoError(t, err)
+
+		assert.Equal(t, "cgroup,env", adjust.Annotations[provenanceAnnotation])
+		assert.True(t, hasEnv(adjust, "container"))
+		assert.NotNil(t, findMount(adjust.Mounts, "/sys/fs/cgroup"))
+		assert.Nil(t, findMount(adjust.Mounts, "/run"))
+		assert.Nil(t, findMount(adjust.Mounts, "/var/lib/docker"))
+		assert.Empty(t, adjust.GetLinux().GetDevices())
+	})
+
+	t.Run("unknown step", func(t *testing.T) {
+		p := newTestPlugin(nil)
+		logs := logtest.NewLocal(p.logs.base)
+		container := newProfileTestContainer(map[string]string{skipAnnotation: "mounts,env"})
+
+		adjust, _, err := p.CreateContainer(context.Background(), &api.PodSandbox{}, container)
+		require.NoError(t, err)
+
+		assert.Equal(t, "cgroup,tmpfs", adjust.Annotations[provenanceAnnotation])
+		warned := false
+		for _, e := range logs.AllEntries() {
+			if e.Level == logrus.WarnLevel && strings.Contains(e.Message, `unknown step "mounts"`) {
+				warned = true
+			}
+		}
+		assert.True(t, warned, "warning about the unknown step")
+	})
+
+	t.Run("config annotation", func(t *testing.T) {
+		p := newTestPlugin(nil)
+		container := newProfileTestContainer(map[string]string{configAnnotation: "skip: [tmpfs]"})
+
+		adjust, _, err := p.CreateContainer(context.Background(), &api.PodSandbox{}, container)
+		require.NoError(t, err)
+		assert.Equal(t, "cgroup,env", adjust.Annotations[provenanceAnnotation])
+	})
+
+	t.Run("no drift for skipped steps", func(t *testing.T) {
+		p := newTestPlugin(nil)
+		container := newProfileTestContainer(map[string]string{skipAnnotation: "cgroup,tmpfs,env"})
+		assert.Empty(t, p.specDrift(context.Background(), p.config(), &api.PodSandbox{}, container, "test"))
+	})
+}
+
+func TestReadOnlyRunMount(t *testing.T) {
+	readOnlyRun := &api.Mount{
+		Destination: "/run",
+		Type:        "bind",
+		Source:      "/var/lib/containers/run",
+		Options:     []string{"rbind", "ro"},
+	}
+
+	t.Run("warn", func(t *testing.T) {
+		p := newTestPlugin(nil)
+		logs := logtest.NewLocal(p.logs.base)
+
+		adjust := &api.ContainerAdjustment{}
+		container := newProfileTestContainer(nil, readOnlyRun)
+		require.NoError(t, p.addSystemdTmpfsMounts(p.config(), adjust, container, "test", nil, nil))
+
+		for _, m := range adjust.Mounts {
+			assert.NotEqual(t, "/run", m.Destination)
+		}
+		if assert.NotNil(t, logs.LastEntry()) {
+			assert.Equal(t, logrus.WarnLevel, logs.LastEntry().Level)
+			assert.Contains(t, logs.LastEntry().Message, "/run is mounted read-only")
+		}
+	})
+
+	t.Run("replace", func(t *testing.T) {
+		cfg := defaultConfig()
+		cfg.ReplaceReadOnlyMounts = true
+		p := newTestPlugin(cfg)
+
+		adjust := &api.ContainerAdjustment{}
+		container := newProfileTestContainer(nil, readOnlyRun)
+		require.NoError(t, p.addSystemdTmpfsMounts(cfg, adjust, container, "test", nil, nil))
+
+		var removed, added bool
+		for _, m := range adjust.Mounts {
+			if dest, marked := m.IsMarkedForRemoval(); marked && dest == "/run" {
+				removed = true
+			}
+			if m.Destination == "/run" {
+				added = true
+				assert.Equal(t, "tmpfs", m.Type)
+				assert.Contains(t, m.Options, "rw")
+			}
+		}
+		assert.True(t, removed, "read-only /run removed")
+		assert.True(t, added, "tmpfs /run added")
+	})
+}
+
+func TestContainerWithoutMounts(t *testing.T) {
+	newContainer := func() *api.Container {
+		return &api.Container{
+			Name:  "test-container",
+			Args:  []string{"/sbin/init"},
+			Linux: &api.LinuxContainer{},
+			Id:    "test-container-id-12345",
+		}
+	}
+
+	// a missing cgroup mount is added by default
+	adjust, _, err := newTestPlugin(nil).CreateContainer(context.Background(), nil, newContainer())
+	require.NoError(t, err)
+	assert.NotNil(t, findMount(adjust.Mounts, "/sys/fs/cgroup"))
+
+	// and an error without addMissingCgroupMount
+	noAdd := newTestPlugin(configWith(func(c *Config) { c.AddMissingCgroupMount = false }))
+	_, _, err = noAdd.CreateContainer(context.Background(), nil, newContainer())
+	assert.ErrorContains(t, err, "cgroup mount required")
+
+	p := newTestPlugin(configWith(func(c *Config) {
+		c.DeferCgroupWithoutMounts = true
+		c.AddMissingCgroupMount = false
+	}))
+	hook := logtest.NewLocal(p.logs.base)
+	adjust, _, err = p.CreateContainer(context.Background(), nil, newContainer())
+	require.NoError(t, err)
+	assert.Nil(t, findMount(adjust.Mounts, "/sys/fs/cgroup"))
+	assert.NotNil(t, findMount(adjust.Mounts, "/run"))
+	assert.Contains(t, hook.AllEntries()[0].Message, "leaving the cgroup mount to the runtime")
+
+	// containers with mounts, but none for cgroups, still fail
+	container := newContainer()
+	container.Mounts = []*api.Mount{{Destination: "/data", Type: "bind", Source: "/srv/data"}}
+	_, _, err = p.CreateContainer(context.Background(), nil, container)
+	assert.ErrorContains(t, err, "cgroup mount required")
+}
+
+func TestWatchdogEnvironment(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Watchdog = Duration(30 * time.Second)
+
+	envOf := func(adjust *api.ContainerAdjustment) map[string]string {
+		env := map[string]string{}
+		for _, kv := range adjust.Env {
+			env[kv.Key] = kv.Value
+		}
+		return env
+	}
+
+	t.Run("injected", func(t *testing.T) {
+		adjust := &api.ContainerAdjustment{}
+		container := &api.Container{Env: []string{"PATH=/usr/bin"}}
+		setSystemdEnvironment(newAdjustmentTemplate(cfg), adjust, nil, container, "")
+
+		env := envOf(adjust)
+		assert.Equal(t, "30000000", env["WATCHDOG_USEC"])
+		assert.Equal(t, "1", env["WATCHDOG_PID"])
+	})
+
+	t.Run("already set", func(t *testing.T) {
+		adjust := &api.ContainerAdjustment{}
+		container := &api.Container{Env: []string{"WATCHDOG_USEC=5000000"}}
+		setSystemdEnvironment(newAdjustmentTemplate(cfg), adjust, nil, container, "")
+
+		env := envOf(adjust)
+		assert.NotContains(t, env, "WATCHDOG_USEC")
+		assert.NotContains(t, env, "WATCHDOG_PID")
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		adjust := &api.ContainerAdjustment{}
+		container := &api.Container{}
+		setSystemdEnvironment(newAdjustmentTemplate(defaultConfig()), adjust, nil, container, "")
+
+		assert.NotContains(t, envOf(adjust), "WATCHDOG_USEC")
+	})
+}
+
+func TestHookDeadline(t *testing.T) {
+	for _, policy := range []FailurePolicy{"", FailOpen, FailClosed} {
+		t.Run("policy "+string(policy), func(t *testing.T) {
+			cfg := defaultConfig()
+			cfg.HookTimeout = Duration(20 * time.Millisecond)
+			cfg.FailurePolicy = policy
+
+			p := newTestPlugin(cfg)
+			p.prober = slowProber{}
+			logs := logtest.NewLocal(p.logs.base)
+
+			container := newProfileTestContainer(map[string]string{})
+			adjust, updates, err := p.CreateContainer(context.Background(), nil, container)
+
+			assert.Nil(t, adjust)
+			assert.Nil(t, updates)
+			if policy == FailClosed {
+				assert.ErrorIs(t, err, context.DeadlineExceeded)
+				assert.ErrorContains(t, err, "step cgroup")
+			} else {
+				assert.NoError(t, err)
+			}
+
+			found := false
+			for _, e := range logs.AllEntries() {
+				if strings.Contains(e.Message, "step cgroup exceeded the hook deadline") {
+					found = true
+				}
+			}
+			assert.True(t, found, "deadline log entry naming the step")
+
+			assert.Equal(t, 1.0, testutil.ToFloat64(p.metrics.deadlineExceeded.WithLabelValues("cgroup")))
+			assert.Equal(t, 1, testutil.CollectAndCount(p.metrics.stepDuration))
+		})
+	}
+}
+
+func TestFailurePolicy(t *testing.T) {
+	readOnlyRun := &api.Mount{Destination: "/run", Type: "tmpfs", Source: "tmpfs", Options: []string{"ro"}}
+
+	tests := []struct {
+		name      string
+		soft      bool
+		container *api.Container
+		setup     func(p *plugin)
+	}{
+		{
+			name:      "read-only tmpfs",
+			soft:      true,
+			container: newProfileTestContainer(nil, readOnlyRun),
+		},
+		{
+			name:      "no cgroup filesystem",
+			soft:      true,
+			container: newProfileTestContainer(nil),
+			setup: func(p *plugin) {
+				p.prober = &fakeProber{paths: map[string]bool{}}
+			},
+		},
+		{
+			name: "no cgroup mount",
+			container: &api.Container{
+				Id:     "test-container-id-12345",
+				Args:   []string{"/sbin/init"},
+				Mounts: []*api.Mount{{Destination: "/data", Type: "bind", Source: "/srv/data"}},
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		for _, policy := range []FailurePolicy{"", FailOpen, FailClosed} {
+			t.Run(tc.name+" policy "+string(policy), func(t *testing.T) {
+				p := newTestPlugin(configWith(func(c *Config) {
+					c.FailurePolicy = policy
+					c.AddMissingCgroupMount = false
+				}))
+				if tc.setup != nil {
+					tc.setup(p)
+				}
+
+				adjust, _, err := p.CreateContainer(context.Background(), &api.PodSandbox{}, tc.container)
+
+				failClosed := policy == FailClosed || (policy == "" && !tc.soft)
+				switch {
+				case failClosed:
+					assert.Error(t, err)
+					assert.Nil(t, adjust)
+					assert.Empty(t, p.state.list())
+				case tc.soft:
+					// adjusted anyway
+					assert.NoError(t, err)
+					assert.NotNil(t, adjust)
+					assert.Len(t, p.state.list(), 1)
+				default:
+					// created without systemd support
+					assert.NoError(t, err)
+					assert.Nil(t, adjust)
+					assert.Empty(t, p.state.list())
+				}
+			})
+		}
+	}
+}
+
+func TestConcurrencyLimit(t *testing.T) {
+	cfg := configWith(func(c *Config) {
+		c.MaxConcurrentAdjustments = 2
+		c.HookTimeout = Duration(10 * time.Second)
+	})
+	p := newTestPlugin(cfg)
+	gate := &gateProber{gate: make(chan struct{}), prober: p.prober}
+	p.prober = gate
+
+	const containers = 5
+	var wg sync.WaitGroup
+	errs := make(chan error, containers)
+	for i := 0; i < containers; i++ {
+		container := newProfileTestContainer(nil)
+		container.Id = fmt.Sprintf("ctr-%d", i)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _, err := p.CreateContainer(context.Background(), nil, container)
+			errs <- err
+		}()
+	}
+
+	// two containers are stuck probing the host, the rest queue up
+	assert.Eventually(t, func() bool {
+		return testutil.ToFloat64(p.metrics.queueDepth) == containers-2
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, 0, len(p.state.list()))
+
+	close(gate.gate)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, containers, len(p.state.list()))
+	assert.Equal(t, 0.0, testutil.ToFloat64(p.metrics.queueDepth))
+}
+
+func TestConcurrentHooksWithReload(t *testing.T) {
+	p := newTestPlugin(nil)
+	pod := &api.PodSandbox{
+		Name:        "test-pod-systemd",
+		Annotations: map[string]string{},
+	}
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			cfg := defaultConfig()
+			cfg.Verbose = i%2 == 0
+			if i%3 == 0 {
+				cfg.Profile = profileNestedRuntime
+			}
+			require.NoError(t, p.setConfig(cfg))
+		}
+	}()
+
+	var workers sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for i := 0; i < 50; i++ {
+				container := newProfileTestContainer(map[string]string{})
+				adjust, _, err := p.CreateContainer(context.Background(), pod, container)
+				assert.NoError(t, err)
+				assert.NotNil(t, adjust)
+			}
+		}()
+	}
+
+	workers.Wait()
+	close(done)
+	wg.Wait()
+}
+
+func TestCreateContainerRedelivery(t *testing.T) {
+	p := newCgroupV1TestPlugin(configWith(func(c *Config) {
+		c.Profile = profileNestedRuntime
+		c.Watchdog = Duration(30 * time.Second)
+	}))
+	pod := &api.PodSandbox{
+		Id:          "pod",
+		Name:        "test-pod",
+		Namespace:   "default",
+		Annotations: map[string]string{"io.kubernetes.pod.uid": "uid"},
+	}
+	ctr := newProfileTestContainer(nil)
+	ctr.Id = "ctr"
+
+	first, _, err := p.CreateContainer(context.Background(), pod, ctr)
+	assert.NoError(t, err)
+	second, _, err := p.CreateContainer(context.Background(), pod, ctr)
+	assert.NoError(t, err)
+
+	assert.NotNil(t, first)
+	assert.Equal(t, first, second)
+	assertContainerGauge(t, p, `nri_systemd_containers{namespace="default",profile="nested-runtime"} 1`)
+}
+
+func TestExcludeMounts(t *testing.T) {
+	pod := &api.PodSandbox{Name: "test-pod"}
+
+	tests := []struct {
+		name     string
+		exclude  []string
+		excluded []string
+		kept     []string
+	}{
+		{
+			name:     "exact path",
+			exclude:  []string{"/tmp"},
+			excluded: []string{"/tmp"},
+			kept:     []string{"/run", "/run/lock", "/var/log/journal", "/sys/fs/cgroup"},
+		},
+		{
+			name:     "parent directory",
+			exclude:  []string{"/run"},
+			excluded: []string{"/run", "/run/lock"},
+			kept:     []string{"/tmp", "/var/log/journal"},
+		},
+		{
+			name:     "pattern",
+			exclude:  []string{"/var/*"},
+			excluded: []string{"/var/log/journal"},
+			kept:     []string{"/run", "/tmp"},
+		},
+		{
+			name:     "cgroup rewrite",
+			exclude:  []string{"/sys/fs/cgroup"},
+			excluded: []string{"/sys/fs/cgroup", "-/sys/fs/cgroup"},
+			kept:     []string{"/run", "/tmp"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestPlugin(configWith(func(c *Config) { c.ExcludeMounts = tt.exclude }))
+
+			adjust, _, err := p.CreateContainer(context.Background(), pod, newProfileTestContainer(nil))
+			assert.NoError(t, err)
+
+			for _, dest := range tt.excluded {
+				assert.Nil(t, findMount(adjust.Mounts, dest), dest)
+			}
+			for _, dest := range tt.kept {
+				assert.NotNil(t, findMount(adjust.Mounts, dest), dest)
+			}
+		})
+	}
+}
+
+func TestTmpfsCopyUp(t *testing.T) {
+	pod := &api.PodSandbox{Name: "test-pod"}
+	destinations := []string{"/run", "/run/lock", "/tmp", "/var/log/journal"}
+
+	for _, copyUp := range []bool{false, true} {
+		p := newTestPlugin(configWith(func(c *Config) { c.TmpfsCopyUp = copyUp }))
+
+		adjust, _, err := p.CreateContainer(context.Background(), pod, newProfileTestContainer(nil))
+		assert.NoError(t, err)
+
+		for _, dest := range destinations {
+			m := findMount(adjust.Mounts, dest)
+			if assert.NotNil(t, m, dest) {
+				if copyUp {
+					assert.Contains(t, m.Options, "tmpcopyup", dest)
+				} else {
+					assert.NotContains(t, m.Options, "tmpcopyup", dest)
+				}
+			}
+		}
+	}
+}
+
+func TestTmpfsCopyUpMinSize(t *testing.T) {
+	pod := &api.PodSandbox{Name: "test-pod"}
+
+	tests := []struct {
+		name     string
+		cfg      func(c *Config)
+		expected []string
+	}{
+		{
+			name: "default sizes",
+			cfg:  func(c *Config) { c.TmpfsCopyUp = true },
+		},
+		{
+			name: "small /run",
+			cfg: func(c *Config) {
+				c.TmpfsCopyUp = true
+				c.TmpfsMountOptions = map[string]TmpfsOptions{"/run": {Size: "size=2m"}}
+			},
+			expected: []string{"/run tmpfs has only 2m"},
+		},
+		{
+			name: "raised floor",
+			cfg: func(c *Config) {
+				c.TmpfsCopyUp = true
+				c.TmpfsCopyUpMinSize = "size=100m"
+			},
+			expected: []string{"/run tmpfs has only 64m", "/run/lock tmpfs has only 8m"},
+		},
+		{
+			name: "without copy-up",
+			cfg:  func(c *Config) { c.TmpfsMountOptions = map[string]TmpfsOptions{"/run": {Size: "size=2m"}} },
+		},
+		{
+			name: "disabled",
+			cfg: func(c *Config) {
+				c.TmpfsCopyUp = true
+				c.TmpfsCopyUpMinSize = ""
+				c.TmpfsMountOptions = map[string]TmpfsOptions{"/run": {Size: "size=2m"}}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestPlugin(configWith(tt.cfg))
+			logs := logtest.NewLocal(p.logs.base)
+
+			_, _, err := p.CreateContainer(context.Background(), pod, newProfileTestContainer(nil))
+			require.NoError(t, err)
+
+			var warnings []string
+			for _, e := range logs.AllEntries() {
+				if e.Level == logrus.WarnLevel {
+					warnings = append(warnings, e.Message)
+				}
+			}
+			require.Len(t, warnings, len(tt.expected))
+			for i, w := range tt.expected {
+				assert.Contains(t, warnings[i], w)
+			}
+		})
+	}
+}
+
+func TestTmpfsOwnership(t *testing.T) {
+	cfg, err := parseConfig([]byte(`
+tmpfsOptions:
+  uid: 1000
+  gid: "1000"
+tmpfsMountOptions:
+  /tmp:
+    uid: 0
+    mode: "1770"
+`))
+	require.NoError(t, err)
+	p := newTestPlugin(cfg)
+
+	adjust, _, err := p.CreateContainer(context.Background(), nil, newProfileTestContainer(nil))
+	require.NoError(t, err)
+
+	for dest, expected := range map[string][]string{
+		"/run":             {"rw", "rprivate", "nosuid", "nodev", "mode=0755", "uid=1000", "gid=1000", "size=64m"},
+		"/run/lock":        {"rw", "rprivate", "nosuid", "nodev", "mode=0755", "uid=1000", "gid=1000", "size=8m"},
+		"/tmp":             {"rw", "rprivate", "nosuid", "nodev", "mode=1770", "uid=0", "gid=1000", "size=256m"},
+		"/var/log/journal": {"rw", "rprivate", "nosuid", "nodev", "mode=0755", "uid=1000", "gid=1000", "size=128m"},
+	} {
+		m := findMount(adjust.Mounts, dest)
+		if assert.NotNil(t, m, dest) {
+			assert.Equal(t, expected, m.Options, dest)
+		}
+	}
+
+	// by default, neither uid nor gid are set
+	adjust, _, err = newTestPlugin(nil).CreateContainer(context.Background(), nil, newProfileTestContainer(nil))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"rw", "rprivate", "nosuid", "nodev", "mode=0755", "size=64m"}, findMount(adjust.Mounts, "/run").Options)
+}
+
+func TestTmpfsMounts(t *testing.T) {
+	cfg, err := parseConfig([]byte(`
+tmpfsMounts:
+- destination: /var/log/journal
+- destination: /run/user
+  mode: "700"
+  options: [noexec]
+- destination: /run
+optionalTmpfs: [/var/tmp]
+`))
+	require.NoError(t, err)
+	p := newTestPlugin(cfg)
+
+	adjust, _, err := p.CreateContainer(context.Background(), nil, newProfileTestContainer(nil))
+	require.NoError(t, err)
+
+	var tmpfs []string
+	for _, m := range adjust.Mounts {
+		if m.Type == "tmpfs" {
+			tmpfs = append(tmpfs, m.Destination)
+		}
+	}
+	// parents are mounted first, /tmp and /run/lock are left to the image
+	assert.Equal(t, []string{"/run", "/run/user", "/var/log/journal", "/var/tmp"}, tmpfs)
+	assert.Equal(t, []string{"rw", "rprivate", "nosuid", "nodev", "mode=0700", "size=64m", "noexec"}, findMount(adjust.Mounts, "/run/user").Options)
+	assert.Equal(t, []string{"rw", "rprivate", "nosuid", "nodev", "mode=0755", "size=64m"}, findMount(adjust.Mounts, "/run").Options)
+}
+
+func TestTmpfsSizes(t *testing.T) {
+	sizes := func(t *testing.T, cfg *Config) map[string][]string {
+		adjust, _, err := newTestPlugin(cfg).CreateContainer(context.Background(), nil, newProfileTestContainer(nil))
+		require.NoError(t, err)
+		sizes := map[string][]string{}
+		for _, m := range adjust.Mounts {
+			for _, opt := range m.Options {
+				if strings.HasPrefix(opt, "size=") {
+					sizes[m.Destination] = append(sizes[m.Destination], opt)
+				}
+			}
+		}
+		return sizes
+	}
+
+	t.Run("defaults", func(t *testing.T) {
+		assert.Equal(t, map[string][]string{
+			"/run":             {"size=64m"},
+			"/run/lock":        {"size=8m"},
+			"/tmp":             {"size=256m"},
+			"/var/log/journal": {"size=128m"},
+		}, sizes(t, nil))
+	})
+
+	t.Run("configured", func(t *testing.T) {
+		cfg, err := parseConfig([]byte(`
+tmpfsMounts:
+- destination: /run
+  size: 32m
+- destination: /tmp
+  options: [size=1g, noexec]
+- destination: /run/user
+- destination: /var/log/journal
+tmpfsMountOptions:
+  /var/log/journal:
+    size: 16m
+`))
+		require.NoError(t, err)
+		// a size option is rendered once, tmpfsMountOptions win
+		assert.Equal(t, map[string][]string{
+			"/run":             {"size=32m"},
+			"/tmp":             {"size=1g"},
+			"/run/user":        {"size=64m"},
+			"/var/log/journal": {"size=16m"},
+		}, sizes(t, cfg))
+	})
+}
+
+func TestOptionalTmpfs(t *testing.T) {
+	annotated := func(value string, mounts ...*api.Mount) *api.Container {
+		return newProfileTestContainer(map[string]string{optionalTmpfsAnnotation: value}, mounts...)
+	}
+
+	tests := []struct {
+		name      string
+		cfg       *Config
+		container *api.Container
+		expected  []string
+	}{
+		{
+			name:      "off by default",
+			container: newProfileTestContainer(nil),
+		},
+		{
+			name:      "enabled by annotation",
+			container: annotated("/var/tmp"),
+			expected:  []string{"/var/tmp"},
+		},
+		{
+			name:      "enabled by configuration",
+			cfg:       configWith(func(c *Config) { c.OptionalTmpfs = []string{"/var/cache"} }),
+			container: newProfileTestContainer(nil),
+			expected:  []string{"/var/cache"},
+		},
+		{
+			name:      "unknown destination ignored",
+			container: annotated("/var/tmp, /srv, /run"),
+			expected:  []string{"/var/tmp"},
+		},
+		{
+			name:      "existing mount kept",
+			container: annotated("/var/tmp,/var/cache", &api.Mount{Destination: "/var/cache", Type: "bind", Source: "/data"}),
+			expected:  []string{"/var/tmp"},
+		},
+		{
+			name:      "parent mount not shadowed",
+			container: annotated("/var/tmp,/var/cache", &api.Mount{Destination: "/var", Type: "bind", Source: "/data"}),
+		},
+		{
+			name:      "child mount not hidden",
+			container: annotated("/var/tmp,/var/cache", &api.Mount{Destination: "/var/cache/apt", Type: "bind", Source: "/data"}),
+			expected:  []string{"/var/tmp"},
+		},
+		{
+			name:      "added with runtimeTmpfs",
+			cfg:       configWith(func(c *Config) { c.RuntimeTmpfs = true }),
+			container: annotated("/var/cache"),
+			expected:  []string{"/var/cache"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			adjust, _, err := newTestPlugin(tc.cfg).CreateContainer(context.Background(), nil, tc.container)
+			require.NoError(t, err)
+
+			var added []string
+			for _, dest := range []string{"/var/tmp", "/var/cache"} {
+				if findMount(adjust.Mounts, dest) != nil {
+					added = append(added, dest)
+				}
+			}
+			assert.Equal(t, tc.expected, added)
+		})
+	}
+
+	cfg, err := parseConfig([]byte(`
+tmpfsMountOptions:
+  /var/cache:
+    size: 1g
+`))
+	require.NoError(t, err)
+	adjust, _, err := newTestPlugin(cfg).CreateContainer(context.Background(), nil, annotated("/var/tmp,/var/cache"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"rw", "rprivate", "nosuid", "nodev", "mode=1777", "size=256m"}, findMount(adjust.Mounts, "/var/tmp").Options)
+	assert.Equal(t, []string{"rw", "rprivate", "nosuid", "nodev", "mode=0755", "size=1g"}, findMount(adjust.Mounts, "/var/cache").Options)
+
+	// /var/tmp enabled for all containers, with its own mode and size
+	cfg, err = parseConfig([]byte(`
+optionalTmpfs: [/var/tmp]
+tmpfsMountOptions:
+  /var/tmp:
+    mode: "1770"
+    size: 2g
+`))
+	require.NoError(t, err)
+	adjust, _, err = newTestPlugin(cfg).CreateContainer(context.Background(), nil, newProfileTestContainer(nil))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"rw", "rprivate", "nosuid", "nodev", "mode=1770", "size=2g"}, findMount(adjust.Mounts, "/var/tmp").Options)
+	assert.Nil(t, findMount(adjust.Mounts, "/var/cache"))
+}
+
+func TestNestedTmpfs(t *testing.T) {
+	indexOf := func(mounts []*api.Mount, dest string) int {
+		for i, m := range mounts {
+			if m.Destination == dest {
+				return i
+			}
+		}
+		return -1
+	}
+
+	adjust, _, err := newTestPlugin(nil).CreateContainer(context.Background(), nil, newProfileTestContainer(nil))
+	require.NoError(t, err)
+	run, lock := indexOf(adjust.Mounts, "/run"), indexOf(adjust.Mounts, "/run/lock")
+	require.NotEqual(t, -1, run)
+	require.NotEqual(t, -1, lock)
+	assert.Less(t, run, lock, "/run must be mounted before /run/lock")
+
+	p := newTestPlugin(configWith(func(c *Config) { c.SkipNestedTmpfs = true }))
+	adjust, _, err = p.CreateContainer(context.Background(), nil, newProfileTestContainer(nil))
+	require.NoError(t, err)
+	assert.NotNil(t, findMount(adjust.Mounts, "/run"))
+	assert.Nil(t, findMount(adjust.Mounts, "/run/lock"))
+	assert.NotNil(t, findMount(adjust.Mounts, "/tmp"))
+
+	// a writable tmpfs of the container covers /run/lock as well
+	adjust, _, err = p.CreateContainer(context.Background(), nil, newProfileTestContainer(nil,
+		&api.Mount{Destination: "/run", Type: "tmpfs", Source: "tmpfs", Options: []string{"rw"}}))
+	require.NoError(t, err)
+	assert.Nil(t, findMount(adjust.Mounts, "/run"))
+	assert.Nil(t, findMount(adjust.Mounts, "/run/lock"))
+
+	// but a bind mount does not
+	adjust, _, err = p.CreateContainer(context.Background(), nil, newProfileTestContainer(nil,
+		&api.Mount{Destination: "/run", Type: "bind", Source: "/host/run", Options: []string{"rw"}}))
+	require.NoError(t, err)
+	assert.NotNil(t, findMount(adjust.Mounts, "/run/lock"))
+}
+
+func TestContainerEnvironmentKept(t *testing.T) {
+	p := newTestPlugin(nil)
+	pod := &api.PodSandbox{Name: "test-pod"}
+	container := newProfileTestContainer(nil)
+	container.Env = []string{"container=systemd-nspawn"}
+
+	adjust, _, err := p.CreateContainer(context.Background(), pod, container)
+	assert.NoError(t, err)
+
+	for _, env := range adjust.Env {
+		assert.NotEqual(t, "container", env.Key)
+	}
+	assert.Contains(t, adjust.Env, &api.KeyValue{Key: "container_uuid", Value: container.Id})
+}
+
+func TestEnvCasing(t *testing.T) {
+	env := func(adjust *api.ContainerAdjustment) map[string]string {
+		values := map[string]string{}
+		for _, e := range adjust.Env {
+			values[e.Key] = e.Value
+		}
+		return values
+	}
+	pod := &api.PodSandbox{Name: "test-pod", Annotations: map[string]string{"io.kubernetes.pod.uid": "pod-uid"}}
+
+	// lowercase only by default
+	adjust, _, err := newTestPlugin(nil).CreateContainer(context.Background(), pod, newProfileTestContainer(nil))
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"container": "other", "container_uuid": "pod-uid"}, env(adjust))
+
+	p := newTestPlugin(configWith(func(c *Config) { c.EnvCasing = EnvCasingBoth }))
+	adjust, _, err = p.CreateContainer(context.Background(), pod, newProfileTestContainer(nil))
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"container":      "other",
+		"container_uuid": "pod-uid",
+		"CONTAINER":      "other",
+		"CONTAINER_UUID": "pod-uid",
+	}, env(adjust))
+
+	// variables set by the image are kept and mirrored
+	container := newProfileTestContainer(nil)
+	container.Env = []string{"container=systemd-nspawn", "CONTAINER_UUID=image-uuid"}
+	adjust, _, err = p.CreateContainer(context.Background(), pod, container)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"container_uuid": "pod-uid",
+		"CONTAINER":      "systemd-nspawn",
+	}, env(adjust))
+}
+
+func TestPinnedUUID(t *testing.T) {
+	const pinned = "6f1c2a9b-e3d0-4c1a-9b2e-7d3f4a5b6c7d"
+	uuidOf := func(adjust *api.ContainerAdjustment, key string) string {
+		value := ""
+		for _, e := range adjust.Env {
+			if e.Key == key {
+				value = e.Value
+			}
+		}
+		return value
+	}
+	pod := &api.PodSandbox{Name: "test-pod", Annotations: map[string]string{"io.kubernetes.pod.uid": "pod-uid"}}
+
+	tests := []struct {
+		name     string
+		value    string
+		env      []string
+		expected string
+		warning  bool
+	}{
+		{name: "pinned", value: pinned, expected: pinned},
+		{name: "pinned over image", value: pinned, env: []string{"container_uuid=image-uuid"}, expected: pinned},
+		{name: "invalid", value: "not-a-uuid", expected: "pod-uid", warning: true},
+		{name: "wrong variant", value: "6f1c2a9b-e3d0-4c1a-cb2e-7d3f4a5b6c7d", expected: "pod-uid", warning: true},
+		{name: "invalid with image", value: "42", env: []string{"container_uuid=image-uuid"}, warning: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			p := newTestPlugin(nil)
+			hook := logtest.NewLocal(p.logs.base)
+			container := newProfileTestContainer(map[string]string{uuidAnnotation: tc.value})
+			container.Env = tc.env
+
+			adjust, _, err := p.CreateContainer(context.Background(), pod, container)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, uuidOf(adjust, "container_uuid"))
+
+			warned := false
+			for _, e := range hook.AllEntries() {
+				warned = warned || strings.Contains(e.Message, uuidAnnotation)
+			}
+			assert.Equal(t, tc.warning, warned)
+		})
+	}
+
+	// the machine ID is derived from the pinned UUID in either casing
+	p := newTestPlugin(configWith(func(c *Config) { c.EnvCasing = EnvCasingBoth }))
+	adjust, _, err := p.CreateContainer(context.Background(), pod, newProfileTestContainer(map[string]string{uuidAnnotation: pinned}))
+	require.NoError(t, err)
+	assert.Equal(t, pinned, uuidOf(adjust, "container_uuid"))
+	assert.Equal(t, pinned, uuidOf(adjust, "CONTAINER_UUID"))
+}
+
+func TestRunsAsPID1(t *testing.T) {
+	ownPID := []*api.LinuxNamespace{{Type: "pid"}, {Type: "mount"}}
+	podPID := []*api.LinuxNamespace{{Type: "pid", Path: "/proc/4242/ns/pid"}, {Type: "mount"}}
+	hostPID := []*api.LinuxNamespace{{Type: "mount"}}
+
+	tests := []struct {
+		name           string
+		namespaces     []*api.LinuxNamespace
+		podAnnotations map[string]string
+		annotations    map[string]string
+		expected       bool
+		expectErr      bool
+	}{
+		{name: "own pid namespace", namespaces: ownPID, expected: true},
+		{name: "shared process namespace", namespaces: podPID, expected: false},
+		{name: "host pid namespace", namespaces: hostPID, expected: false},
+		{name: "no namespace information", expected: true},
+		{
+			name:        "container annotation",
+			namespaces:  ownPID,
+			annotations: map[string]string{pid1Annotation: "false"},
+			expected:    false,
+		},
+		{
+			name:           "pod annotation",
+			namespaces:     podPID,
+			podAnnotations: map[string]string{pid1Annotation: "true"},
+			expected:       true,
+		},
+		{
+			name:           "container annotation over pod annotation",
+			namespaces:     ownPID,
+			podAnnotations: map[string]string{pid1Annotation: "false"},
+			annotations:    map[string]string{pid1Annotation: "true"},
+			expected:       true,
+		},
+		{
+			name:        "invalid annotation",
+			annotations: map[string]string{pid1Annotation: "sometimes"},
+			expectErr:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := &api.PodSandbox{Annotations: tt.podAnnotations}
+			container := newProfileTestContainer(tt.annotations)
+			container.Linux.Namespaces = tt.namespaces
+
+			pid1, err := runsAsPID1(pod, container)
+			if tt.expectErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, pid1)
+		})
+	}
+}
+
+func TestNonPID1Container(t *testing.T) {
+	newContainer := func() *api.Container {
+		container := newProfileTestContainer(nil)
+		container.Linux.Namespaces = []*api.LinuxNamespace{{Type: "pid", Path: "/proc/4242/ns/pid"}}
+		return container
+	}
+
+	t.Run("adjusted by default", func(t *testing.T) {
+		p := newTestPlugin(nil)
+		logs := logtest.NewLocal(p.logs.base)
+
+		adjust, _, err := p.CreateContainer(context.Background(), nil, newContainer())
+		assert.NoError(t, err)
+		assert.NotNil(t, adjust)
+
+		warned := false
+		for _, e := range logs.AllEntries() {
+			if e.Level == logrus.WarnLevel && strings.Contains(e.Message, "does not run as PID 1") {
+				warned = true
+			}
+		}
+		assert.True(t, warned, "warning about systemd not running as PID 1")
+	})
+
+	t.Run("skipped", func(t *testing.T) {
+		p := newTestPlugin(configWith(func(c *Config) { c.SkipNonPID1 = true }))
+		logs := logtest.NewLocal(p.logs.base)
+
+		adjust, _, err := p.CreateContainer(context.Background(), nil, newContainer())
+		assert.NoError(t, err)
+		assert.Nil(t, adjust)
+		assert.Empty(t, p.state.list())
+		assert.Equal(t, logrus.WarnLevel, logs.LastEntry().Level)
+		assert.Contains(t, logs.LastEntry().Message, "not adjusted: systemd does not run as PID 1, skipNonPid1 is on")
+	})
+}
+
+// TestMemorySizedTmpfsMount checks that tmpfs mounts are sized from the
+// memory limit of the container.
+func TestMemorySizedTmpfsMount(t *testing.T) {
+	const gib = 1 << 30
+	p := newTestPlugin(configWith(func(c *Config) {
+		c.TmpfsMountOptions = map[string]TmpfsOptions{
+			"/run": {MemorySize: 5, MinSize: "size=16m", MaxSize: "size=256m"},
+			"/tmp": {MemorySize: 25},
+		}
+	}))
+	container := newProfileTestContainer(nil)
+	container.Linux.Resources = &api.LinuxResources{Memory: &api.LinuxMemory{Limit: api.Int64(2 * gib)}}
+
+	adjust, _, err := p.CreateContainer(context.Background(), &api.PodSandbox{}, container)
+	require.NoError(t, err)
+	assert.Contains(t, findMount(adjust.Mounts, "/run").Options, "size=104857k")
+	assert.Contains(t, findMount(adjust.Mounts, "/tmp").Options, "size=524288k")
+
+	// the default size applies without a limit
+	adjust, _, err = p.CreateContainer(context.Background(), &api.PodSandbox{}, newProfileTestContainer(nil))
+	require.NoError(t, err)
+	assert.Contains(t, findMount(adjust.Mounts, "/tmp").Options, "size=256m")
+}
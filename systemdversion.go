@@ -0,0 +1,75 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/nri/pkg/api"
+)
+
+const (
+	// systemdVersionAnnotation declares the version of systemd in the image,
+	// like "245", typically stamped by image build pipelines. Set on the pod
+	// it applies to all containers of the pod without their own annotation.
+	systemdVersionAnnotation = "io.systemd.container/systemd-version"
+
+	// defaultMinSystemdVersionV2 is the first systemd version booting
+	// reliably in a container on a host with only the unified cgroup
+	// hierarchy.
+	defaultMinSystemdVersionV2 = 239
+)
+
+// parseSystemdVersion parses a systemd version like "245", also accepting
+// the point releases and package versions of distributions, like "245.4"
+// or "239-58.el8".
+func parseSystemdVersion(s string) (int, error) {
+	digits, _, _ := strings.Cut(strings.TrimSpace(s), ".")
+	digits, _, _ = strings.Cut(digits, "-")
+	version, err := strconv.Atoi(digits)
+	if err != nil || version <= 0 {
+		return 0, fmt.Errorf("invalid systemd version %q", s)
+	}
+	return version, nil
+}
+
+// checkSystemdVersion fails for containers declaring a systemd version too
+// old for the cgroup v2 host, which would keep restarting as systemd fails
+// to boot. Containers without the annotation are not checked.
+func (p *plugin) checkSystemdVersion(ctx context.Context, cfg *Config, pod *api.PodSandbox, container *api.Container) error {
+	value, ok := lookupAnnotation(pod, container, systemdVersionAnnotation)
+	if !ok || cfg.MinSystemdVersionV2 == 0 {
+		return nil
+	}
+	version, err := parseSystemdVersion(value)
+	if err != nil {
+		return fmt.Errorf("invalid %s annotation: %w", systemdVersionAnnotation, err)
+	}
+
+	host, err := p.host(ctx)
+	if err != nil {
+		return err
+	}
+	if host.CgroupMode != cgroupV2 || version >= cfg.MinSystemdVersionV2 {
+		return nil
+	}
+	return fmt.Errorf("systemd %d of the image cannot boot on this cgroup v2 host, which needs systemd %d or later (%s annotation)",
+		version, cfg.MinSystemdVersionV2, systemdVersionAnnotation)
+}
@@ -0,0 +1,93 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSystemdVersion(t *testing.T) {
+	for value, expected := range map[string]int{"245": 245, " 252 ": 252, "245.4": 245, "239-58.el8": 239} {
+		version, err := parseSystemdVersion(value)
+		require.NoError(t, err, value)
+		assert.Equal(t, expected, version, value)
+	}
+	for _, value := range []string{"", "latest", "v245", "0", "-1", "245a"} {
+		_, err := parseSystemdVersion(value)
+		assert.Error(t, err, value)
+	}
+}
+
+func TestSystemdVersionGate(t *testing.T) {
+	withVersion := func(version string) map[string]string {
+		return map[string]string{systemdVersionAnnotation: version}
+	}
+
+	t.Run("compatible version is adjusted", func(t *testing.T) {
+		p := newTestPlugin(nil)
+		adjust, _, err := p.CreateContainer(context.Background(), nil, newProfileTestContainer(withVersion("245")))
+		require.NoError(t, err)
+		assert.NotNil(t, findMount(adjust.Mounts, "/run"))
+	})
+
+	t.Run("without annotation", func(t *testing.T) {
+		p := newTestPlugin(nil)
+		adjust, _, err := p.CreateContainer(context.Background(), nil, newProfileTestContainer(nil))
+		require.NoError(t, err)
+		assert.NotNil(t, adjust)
+	})
+
+	t.Run("incompatible version fails on cgroup v2", func(t *testing.T) {
+		p := newTestPlugin(nil)
+		_, _, err := p.CreateContainer(context.Background(), nil, newProfileTestContainer(withVersion("219")))
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "systemd 219")
+		assert.Contains(t, err.Error(), "systemd 239 or later")
+	})
+
+	t.Run("incompatible version on cgroup v1", func(t *testing.T) {
+		p := newCgroupV1TestPlugin(nil)
+		adjust, _, err := p.CreateContainer(context.Background(), nil, newProfileTestContainer(withVersion("219")))
+		require.NoError(t, err)
+		assert.NotNil(t, adjust)
+	})
+
+	t.Run("incompatible version fails open by policy", func(t *testing.T) {
+		p := newTestPlugin(configWith(func(c *Config) { c.FailurePolicy = FailOpen }))
+		adjust, _, err := p.CreateContainer(context.Background(), nil, newProfileTestContainer(withVersion("219")))
+		assert.NoError(t, err)
+		assert.Nil(t, adjust)
+	})
+
+	t.Run("check disabled", func(t *testing.T) {
+		p := newTestPlugin(configWith(func(c *Config) { c.MinSystemdVersionV2 = 0 }))
+		adjust, _, err := p.CreateContainer(context.Background(), nil, newProfileTestContainer(withVersion("219")))
+		require.NoError(t, err)
+		assert.NotNil(t, adjust)
+	})
+
+	t.Run("unparseable version", func(t *testing.T) {
+		p := newTestPlugin(nil)
+		_, _, err := p.CreateContainer(context.Background(), nil, newProfileTestContainer(withVersion("latest")))
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), systemdVersionAnnotation)
+	})
+}
@@ -0,0 +1,108 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"slices"
+	"strconv"
+
+	"github.com/containerd/nri/pkg/api"
+)
+
+// adjustmentTemplate holds the parts of adjusting a systemd container which
+// only depend on the configuration, computed once per configuration rather
+// than for every container. Templates are never changed, adjustments get
+// copies of their parts.
+type adjustmentTemplate struct {
+	cfg *Config
+
+	// mounts are the tmpfs mounts for systemd of the configuration.
+	mounts []systemdTmpfsMount
+
+	// tmpfsOptions are the mount options of the tmpfs mounts for systemd,
+	// by destination. Mounts sized from the memory limit of the container
+	// are missing.
+	tmpfsOptions map[string][]string
+
+	// watchdogUsec is the WATCHDOG_USEC of the systemd watchdog, empty
+	// without.
+	watchdogUsec string
+}
+
+func newAdjustmentTemplate(cfg *Config) *adjustmentTemplate {
+	mounts := cfg.systemdTmpfsMounts()
+	t := &adjustmentTemplate{
+		cfg:          cfg,
+		mounts:       mounts,
+		tmpfsOptions: make(map[string][]string, len(mounts)),
+	}
+	for _, m := range mounts {
+		if opts := m.options(cfg); opts.MemorySize == 0 {
+			t.tmpfsOptions[m.dest] = tmpfsMountOptions(cfg, m, opts)
+		}
+	}
+	if cfg.Watchdog > 0 {
+		t.watchdogUsec = strconv.FormatInt(cfg.Watchdog.Duration().Microseconds(), 10)
+	}
+	return t
+}
+
+// template returns the adjustment template of the configuration: the one
+// of the current configuration, computed when it was set, or a new one for
+// configurations derived per container, e.g. with the tmpfs options of its
+// namespace.
+func (p *plugin) template(cfg *Config) *adjustmentTemplate {
+	if t := p.tmpl.Load(); t != nil && t.cfg == cfg {
+		return t
+	}
+	return newAdjustmentTemplate(cfg)
+}
+
+// options returns the tmpfs options of the mount in the configuration.
+func (m systemdTmpfsMount) options(cfg *Config) TmpfsOptions {
+	return cfg.TmpfsMountOptions[m.dest].merge(cfg.TmpfsOptions).merge(TmpfsOptions{Mode: m.mode, Size: m.size})
+}
+
+// tmpfsMountOptions returns the mount options of the tmpfs mount m for
+// systemd with the given tmpfs options.
+func tmpfsMountOptions(cfg *Config, m systemdTmpfsMount, opts TmpfsOptions) []string {
+	options := append([]string{"rw", "rprivate", "nosuid", "nodev"}, opts.mountOptions()...)
+	options = append(options, m.extra...)
+	if cfg.TmpfsCopyUp {
+		// runc and crun copy the image content shadowed by the tmpfs into
+		// it, other runtimes ignore the option
+		options = append(options, "tmpcopyup")
+	}
+	return options
+}
+
+// tmpfsMount returns the tmpfs mount for systemd at the destination of m
+// for the container.
+func (t *adjustmentTemplate) tmpfsMount(m systemdTmpfsMount, container *api.Container) *api.Mount {
+	options, ok := t.tmpfsOptions[m.dest]
+	if ok {
+		options = slices.Clone(options)
+	} else {
+		options = tmpfsMountOptions(t.cfg, m, m.options(t.cfg).sized(memoryLimit(container)))
+	}
+	return &api.Mount{
+		Destination: m.dest,
+		Type:        "tmpfs",
+		Source:      "tmpfs",
+		Options:     options,
+	}
+}
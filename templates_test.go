@@ -0,0 +1,122 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/containerd/nri/pkg/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestAdjustmentTemplate checks that adjusting containers with the cached
+// template of the configuration gives the same adjustments as computing
+// them for every container.
+func TestAdjustmentTemplate(t *testing.T) {
+	const gib = 1 << 30
+	uid := OwnerID(1000)
+
+	configs := map[string]func(c *Config){
+		"default":  func(c *Config) {},
+		"copy-up":  func(c *Config) { c.TmpfsCopyUp = true },
+		"watchdog": func(c *Config) { c.Watchdog = Duration(3 * time.Minute) },
+		"ownership": func(c *Config) {
+			c.TmpfsOptions = TmpfsOptions{Size: "size=64m", UID: &uid}
+			c.TmpfsMountOptions = map[string]TmpfsOptions{"/tmp": {Mode: "1770"}}
+		},
+		"memory-sized": func(c *Config) {
+			c.TmpfsMountOptions = map[string]TmpfsOptions{
+				"/run": {MemorySize: 5, MinSize: "size=16m", MaxSize: "size=256m"},
+			}
+		},
+		"namespace": func(c *Config) {
+			c.NamespaceTmpfs = map[string]NamespaceTmpfs{
+				"batch": {TmpfsOptions: TmpfsOptions{Size: "size=512m"}},
+			}
+		},
+	}
+
+	limited := newProfileTestContainer(nil)
+	limited.Linux.Resources = &api.LinuxResources{Memory: &api.LinuxMemory{Limit: api.Int64(2 * gib)}}
+	containers := map[string]func() *api.Container{
+		"plain":   func() *api.Container { return newProfileTestContainer(nil) },
+		"limited": func() *api.Container { return limited },
+		"overridden": func() *api.Container {
+			return newProfileTestContainer(map[string]string{configAnnotation: "tmpfsMountOptions:\n  /tmp:\n    size: 1g\n"})
+		},
+	}
+	pods := []*api.PodSandbox{
+		nil,
+		{Name: "web-0", Namespace: "apps"},
+		{Name: "job-0", Namespace: "batch"},
+	}
+
+	for name, fn := range configs {
+		cached := newTestPlugin(configWith(fn))
+		uncached := newTestPlugin(configWith(fn))
+		require.Same(t, cached.tmpl.Load(), cached.template(cached.config()), name)
+		for ctrName, container := range containers {
+			for _, pod := range pods {
+				expected, _, err := cached.CreateContainer(context.Background(), pod, container())
+				require.NoError(t, err)
+				uncached.tmpl.Store(nil)
+				actual, _, err := uncached.CreateContainer(context.Background(), pod, container())
+				require.NoError(t, err)
+				assert.Equal(t, expected, actual, "%s: %s in %v", name, ctrName, pod)
+			}
+		}
+	}
+}
+
+// TestAdjustmentTemplateUnchanged checks that adjustments get copies of the
+// template, so that changing them leaves later adjustments alone.
+func TestAdjustmentTemplateUnchanged(t *testing.T) {
+	p := newTestPlugin(nil)
+
+	adjust, _, err := p.CreateContainer(context.Background(), nil, newProfileTestContainer(nil))
+	require.NoError(t, err)
+	m := findMount(adjust.Mounts, "/run")
+	require.NotNil(t, m)
+	expected := append([]string(nil), m.Options...)
+	m.Options[0] = "ro"
+
+	adjust, _, err = p.CreateContainer(context.Background(), nil, newProfileTestContainer(nil))
+	require.NoError(t, err)
+	assert.Equal(t, expected, findMount(adjust.Mounts, "/run").Options)
+}
+
+// BenchmarkCreateContainer measures adjusting a systemd container with the
+// default configuration.
+func BenchmarkCreateContainer(b *testing.B) {
+	p := newTestPlugin(configWith(func(c *Config) { c.StateDir = b.TempDir() }))
+	pod := &api.PodSandbox{
+		Id:          "pod",
+		Name:        "web-0",
+		Namespace:   "apps",
+		Annotations: map[string]string{"io.kubernetes.pod.uid": "uid"},
+	}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := p.CreateContainer(context.Background(), pod, newProfileTestContainer(nil)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/nri/pkg/api"
+)
+
+// tmpfsMountsAnnotation adds or overrides tmpfs mounts for systemd for a
+// container, as entries of a destination with optional mount options,
+// separated by semicolons, e.g. "/run:size=128m,mode=755;/tmp:size=1g".
+// Set on the pod it applies to all containers of the pod without their
+// own annotation.
+const tmpfsMountsAnnotation = "io.systemd.container/tmpfs-mounts"
+
+// tmpfsAnnotationOptions are the mount options besides size and mode the
+// annotation may set. Options weakening the mounts, like suid or dev, are
+// left to the configuration.
+var tmpfsAnnotationOptions = []string{"noexec", "exec", "noatime", "relatime", "strictatime"}
+
+// tmpfsMountEntry is an entry of the tmpfs-mounts annotation.
+type tmpfsMountEntry struct {
+	dest  string
+	mode  TmpfsMode
+	size  TmpfsSize
+	extra []string
+}
+
+// parseTmpfsMountsAnnotation parses the value of the tmpfs-mounts
+// annotation.
+func parseTmpfsMountsAnnotation(value string) ([]tmpfsMountEntry, error) {
+	var entries []tmpfsMountEntry
+	seen := map[string]bool{}
+	for _, item := range strings.Split(value, ";") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		dest, options, _ := strings.Cut(item, ":")
+		if !path.IsAbs(dest) || path.Clean(dest) != dest || dest == "/" {
+			return nil, fmt.Errorf("invalid destination %q, must be a clean absolute path other than /", dest)
+		}
+		if seen[dest] {
+			return nil, fmt.Errorf("destination %s listed twice", dest)
+		}
+		seen[dest] = true
+
+		e := tmpfsMountEntry{dest: dest}
+		if options == "" {
+			entries = append(entries, e)
+			continue
+		}
+		for _, opt := range strings.Split(options, ",") {
+			opt = strings.TrimSpace(opt)
+			var err error
+			switch {
+			case strings.HasPrefix(opt, "size="):
+				// the kernel takes the suffixes in either case
+				e.size, err = parseTmpfsSize(strings.ToLower(opt))
+			case strings.HasPrefix(opt, "mode="):
+				e.mode, err = parseTmpfsMode(opt)
+			case strings.HasPrefix(opt, "nr_inodes="):
+				if _, perr := strconv.ParseUint(strings.TrimPrefix(opt, "nr_inodes="), 10, 64); perr != nil {
+					err = fmt.Errorf("invalid option %q, must be a number of inodes", opt)
+				}
+				e.extra = append(e.extra, opt)
+			case slices.Contains(tmpfsAnnotationOptions, opt):
+				e.extra = append(e.extra, opt)
+			default:
+				err = fmt.Errorf("unsupported option %q, must be size, mode, nr_inodes or one of %s",
+					opt, strings.Join(tmpfsAnnotationOptions, ", "))
+			}
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", dest, err)
+			}
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// applyTmpfsMountsAnnotation returns the configuration with the tmpfs
+// mounts of the tmpfs-mounts annotation of the container added to its own,
+// or overriding them. Their mode and size take precedence over the tmpfs
+// options of the configuration. Without the annotation, the configuration
+// is returned unchanged.
+func applyTmpfsMountsAnnotation(cfg *Config, pod *api.PodSandbox, container *api.Container) (*Config, error) {
+	value, ok := lookupAnnotation(pod, container, tmpfsMountsAnnotation)
+	if !ok {
+		return cfg, nil
+	}
+	entries, err := parseTmpfsMountsAnnotation(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s annotation: %w", tmpfsMountsAnnotation, err)
+	}
+
+	mounts := slices.Clone(cfg.TmpfsMounts)
+	if len(mounts) == 0 {
+		for _, m := range systemdTmpfsMounts {
+			if !m.optional {
+				mounts = append(mounts, TmpfsMountSpec{Destination: m.dest, Mode: m.mode, Size: m.size})
+			}
+		}
+	}
+	options := map[string]TmpfsOptions{}
+	for _, e := range entries {
+		i := slices.IndexFunc(mounts, func(s TmpfsMountSpec) bool { return s.Destination == e.dest })
+		if i < 0 {
+			mounts = append(mounts, TmpfsMountSpec{Destination: e.dest})
+			i = len(mounts) - 1
+		}
+		// annotated mounts are regular ones, even at the destination of an
+		// optional one
+		if m := cfg.findSystemdTmpfsMount(e.dest); m != nil && m.optional {
+			mounts[i].Mode, mounts[i].Size = m.mode, m.size
+		}
+		mounts[i].Options = slices.Concat(mounts[i].Options, e.extra)
+		options[e.dest] = TmpfsOptions{Mode: e.mode, Size: e.size}
+	}
+
+	annotated := *cfg
+	annotated.TmpfsMounts = mounts
+	annotated.OptionalTmpfs = slices.DeleteFunc(slices.Clone(cfg.OptionalTmpfs), func(dest string) bool {
+		_, ok := options[dest]
+		return ok
+	})
+
+	// the annotation takes precedence over the tmpfs options per field.
+	// Sizing from the memory limit would take precedence over an annotated
+	// size, so it moves from the general options to those of the mounts,
+	// where it is dropped for annotated sizes.
+	sizing := TmpfsOptions{MemorySize: cfg.TmpfsOptions.MemorySize, MinSize: cfg.TmpfsOptions.MinSize, MaxSize: cfg.TmpfsOptions.MaxSize}
+	annotated.TmpfsOptions.MemorySize, annotated.TmpfsOptions.MinSize, annotated.TmpfsOptions.MaxSize = 0, "", ""
+	annotated.TmpfsMountOptions = map[string]TmpfsOptions{}
+	for _, m := range annotated.systemdTmpfsMounts() {
+		opts := cfg.TmpfsMountOptions[m.dest].merge(sizing)
+		if a, ok := options[m.dest]; ok {
+			if a.Size != "" {
+				opts.MemorySize = 0
+			}
+			opts = a.merge(opts)
+		}
+		if opts != (TmpfsOptions{}) {
+			annotated.TmpfsMountOptions[m.dest] = opts
+		}
+	}
+	if err := annotated.validate(); err != nil {
+		return nil, fmt.Errorf("invalid %s annotation: %w", tmpfsMountsAnnotation, err)
+	}
+	return &annotated, nil
+}
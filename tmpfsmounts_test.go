@@ -0,0 +1,133 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/containerd/nri/pkg/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTmpfsMountsAnnotation(t *testing.T) {
+	entries, err := parseTmpfsMountsAnnotation(" /run:size=128M,mode=755 ; /tmp:size=1g;/run/user:noexec,nr_inodes=4096;/srv;")
+	require.NoError(t, err)
+	assert.Equal(t, []tmpfsMountEntry{
+		{dest: "/run", size: "size=128m", mode: "mode=0755"},
+		{dest: "/tmp", size: "size=1g"},
+		{dest: "/run/user", extra: []string{"noexec", "nr_inodes=4096"}},
+		{dest: "/srv"},
+	}, entries)
+
+	for value, expected := range map[string]string{
+		"run:size=1g":         `invalid destination "run"`,
+		"/run/../tmp":         `invalid destination "/run/../tmp"`,
+		"/:size=1g":           `invalid destination "/"`,
+		"/run;/run:size=1g":   "destination /run listed twice",
+		"/run:size=lots":      `/run: invalid tmpfs size "lots"`,
+		"/run:mode=999":       `/run: invalid tmpfs mode "mode=999"`,
+		"/run:suid":           `/run: unsupported option "suid"`,
+		"/run:size=1g,":       `/run: unsupported option ""`,
+		"/run:nr_inodes=many": `/run: invalid option "nr_inodes=many"`,
+	} {
+		_, err := parseTmpfsMountsAnnotation(value)
+		assert.ErrorContains(t, err, expected, value)
+	}
+}
+
+func TestTmpfsMountsAnnotation(t *testing.T) {
+	annotated := func(value string, mounts ...*api.Mount) *api.Container {
+		return newProfileTestContainer(map[string]string{tmpfsMountsAnnotation: value}, mounts...)
+	}
+
+	t.Run("added and overridden", func(t *testing.T) {
+		p := newTestPlugin(nil)
+
+		adjust, _, err := p.CreateContainer(context.Background(), nil, annotated("/run:size=128M,mode=700;/tmp:size=1G;/run/user:noexec"))
+		require.NoError(t, err)
+		assert.Equal(t, []string{"rw", "rprivate", "nosuid", "nodev", "mode=0700", "size=128m"}, findMount(adjust.Mounts, "/run").Options)
+		assert.Equal(t, []string{"rw", "rprivate", "nosuid", "nodev", "mode=1777", "size=1g"}, findMount(adjust.Mounts, "/tmp").Options)
+		assert.Equal(t, []string{"rw", "rprivate", "nosuid", "nodev", "mode=0755", "size=64m", "noexec"}, findMount(adjust.Mounts, "/run/user").Options)
+		// the other mounts are kept
+		assert.Equal(t, []string{"rw", "rprivate", "nosuid", "nodev", "mode=0755", "size=8m"}, findMount(adjust.Mounts, "/run/lock").Options)
+		assert.NotNil(t, findMount(adjust.Mounts, "/var/log/journal"))
+	})
+
+	t.Run("precedence over the configuration", func(t *testing.T) {
+		cfg, err := parseConfig([]byte(`
+tmpfsOptions:
+  memorySize: "10%"
+tmpfsMountOptions:
+  /tmp:
+    size: 2g
+    uid: 1000
+optionalTmpfs: [/var/tmp]
+`))
+		require.NoError(t, err)
+		p := newTestPlugin(cfg)
+		container := annotated("/tmp:size=512m;/var/tmp")
+		container.Linux.Resources = &api.LinuxResources{Memory: &api.LinuxMemory{Limit: api.Int64(1 << 30)}}
+
+		adjust, _, err := p.CreateContainer(context.Background(), nil, container)
+		require.NoError(t, err)
+		// the annotated size wins over tmpfsMountOptions and memorySize,
+		// other fields are kept
+		assert.Equal(t, []string{"rw", "rprivate", "nosuid", "nodev", "mode=1777", "uid=1000", "size=512m"}, findMount(adjust.Mounts, "/tmp").Options)
+		// mounts without an annotated size are still sized from the limit
+		assert.Contains(t, findMount(adjust.Mounts, "/run").Options, "size=104857k")
+		assert.Contains(t, findMount(adjust.Mounts, "/var/tmp").Options, "size=104857k")
+	})
+
+	t.Run("container mounts win", func(t *testing.T) {
+		p := newTestPlugin(nil)
+		container := annotated("/tmp:size=1g;/srv:size=1g",
+			&api.Mount{Destination: "/tmp", Type: "bind", Source: "/data/tmp", Options: []string{"rbind", "rw"}},
+			&api.Mount{Destination: "/srv", Type: "tmpfs", Source: "tmpfs", Options: []string{"rw", "size=2g"}},
+		)
+
+		adjust, _, err := p.CreateContainer(context.Background(), nil, container)
+		require.NoError(t, err)
+		assert.Nil(t, findMount(adjust.Mounts, "/tmp"))
+		assert.Nil(t, findMount(adjust.Mounts, "/srv"))
+	})
+
+	t.Run("on the pod", func(t *testing.T) {
+		pod := &api.PodSandbox{Annotations: map[string]string{tmpfsMountsAnnotation: "/run:size=32m"}}
+
+		adjust, _, err := newTestPlugin(nil).CreateContainer(context.Background(), pod, newProfileTestContainer(nil))
+		require.NoError(t, err)
+		assert.Contains(t, findMount(adjust.Mounts, "/run").Options, "size=32m")
+	})
+
+	t.Run("with the config annotation", func(t *testing.T) {
+		container := newProfileTestContainer(map[string]string{
+			configAnnotation:      "tmpfsMountOptions:\n  /run:\n    size: 1g\n    mode: \"700\"\n",
+			tmpfsMountsAnnotation: "/run:size=32m",
+		})
+
+		adjust, _, err := newTestPlugin(nil).CreateContainer(context.Background(), nil, container)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"rw", "rprivate", "nosuid", "nodev", "mode=0700", "size=32m"}, findMount(adjust.Mounts, "/run").Options)
+	})
+
+	t.Run("malformed", func(t *testing.T) {
+		_, _, err := newTestPlugin(nil).CreateContainer(context.Background(), nil, annotated("/run:size=1t"))
+		assert.ErrorContains(t, err, `invalid io.systemd.container/tmpfs-mounts annotation: /run: invalid tmpfs size "1t"`)
+	})
+}
@@ -0,0 +1,253 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/containerd/nri/pkg/api"
+)
+
+const (
+	// enableUnitsAnnotation and disableUnitsAnnotation list units to
+	// enable or disable at boot, separated by commas. Set on the pod they
+	// apply to all containers of the pod without their own annotation.
+	enableUnitsAnnotation  = "io.systemd.container/enable-units"
+	disableUnitsAnnotation = "io.systemd.container/disable-units"
+
+	// runtimeUnitDir is where the rendered units are mounted. Units in
+	// /run/systemd/system take precedence over those in /etc, like units
+	// enabled with systemctl --runtime, without hiding the units enabled
+	// by the image.
+	runtimeUnitDir = "/run/systemd/system"
+
+	// unitLinkDir is the target directory of the links enabling units.
+	// systemd only uses the name of links in .wants directories.
+	unitLinkDir = "/usr/lib/systemd/system"
+
+	wantsDir = "multi-user.target.wants"
+
+	// defaultTargetAnnotation selects the target a container boots into
+	// instead of default.target, e.g. rescue.target. Set on the pod it
+	// applies to all containers of the pod without their own annotation.
+	defaultTargetAnnotation = "io.systemd.container/default-target"
+
+	// procCmdlineEnv replaces the kernel command line for systemd.
+	procCmdlineEnv = "SYSTEMD_PROC_CMDLINE"
+)
+
+// Mechanisms for selecting the boot target, recorded in the provenance
+// annotation.
+const (
+	// targetCmdline passes systemd.unit=<target> in SYSTEMD_PROC_CMDLINE.
+	targetCmdline = "cmdline"
+	// targetSymlink renders default.target as a link to the target, used
+	// if the container sets SYSTEMD_PROC_CMDLINE itself.
+	targetSymlink = "symlink"
+)
+
+var unitName = regexp.MustCompile(`^[A-Za-z0-9:_.\\-]+(@[A-Za-z0-9:_.\\-]*)?\.(service|socket|timer|path|target|mount|automount|swap|slice)$`)
+
+// unitSelection is what a container enables and disables at boot.
+type unitSelection struct {
+	enable  []string
+	disable []string
+
+	// defaultTarget, if set, is linked as default.target.
+	defaultTarget string
+}
+
+// selectUnits returns the units selected by the annotations of the
+// container, nil if there are none.
+func selectUnits(cfg *Config, pod *api.PodSandbox, container *api.Container) (*unitSelection, error) {
+	enable, err := parseUnits(cfg, pod, container, enableUnitsAnnotation)
+	if err != nil {
+		return nil, err
+	}
+	disable, err := parseUnits(cfg, pod, container, disableUnitsAnnotation)
+	if err != nil {
+		return nil, err
+	}
+
+	target, err := selectBootTarget(cfg, pod, container)
+	if err != nil {
+		return nil, err
+	}
+
+	sel := &unitSelection{enable: enable, disable: disable}
+	if target != nil && target.mechanism == targetSymlink {
+		sel.defaultTarget = target.name
+	}
+	if len(sel.enable) == 0 && len(sel.disable) == 0 && sel.defaultTarget == "" {
+		return nil, nil
+	}
+	for _, unit := range enable {
+		if slices.Contains(disable, unit) {
+			return nil, fmt.Errorf("unit %s is both enabled and disabled", unit)
+		}
+	}
+
+	return sel, nil
+}
+
+func parseUnits(cfg *Config, pod *api.PodSandbox, container *api.Container, key string) ([]string, error) {
+	value, ok := lookupAnnotation(pod, container, key)
+	if !ok {
+		return nil, nil
+	}
+
+	var units []string
+	for _, unit := range strings.Split(value, ",") {
+		unit = strings.TrimSpace(unit)
+		if unit == "" || slices.Contains(units, unit) {
+			continue
+		}
+		if !unitName.MatchString(unit) || len(unit) > 255 {
+			return nil, fmt.Errorf("invalid unit name %q in %s annotation", unit, key)
+		}
+		if !cfg.unitAllowed(unit) {
+			return nil, fmt.Errorf("unit %s in %s annotation is not in allowedUnits", unit, key)
+		}
+		units = append(units, unit)
+	}
+	return units, nil
+}
+
+func (c *Config) unitAllowed(unit string) bool {
+	return matchAny(c.AllowedUnits, unit)
+}
+
+func (c *Config) targetAllowed(target string) bool {
+	return matchAny(c.AllowedTargets, target)
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// bootTarget is the target a container boots into, and how it is selected.
+type bootTarget struct {
+	name      string
+	mechanism string
+}
+
+// selectBootTarget returns the target selected by the annotations of the
+// container, nil if there is none.
+func selectBootTarget(cfg *Config, pod *api.PodSandbox, container *api.Container) (*bootTarget, error) {
+	value, ok := lookupAnnotation(pod, container, defaultTargetAnnotation)
+	if !ok {
+		return nil, nil
+	}
+
+	target := strings.TrimSpace(value)
+	if !unitName.MatchString(target) || !strings.HasSuffix(target, ".target") || len(target) > 255 {
+		return nil, fmt.Errorf("invalid target name %q in %s annotation", target, defaultTargetAnnotation)
+	}
+	if !cfg.targetAllowed(target) {
+		return nil, fmt.Errorf("target %s in %s annotation is not in allowedTargets", target, defaultTargetAnnotation)
+	}
+
+	mechanism := targetCmdline
+	if hasEnv(container, procCmdlineEnv) {
+		mechanism = targetSymlink
+	}
+	return &bootTarget{name: target, mechanism: mechanism}, nil
+}
+
+// hasUnitAnnotations tells whether the container enables or disables units.
+func hasUnitAnnotations(pod *api.PodSandbox, container *api.Container) bool {
+	for _, key := range []string{enableUnitsAnnotation, disableUnitsAnnotation} {
+		if _, ok := lookupAnnotation(pod, container, key); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// addUnitsMount mounts the rendered units of the container, if it selects
+// any, at /run/systemd/system.
+func (p *plugin) addUnitsMount(cfg *Config, adjust *api.ContainerAdjustment, pod *api.PodSandbox, container *api.Container, ctrName string) error {
+	sel, err := selectUnits(cfg, pod, container)
+	if err != nil || sel == nil {
+		return err
+	}
+	dir, err := renderedDir(cfg, renderedUnits, container.Id)
+	if err != nil {
+		return err
+	}
+
+	adjust.AddMount(&api.Mount{
+		Destination: runtimeUnitDir,
+		Type:        "bind",
+		Source:      dir,
+		Options:     []string{"rbind", "ro", "nosuid", "nodev"},
+	})
+	p.mountLog.Debugf("%s: enabling units %v, disabling units %v", ctrName, sel.enable, sel.disable)
+	if sel.defaultTarget != "" {
+		p.mountLog.Debugf("%s: linking default.target to %s", ctrName, sel.defaultTarget)
+	}
+
+	return nil
+}
+
+// renderUnits renders the units selected by the container, replacing an
+// earlier rendering. Enabled units are linked from multi-user.target.wants,
+// disabled units are masked, and a selected target replaces default.target.
+func renderUnits(ctx context.Context, cfg *Config, pod *api.PodSandbox, container *api.Container) error {
+	sel, err := selectUnits(cfg, pod, container)
+	if err != nil || sel == nil {
+		return err
+	}
+	dir, err := renderedDir(cfg, renderedUnits, container.Id)
+	if err != nil {
+		return err
+	}
+
+	return renderDir(ctx, dir, func(tmp string) error {
+		if err := os.MkdirAll(filepath.Join(tmp, wantsDir), 0o755); err != nil {
+			return fmt.Errorf("failed to render units: %w", err)
+		}
+		for _, unit := range sel.enable {
+			if err := os.Symlink(path.Join(unitLinkDir, unit), filepath.Join(tmp, wantsDir, unit)); err != nil {
+				return fmt.Errorf("failed to enable unit %s: %w", unit, err)
+			}
+		}
+		for _, unit := range sel.disable {
+			if err := os.Symlink("/dev/null", filepath.Join(tmp, unit)); err != nil {
+				return fmt.Errorf("failed to disable unit %s: %w", unit, err)
+			}
+		}
+		if sel.defaultTarget != "" {
+			if err := os.Symlink(path.Join(unitLinkDir, sel.defaultTarget), filepath.Join(tmp, "default.target")); err != nil {
+				return fmt.Errorf("failed to link default.target: %w", err)
+			}
+		}
+		return nil
+	})
+}
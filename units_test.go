@@ -0,0 +1,336 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/containerd/nri/pkg/api"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// readLinks returns the symlinks below dir with their targets.
+func readLinks(t *testing.T, dir string) map[string]string {
+	t.Helper()
+
+	links := map[string]string{}
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.Type()&fs.ModeSymlink == 0 {
+			return err
+		}
+		target, err := os.Readlink(p)
+		rel, _ := filepath.Rel(dir, p)
+		links[rel] = target
+		return err
+	})
+	require.NoError(t, err)
+	return links
+}
+
+func TestUnits(t *testing.T) {
+	newPlugin := func() *plugin {
+		return newTestPlugin(configWith(func(c *Config) {
+			c.StateDir = t.TempDir()
+			c.AllowedUnits = []string{"sshd.service", "node_exporter.service", "getty@*.service"}
+			c.OrphanGC.MinAge = 0
+		}))
+	}
+
+	t.Run("rendered", func(t *testing.T) {
+		p := newPlugin()
+		pod := &api.PodSandbox{Annotations: map[string]string{
+			disableUnitsAnnotation: "getty@tty1.service",
+		}}
+		container := newProfileTestContainer(map[string]string{
+			enableUnitsAnnotation: "sshd.service, node_exporter.service,sshd.service",
+		})
+
+		adjust, _, err := p.CreateContainer(context.Background(), pod, container)
+		require.NoError(t, err)
+
+		dir := filepath.Join(p.config().StateDir, "units", container.Id)
+		assert.Equal(t, &api.Mount{
+			Destination: "/run/systemd/system",
+			Type:        "bind",
+			Source:      dir,
+			Options:     []string{"rbind", "ro", "nosuid", "nodev"},
+		}, findMount(adjust.Mounts, "/run/systemd/system"))
+
+		assert.Equal(t, map[string]string{
+			"multi-user.target.wants/sshd.service":          "/usr/lib/systemd/system/sshd.service",
+			"multi-user.target.wants/node_exporter.service": "/usr/lib/systemd/system/node_exporter.service",
+			"getty@tty1.service":                            "/dev/null",
+		}, readLinks(t, dir))
+
+		// a redelivered event renders the same tree
+		_, _, err = p.CreateContainer(context.Background(), pod, container)
+		require.NoError(t, err)
+		assert.Len(t, readLinks(t, dir), 3)
+
+		require.NoError(t, p.RemoveContainer(context.Background(), pod, container))
+		assert.NoDirExists(t, dir)
+	})
+
+	t.Run("no annotations", func(t *testing.T) {
+		p := newPlugin()
+
+		adjust, _, err := p.CreateContainer(context.Background(), nil, newProfileTestContainer(nil))
+		require.NoError(t, err)
+		assert.Nil(t, findMount(adjust.Mounts, "/run/systemd/system"))
+		assert.NoDirExists(t, filepath.Join(p.config().StateDir, "units"))
+	})
+
+	for name, annotations := range map[string]map[string]string{
+		"not allowed":            {enableUnitsAnnotation: "sshd.service,docker.service"},
+		"invalid name":           {enableUnitsAnnotation: "../../etc/passwd"},
+		"missing suffix":         {disableUnitsAnnotation: "sshd"},
+		"enabled and disabled":   {enableUnitsAnnotation: "sshd.service", disableUnitsAnnotation: "sshd.service"},
+		"not allowed to disable": {disableUnitsAnnotation: "systemd-journald.service"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			p := newPlugin()
+
+			adjust, _, err := p.CreateContainer(context.Background(), nil, newProfileTestContainer(annotations))
+			assert.Error(t, err)
+			assert.Nil(t, adjust)
+			assert.NoDirExists(t, filepath.Join(p.config().StateDir, "units"))
+		})
+	}
+
+	t.Run("pruned on synchronize", func(t *testing.T) {
+		p := newPlugin()
+		units := filepath.Join(p.config().StateDir, "units")
+		require.NoError(t, os.MkdirAll(filepath.Join(units, "running"), 0o755))
+		require.NoError(t, os.MkdirAll(filepath.Join(units, "removed"), 0o755))
+		require.NoError(t, os.MkdirAll(filepath.Join(units, "removed.tmp"), 0o755))
+
+		_, err := p.Synchronize(context.Background(), nil, []*api.Container{{Id: "running"}})
+		require.NoError(t, err)
+
+		entries, err := os.ReadDir(units)
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+		assert.Equal(t, "running", entries[0].Name())
+	})
+
+	t.Run("orphans", func(t *testing.T) {
+		stateDir := t.TempDir()
+		units := filepath.Join(stateDir, "units")
+		now := time.Now()
+		for name, age := range map[string]time.Duration{"live": time.Hour, "young": time.Minute, "old": time.Hour} {
+			dir := filepath.Join(units, name)
+			require.NoError(t, os.MkdirAll(dir, 0o755))
+			require.NoError(t, os.WriteFile(filepath.Join(dir, "basic.target"), []byte("0123456789"), 0o644))
+			require.NoError(t, os.Chtimes(dir, now.Add(-age), now.Add(-age)))
+		}
+		containers := []*api.Container{{Id: "live"}}
+
+		t.Run("removed", func(t *testing.T) {
+			cfg := configWith(func(c *Config) {
+				c.StateDir = stateDir
+				c.OrphanGC.MinAge = Duration(10 * time.Minute)
+			})
+
+			summary, err := pruneRendered(cfg, nil, containers, now)
+			require.NoError(t, err)
+			assert.Equal(t, orphanSummary{removed: 1, kept: 1, reclaimed: 10}, summary)
+			assert.DirExists(t, filepath.Join(units, "live"))
+			assert.DirExists(t, filepath.Join(units, "young"))
+			assert.NoDirExists(t, filepath.Join(units, "old"))
+		})
+
+		t.Run("young kept by default", func(t *testing.T) {
+			cfg := configWith(func(c *Config) { c.StateDir = stateDir })
+
+			summary, err := pruneRendered(cfg, nil, containers, now)
+			require.NoError(t, err)
+			assert.Equal(t, orphanSummary{kept: 1}, summary)
+			assert.DirExists(t, filepath.Join(units, "young"))
+		})
+
+		t.Run("quarantined", func(t *testing.T) {
+			cfg := configWith(func(c *Config) {
+				c.StateDir = stateDir
+				c.OrphanGC.MinAge = 0
+				c.OrphanGC.Quarantine = true
+			})
+
+			summary, err := pruneRendered(cfg, nil, containers, now)
+			require.NoError(t, err)
+			assert.Equal(t, orphanSummary{quarantined: 1}, summary)
+			assert.DirExists(t, filepath.Join(units, "live"))
+			assert.NoDirExists(t, filepath.Join(units, "young"))
+			assert.FileExists(t, filepath.Join(stateDir, "quarantine", "units", "young", "basic.target"))
+		})
+	})
+
+	t.Run("pod directories", func(t *testing.T) {
+		stateDir := t.TempDir()
+		shared := filepath.Join(stateDir, sharedRunKind)
+		now := time.Now()
+		for name, age := range map[string]time.Duration{"live-uid": time.Hour, "young-uid": time.Minute, "old-uid": time.Hour, "live-sandbox-id": time.Hour} {
+			dir := filepath.Join(shared, name)
+			require.NoError(t, os.MkdirAll(dir, 0o755))
+			require.NoError(t, os.Chtimes(dir, now.Add(-age), now.Add(-age)))
+		}
+		pods := []*api.PodSandbox{{Id: "live-sandbox-id", Uid: "live-uid"}}
+		// a container ID never keeps the directory of a pod
+		containers := []*api.Container{{Id: "old-uid"}}
+
+		summary, err := pruneRendered(configWith(func(c *Config) { c.StateDir = stateDir }), pods, containers, now)
+		require.NoError(t, err)
+		assert.Equal(t, orphanSummary{removed: 2, kept: 1}, summary)
+		assert.DirExists(t, filepath.Join(shared, "live-uid"))
+		assert.DirExists(t, filepath.Join(shared, "young-uid"))
+		assert.NoDirExists(t, filepath.Join(shared, "old-uid"))
+		assert.NoDirExists(t, filepath.Join(shared, "live-sandbox-id"))
+	})
+
+	t.Run("reclaimed metric", func(t *testing.T) {
+		p := newPlugin()
+		orphan := filepath.Join(p.config().StateDir, "units", "removed")
+		require.NoError(t, os.MkdirAll(orphan, 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(orphan, "basic.target"), []byte("0123456789"), 0o644))
+		logs := logtest.NewLocal(p.logs.base)
+
+		_, err := p.Synchronize(context.Background(), nil, nil)
+		require.NoError(t, err)
+
+		assert.Equal(t, 10.0, testutil.ToFloat64(p.metrics.reclaimedBytes))
+		require.NotNil(t, logs.LastEntry())
+		assert.Contains(t, logs.AllEntries()[0].Message, "1 removed (10 bytes)")
+	})
+}
+
+func TestRenderDirInterrupted(t *testing.T) {
+	t.Run("hung filesystem", func(t *testing.T) {
+		stateDir := t.TempDir()
+		// writing to a FIFO without a reader blocks like a hung filesystem
+		fifo := filepath.Join(stateDir, "fifo")
+		require.NoError(t, syscall.Mkfifo(fifo, 0o600))
+		dir := filepath.Join(stateDir, "units", "hung")
+		written := make(chan struct{})
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		err := renderDir(ctx, dir, func(string) error {
+			defer close(written)
+			return os.WriteFile(fifo, []byte("x"), 0o600)
+		})
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+		// the write left behind stops before replacing the directory
+		r, err := os.OpenFile(fifo, os.O_RDONLY, 0)
+		require.NoError(t, err)
+		defer r.Close()
+		<-written
+		assert.Never(t, func() bool {
+			_, err := os.Stat(dir)
+			return err == nil
+		}, 100*time.Millisecond, 10*time.Millisecond)
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		cfg := configWith(func(c *Config) {
+			c.StateDir = t.TempDir()
+			c.AllowedUnits = []string{"sshd.service"}
+		})
+		container := newProfileTestContainer(map[string]string{enableUnitsAnnotation: "sshd.service"})
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		assert.ErrorIs(t, renderUnits(ctx, cfg, nil, container), context.Canceled)
+		assert.NoDirExists(t, filepath.Join(cfg.StateDir, "units", container.Id))
+	})
+}
+
+func TestInsideDir(t *testing.T) {
+	assert.True(t, insideDir("/var/lib/state", "/var/lib/state/units/x"))
+	assert.True(t, insideDir("/var/lib/state/", "/var/lib/state/units"))
+	assert.False(t, insideDir("/var/lib/state", "/var/lib/state"))
+	assert.False(t, insideDir("/var/lib/state", "/var/lib/state/../other"))
+	assert.False(t, insideDir("/var/lib/state", "/var/lib/stateful"))
+	assert.False(t, insideDir("/var/lib/state", "/"))
+}
+
+func TestDefaultTarget(t *testing.T) {
+	newPlugin := func() *plugin {
+		return newTestPlugin(configWith(func(c *Config) {
+			c.StateDir = t.TempDir()
+			c.AllowedTargets = []string{"rescue.target", "ci-*.target"}
+		}))
+	}
+
+	t.Run("cmdline", func(t *testing.T) {
+		p := newPlugin()
+		pod := &api.PodSandbox{Annotations: map[string]string{defaultTargetAnnotation: "rescue.target"}}
+		container := newProfileTestContainer(nil)
+
+		adjust, _, err := p.CreateContainer(context.Background(), pod, container)
+		require.NoError(t, err)
+
+		assert.Contains(t, adjust.Env, &api.KeyValue{Key: "SYSTEMD_PROC_CMDLINE", Value: "systemd.unit=rescue.target"})
+		assert.Nil(t, findMount(adjust.Mounts, "/run/systemd/system"))
+		assert.Equal(t, "cgroup,tmpfs,env,default-target=cmdline", adjust.Annotations[provenanceAnnotation])
+		assert.NoDirExists(t, filepath.Join(p.config().StateDir, "units"))
+	})
+
+	t.Run("symlink", func(t *testing.T) {
+		p := newPlugin()
+		container := newProfileTestContainer(map[string]string{defaultTargetAnnotation: "ci-e2e.target"})
+		container.Env = append(container.Env, "SYSTEMD_PROC_CMDLINE=quiet")
+
+		adjust, _, err := p.CreateContainer(context.Background(), nil, container)
+		require.NoError(t, err)
+
+		for _, env := range adjust.Env {
+			assert.NotEqual(t, "SYSTEMD_PROC_CMDLINE", env.Key)
+		}
+		dir := filepath.Join(p.config().StateDir, "units", container.Id)
+		assert.NotNil(t, findMount(adjust.Mounts, "/run/systemd/system"))
+		assert.Equal(t, map[string]string{
+			"default.target": "/usr/lib/systemd/system/ci-e2e.target",
+		}, readLinks(t, dir))
+		assert.Equal(t, "cgroup,tmpfs,env,units,default-target=symlink", adjust.Annotations[provenanceAnnotation])
+	})
+
+	for name, target := range map[string]string{
+		"not allowed":    "emergency.target",
+		"invalid name":   "../rescue.target",
+		"not a target":   "rescue.service",
+		"empty":          "",
+		"kernel options": "rescue.target systemd.debug_shell",
+	} {
+		t.Run(name, func(t *testing.T) {
+			p := newPlugin()
+
+			adjust, _, err := p.CreateContainer(context.Background(), nil,
+				newProfileTestContainer(map[string]string{defaultTargetAnnotation: target}))
+			assert.Error(t, err)
+			assert.Nil(t, adjust)
+		})
+	}
+}
@@ -0,0 +1,157 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// workQueue bounds the number of events processed concurrently and runs
+// the events of a single container strictly one after another, in the
+// order they arrived. Waiting is bounded by the context of the event, so
+// a busy queue never blocks the NRI event loop past the hook deadline.
+type workQueue struct {
+	slots   chan struct{}
+	metrics *metrics
+
+	mu      sync.Mutex
+	waiters map[string][]chan struct{}
+}
+
+// ticket is the place of an event in the queue of its container.
+type ticket struct {
+	q        *workQueue
+	id       string
+	turn     chan struct{}
+	enqueued time.Time
+}
+
+func newWorkQueue(size int, m *metrics) *workQueue {
+	return &workQueue{
+		slots:   make(chan struct{}, size),
+		metrics: m,
+		waiters: make(map[string][]chan struct{}),
+	}
+}
+
+// acquire waits until the event for the given container may be processed.
+// The returned function must be called once processing is done.
+func (q *workQueue) acquire(ctx context.Context, id string) (func(), error) {
+	return q.enqueue(id).wait(ctx)
+}
+
+// enqueue takes a place in the queue of the given container without
+// waiting for its turn.
+func (q *workQueue) enqueue(id string) *ticket {
+	t := &ticket{
+		q:        q,
+		id:       id,
+		turn:     make(chan struct{}),
+		enqueued: time.Now(),
+	}
+
+	q.mu.Lock()
+	q.waiters[id] = append(q.waiters[id], t.turn)
+	if len(q.waiters[id]) == 1 {
+		close(t.turn)
+	}
+	q.mu.Unlock()
+
+	q.metrics.queueDepth.Inc()
+
+	return t
+}
+
+// wait for the turn of the container and a free processing slot.
+func (t *ticket) wait(ctx context.Context) (func(), error) {
+	q := t.q
+	defer q.metrics.queueDepth.Dec()
+
+	select {
+	case <-t.turn:
+	case <-ctx.Done():
+		q.leave(t)
+		return nil, ctx.Err()
+	}
+
+	select {
+	case q.slots <- struct{}{}:
+	case <-ctx.Done():
+		q.leave(t)
+		return nil, ctx.Err()
+	}
+
+	start := time.Now()
+	q.metrics.queueWait.Observe(start.Sub(t.enqueued).Seconds())
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			q.metrics.processing.Observe(time.Since(start).Seconds())
+			<-q.slots
+			q.leave(t)
+		})
+	}, nil
+}
+
+// drain waits until no event is processed, or ctx is done. Events
+// waiting for a slot meanwhile are processed as well, before those
+// arriving later.
+func (q *workQueue) drain(ctx context.Context) error {
+	taken := 0
+	defer func() {
+		for ; taken > 0; taken-- {
+			<-q.slots
+		}
+	}()
+	for taken < cap(q.slots) {
+		select {
+		case q.slots <- struct{}{}:
+			taken++
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// leave removes the ticket from the queue of its container, handing the
+// turn to the next event if the ticket held it.
+func (q *workQueue) leave(t *ticket) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	waiters := q.waiters[t.id]
+	for i, turn := range waiters {
+		if turn != t.turn {
+			continue
+		}
+		waiters = append(waiters[:i], waiters[i+1:]...)
+		if i == 0 && len(waiters) > 0 {
+			close(waiters[0])
+		}
+		break
+	}
+
+	if len(waiters) == 0 {
+		delete(q.waiters, t.id)
+	} else {
+		q.waiters[t.id] = waiters
+	}
+}
@@ -0,0 +1,146 @@
+/*
+   Copyright 2024 Thomas Weber
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWorkQueueStress(t *testing.T) {
+	const (
+		workers    = 4
+		containers = 50
+		events     = 3000
+	)
+
+	m := newMetrics()
+	q := newWorkQueue(workers, m)
+
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		processed = map[string][]int{}
+		busy      = map[string]bool{}
+		running   atomic.Int32
+		maxSeen   atomic.Int32
+	)
+
+	for i := 0; i < events; i++ {
+		id := fmt.Sprintf("ctr-%d", rand.Intn(containers))
+		ticket := q.enqueue(id)
+
+		wg.Add(1)
+		go func(seq int) {
+			defer wg.Done()
+
+			release, err := ticket.wait(context.Background())
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer release()
+
+			n := running.Add(1)
+			for {
+				prev := maxSeen.Load()
+				if n <= prev || maxSeen.CompareAndSwap(prev, n) {
+					break
+				}
+			}
+
+			mu.Lock()
+			assert.False(t, busy[id], "concurrent events for %s", id)
+			busy[id] = true
+			processed[id] = append(processed[id], seq)
+			mu.Unlock()
+
+			time.Sleep(time.Duration(rand.Intn(50)) * time.Microsecond)
+
+			mu.Lock()
+			busy[id] = false
+			mu.Unlock()
+
+			running.Add(-1)
+		}(i)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(30 * time.Second):
+		t.Fatal("deadlock: events still pending")
+	}
+
+	total := 0
+	for id, seqs := range processed {
+		total += len(seqs)
+		for i := 1; i < len(seqs); i++ {
+			assert.Less(t, seqs[i-1], seqs[i], "events for %s processed out of order", id)
+		}
+	}
+	assert.Equal(t, events, total)
+	assert.LessOrEqual(t, maxSeen.Load(), int32(workers))
+	assert.Empty(t, q.waiters)
+	assert.Equal(t, 0.0, testutil.ToFloat64(m.queueDepth))
+}
+
+func TestWorkQueueDeadline(t *testing.T) {
+	m := newMetrics()
+	q := newWorkQueue(1, m)
+
+	// the same container is busy
+	release, err := q.acquire(context.Background(), "ctr-a")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = q.acquire(ctx, "ctr-a")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// all workers are busy
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = q.acquire(ctx, "ctr-b")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	release()
+
+	// abandoned tickets do not block later events
+	release, err = q.acquire(context.Background(), "ctr-a")
+	require.NoError(t, err)
+	release()
+	release, err = q.acquire(context.Background(), "ctr-b")
+	require.NoError(t, err)
+	release()
+
+	assert.Empty(t, q.waiters)
+	assert.Equal(t, 0.0, testutil.ToFloat64(m.queueDepth))
+}